@@ -24,15 +24,42 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/rsvihladremio/ssdownloader/hooks"
 )
 
 type Config struct {
-	SsAPIKey      string
-	SsAPISecret   string
+	SsAPIKey    string
+	SsAPISecret string
+	// SsAPIURL overrides the SendSafely api taken from the host of each trusted link
+	SsAPIURL string
+	// SsHosts are enterprise SendSafely hosts, ie files.customer.com, whose https links are followed in tickets and
+	// whose api is trusted with our credentials
+	SsHosts       []string
 	ZendeskDomain string
-	ZendeskEmail  string
-	ZendeskToken  string
-	DownloadDir   string
+	// ZendeskURL overrides https://{ZendeskDomain}.zendesk.com, ie for a proxy or a test server
+	ZendeskURL   string
+	ZendeskEmail string
+	ZendeskToken string
+	DownloadDir  string
+	// network settings shared by every http call, see the transport package
+	ProxyURL              string
+	CAFile                string
+	ClientCertFile        string
+	ClientKeyFile         string
+	ConnectTimeoutSeconds int
+	ReadTimeoutSeconds    int
+	// where downloads are written, local or s3, see the storage package
+	Storage     string
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3Prefix    string
+	S3AccessKey string
+	S3SecretKey string
+	S3PathStyle bool
+	// external commands run when files, packages and tickets finish or fail, see the hooks package
+	Hooks []hooks.Hook
 }
 
 func ReadConfigFile(cfgFile string) (string, error) {
@@ -17,7 +17,11 @@
 // config package handles the reading and writing of the app configuration file
 package config
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/rsvihladremio/ssdownloader/hooks"
+)
 
 func TestLoadConfig(t *testing.T) {
 	var c Config
@@ -53,4 +57,18 @@ func TestLoadConfig(t *testing.T) {
 	if c.SsAPISecret != expectedSSSecret {
 		t.Errorf("expected %v but was %v", expectedSSSecret, c.SsAPISecret)
 	}
+
+	expectedProxy := "socks5://127.0.0.1:1080"
+	if c.ProxyURL != expectedProxy {
+		t.Errorf("expected %v but was %v", expectedProxy, c.ProxyURL)
+	}
+
+	if c.ReadTimeoutSeconds != 45 {
+		t.Errorf("expected %v but was %v", 45, c.ReadTimeoutSeconds)
+	}
+
+	expectedHook := hooks.Hook{Event: "file_complete", Command: "index-file", TimeoutSeconds: 30, FailurePolicy: "abort"}
+	if len(c.Hooks) != 1 || c.Hooks[0] != expectedHook {
+		t.Errorf("expected %v but was %v", expectedHook, c.Hooks)
+	}
 }
@@ -0,0 +1,268 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// cmd package contains all the command line flag configuration
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/rsvihladremio/ssdownloader/filter"
+	"github.com/rsvihladremio/ssdownloader/link"
+	"github.com/rsvihladremio/ssdownloader/sendsafely"
+	"github.com/rsvihladremio/ssdownloader/zendesk"
+)
+
+var inspectOutput string
+
+// output formats of inspect
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+)
+
+// FileInfo is a SendSafely file or zendesk attachment as inspect shows it, Skip is why the current flags would not download it
+type FileInfo struct {
+	Name       string    `json:"name"`
+	FileID     string    `json:"file_id"`
+	Size       int64     `json:"size"`
+	Parts      int       `json:"parts,omitempty"`
+	UploadedBy string    `json:"uploaded_by,omitempty"`
+	Uploaded   time.Time `json:"uploaded"`
+	Skip       string    `json:"skip,omitempty"`
+}
+
+// PackageInfo is a SendSafely package as inspect shows it, Error is set instead of the rest when it could not be retrieved
+type PackageInfo struct {
+	// URL is the link without its keyCode
+	URL       string    `json:"url"`
+	PackageID string    `json:"package_id"`
+	State     string    `json:"state,omitempty"`
+	Created   time.Time `json:"created,omitzero"`
+	Expires   time.Time `json:"expires,omitzero"`
+	// Message is the decrypted secure message the sender wrote with the package
+	Message string     `json:"message,omitempty"`
+	Files   []FileInfo `json:"files"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// Inspection is everything inspect found for a link or a ticket
+type Inspection struct {
+	TicketID    string        `json:"ticket_id,omitempty"`
+	Packages    []PackageInfo `json:"packages"`
+	Attachments []FileInfo    `json:"attachments"`
+}
+
+// inspectCmd represents the inspect command
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <sendsafely package link or zendesk ticket id>",
+	Short: "lists the files of a package or ticket without downloading them",
+	Long: `lists every package and attachment with the size, uploader and upload time of each file and which files
+the current flags would skip, nothing is downloaded. Examples below:
+
+	ssdownloader inspect "https://sendsafely.tester.com/receive/?thread=MYTHREAD&packageCode=MYPKGCODE#keyCode=MYKEYCODE"
+
+	//ticket id is 1111 as json for scripts
+	ssdownloader inspect 1111 --output json
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		SetVerbosity()
+		if inspectOutput != OutputTable && inspectOutput != OutputJSON {
+			slog.Error("unsupported output, use table or json", "output", inspectOutput)
+			os.Exit(1)
+		}
+		ctx, stop := InterruptContext()
+		defer stop()
+		httpClient := NewHTTPClient()
+		clients := NewSendSafelyClients(httpClient)
+		f := NewFilter()
+		var i Inspection
+		var urls []string
+		if strings.Contains(args[0], "://") {
+			urls = append(urls, args[0])
+		} else {
+			i.TicketID = args[0]
+			zendeskAPI := NewZendeskClient(httpClient)
+			comments, attachments := TicketComments(ctx, zendeskAPI, i.TicketID)
+			for _, c := range comments {
+				if link.IsSendSafely(c.URL, C.SsHosts) {
+					urls = append(urls, c.URL)
+				}
+			}
+			for _, a := range attachments {
+				i.Attachments = append(i.Attachments, InspectAttachment(a, f))
+			}
+		}
+		if len(urls) > 0 && (C.SsAPIKey == "" || C.SsAPISecret == "") {
+			slog.Error("ss-api-key and ss-api-secret are required to inspect sendsafely packages")
+			os.Exit(1)
+		}
+		for _, url := range urls {
+			i.Packages = append(i.Packages, inspectLink(ctx, clients, url, f))
+		}
+		if inspectOutput == OutputJSON {
+			b, err := json.MarshalIndent(i, "", "  ")
+			if err != nil {
+				slog.Error("unable to write json", "error_msg", err)
+				os.Exit(1)
+			}
+			fmt.Println(string(b))
+			return
+		}
+		fmt.Print(InspectTable(i))
+	},
+}
+
+// inspectLink retrieves the package the link points to, a failure is kept in the result so the other packages are still shown
+func inspectLink(ctx context.Context, clients *SendSafelyClients, url string, f *filter.Filter) PackageInfo {
+	linkParts, err := link.ParseLink(url)
+	if err != nil {
+		return PackageInfo{URL: link.Redact(url), Error: "invalid link", Files: []FileInfo{}}
+	}
+	p, err := sendsafely.RetrievePackage(ctx, clients.For(linkParts), linkParts.PackageCode, DirPrefix)
+	if err != nil {
+		slog.Debug("unable to retrieve package", "package_id", linkParts.PackageCode, "error_msg", err)
+		return PackageInfo{URL: link.Redact(url), PackageID: linkParts.PackageCode, Error: sendsafely.FailureReason(err), Files: []FileInfo{}}
+	}
+	info := InspectPackage(url, p, int64(MaxFileSizeGiB)*1000000000, f)
+	if p.ContainsMessage {
+		password := PackagePasswordFor(p)
+		if p.PasswordRequired && password == "" {
+			slog.Warn("unable to show the secure message of the package", "package_id", p.PackageID, "error_msg", sendsafely.PasswordRequiredErr{PackageID: p.PackageID})
+			return info
+		}
+		info.Message, err = sendsafely.PackageMessage(ctx, clients.For(linkParts), p, sendsafely.PackageSecret(p, linkParts.KeyCode, password))
+		if err != nil {
+			slog.Warn("unable to show the secure message of the package", "package_id", p.PackageID, "error_msg", err)
+		}
+	}
+	return info
+}
+
+// InspectPackage lists the files of the package, files over maxFileSizeBytes or not selected by f are marked as skipped.
+// The keyCode is left out of the url since the output is meant to be shared and kept by scripts
+func InspectPackage(url string, p sendsafely.Package, maxFileSizeBytes int64, f *filter.Filter) PackageInfo {
+	info := PackageInfo{
+		URL:       link.Redact(url),
+		PackageID: p.PackageID,
+		State:     p.State,
+		Created:   p.PackageTimestamp,
+		Expires:   p.Expires(),
+		Files:     []FileInfo{},
+	}
+	for _, file := range p.Files {
+		fi := FileInfo{
+			Name:       filepath.ToSlash(file.RelPath()),
+			FileID:     file.FileID,
+			Size:       file.FileSize,
+			Parts:      file.Parts,
+			UploadedBy: file.CreatedByEmail,
+			Uploaded:   file.FileUploaded,
+		}
+		fi.Skip = f.Skip(fi.Name, fi.FileID, fi.UploadedBy)
+		if file.FileSize > maxFileSizeBytes {
+			fi.Skip = "over --max-file-size-gib"
+		}
+		info.Files = append(info.Files, fi)
+	}
+	return info
+}
+
+// InspectAttachment describes a zendesk attachment, deleted attachments and those not selected by f are marked as skipped
+func InspectAttachment(a zendesk.Attachment, f *filter.Filter) FileInfo {
+	fi := FileInfo{
+		Name:       a.FileName,
+		Size:       a.Size,
+		UploadedBy: a.UploadedBy,
+		Uploaded:   a.ParentCommentDate,
+		Skip:       AttachmentSkip(f, a),
+	}
+	if a.ID != 0 {
+		fi.FileID = strconv.FormatInt(a.ID, 10)
+	}
+	if a.Deleted {
+		fi.Skip = "deleted"
+	}
+	return fi
+}
+
+// InspectTable is the human readable output of inspect, one table per package followed by the attachments
+func InspectTable(i Inspection) string {
+	var b strings.Builder
+	for _, p := range i.Packages {
+		if p.Error != "" {
+			fmt.Fprintf(&b, "package %v: %v\n  %v\n\n", p.PackageID, p.Error, p.URL)
+			continue
+		}
+		expires := "never"
+		if !p.Expires.IsZero() {
+			expires = p.Expires.Format(time.RFC3339)
+		}
+		fmt.Fprintf(&b, "package %v state %v created %v expires %v\n  %v\n", p.PackageID, p.State, p.Created.Format(time.RFC3339), expires, p.URL)
+		if p.Message != "" {
+			fmt.Fprintf(&b, "  message:\n    %v\n", strings.ReplaceAll(strings.TrimSpace(p.Message), "\n", "\n    "))
+		}
+		writeFileTable(&b, p.Files, true)
+		b.WriteString("\n")
+	}
+	if len(i.Attachments) > 0 {
+		fmt.Fprintf(&b, "attachments of ticket %v\n", i.TicketID)
+		writeFileTable(&b, i.Attachments, false)
+	}
+	if len(i.Packages) == 0 && len(i.Attachments) == 0 {
+		b.WriteString("no packages or attachments found\n")
+	}
+	return b.String()
+}
+
+func writeFileTable(b *strings.Builder, files []FileInfo, sendSafely bool) {
+	w := tabwriter.NewWriter(b, 0, 0, 2, ' ', 0)
+	if sendSafely {
+		fmt.Fprintln(w, "NAME\tFILE ID\tSIZE\tPARTS\tUPLOADED BY\tUPLOADED\tSKIPPED")
+	} else {
+		fmt.Fprintln(w, "NAME\tFILE ID\tSIZE\tUPLOADED BY\tUPLOADED\tSKIPPED")
+	}
+	for _, f := range files {
+		skip := "-"
+		if f.Skip != "" {
+			skip = f.Skip
+		}
+		if sendSafely {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", f.Name, f.FileID, sendsafely.Human(f.Size), f.Parts, f.UploadedBy, f.Uploaded.Format(time.RFC3339), skip)
+		} else {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", f.Name, f.FileID, sendsafely.Human(f.Size), f.UploadedBy, f.Uploaded.Format(time.RFC3339), skip)
+		}
+	}
+	_ = w.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+	inspectCmd.Flags().StringVarP(&inspectOutput, "output", "o", OutputTable, "table for people or json for scripts")
+	inspectCmd.Flags().BoolVarP(&useZendeskPassword, "zendesk-password", "p", false, "Use a password instead of an api key to authenticate against zendesk")
+}
@@ -0,0 +1,142 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// cmd package contains all the command line flag configuration
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rsvihladremio/ssdownloader/filter"
+	"github.com/rsvihladremio/ssdownloader/sendsafely"
+	"github.com/rsvihladremio/ssdownloader/zendesk"
+)
+
+func inspectTestPackage() sendsafely.Package {
+	created := time.Date(2019, 2, 1, 14, 7, 28, 0, time.UTC)
+	return sendsafely.Package{
+		PackageID:        "GVG2-MNZT",
+		State:            "PACKAGE_STATE_IN_PROGRESS",
+		PackageTimestamp: created,
+		Life:             10,
+		Files: []sendsafely.File{
+			{FileID: "f1", FileName: "server.log", FileSize: 2048, Parts: 1, CreatedByEmail: "a@example.com", FileUploaded: created},
+			{FileID: "f2", FileName: "heap.hprof", FileSize: 20000000000, Parts: 800, CreatedByEmail: "a@example.com", FileUploaded: created, Path: "dumps"},
+		},
+	}
+}
+
+func TestInspectPackage(t *testing.T) {
+	info := InspectPackage("https://app.sendsafely.com/receive/?packageCode=abc", inspectTestPackage(), 10000000000, nil)
+	if len(info.Files) != 2 {
+		t.Fatalf("expected 2 files but was %#v", info.Files)
+	}
+	if info.Files[0].Skip != "" {
+		t.Errorf("expected server.log to be downloaded but was skipped for %v", info.Files[0].Skip)
+	}
+	if info.Files[1].Name != "dumps/heap.hprof" || info.Files[1].Skip != "over --max-file-size-gib" {
+		t.Errorf("expected the heap dump to be skipped for its size but was %#v", info.Files[1])
+	}
+	if info.Expires.Format(time.RFC3339) != "2019-02-11T14:07:28Z" {
+		t.Errorf("unexpected expiration %v", info.Expires)
+	}
+}
+
+func TestInspectPackageWithFilter(t *testing.T) {
+	f, err := filter.New([]string{"*.log"}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := InspectPackage("https://app.sendsafely.com/receive/?packageCode=abc", inspectTestPackage(), 100000000000, f)
+	if info.Files[0].Skip != "" || info.Files[1].Skip != "not matched by --include" {
+		t.Errorf("expected only the heap dump to be skipped by the filter but was %#v", info.Files)
+	}
+}
+
+func TestInspectTable(t *testing.T) {
+	withMessage := InspectPackage("https://app.sendsafely.com/receive/?packageCode=abc", inspectTestPackage(), 10000000000, nil)
+	withMessage.Message = "logs from both nodes\nthe heap dump is from node1\n"
+	i := Inspection{
+		TicketID: "1111",
+		Packages: []PackageInfo{
+			withMessage,
+			{URL: "https://app.sendsafely.com/receive/?packageCode=old", PackageID: "old", Error: "package expired"},
+		},
+		Attachments: []FileInfo{InspectAttachment(zendesk.Attachment{ID: 7, FileName: "notes.txt", Size: 10, Deleted: true, ParentCommentDate: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}, nil)},
+	}
+	expected := `package GVG2-MNZT state PACKAGE_STATE_IN_PROGRESS created 2019-02-01T14:07:28Z expires 2019-02-11T14:07:28Z
+  https://app.sendsafely.com/receive/?packageCode=abc
+  message:
+    logs from both nodes
+    the heap dump is from node1
+NAME              FILE ID  SIZE      PARTS  UPLOADED BY    UPLOADED              SKIPPED
+server.log        f1       2.00 kb   1      a@example.com  2019-02-01T14:07:28Z  -
+dumps/heap.hprof  f2       18.63 gb  800    a@example.com  2019-02-01T14:07:28Z  over --max-file-size-gib
+
+package old: package expired
+  https://app.sendsafely.com/receive/?packageCode=old
+
+attachments of ticket 1111
+NAME       FILE ID  SIZE      UPLOADED BY  UPLOADED              SKIPPED
+notes.txt  7        10 bytes               2020-01-01T00:00:00Z  deleted
+`
+	if out := InspectTable(i); out != expected {
+		t.Errorf("table did not match, output was\n%v\nbut expected\n%v", out, expected)
+	}
+}
+
+func TestInspectJSON(t *testing.T) {
+	i := Inspection{Packages: []PackageInfo{{URL: "u", PackageID: "old", Error: "package expired"}}}
+	b, err := json.Marshal(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(b)
+	if strings.Contains(out, "created") || strings.Contains(out, "expires") {
+		t.Errorf("expected dates of a package that could not be retrieved to be left out but was %v", out)
+	}
+	if !strings.Contains(out, `"error":"package expired"`) {
+		t.Errorf("expected the error in %v", out)
+	}
+}
+
+func TestInspectLeavesOutKeyCode(t *testing.T) {
+	info := InspectPackage("https://app.sendsafely.com/receive/?thread=MYTHREAD&packageCode=abc#keyCode=MYKEYCODE", inspectTestPackage(), 10000000000, nil)
+	invalid := inspectLink(context.Background(), nil, "https://app.sendsafely.com/receive/?thread=MYTHREAD#keyCode=MYKEYCODE", nil)
+	if invalid.Error != "invalid link" {
+		t.Fatalf("expected the link without a packageCode to be invalid but was %#v", invalid)
+	}
+	i := Inspection{Packages: []PackageInfo{info, invalid}}
+	b, err := json.Marshal(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), `"files":null`) {
+		t.Errorf("expected the invalid link to have an empty list of files but was %v", string(b))
+	}
+	for _, out := range []string{string(b), InspectTable(i)} {
+		if strings.Contains(out, "keyCode") || strings.Contains(out, "MYKEYCODE") {
+			t.Errorf("expected the keyCode to be left out but was\n%v", out)
+		}
+	}
+	if info.URL != "https://app.sendsafely.com/receive/?thread=MYTHREAD&packageCode=abc" {
+		t.Errorf("expected the link without its keyCode but was %v", info.URL)
+	}
+}
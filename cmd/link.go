@@ -21,11 +21,14 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
 
 	"github.com/spf13/cobra"
 
 	"github.com/rsvihladremio/ssdownloader/downloader"
+	"github.com/rsvihladremio/ssdownloader/hooks"
 	"github.com/rsvihladremio/ssdownloader/link"
+	"github.com/rsvihladremio/ssdownloader/reporting"
 	"github.com/rsvihladremio/ssdownloader/sendsafely"
 )
 
@@ -40,6 +43,8 @@ var linkCmd = &cobra.Command{
 	Args: cobra.ExactArgs(1),
 	Run: func(_ *cobra.Command, args []string) {
 		SetVerbosity()
+		// invalid globs are reported before anything is downloaded
+		f := NewFilter()
 		if C.SsAPIKey == "" {
 			slog.Error("ss-api-key is not set and this is required")
 			os.Exit(1)
@@ -51,12 +56,14 @@ var linkCmd = &cobra.Command{
 		url := args[0]
 		linkParts, err := link.ParseLink(url)
 		if err != nil {
-			slog.Error("unexpected error reading url", "url", url, "error_msg", err)
+			slog.Error("unexpected error reading url", "url", link.Redact(url), "error_msg", err)
 			os.Exit(1)
 		}
 		packageID := linkParts.PackageCode
-		d := downloader.NewGenericDownloader(DownloadBufferSize)
-		client := sendsafely.NewClient(C.SsAPIKey, C.SsAPISecret, Verbose)
+		httpClient := NewHTTPClient()
+		store := NewStorage(httpClient)
+		d := downloader.NewGenericDownloader(DownloadBufferSize, httpClient, store, RetryPolicy)
+		client := NewSendSafelyClients(httpClient).For(linkParts)
 		a := sendsafely.DownloadArgs{
 			DownloadDir:      C.DownloadDir,
 			MaxFileSizeByte:  int64(MaxFileSizeGiB) * 1000000000,
@@ -65,9 +72,39 @@ var linkCmd = &cobra.Command{
 			SkipList:         []string{},
 			SubDirToDownload: "packages",
 			Verbose:          Verbose,
+			StreamParts:      StreamParts,
+			PartThreads:      PartThreads,
+			DirPrefix:        DirPrefix,
+			Filter:           f,
+			Storage:          store,
+			Dedup:            NewDedup(),
+			Extract:          NewExtractor(),
 		}
-		_, invalidFiles, err := sendsafely.DownloadFilesFromPackage(client, d, a)
+		ctx, stop := InterruptContext()
+		defer stop()
+		a.Hooks = NewHooks(stop)
+		RemoveOrphans(ctx, store, filepath.Join(C.DownloadDir, a.SubDirToDownload), nil)
+		p, err := sendsafely.RetrievePackage(ctx, client, packageID, DirPrefix)
 		if err != nil {
+			slog.Error("unable to retrieve package", "package_id", packageID, "reason", sendsafely.FailureReason(err), "error_msg", err)
+			a.Hooks.Run(ctx, hooks.Event{Event: hooks.Failure, Source: hooks.SourceSendSafely, PackageID: packageID, Error: err.Error()})
+			os.Exit(1)
+		}
+		sizes, err := sendsafely.PlannedFileSizes(ctx, p, a)
+		if err != nil {
+			slog.Warn("unable to find out how much will be downloaded, skipping the disk space check", "package_id", packageID, "error_msg", err)
+		} else {
+			// the files of a package are downloaded one after another
+			PreflightDiskSpace(SpaceNeeded(sizes, sendsafely.ScratchFactor(StreamParts), 1))
+		}
+		a.Package = &p
+		a.PackagePassword = PackagePasswordFor(p)
+		_, invalidFiles, err := sendsafely.DownloadFilesFromPackage(ctx, client, d, a)
+		if err != nil {
+			if ctx.Err() != nil {
+				slog.Warn("download interrupted, partial downloads have been kept so they can be resumed")
+				os.Exit(1)
+			}
 			slog.Error("unexpected error downloading files", "error_msg", err)
 			os.Exit(1)
 		}
@@ -75,6 +112,12 @@ var linkCmd = &cobra.Command{
 		if result := InvalidFilesReport(invalidFiles); result != "" {
 			fmt.Println(result)
 		}
+		if a.Dedup != nil {
+			fmt.Println(DedupReport(reporting.GetTotalDeduplicated(), reporting.GetTotalDeduplicatedBytes()))
+		}
+		if a.Extract != nil {
+			fmt.Println(ExtractReport(reporting.GetTotalExtracted(), reporting.GetTotalExtractedFiles(), reporting.GetTotalExtractFailed()))
+		}
 	},
 }
 
@@ -0,0 +1,84 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// cmd package contains all the command line flag configuration
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+
+	"github.com/rsvihladremio/ssdownloader/sendsafely"
+)
+
+var PackagePassword string
+var PackagePasswordStdin bool
+
+// the password read with --package-password-stdin, stdin can only be read once
+var stdinPassword struct {
+	once     sync.Once
+	password string
+}
+
+// PackagePasswordFor returns the password of a package that is protected with one from --package-password,
+// --package-password-stdin or a prompt when run from a terminal, in that order. Empty is returned for a package
+// without a password or when there is no way to get one
+func PackagePasswordFor(p sendsafely.Package) string {
+	if !p.PasswordRequired {
+		return ""
+	}
+	if PackagePassword != "" {
+		return PackagePassword
+	}
+	if PackagePasswordStdin {
+		stdinPassword.once.Do(func() {
+			password, err := ReadPasswordLine(os.Stdin)
+			if err != nil {
+				slog.Error("unable to read the package password from stdin", "error_msg", err)
+				return
+			}
+			stdinPassword.password = password
+		})
+		return stdinPassword.password
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return ""
+	}
+	// the prompt goes to stderr so it is not mixed into output such as inspect --output json
+	fmt.Fprintf(os.Stderr, "enter the password for sendsafely package %v:\n", p.PackageID)
+	bytePassword, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		slog.Error("unexpected error reading password", "error_msg", err)
+		return ""
+	}
+	return strings.TrimSpace(string(bytePassword))
+}
+
+// ReadPasswordLine reads the first line of r without the line ending
+func ReadPasswordLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
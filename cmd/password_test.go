@@ -0,0 +1,55 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// cmd package contains all the command line flag configuration
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rsvihladremio/ssdownloader/sendsafely"
+)
+
+func TestReadPasswordLine(t *testing.T) {
+	for input, expected := range map[string]string{
+		"hunter2\n":         "hunter2",
+		"hunter2\r\nmore\n": "hunter2",
+		"hunter2":           "hunter2",
+		" spaced out \n":    " spaced out ",
+	} {
+		password, err := ReadPasswordLine(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if password != expected {
+			t.Errorf("expected '%v' for %q but was '%v'", expected, input, password)
+		}
+	}
+}
+
+func TestPackagePasswordFor(t *testing.T) {
+	defer func() {
+		PackagePassword = ""
+	}()
+	PackagePassword = "hunter2"
+	if password := PackagePasswordFor(sendsafely.Package{}); password != "" {
+		t.Errorf("expected no password for a package that does not require one but was '%v'", password)
+	}
+	if password := PackagePasswordFor(sendsafely.Package{PasswordRequired: true}); password != "hunter2" {
+		t.Errorf("expected the --package-password but was '%v'", password)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// cmd package contains all the command line flag configuration
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/rsvihladremio/ssdownloader/futils"
+	"github.com/rsvihladremio/ssdownloader/journal"
+	"github.com/rsvihladremio/ssdownloader/storage"
+	"golang.org/x/term"
+)
+
+var SkipSpaceCheck bool
+
+// SpaceNeeded is the total size of the files plus the scratch space for the largest of them. Up to concurrent files
+// are downloading at once and each one needs factor-1 times its size on top of the final file while it downloads
+func SpaceNeeded(sizes []int64, factor int64, concurrent int) int64 {
+	var total int64
+	for _, s := range sizes {
+		total += s
+	}
+	if factor <= 1 {
+		return total
+	}
+	largest := slices.Clone(sizes)
+	slices.Sort(largest)
+	slices.Reverse(largest)
+	for i := 0; i < len(largest) && i < concurrent; i++ {
+		total += (factor - 1) * largest[i]
+	}
+	return total
+}
+
+// Confirm asks the question and only returns true when the answer is y or yes
+func Confirm(in io.Reader, out io.Writer, question string) bool {
+	fmt.Fprintf(out, "%v [y/N]: ", question)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// PreflightDiskSpace checks the download dir has room for needed bytes before anything is downloaded. When it does
+// not we ask if running in a terminal and exit otherwise, --skip-space-check turns the check off. There is nothing to
+// check when the files are going to s3
+func PreflightDiskSpace(needed int64) {
+	if SkipSpaceCheck {
+		return
+	}
+	if C.Storage == "s3" {
+		slog.Debug("skipping disk space check since files are uploaded to s3")
+		return
+	}
+	err := futils.CheckFreeSpace(C.DownloadDir, needed)
+	if err == nil {
+		slog.Debug("enough free space to download", "dir", C.DownloadDir, "needed_bytes", needed)
+		return
+	}
+	var spaceErr futils.InsufficientSpaceErr
+	if !errors.As(err, &spaceErr) {
+		slog.Warn("unable to check free space, downloading anyway", "dir", C.DownloadDir, "error_msg", err)
+		return
+	}
+	if term.IsTerminal(int(syscall.Stdin)) && Confirm(os.Stdin, os.Stdout, fmt.Sprintf("%v, download anyway?", spaceErr)) {
+		return
+	}
+	slog.Error("not enough free space to download, free up space or use --skip-space-check", "dir", C.DownloadDir, "needed_bytes", spaceErr.Needed, "free_bytes", spaceErr.Free)
+	os.Exit(1)
+}
+
+// RemoveOrphans cleans up files a crashed or killed run left under dir while they were being written, partial
+// downloads and files the journal can resume are kept. j can be nil
+func RemoveOrphans(ctx context.Context, store storage.Storage, dir string, j *journal.Journal) {
+	removed, err := storage.RemoveOrphans(ctx, store, dir, j.Resumable)
+	if err != nil {
+		slog.Warn("unable to clean up files left over from an earlier run", "dir", dir, "error_msg", err)
+	}
+	for _, f := range removed {
+		slog.Info("removed incomplete file left over from an earlier run", "file_name", f)
+	}
+}
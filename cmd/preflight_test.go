@@ -0,0 +1,55 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// cmd package contains all the command line flag configuration
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpaceNeededStreaming(t *testing.T) {
+	assert.Equal(t, int64(60), SpaceNeeded([]int64{10, 20, 30}, 1, 2))
+}
+
+func TestSpaceNeededAddsScratchForLargestFiles(t *testing.T) {
+	// 60 for the files and 2x scratch for the two largest files being downloaded at once
+	assert.Equal(t, int64(60+2*30+2*20), SpaceNeeded([]int64{10, 30, 20}, 3, 2))
+}
+
+func TestSpaceNeededMoreThreadsThanFiles(t *testing.T) {
+	assert.Equal(t, int64(30), SpaceNeeded([]int64{10}, 3, 8))
+	assert.Equal(t, int64(0), SpaceNeeded(nil, 3, 8))
+}
+
+func TestConfirm(t *testing.T) {
+	for answer, expected := range map[string]bool{
+		"y\n":   true,
+		"YES\n": true,
+		"yes":   true,
+		"n\n":   false,
+		"\n":    false,
+		"":      false,
+	} {
+		var out bytes.Buffer
+		assert.Equal(t, expected, Confirm(strings.NewReader(answer), &out, "continue?"), "answer %q", answer)
+		assert.Equal(t, "continue? [y/N]: ", out.String())
+	}
+}
@@ -19,9 +19,43 @@ package cmd
 
 import (
 	"fmt"
+	"slices"
 	"strings"
+
+	"github.com/rsvihladremio/ssdownloader/link"
+	"github.com/rsvihladremio/ssdownloader/sendsafely"
 )
 
+// LinkFailure is a SendSafely link from a ticket that could not be downloaded and why, the URL still has its keyCode
+type LinkFailure struct {
+	URL    string
+	Reason string
+}
+
+// FailedLinksReport lists the links that failed sorted by url, empty when none did. The keyCode is left out of the
+// links as the summary ends up in terminals and CI logs
+func FailedLinksReport(failures []LinkFailure) string {
+	if len(failures) == 0 {
+		return ""
+	}
+	sorted := make([]LinkFailure, 0, len(failures))
+	for _, f := range failures {
+		sorted = append(sorted, LinkFailure{URL: link.Redact(f.URL), Reason: f.Reason})
+	}
+	slices.SortFunc(sorted, func(a, b LinkFailure) int {
+		return strings.Compare(a.URL, b.URL)
+	})
+	str := `
+the following links failed to download
+--------------------------------------
+`
+	rows := []string{}
+	for _, f := range sorted {
+		rows = append(rows, fmt.Sprintf("* %v: %v\n", f.URL, f.Reason))
+	}
+	return str + strings.Join(rows, "")
+}
+
 func InvalidFilesReport(invalidFiles []string) string {
 	str := ""
 	if len(invalidFiles) > 0 {
@@ -37,3 +71,13 @@ the following files failed validation
 	}
 	return str
 }
+
+// DedupReport is the summary line for --dedup
+func DedupReport(files int, bytes int64) string {
+	return fmt.Sprintf("deduplicated %v files saving %v", files, sendsafely.Human(bytes))
+}
+
+// ExtractReport is the summary line for --extract
+func ExtractReport(archives, files, failed int) string {
+	return fmt.Sprintf("extracted %v archives into %v files, %v archives failed to extract", archives, files, failed)
+}
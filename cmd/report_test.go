@@ -17,7 +17,10 @@
 // cmd package contains all the command line flag configuration
 package cmd
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestInvalidReportOutput(t *testing.T) {
 	report := InvalidFilesReport([]string{"test.txt", "server.log"})
@@ -38,3 +41,51 @@ func TestInvalidReportOutputEmpty(t *testing.T) {
 		t.Errorf("expected empty report but it had the following data %v", report)
 	}
 }
+
+func TestDedupReport(t *testing.T) {
+	report := DedupReport(2, 2048)
+	expected := "deduplicated 2 files saving 2.00 kb"
+	if report != expected {
+		t.Errorf("report did not match, output was %v\nbut expected\n%v", report, expected)
+	}
+}
+
+func TestExtractReport(t *testing.T) {
+	report := ExtractReport(3, 120, 1)
+	expected := "extracted 3 archives into 120 files, 1 archives failed to extract"
+	if report != expected {
+		t.Errorf("report did not match, output was %v\nbut expected\n%v", report, expected)
+	}
+}
+
+func TestFailedLinksReport(t *testing.T) {
+	report := FailedLinksReport([]LinkFailure{
+		{URL: "https://sendsafely.example.com/b", Reason: "package expired"},
+		{URL: "https://sendsafely.example.com/a", Reason: "invalid keycode"},
+	})
+	expected := `
+the following links failed to download
+--------------------------------------
+* https://sendsafely.example.com/a: invalid keycode
+* https://sendsafely.example.com/b: package expired
+`
+	if report != expected {
+		t.Errorf("report did not match, output was %v\nbut expected\n%v", report, expected)
+	}
+	if report := FailedLinksReport(nil); report != "" {
+		t.Errorf("expected empty report but it had the following data %v", report)
+	}
+}
+
+func TestFailedLinksReportLeavesOutKeyCode(t *testing.T) {
+	report := FailedLinksReport([]LinkFailure{
+		{URL: "https://app.sendsafely.com/receive/?thread=MYTHREAD&packageCode=MYPKGCODE#keyCode=MYKEYCODE", Reason: "package expired"},
+		{URL: "https://www.google.com/url?q=https://app.sendsafely.com/receive/?packageCode%3DOTHERPKG%23keyCode%3DOTHERKEY", Reason: "invalid link"},
+	})
+	if strings.Contains(report, "keyCode") || strings.Contains(report, "KEY") {
+		t.Errorf("expected the keyCode to be left out of the report but it was\n%v", report)
+	}
+	if !strings.Contains(report, "* https://app.sendsafely.com/receive/?thread=MYTHREAD&packageCode=MYPKGCODE: package expired") {
+		t.Errorf("expected the redacted link in the report but it was\n%v", report)
+	}
+}
@@ -18,12 +18,29 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/rsvihladremio/ssdownloader/cmd/config"
+	"github.com/rsvihladremio/ssdownloader/dedup"
+	"github.com/rsvihladremio/ssdownloader/extract"
+	"github.com/rsvihladremio/ssdownloader/filter"
+	"github.com/rsvihladremio/ssdownloader/hooks"
+	"github.com/rsvihladremio/ssdownloader/link"
+	"github.com/rsvihladremio/ssdownloader/retry"
+	"github.com/rsvihladremio/ssdownloader/sendsafely"
+	"github.com/rsvihladremio/ssdownloader/storage"
+	"github.com/rsvihladremio/ssdownloader/transport"
+	"github.com/rsvihladremio/ssdownloader/zendesk"
 	"github.com/spf13/cobra"
 )
 
@@ -34,6 +51,28 @@ var Verbose bool
 var DownloadBufferSize int
 var DownloadThreads int
 var MaxFileSizeGiB int
+var RetryPolicy retry.Policy
+var StreamParts bool
+var PartThreads int
+var DirPrefix string
+
+// selection of the files to download, applied to SendSafely files and zendesk attachments alike
+var Include []string
+var Exclude []string
+var FileIDs []string
+var UploadedBy []string
+var Dedup bool
+var Extract bool
+var ExtractLimits extract.Limits
+var ExtractMaxSizeGiB int
+
+// hooks given on the command line, they are added to the hooks in the config file
+var HookFileComplete string
+var HookPackageComplete string
+var HookTicketComplete string
+var HookFailure string
+var HookTimeoutSeconds int
+var HookFailurePolicy string
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -77,6 +116,194 @@ func Execute() {
 
 }
 
+// InterruptContext is cancelled on SIGINT or SIGTERM so downloads in flight can stop cleanly and the summary
+// can still be printed, after the first signal the default behavior is restored so a second one kills the process
+func InterruptContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// RunStatus is reported in the summary so an interrupted run is not mistaken for a complete one
+func RunStatus(ctx context.Context) string {
+	if ctx.Err() != nil {
+		return "interrupted"
+	}
+	return "completed"
+}
+
+// NewHTTPClient builds the http client shared by zendesk, sendsafely and the downloader from the configuration.
+// The keep-alive pool is sized so every download running at once can keep its connection
+func NewHTTPClient() *http.Client {
+	client, err := transport.NewClient(transport.Options{
+		ProxyURL:            C.ProxyURL,
+		CAFile:              C.CAFile,
+		ClientCertFile:      C.ClientCertFile,
+		ClientKeyFile:       C.ClientKeyFile,
+		ConnectTimeout:      time.Duration(C.ConnectTimeoutSeconds) * time.Second,
+		ReadTimeout:         time.Duration(C.ReadTimeoutSeconds) * time.Second,
+		MaxIdleConnsPerHost: DownloadThreads * PartThreads,
+	})
+	if err != nil {
+		slog.Error("unable to setup http client", "error_msg", err)
+		os.Exit(1)
+	}
+	return client
+}
+
+// NewDedup builds the content store used by --dedup, nil when it is disabled. Downloads are linked to the stored copies
+// so they have to be on the same local volume. Stored copies no download uses anymore are pruned first
+func NewDedup() *dedup.Store {
+	if !Dedup {
+		return nil
+	}
+	if C.Storage != "" && C.Storage != "local" {
+		slog.Warn("--dedup only works with local storage, files will not be deduplicated", "storage", C.Storage)
+		return nil
+	}
+	s := dedup.New(filepath.Join(C.DownloadDir, dedup.DirName))
+	removed, freed, err := s.Prune()
+	if err != nil {
+		slog.Warn("unable to prune deduplicated files", "error_msg", err)
+	} else if removed > 0 {
+		slog.Info("pruned deduplicated files no download uses", "files", removed, "bytes", freed)
+	}
+	return s
+}
+
+// NewFilter builds the filter from --include, --exclude, --file-id and --uploaded-by, nil when none are set
+func NewFilter() *filter.Filter {
+	f, err := filter.New(Include, Exclude, FileIDs, UploadedBy)
+	if err != nil {
+		slog.Error("unable to use --include or --exclude", "error_msg", err)
+		os.Exit(1)
+	}
+	return f
+}
+
+// NewExtractor builds the extractor used by --extract, nil when it is disabled
+func NewExtractor() *extract.Extractor {
+	if !Extract {
+		return nil
+	}
+	if C.Storage != "" && C.Storage != "local" {
+		slog.Warn("--extract only works with local storage, archives will not be extracted", "storage", C.Storage)
+		return nil
+	}
+	limits := ExtractLimits
+	limits.MaxBytes = int64(ExtractMaxSizeGiB) * 1000000000
+	return extract.New(limits)
+}
+
+// NewHooks builds the runner for the hooks in the config file and on the command line, abort is called by a hook
+// with the abort failure policy. nil is returned when there are no hooks or the storage is not local, since the paths
+// hooks are given would not exist on disk
+func NewHooks(abort func()) *hooks.Runner {
+	configured := append([]hooks.Hook{}, C.Hooks...)
+	for event, command := range map[string]string{
+		hooks.FileComplete:    HookFileComplete,
+		hooks.PackageComplete: HookPackageComplete,
+		hooks.TicketComplete:  HookTicketComplete,
+		hooks.Failure:         HookFailure,
+	} {
+		if command != "" {
+			configured = append(configured, hooks.Hook{Event: event, Command: command, TimeoutSeconds: HookTimeoutSeconds, FailurePolicy: HookFailurePolicy})
+		}
+	}
+	r, err := hooks.New(configured, abort)
+	if err != nil {
+		slog.Error("unable to setup hooks", "error_msg", err)
+		os.Exit(1)
+	}
+	if r != nil && C.Storage != "" && C.Storage != "local" {
+		slog.Warn("hooks only work with local storage, no hooks will be run", "storage", C.Storage)
+		return nil
+	}
+	return r
+}
+
+// SendSafelyClients hands out one SendSafely client per api so links to enterprise hosts are sent to their own host
+type SendSafelyClients struct {
+	lock       sync.Mutex
+	clients    map[string]sendsafely.Client
+	httpClient *http.Client
+}
+
+// NewSendSafelyClients builds the clients as they are needed with the configured credentials
+func NewSendSafelyClients(httpClient *http.Client) *SendSafelyClients {
+	return &SendSafelyClients{clients: make(map[string]sendsafely.Client), httpClient: httpClient}
+}
+
+// For returns the client for the api the link points to when its host is trusted, or the one configured with
+// --ss-api-url. Links to any other host use the default api so our credentials never leave for hosts we do not know
+func (s *SendSafelyClients) For(linkParts link.Parts) sendsafely.Client {
+	apiURL := C.SsAPIURL
+	if apiURL == "" {
+		apiURL = linkParts.TrustedAPIURL(C.SsHosts)
+	}
+	if apiURL == "" {
+		apiURL = sendsafely.URL
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	client, ok := s.clients[apiURL]
+	if !ok {
+		client = sendsafely.NewClient(apiURL, C.SsAPIKey, C.SsAPISecret, s.httpClient, RetryPolicy, Verbose)
+		s.clients[apiURL] = client
+	}
+	return client
+}
+
+// NewZendeskClient builds the zendesk client for the configured subdomain, or the url set with --zendesk-url
+func NewZendeskClient(httpClient *http.Client) *zendesk.Client {
+	baseURL := C.ZendeskURL
+	if baseURL == "" {
+		baseURL = zendesk.BaseURL(C.ZendeskDomain)
+	}
+	return zendesk.NewClient(C.ZendeskEmail, ZendeskPassword(), baseURL, httpClient, RetryPolicy, Verbose)
+}
+
+// NewStorage builds the storage downloads are written to, for s3 the download dir is only used to build the object keys
+// and the credentials fall back to AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+func NewStorage(httpClient *http.Client) storage.Storage {
+	switch C.Storage {
+	case "", "local":
+		return storage.NewLocal()
+	case "s3":
+		accessKey := C.S3AccessKey
+		if accessKey == "" {
+			accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		}
+		secretKey := C.S3SecretKey
+		if secretKey == "" {
+			secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+		store, err := storage.NewS3(storage.S3Options{
+			Endpoint:     C.S3Endpoint,
+			Region:       C.S3Region,
+			Bucket:       C.S3Bucket,
+			Prefix:       C.S3Prefix,
+			AccessKey:    accessKey,
+			SecretKey:    secretKey,
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			PathStyle:    C.S3PathStyle,
+			Root:         C.DownloadDir,
+		}, httpClient, RetryPolicy)
+		if err != nil {
+			slog.Error("unable to setup s3 storage", "error_msg", err)
+			os.Exit(1)
+		}
+		return store
+	default:
+		slog.Error("unsupported storage, use local or s3", "storage", C.Storage)
+		os.Exit(1)
+	}
+	return nil
+}
+
 func DefaultDownloadDir() string {
 	userDir, err := os.UserHomeDir()
 	if err != nil {
@@ -89,17 +316,62 @@ func DefaultDownloadDir() string {
 func init() {
 	h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: programLevel})
 	slog.SetDefault(slog.New(h))
-	fmt.Println(PrintHeader(Version, platform, arch, GitSha))
+	fmt.Fprintln(os.Stderr, PrintHeader(Version, platform, arch, GitSha))
 	rootCmd.PersistentFlags().BoolVarP(&Verbose, "verbose", "v", false, "verbose logging")
 	rootCmd.PersistentFlags().StringVar(&C.SsAPIKey, "ss-api-key", "", "the SendSafely API key")
 	rootCmd.PersistentFlags().StringVar(&C.SsAPISecret, "ss-api-secret", "", "the SendSafely API secret")
+	rootCmd.PersistentFlags().StringVar(&C.SsAPIURL, "ss-api-url", "", "the SendSafely API url ie https://app.sendsafely.com/api/v2.0, when empty the api on the host of each https link to sendsafely.com or an --ss-host is used")
+	rootCmd.PersistentFlags().StringSliceVar(&C.SsHosts, "ss-host", []string{}, "enterprise SendSafely host ie files.customer.com whose https links are downloaded from tickets with its api, links to sendsafely.com are always downloaded")
 	rootCmd.PersistentFlags().StringVar(&C.ZendeskDomain, "zendesk-subdomain", "", "the customer domain part of the zendesk url that you login against ie https://test.zendesk.com would be 'test'")
+	rootCmd.PersistentFlags().StringVar(&C.ZendeskURL, "zendesk-url", "", "the zendesk url ie https://test.zendesk.com, when empty it is made from --zendesk-subdomain")
 	rootCmd.PersistentFlags().StringVar(&C.ZendeskEmail, "zendesk-email", "", "zendesk email address")
 	rootCmd.PersistentFlags().StringVar(&C.ZendeskToken, "zendesk-token", "", "zendesk api token")
 	rootCmd.PersistentFlags().StringVar(&C.DownloadDir, "download-dir", DefaultDownloadDir(), "base directory to put downloads")
 	rootCmd.PersistentFlags().IntVarP(&DownloadBufferSize, "download-buffer-size-kb", "b", 4096, "buffer size in kb to use during downloads")
 	rootCmd.PersistentFlags().IntVarP(&DownloadThreads, "download-threads", "t", 8, "number of threads to use when downloading")
 	rootCmd.PersistentFlags().IntVarP(&MaxFileSizeGiB, "max-file-size-gib", "m", 10, "max file size in GiB (base 1000) to download, anything over this size will be skipped")
+	rootCmd.PersistentFlags().IntVar(&PartThreads, "part-threads", 4, "number of parts of a single sendsafely file to download at once, this is per file on top of --download-threads")
+	rootCmd.PersistentFlags().StringVar(&DirPrefix, "dir-prefix", "", "only download the files of a sendsafely package under this directory path ie logs/node1, files are written into matching sub directories of the package dir")
+	rootCmd.PersistentFlags().StringSliceVar(&Include, "include", []string{}, "only download files matching this glob ie '*.log', a glob with a / is matched against the path of the file in its package, can be repeated")
+	rootCmd.PersistentFlags().StringSliceVar(&Exclude, "exclude", []string{}, "do not download files matching this glob ie '*.hprof', checked after --include, can be repeated")
+	rootCmd.PersistentFlags().StringSliceVar(&FileIDs, "file-id", []string{}, "only download the sendsafely file or zendesk attachment with this id, can be repeated")
+	rootCmd.PersistentFlags().StringSliceVar(&UploadedBy, "uploaded-by", []string{}, "only download files uploaded by this email, for zendesk attachments this is the author of the comment, can be repeated")
+	rootCmd.PersistentFlags().StringVar(&PackagePassword, "package-password", "", "password of sendsafely packages protected with one in addition to the keycode, when not set it is prompted for from a terminal")
+	rootCmd.PersistentFlags().BoolVar(&PackagePasswordStdin, "package-password-stdin", false, "read the password of sendsafely packages protected with one from the first line of stdin")
+	rootCmd.PersistentFlags().BoolVar(&StreamParts, "stream-parts", true, "decrypt sendsafely parts as they download straight into the final file, set to false to write every part to disk and combine them at the end")
+	rootCmd.PersistentFlags().StringVar(&C.ProxyURL, "proxy", "", "proxy url for all http calls, http, https, socks5 and socks5h are supported. When empty HTTPS_PROXY, HTTP_PROXY and NO_PROXY are used")
+	rootCmd.PersistentFlags().StringVar(&C.CAFile, "ca-file", "", "pem file of certificate authorities to trust in addition to the system ones, needed on networks that inspect tls")
+	rootCmd.PersistentFlags().StringVar(&C.ClientCertFile, "client-cert", "", "pem encoded client certificate for mutual tls, requires --client-key")
+	rootCmd.PersistentFlags().StringVar(&C.ClientKeyFile, "client-key", "", "pem encoded client key for mutual tls, requires --client-cert")
+	rootCmd.PersistentFlags().IntVar(&C.ConnectTimeoutSeconds, "connect-timeout-seconds", 30, "seconds to wait for a connection and tls handshake, 0 waits forever")
+	rootCmd.PersistentFlags().IntVar(&C.ReadTimeoutSeconds, "read-timeout-seconds", 120, "seconds to wait for response headers or for any read to make progress, 0 waits forever. This does not limit how long a download takes")
+	rootCmd.PersistentFlags().BoolVar(&SkipSpaceCheck, "skip-space-check", false, "download even when the download dir does not have enough free space for the planned files")
+	rootCmd.PersistentFlags().BoolVar(&Dedup, "dedup", false, "hardlink every completed file into "+dedup.DirName+" under --download-dir by the hash of its content and replace files with the same content with a reflink where supported or a hardlink to it, only supported with local storage. "+
+		"Hardlinked files share their content, so editing one in place changes every file with the same content. "+
+		"Stored files no download uses anymore are removed at the start of each run")
+	rootCmd.PersistentFlags().BoolVar(&Extract, "extract", false, "unpack every downloaded .zip, .tar.gz and .tgz into a dir next to it named after the archive, only supported with local storage")
+	rootCmd.PersistentFlags().IntVar(&ExtractLimits.MaxDepth, "extract-max-depth", 2, "how many levels of archives inside a downloaded archive are also unpacked, 0 only unpacks the downloaded archive")
+	rootCmd.PersistentFlags().IntVar(&ExtractMaxSizeGiB, "extract-max-size-gib", 50, "max size in GiB (base 1000) one downloaded archive can unpack to, nested archives included, 0 for no limit")
+	rootCmd.PersistentFlags().IntVar(&ExtractLimits.MaxEntries, "extract-max-entries", 100000, "max number of files and dirs one downloaded archive can unpack to, nested archives included, 0 for no limit")
+	rootCmd.PersistentFlags().Int64Var(&ExtractLimits.MaxRatio, "extract-max-ratio", 200, "max times larger than itself an archive can unpack to, 0 for no limit")
+	rootCmd.PersistentFlags().StringVar(&HookFileComplete, "hook-file-complete", "", "command run when a file is downloaded, the event is written to its stdin as json and set as SSDOWNLOADER_ env vars. More hooks with their own timeout and failure policy can be added to the Hooks list in the config file. Hooks only run with local storage")
+	rootCmd.PersistentFlags().StringVar(&HookPackageComplete, "hook-package-complete", "", "command run when every file in a sendsafely package has been downloaded or skipped, a package with a failed file runs --hook-failure instead")
+	rootCmd.PersistentFlags().StringVar(&HookTicketComplete, "hook-ticket-complete", "", "command run when everything in a ticket has been processed")
+	rootCmd.PersistentFlags().StringVar(&HookFailure, "hook-failure", "", "command run when a file, attachment or package fails to download")
+	rootCmd.PersistentFlags().IntVar(&HookTimeoutSeconds, "hook-timeout-seconds", int(hooks.DefaultTimeout.Seconds()), "seconds the hooks given on the command line can run before they are killed")
+	rootCmd.PersistentFlags().StringVar(&HookFailurePolicy, "hook-failure-policy", hooks.PolicyWarn, "what happens when a hook given on the command line fails or times out: ignore, warn or abort which stops the run like an interrupt")
+	rootCmd.PersistentFlags().StringVar(&C.Storage, "storage", "local", "where downloads are written, local or s3. With s3 the files are uploaded to the bucket with keys relative to --download-dir")
+	rootCmd.PersistentFlags().StringVar(&C.S3Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "base url of the S3 compatible service ie http://localhost:9000 for MinIO")
+	rootCmd.PersistentFlags().StringVar(&C.S3Region, "s3-region", "us-east-1", "region used to sign s3 requests")
+	rootCmd.PersistentFlags().StringVar(&C.S3Bucket, "s3-bucket", "", "bucket to upload downloads to when --storage is s3")
+	rootCmd.PersistentFlags().StringVar(&C.S3Prefix, "s3-prefix", "", "prefix added to every key so a bucket can be shared")
+	rootCmd.PersistentFlags().StringVar(&C.S3AccessKey, "s3-access-key", "", "s3 access key, when empty AWS_ACCESS_KEY_ID is used")
+	rootCmd.PersistentFlags().StringVar(&C.S3SecretKey, "s3-secret-key", "", "s3 secret key, when empty AWS_SECRET_ACCESS_KEY is used")
+	rootCmd.PersistentFlags().BoolVar(&C.S3PathStyle, "s3-path-style", true, "put the bucket in the url path instead of the host name, needed by MinIO and most self hosted servers")
+	defaultPolicy := retry.DefaultPolicy()
+	rootCmd.PersistentFlags().IntVar(&RetryPolicy.MaxAttempts, "retry-max-attempts", defaultPolicy.MaxAttempts, "max number of attempts for each network call before giving up, 1 disables retries")
+	rootCmd.PersistentFlags().DurationVar(&RetryPolicy.InitialBackoff, "retry-initial-backoff", defaultPolicy.InitialBackoff, "how long to wait before the first retry, this doubles with each attempt")
+	rootCmd.PersistentFlags().DurationVar(&RetryPolicy.MaxBackoff, "retry-max-backoff", defaultPolicy.MaxBackoff, "the longest to wait between retries unless the server asks for longer with Retry-After")
 	initConfig()
 }
 
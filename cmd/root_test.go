@@ -18,9 +18,12 @@
 package cmd
 
 import (
+	"context"
 	"log/slog"
+	"net/http"
 	"testing"
 
+	"github.com/rsvihladremio/ssdownloader/link"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -41,3 +44,56 @@ func TestVerbosityLevelDefault(t *testing.T) {
 	SetVerbosity()
 	assert.Equal(t, slog.LevelInfo, programLevel.Level())
 }
+
+func TestRunStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.Equal(t, "completed", RunStatus(ctx))
+	cancel()
+	assert.Equal(t, "interrupted", RunStatus(ctx))
+}
+
+func TestSendSafelyClientsPerHost(t *testing.T) {
+	defer func() {
+		C.SsAPIURL = ""
+		C.SsHosts = nil
+	}()
+	clients := NewSendSafelyClients(&http.Client{})
+	parse := func(u string) link.Parts {
+		parts, err := link.ParseLink(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parts
+	}
+	app := parse("https://app.sendsafely.com/receive/?packageCode=A#keyCode=B")
+	enterprise := parse("https://files.customer.com/receive/?packageCode=A#keyCode=B")
+	untrusted := parse("https://sendsafely.attacker.net/receive/?packageCode=A#keyCode=B")
+	assert.Same(t, clients.For(app), clients.For(app))
+	// hosts that are not configured get the default api and never our credentials
+	assert.Same(t, clients.For(app), clients.For(enterprise))
+	assert.Same(t, clients.For(app), clients.For(untrusted))
+
+	C.SsHosts = []string{"files.customer.com"}
+	assert.NotSame(t, clients.For(app), clients.For(enterprise))
+	assert.Same(t, clients.For(app), clients.For(untrusted))
+
+	// an api set in the config is used for every link
+	C.SsAPIURL = "http://127.0.0.1:8080/api/v2.0"
+	clients = NewSendSafelyClients(&http.Client{})
+	assert.Same(t, clients.For(app), clients.For(enterprise))
+}
+
+func TestNewHooksOnlyWithLocalStorage(t *testing.T) {
+	storage := C.Storage
+	defer func() {
+		HookFailure = ""
+		C.Storage = storage
+	}()
+	HookFailure = "echo failed"
+	C.Storage = "local"
+	assert.NotNil(t, NewHooks(nil))
+
+	// the paths in the events would not exist on disk
+	C.Storage = "s3"
+	assert.Nil(t, NewHooks(nil))
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// cmd package contains all the command line flag configuration
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/rsvihladremio/ssdownloader/sendsafely"
+)
+
+var sendTo []string
+var sendTicket string
+
+// sendCmd represents the send command
+var sendCmd = &cobra.Command{
+	Use:   "send <files...>",
+	Short: "encrypts and uploads files to a new sendsafely package and prints its link",
+	Long: `send encrypts and uploads files to a new sendsafely package shared with the --to recipients and prints the link
+to it. The keycode is only in the printed link so keep it somewhere safe. Examples below:
+
+	ssdownloader send diag.tar.gz --to customer@example.com
+
+	//also post the link as a public comment on zendesk ticket 1111
+	ssdownloader send diag.tar.gz profile.json --to customer@example.com --ticket 1111
+`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		SetVerbosity()
+		if C.SsAPIKey == "" {
+			slog.Error("ss-api-key is not set and this is required")
+			os.Exit(1)
+		}
+		if C.SsAPISecret == "" {
+			slog.Error("ss-api-secret is not set and this is required")
+			os.Exit(1)
+		}
+		if len(sendTo) == 0 {
+			slog.Error("--to is not set and at least one recipient is required")
+			os.Exit(1)
+		}
+		httpClient := NewHTTPClient()
+		ctx, stop := InterruptContext()
+		defer stop()
+		sender := sendsafely.NewSender(C.SsAPIURL, C.SsAPIKey, C.SsAPISecret, httpClient, RetryPolicy, Verbose)
+		link, err := sendsafely.SendFiles(ctx, sender, sendsafely.SendArgs{
+			Files:      args,
+			Recipients: sendTo,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				slog.Warn("send interrupted, the package was never finalized so nobody can see it")
+				os.Exit(1)
+			}
+			slog.Error("unable to send files", "reason", sendsafely.FailureReason(err), "error_msg", err)
+			os.Exit(1)
+		}
+		fmt.Println()
+		fmt.Println(link)
+		if sendTicket == "" {
+			return
+		}
+		zendeskAPI := NewZendeskClient(httpClient)
+		if err := zendeskAPI.AddComment(ctx, sendTicket, SendComment(args, link)); err != nil {
+			slog.Error("files were sent but the link could not be added to the ticket", "ticket_id", sendTicket, "error_msg", err)
+			os.Exit(1)
+		}
+		slog.Info("added link to ticket", "ticket_id", sendTicket)
+	},
+}
+
+// SendComment is the ticket comment that shares the link to the sent files
+func SendComment(files []string, link string) string {
+	comment := "The following files have been sent with SendSafely:\n\n"
+	for _, f := range files {
+		comment += fmt.Sprintf("* %v\n", filepath.Base(f))
+	}
+	return comment + "\n" + link
+}
+
+func init() {
+	rootCmd.AddCommand(sendCmd)
+	sendCmd.Flags().StringSliceVar(&sendTo, "to", []string{}, "email of a recipient of the package, repeat or separate with commas for more than one")
+	sendCmd.Flags().StringVar(&sendTicket, "ticket", "", "zendesk ticket id to add the link to as a public comment")
+	sendCmd.Flags().BoolVarP(&useZendeskPassword, "zendesk-password", "p", false, "Use a password instead of an api key to authenticate against zendesk")
+}
@@ -18,20 +18,28 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 
 	"github.com/panjf2000/ants/v2"
+	"github.com/rsvihladremio/ssdownloader/dedup"
 	"github.com/rsvihladremio/ssdownloader/downloader"
-	"github.com/rsvihladremio/ssdownloader/futils"
+	"github.com/rsvihladremio/ssdownloader/extract"
+	"github.com/rsvihladremio/ssdownloader/filter"
+	"github.com/rsvihladremio/ssdownloader/hooks"
+	"github.com/rsvihladremio/ssdownloader/journal"
 	"github.com/rsvihladremio/ssdownloader/link"
 	"github.com/rsvihladremio/ssdownloader/reporting"
+	"github.com/rsvihladremio/ssdownloader/retry"
 	"github.com/rsvihladremio/ssdownloader/sendsafely"
+	"github.com/rsvihladremio/ssdownloader/storage"
 	"github.com/rsvihladremio/ssdownloader/zendesk"
 	"github.com/spf13/cobra"
 	"golang.org/x/term"
@@ -39,6 +47,7 @@ import (
 
 var useZendeskPassword bool
 var onlySendSafelyLinks bool
+var restart bool
 
 // ticketCmd represents the ticket command
 var ticketCmd = &cobra.Command{
@@ -56,51 +65,18 @@ var ticketCmd = &cobra.Command{
 	Args: cobra.ExactArgs(1),
 	Run: func(_ *cobra.Command, args []string) {
 		SetVerbosity()
-		d := downloader.NewGenericDownloader(DownloadBufferSize)
-		password := ""
-		if useZendeskPassword {
-			fmt.Println("enter password:")
-			bytePassword, err := term.ReadPassword(int(syscall.Stdin))
-			if err != nil {
-				slog.Error("unexpected error reading password", "error_msg", err)
-				os.Exit(1)
-			}
-			password = strings.TrimSpace(string(bytePassword))
-		} else {
-			password = C.ZendeskToken
-		}
-		zendeskAPI := zendesk.NewClient(C.ZendeskEmail, password, C.ZendeskDomain, Verbose)
+		// invalid globs are reported before anything is downloaded
+		f := NewFilter()
+		httpClient := NewHTTPClient()
+		store := NewStorage(httpClient)
+		d := downloader.NewGenericDownloader(DownloadBufferSize, httpClient, store, RetryPolicy)
+		zendeskAPI := NewZendeskClient(httpClient)
 		ticketID := args[0]
+		ctx, stop := InterruptContext()
+		defer stop()
 
-		// Handle paging when ticket comments > 100
-		var commentLinkTuples []zendesk.CommentTextWithLink
-		var attachments []zendesk.Attachment
-		emptyString := ""
-		nextPage := &emptyString
-
-		for nextPage != nil {
-			var commentResults []zendesk.CommentTextWithLink
-			results, err := zendeskAPI.GetTicketComentsJSON(ticketID, nextPage)
-			if err != nil {
-				slog.Error("unexpected error getting ticket comments", "error_msg", err)
-				os.Exit(1)
-			}
-			commentResults, nextPage, err = zendesk.GetLinksFromComments(results)
-			if err != nil {
-				slog.Error("unable to parse ticket comments", "error_msg", err)
-				os.Exit(1)
-			}
-			// Append to array for comments (short hand with "...")
-			commentLinkTuples = append(commentLinkTuples, commentResults...)
-
-			attResults, _, err := zendesk.GetAttachmentsFromComments(results)
-			if err != nil {
-				slog.Error("unable parse attachments", "error_msg", err)
-				os.Exit(1)
-			}
-			// Append to array for attachments
-			attachments = append(attachments, attResults...)
-		}
+		commentLinkTuples, attachments := TicketComments(ctx, zendeskAPI, ticketID)
+		attachments = SelectAttachments(f, attachments)
 
 		p, err := ants.NewPool(DownloadThreads)
 		if err != nil {
@@ -111,42 +87,129 @@ var ticketCmd = &cobra.Command{
 		defer p.Release()
 		var m sync.Mutex
 		var allInvalidFiles []string
+		var failedLinks []LinkFailure
 		var wg sync.WaitGroup
-		client := sendsafely.NewClient(C.SsAPIKey, C.SsAPISecret, Verbose)
+		clients := NewSendSafelyClients(httpClient)
+		ticketDir := filepath.Join(C.DownloadDir, "tickets", ticketID)
+		j, err := journal.Open(ctx, store, filepath.Join(ticketDir, journal.FileName), restart)
+		if err != nil {
+			slog.Error("unable to open download journal", "error_msg", err)
+			os.Exit(1)
+		}
+		RemoveOrphans(ctx, store, ticketDir, j)
+		hr := NewHooks(stop)
+		attachmentArgs := AttachmentArgs{
+			TicketID:   ticketID,
+			Downloader: d,
+			Storage:    store,
+			Journal:    j,
+			Dedup:      NewDedup(),
+			Extract:    NewExtractor(),
+			Hooks:      hr,
+		}
+		// every package is looked up before downloading anything so we know the space needed up front
+		packages := make(map[string]*sendsafely.Package)
+		// asked for up front so the prompts do not interleave with the downloads
+		passwords := make(map[string]string)
+		// packages SendSafely refused for good, ie expired, are not tried again
+		packageErrs := make(map[string]error)
+		var packageSizes []int64
+		for _, c := range commentLinkTuples {
+			if !link.IsSendSafely(c.URL, C.SsHosts) {
+				continue
+			}
+			linkParts, err := link.ParseLink(c.URL)
+			if err != nil {
+				// reported below when it is downloaded
+				continue
+			}
+			pkg, err := sendsafely.RetrievePackage(ctx, clients.For(linkParts), linkParts.PackageCode, DirPrefix)
+			if err != nil {
+				if ctx.Err() == nil && retry.Classify(err) == retry.Permanent {
+					packageErrs[linkParts.PackageCode] = err
+					continue
+				}
+				slog.Warn("unable to retrieve package to check disk space, it will be tried again when downloading", "package_id", linkParts.PackageCode, "error_msg", err)
+				continue
+			}
+			packages[linkParts.PackageCode] = &pkg
+			if _, ok := passwords[linkParts.PackageCode]; !ok {
+				passwords[linkParts.PackageCode] = PackagePasswordFor(pkg)
+			}
+			sizes, err := sendsafely.PlannedFileSizes(ctx, pkg, ticketPackageArgs(ticketID, linkParts, store, f))
+			if err != nil {
+				slog.Warn("unable to find out how much will be downloaded for package", "package_id", linkParts.PackageCode, "error_msg", err)
+				continue
+			}
+			packageSizes = append(packageSizes, sizes...)
+		}
+		var attachmentSizes []int64
+		if !onlySendSafelyLinks {
+			for _, a := range attachments {
+				if a.Deleted {
+					continue
+				}
+				if exists, err := storage.Exists(ctx, store, AttachmentPath(a, ticketID)); err == nil && !exists {
+					attachmentSizes = append(attachmentSizes, a.Size)
+				}
+			}
+		}
+		// attachments are downloaded straight to their final file so they need no scratch space
+		PreflightDiskSpace(SpaceNeeded(packageSizes, sendsafely.ScratchFactor(StreamParts), DownloadThreads) + SpaceNeeded(attachmentSizes, 1, 0))
+
 		for _, c := range commentLinkTuples {
 			url := c.URL
-			if strings.HasPrefix(url, "https://sendsafely") {
+			if link.IsSendSafely(url, C.SsHosts) {
 				linkParts, err := link.ParseLink(url)
 				if err != nil {
-					slog.Error("unexpected error reading url", "error_msg", err, "url", url)
+					slog.Error("unexpected error reading url", "error_msg", err, "url", link.Redact(url))
+					failedLinks = append(failedLinks, LinkFailure{URL: url, Reason: "invalid link"})
+					continue
 				}
 				packageID := linkParts.PackageCode
+				if err, ok := packageErrs[packageID]; ok {
+					slog.Error("error downloading files from package", "error_msg", err, "package_id", packageID)
+					failedLinks = append(failedLinks, LinkFailure{URL: url, Reason: sendsafely.FailureReason(err)})
+					hr.Run(ctx, hooks.Event{Event: hooks.Failure, Source: hooks.SourceSendSafely, TicketID: ticketID, PackageID: packageID, Error: err.Error()})
+					continue
+				}
 				wg.Add(1)
 				err = p.Submit(func() {
-					keyCode := linkParts.KeyCode
-					a := sendsafely.DownloadArgs{
-						PackageID:        packageID,
-						KeyCode:          keyCode,
-						SubDirToDownload: filepath.Join("tickets", ticketID),
-						DownloadDir:      C.DownloadDir,
-						MaxFileSizeByte:  int64(MaxFileSizeGiB) * 1000000000,
-						Verbose:          Verbose,
-						SkipList:         []string{},
+					defer wg.Done()
+					// queued tasks still run after an interrupt, they just have nothing to do
+					if ctx.Err() != nil {
+						return
+					}
+					a := ticketPackageArgs(ticketID, linkParts, store, f)
+					a.Package = packages[packageID]
+					if password, ok := passwords[packageID]; ok {
+						a.PackagePassword = password
 					}
-					outDir, invalidFiles, err := sendsafely.DownloadFilesFromPackage(client, d, a)
+					a.Journal = j
+					a.Dedup = attachmentArgs.Dedup
+					a.Extract = attachmentArgs.Extract
+					a.Hooks = hr
+					a.TicketID = ticketID
+					outDir, invalidFiles, err := sendsafely.DownloadFilesFromPackage(ctx, clients.For(linkParts), d, a)
 					if err != nil {
+						if ctx.Err() != nil {
+							slog.Warn("download of package interrupted", "package_id", packageID)
+							return
+						}
 						slog.Error("error downloading files from package", "error_msg", err, "package_id", packageID)
+						m.Lock()
+						failedLinks = append(failedLinks, LinkFailure{URL: url, Reason: sendsafely.FailureReason(err)})
+						m.Unlock()
 					} else {
 						m.Lock()
 						allInvalidFiles = append(allInvalidFiles, invalidFiles...)
 						m.Unlock()
 						outputFile := filepath.Join(outDir, "comment.txt")
-						err = os.WriteFile(outputFile, []byte(c.Body), 0600)
+						err = storage.WriteFile(ctx, store, outputFile, []byte(c.Body))
 						if err != nil {
-							slog.Error("error writing comment text", "error_msg", err, "comment_url", c.URL, "output_file", outputFile)
+							slog.Error("error writing comment text", "error_msg", err, "comment_url", link.Redact(c.URL), "output_file", outputFile)
 						}
 					}
-					wg.Done()
 				})
 				if err != nil {
 					slog.Error("cannot initialize sendsafely download", "error_msg", err)
@@ -158,14 +221,21 @@ var ticketCmd = &cobra.Command{
 			for _, a := range attachments {
 				wg.Add(1)
 				err = p.Submit(func() {
-					if invalidFiles, err := DownloadNonSendSafelyLink(d, a, ticketID); err != nil {
+					defer wg.Done()
+					if ctx.Err() != nil {
+						return
+					}
+					if invalidFiles, err := DownloadNonSendSafelyLink(ctx, attachmentArgs, a); err != nil {
+						if ctx.Err() != nil {
+							slog.Warn("download of attachment interrupted", "attachement", a.FileName)
+							return
+						}
 						slog.Warn("error processing attachment; skipping", "error_msg", err, "attachement", a.FileName)
 					} else {
 						m.Lock()
 						allInvalidFiles = append(allInvalidFiles, invalidFiles...)
 						m.Unlock()
 					}
-					wg.Done()
 				})
 				if err != nil {
 					slog.Error("cannot initialize sendsafely download", "error_msg", err)
@@ -174,31 +244,180 @@ var ticketCmd = &cobra.Command{
 			}
 		}
 		wg.Wait()
+		if err := j.Flush(ctx); err != nil {
+			slog.Warn("unable to write download journal, finished files may be checked again on the next run", "error_msg", err)
+		}
 		if result := InvalidFilesReport(allInvalidFiles); result != "" {
 			fmt.Println(result)
 		}
-		fmt.Println(Report(reporting.GetTotalFiles(), reporting.GetTotalSkipped(), reporting.GetTotalFailed(), reporting.GetTotalBytes(), reporting.GetMaxFileSizeBytes()))
+		if result := FailedLinksReport(failedLinks); result != "" {
+			fmt.Println(result)
+		}
+		status := RunStatus(ctx)
+		fmt.Println(Report(status, reporting.GetTotalFiles(), reporting.GetTotalSkipped(), reporting.GetTotalFailed(), reporting.GetTotalBytes(), reporting.GetMaxFileSizeBytes()))
+		if attachmentArgs.Dedup != nil {
+			fmt.Println(DedupReport(reporting.GetTotalDeduplicated(), reporting.GetTotalDeduplicatedBytes()))
+		}
+		if attachmentArgs.Extract != nil {
+			fmt.Println(ExtractReport(reporting.GetTotalExtracted(), reporting.GetTotalExtractedFiles(), reporting.GetTotalExtractFailed()))
+		}
+		if ctx.Err() != nil {
+			p.Release()
+			os.Exit(1)
+		}
+		hr.Run(ctx, hooks.Event{Event: hooks.TicketComplete, Source: hooks.SourceZendesk, TicketID: ticketID, Path: ticketDir, Size: reporting.GetTotalBytes()})
 	},
 }
 
-func DownloadNonSendSafelyLink(d downloader.GenericDownloader, a zendesk.Attachment, ticketID string) (invalidFiles []string, err error) {
+// ZendeskPassword prompts for the zendesk password when -p is set, otherwise the zendesk token is used
+func ZendeskPassword() string {
+	if !useZendeskPassword {
+		return C.ZendeskToken
+	}
+	fmt.Println("enter password:")
+	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+	if err != nil {
+		slog.Error("unexpected error reading password", "error_msg", err)
+		os.Exit(1)
+	}
+	return strings.TrimSpace(string(bytePassword))
+}
+
+// TicketComments reads every page of the ticket comments and returns the SendSafely links and the attachments in them
+func TicketComments(ctx context.Context, zendeskAPI *zendesk.Client, ticketID string) ([]zendesk.CommentTextWithLink, []zendesk.Attachment) {
+	// Handle paging when ticket comments > 100
+	var commentLinkTuples []zendesk.CommentTextWithLink
+	var attachments []zendesk.Attachment
+	emptyString := ""
+	nextPage := &emptyString
+
+	for nextPage != nil {
+		var commentResults []zendesk.CommentTextWithLink
+		results, err := zendeskAPI.GetTicketComentsJSON(ctx, ticketID, nextPage)
+		if err != nil {
+			slog.Error("unexpected error getting ticket comments", "error_msg", err)
+			os.Exit(1)
+		}
+		commentResults, nextPage, err = zendesk.GetLinksFromComments(results)
+		if err != nil {
+			slog.Error("unable to parse ticket comments", "error_msg", err)
+			os.Exit(1)
+		}
+		// Append to array for comments (short hand with "...")
+		commentLinkTuples = append(commentLinkTuples, commentResults...)
+
+		attResults, _, err := zendesk.GetAttachmentsFromComments(results)
+		if err != nil {
+			slog.Error("unable parse attachments", "error_msg", err)
+			os.Exit(1)
+		}
+		// Append to array for attachments
+		attachments = append(attachments, attResults...)
+	}
+	return commentLinkTuples, attachments
+}
+
+// AttachmentSkip is why the filter does not select the attachment, empty when it does
+func AttachmentSkip(f *filter.Filter, a zendesk.Attachment) string {
+	var id string
+	if a.ID != 0 {
+		id = strconv.FormatInt(a.ID, 10)
+	}
+	return f.Skip(a.FileName, id, a.UploadedBy)
+}
+
+// SelectAttachments leaves out the attachments the filter does not select
+func SelectAttachments(f *filter.Filter, attachments []zendesk.Attachment) []zendesk.Attachment {
+	var selected []zendesk.Attachment
+	for _, a := range attachments {
+		if reason := AttachmentSkip(f, a); reason != "" {
+			slog.Info("skipping attachment as it was not selected", "attachment", a.FileName, "reason", reason)
+			continue
+		}
+		selected = append(selected, a)
+	}
+	return selected
+}
+
+// ticketPackageArgs are the arguments to download a package linked from a ticket comment with the files f selects
+func ticketPackageArgs(ticketID string, linkParts link.Parts, store storage.Storage, f *filter.Filter) sendsafely.DownloadArgs {
+	return sendsafely.DownloadArgs{
+		PackageID:        linkParts.PackageCode,
+		KeyCode:          linkParts.KeyCode,
+		SubDirToDownload: filepath.Join("tickets", ticketID),
+		DownloadDir:      C.DownloadDir,
+		MaxFileSizeByte:  int64(MaxFileSizeGiB) * 1000000000,
+		Verbose:          Verbose,
+		SkipList:         []string{},
+		StreamParts:      StreamParts,
+		PartThreads:      PartThreads,
+		DirPrefix:        DirPrefix,
+		Filter:           f,
+		PackagePassword:  PackagePassword,
+		Storage:          store,
+	}
+}
+
+// AttachmentPath is where a zendesk attachment is downloaded to, attachments are grouped by the comment they came from
+func AttachmentPath(a zendesk.Attachment, ticketID string) string {
+	commentDir := fmt.Sprintf("%v_%v", a.ParentCommentDate.Format("2006-01-02T150405Z0700"), a.ParentCommentID)
+	return filepath.Join(C.DownloadDir, "tickets", ticketID, "attachments", commentDir, a.FileName)
+}
+
+// AttachmentArgs is everything DownloadNonSendSafelyLink needs besides the attachment, Journal, Dedup, Extract and Hooks can be nil
+type AttachmentArgs struct {
+	TicketID   string
+	Downloader downloader.GenericDownloader
+	Storage    storage.Storage
+	Journal    *journal.Journal
+	Dedup      *dedup.Store
+	Extract    *extract.Extractor
+	Hooks      *hooks.Runner
+}
+
+// DownloadNonSendSafelyLink downloads a zendesk attachment, the failure hooks are run when it cannot be downloaded
+func DownloadNonSendSafelyLink(ctx context.Context, args AttachmentArgs, a zendesk.Attachment) (invalidFiles []string, err error) {
+	invalidFiles, err = downloadAttachment(ctx, args, a)
+	// an interrupted download has not failed, it is resumed by the next run
+	if err != nil && ctx.Err() == nil {
+		e := attachmentEvent(hooks.Failure, args.TicketID, a)
+		e.Error = err.Error()
+		args.Hooks.Run(ctx, e)
+	}
+	return invalidFiles, err
+}
+
+func attachmentEvent(event, ticketID string, a zendesk.Attachment) hooks.Event {
+	e := hooks.Event{Event: event, Source: hooks.SourceZendesk, TicketID: ticketID, Path: AttachmentPath(a, ticketID), Size: a.Size}
+	if a.ID != 0 {
+		e.FileID = strconv.FormatInt(a.ID, 10)
+	}
+	return e
+}
+
+func downloadAttachment(ctx context.Context, args AttachmentArgs, a zendesk.Attachment) (invalidFiles []string, err error) {
+	ticketID := args.TicketID
+	d := args.Downloader
+	store := args.Storage
+	j := args.Journal
 	reporting.AddFile()
 	if a.Deleted {
 		reporting.AddFailed()
 		return invalidFiles, fmt.Errorf("attachment '%v' from comment %v created on %v is marked as deleted, skipping", a.FileName, a.ParentCommentID, a.ParentCommentDate)
 	}
-	commentDir := fmt.Sprintf("%v_%v", a.ParentCommentDate.Format("2006-01-02T150405Z0700"), a.ParentCommentID)
-	downloadDir := filepath.Join(C.DownloadDir, "tickets", ticketID, "attachments", commentDir)
-	newFileName := filepath.Join(downloadDir, a.FileName)
-	exists, err := futils.FileExists(newFileName)
+	newFileName := AttachmentPath(a, ticketID)
+	exists, err := storage.Exists(ctx, store, newFileName)
 	if err != nil {
 		reporting.AddFailed()
 		return invalidFiles, fmt.Errorf("unable to see if there is an existing file named %v due to error %v, skipping download", newFileName, err)
 	}
 	if exists {
-		if err := sendsafely.FileSizeCheck(newFileName, a.Size); err != nil {
-			reporting.AddFailed()
-			return invalidFiles, fmt.Errorf("already downloaded file %v failed verification and is not readable %v", newFileName, a.Size)
+		// the size was already checked by the run that recorded it as complete
+		if !j.AttachmentComplete(newFileName) {
+			if err := sendsafely.FileSizeCheck(ctx, store, newFileName, a.Size); err != nil {
+				reporting.AddFailed()
+				return invalidFiles, fmt.Errorf("already downloaded file %v failed verification and is not readable %v", newFileName, a.Size)
+			}
 		}
 		reporting.AddSkip()
 		slog.Debug("file already downloaded skipping", "file_name", newFileName)
@@ -206,27 +425,33 @@ func DownloadNonSendSafelyLink(d downloader.GenericDownloader, a zendesk.Attachm
 	}
 	fmt.Print(".")
 	slog.Debug("downloading attachment", "file_name", newFileName)
-	if _, err := os.Stat(downloadDir); err != nil {
-		if os.IsNotExist(err) {
-			err = os.MkdirAll(downloadDir, 0700)
-			if err != nil {
-				reporting.AddFailed()
-				return invalidFiles, fmt.Errorf("unable to make dir %v due to error '%v", downloadDir, err)
-			}
-		} else {
-			reporting.AddFailed()
-			return invalidFiles, fmt.Errorf("unable to read dir %v due to error '%v", downloadDir, err)
-		}
-	}
-
-	if err := d.DownloadFile(newFileName, a.ContentURL); err != nil {
+	resumed, err := d.DownloadFile(ctx, newFileName, a.ContentURL)
+	if err != nil {
 		reporting.AddFailed()
 		return invalidFiles, fmt.Errorf("cannot download %v due to error %v, skipping", newFileName, err)
 	}
-	if err := sendsafely.FileSizeCheck(newFileName, a.Size); err != nil {
+	if resumed {
+		slog.Info("resumed partial download of attachment", "file_name", newFileName)
+	}
+	if err := sendsafely.FileSizeCheck(ctx, store, newFileName, a.Size); err != nil {
 		invalidFiles = append(invalidFiles, newFileName)
 		return invalidFiles, fmt.Errorf("newly downloaded file %v failed verification and is not readable %v", newFileName, a.Size)
 	}
+	if err := j.CompleteAttachment(ctx, newFileName); err != nil {
+		slog.Warn("unable to update download journal", "file_name", newFileName, "error_msg", err)
+	}
+	if saved, err := args.Dedup.Add(newFileName); err != nil {
+		slog.Warn("unable to deduplicate attachment, keeping the downloaded copy", "file_name", newFileName, "error_msg", err)
+	} else if saved > 0 {
+		reporting.AddDeduplicated(saved)
+	}
+	if result, err := args.Extract.Extract(ctx, newFileName); err != nil {
+		reporting.AddExtractFailed()
+		slog.Warn("unable to extract attachment, keeping the downloaded archive", "file_name", newFileName, "error_msg", err)
+	} else if result.Archives > 0 {
+		reporting.AddExtracted(result.Archives, result.Files)
+	}
+	args.Hooks.Run(ctx, attachmentEvent(hooks.FileComplete, ticketID, a))
 	fmt.Print(".")
 	slog.Debug("attachement download complete", "file_name", newFileName)
 	reporting.AddBytes(a.Size)
@@ -234,22 +459,24 @@ func DownloadNonSendSafelyLink(d downloader.GenericDownloader, a zendesk.Attachm
 	return invalidFiles, nil
 }
 
-func Report(totalFiles int, totalSkipped int, totalFailed int, totalBytes int64, maxBytes int64) string {
+func Report(status string, totalFiles int, totalSkipped int, totalFailed int, totalBytes int64, maxBytes int64) string {
 	return fmt.Sprintf(`
 ================================
 = ssdownloader summary         =
 ================================
+= status            : %v
 = total files       : %v
 = total succeeded   : %v
 = total skipped     : %v
 = total failed      : %v
 = total bytes       : %v
 = max bytes         : %v
-================================`, totalFiles, totalFiles-(totalSkipped+totalFailed), totalSkipped, totalFailed, sendsafely.Human(totalBytes), sendsafely.Human(maxBytes))
+================================`, status, totalFiles, totalFiles-(totalSkipped+totalFailed), totalSkipped, totalFailed, sendsafely.Human(totalBytes), sendsafely.Human(maxBytes))
 }
 
 func init() {
 	rootCmd.AddCommand(ticketCmd)
 	ticketCmd.Flags().BoolVarP(&useZendeskPassword, "zendesk-password", "p", false, "Use a password instead of an api key to authenticate against zendesk")
 	ticketCmd.Flags().BoolVar(&onlySendSafelyLinks, "sendsafely-only", false, "when true only sendsafely links will be downloaded")
+	ticketCmd.Flags().BoolVar(&restart, "restart", false, "ignore the download journal of the ticket and start every unfinished file from the beginning")
 }
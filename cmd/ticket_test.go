@@ -18,8 +18,19 @@
 package cmd
 
 import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/rsvihladremio/ssdownloader/cmd/config"
+	"github.com/rsvihladremio/ssdownloader/filter"
+	"github.com/rsvihladremio/ssdownloader/retry"
+	"github.com/rsvihladremio/ssdownloader/sendsafelytest"
+	"github.com/rsvihladremio/ssdownloader/zendesk"
+	"github.com/rsvihladremio/ssdownloader/zendesktest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,11 +40,103 @@ func TestTicketReport(t *testing.T) {
 ================================
 = ssdownloader summary         =
 ================================
+= status            : completed
 = total files       : 100
 = total succeeded   : 20
 = total skipped     : 50
 = total failed      : 30
 = total bytes       : 1000 bytes
 = max bytes         : 200 bytes
-================================`, Report(100, 50, 30, 1000, 200))
+================================`, Report("completed", 100, 50, 30, 1000, 200))
+}
+
+func TestSelectAttachments(t *testing.T) {
+	f, err := filter.New([]string{"*.log"}, nil, nil, []string{"customer@example.com"})
+	assert.Nil(t, err)
+	selected := SelectAttachments(f, []zendesk.Attachment{
+		{ID: 1, FileName: "server.log", UploadedBy: "customer@example.com"},
+		{ID: 2, FileName: "heap.hprof", UploadedBy: "customer@example.com"},
+		{ID: 3, FileName: "agent.log", UploadedBy: "agent@example.com"},
+	})
+	assert.Len(t, selected, 1)
+	assert.Equal(t, int64(1), selected[0].ID)
+	assert.Len(t, SelectAttachments(nil, []zendesk.Attachment{{FileName: "heap.hprof"}}), 1)
+}
+
+// TestTicketCommandEndToEnd runs the ticket command against the fake zendesk and SendSafely apis, the comments are
+// paged one per page and both apis fail once before succeeding
+func TestTicketCommandEndToEnd(t *testing.T) {
+	zd := zendesktest.NewServer("me@example.com", "zdToken")
+	defer zd.Close()
+	ss := sendsafelytest.NewServer("ssKey", "ssSecret")
+	defer ss.Close()
+	packageLink, err := ss.AddPackage(sendsafelytest.Package{
+		PackageID:    "GYL4-DVZN",
+		PackageCode:  "pkgCode",
+		ServerSecret: "serverSecret",
+		KeyCode:      "keyCode",
+		Files: []sendsafelytest.File{
+			{FileID: "file-1", Name: "diag.tar.gz", Content: []byte(strings.Repeat("diag", 50)), PartSize: 64},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only https links are followed, the test server is reached through the configured api instead
+	packageLink = "https://app.sendsafely.com" + strings.TrimPrefix(packageLink, ss.URL)
+	created := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	zd.PageSize = 1
+	zd.AddUser(7, "customer@example.com")
+	zd.AddComments("1111",
+		zendesktest.Comment{ID: 1, AuthorID: 7, Body: "uploaded the diag", HTMLBody: `<p>uploaded <a href="` + packageLink + `">the diag</a></p>`, CreatedAt: created},
+		zendesktest.Comment{ID: 2, AuthorID: 7, Body: "and the logs", CreatedAt: created, Attachments: []zendesktest.Attachment{
+			{ID: 10, FileName: "server.log", ContentType: "text/plain", Content: []byte("server log")},
+			{ID: 11, FileName: "deleted.log", ContentType: "text/plain", Content: []byte("deleted log"), Deleted: true},
+		}},
+	)
+	zd.FailRequests(zendesktest.CommentsPath("1111"), http.StatusInternalServerError, 1)
+	ss.FailRequests("/api/v2.0/package/GYL4-DVZN/file/file-1/download-urls/", http.StatusInternalServerError, 1)
+
+	oldC, oldPolicy := C, RetryPolicy
+	oldThreads, oldPartThreads, oldBuffer, oldMax, oldStream := DownloadThreads, PartThreads, DownloadBufferSize, MaxFileSizeGiB, StreamParts
+	defer func() {
+		C, RetryPolicy = oldC, oldPolicy
+		DownloadThreads, PartThreads, DownloadBufferSize, MaxFileSizeGiB, StreamParts = oldThreads, oldPartThreads, oldBuffer, oldMax, oldStream
+	}()
+	C = config.Config{
+		SsAPIKey:     "ssKey",
+		SsAPISecret:  "ssSecret",
+		SsAPIURL:     ss.APIURL(),
+		ZendeskURL:   zd.URL,
+		ZendeskEmail: "me@example.com",
+		ZendeskToken: "zdToken",
+		DownloadDir:  t.TempDir(),
+	}
+	RetryPolicy = retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	DownloadThreads, PartThreads, DownloadBufferSize, MaxFileSizeGiB, StreamParts = 2, 2, 4, 1, true
+
+	ticketCmd.Run(ticketCmd, []string{"1111"})
+
+	packageFiles, err := filepath.Glob(filepath.Join(C.DownloadDir, "tickets", "1111", "*_GYL4-DVZN", "diag.tar.gz"))
+	if err != nil || len(packageFiles) != 1 {
+		t.Fatalf("expected diag.tar.gz to be downloaded but found %v", packageFiles)
+	}
+	diag, err := os.ReadFile(packageFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, strings.Repeat("diag", 50), string(diag))
+	comment, err := os.ReadFile(filepath.Join(filepath.Dir(packageFiles[0]), "comment.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "uploaded the diag", string(comment))
+	serverLog, err := os.ReadFile(AttachmentPath(zendesk.Attachment{FileName: "server.log", ParentCommentID: 2, ParentCommentDate: created}, "1111"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "server log", string(serverLog))
+	_, err = os.Stat(AttachmentPath(zendesk.Attachment{FileName: "deleted.log", ParentCommentID: 2, ParentCommentDate: created}, "1111"))
+	assert.True(t, os.IsNotExist(err), "deleted attachments are never downloaded")
+	assert.Contains(t, zd.Requests(), "GET /api/v2/tickets/1111/comments.json?page=2&include=users")
 }
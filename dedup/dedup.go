@@ -0,0 +1,259 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// dedup package stores every completed download once by the hash of its content, files with the same content as one
+// already stored are replaced with a link to it
+package dedup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rsvihladremio/ssdownloader/storage"
+)
+
+// DirName is the name of the content store inside the download directory
+const DirName = ".ssdownloader-objects"
+
+// RefsSuffix is added to the name of a stored copy for the list of files reflinked to it, reflinks do not show up in
+// the link count of the stored copy so they are written down instead
+const RefsSuffix = ".refs"
+
+// Store keeps every content it has seen once under dir named by the sha256 of the content
+type Store struct {
+	dir string
+	// held while linking so two downloads of the same content do not race to create the object
+	lock sync.Mutex
+}
+
+// New returns a store keeping its objects in dir, which has to be on the same volume as the downloads for links to work
+func New(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// Add hashes fileName and, when the content is already stored, replaces fileName with a link to the stored copy and
+// returns the bytes saved. Content seen for the first time is hardlinked into the store, so storing it takes no
+// extra space or writes and the download keeps its permissions
+func (s *Store) Add(fileName string) (saved int64, err error) {
+	if s == nil {
+		return 0, nil
+	}
+	sum, size, err := hashFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	object := filepath.Join(s.dir, sum[:2], sum)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	objectInfo, err := os.Stat(object)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, store(fileName, object)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to check content store for '%v' due to error '%v'", object, err)
+	}
+	fileInfo, err := os.Stat(fileName)
+	if err != nil {
+		return 0, fmt.Errorf("unable to check file '%v' due to error '%v'", fileName, err)
+	}
+	if os.SameFile(objectInfo, fileInfo) {
+		return 0, nil
+	}
+	if objectInfo.Size() != size {
+		// a sha256 collision is not a realistic concern, this is someone editing a file hardlinked to the stored copy
+		return 0, fmt.Errorf("stored copy '%v' is %v bytes but file '%v' with the same hash is %v bytes, leaving the file alone", object, objectInfo.Size(), fileName, size)
+	}
+	reflinked, err := replace(fileName, object)
+	if err != nil {
+		return 0, err
+	}
+	if reflinked {
+		if err := s.addRef(object, fileName); err != nil {
+			// the file is already deduplicated, the stored copy may only be pruned while the file still uses it
+			slog.Warn("unable to record reflinked file, the stored copy may be pruned early", "file_name", fileName, "error_msg", err)
+		}
+	}
+	return size, nil
+}
+
+// Prune removes the stored copies no download uses anymore, which frees the space of tickets that were deleted. A copy
+// is in use while another hardlink to it exists or a file reflinked to it is still there
+func (s *Store) Prune() (removed int, freed int64, err error) {
+	if s == nil {
+		return 0, 0, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err = filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(path, RefsSuffix) || strings.HasSuffix(path, storage.InProgressSuffix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if links, ok := linkCount(fi); !ok || links > 1 {
+			return nil
+		}
+		inUse, err := s.reflinksInUse(path, fi.Size())
+		if err != nil || inUse {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if err := os.Remove(path + RefsSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		removed++
+		freed += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return removed, freed, fmt.Errorf("unable to prune content store '%v' due to error '%v'", s.dir, err)
+	}
+	return removed, freed, nil
+}
+
+// addRef writes fileName down as reflinked to object, relative to the dir of the store so a moved download dir still
+// finds its files
+func (s *Store) addRef(object, fileName string) error {
+	rel, err := filepath.Rel(filepath.Dir(s.dir), fileName)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Clean(object+RefsSuffix), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, filepath.ToSlash(rel)); err != nil {
+		if closeErr := f.Close(); closeErr != nil {
+			return fmt.Errorf("write failed with '%v' and close failed with '%v'", err, closeErr)
+		}
+		return err
+	}
+	return f.Close()
+}
+
+// reflinksInUse reports if a file reflinked to object is still there with the size of object, the list is rewritten
+// without the files that are gone. A file of another size was replaced or edited and no longer shares the content
+func (s *Store) reflinksInUse(object string, size int64) (bool, error) {
+	b, err := os.ReadFile(filepath.Clean(object + RefsSuffix))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var kept []string
+	for _, rel := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if rel == "" {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(filepath.Dir(s.dir), filepath.FromSlash(rel)))
+		if err == nil && fi.Size() == size {
+			kept = append(kept, rel)
+		}
+	}
+	if len(kept) == 0 {
+		return false, nil
+	}
+	if err := os.WriteFile(object+RefsSuffix, []byte(strings.Join(kept, "\n")+"\n"), 0600); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// store hardlinks fileName into the store as object, under a temporary name first so a crash never leaves a partial
+// object behind
+func store(fileName, object string) error {
+	if err := os.MkdirAll(filepath.Dir(object), 0700); err != nil {
+		return fmt.Errorf("unable to make dir %v due to error %v", filepath.Dir(object), err)
+	}
+	tmpName := object + storage.InProgressSuffix
+	if err := os.Link(fileName, tmpName); err != nil {
+		return fmt.Errorf("unable to add file '%v' to the content store due to error '%v'", fileName, err)
+	}
+	if err := os.Rename(tmpName, object); err != nil {
+		if removeErr := os.Remove(tmpName); removeErr != nil {
+			slog.Warn("unable to remove temporary link so you will need to manually clean this file up", "file_name", tmpName, "error_msg", removeErr)
+		}
+		return fmt.Errorf("unable to add file '%v' to the content store due to error '%v'", fileName, err)
+	}
+	return nil
+}
+
+// replace swaps fileName for a link to object, linked under a temporary name first so the file is never missing if we
+// crash part way. reflinked is true when the link is a copy on write clone rather than a hardlink
+func replace(fileName, object string) (reflinked bool, err error) {
+	tmpName := fileName + storage.InProgressSuffix
+	reflinked, err = link(object, tmpName)
+	if err != nil {
+		return false, fmt.Errorf("unable to link '%v' to the stored copy due to error '%v'", fileName, err)
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		if removeErr := os.Remove(tmpName); removeErr != nil {
+			slog.Warn("unable to remove temporary link so you will need to manually clean this file up", "file_name", tmpName, "error_msg", removeErr)
+		}
+		return false, fmt.Errorf("unable to replace '%v' with a link to the stored copy due to error '%v'", fileName, err)
+	}
+	return reflinked, nil
+}
+
+// link makes newName share the content of oldName, a copy on write clone is used where the filesystem supports it
+// since changing one of the files then leaves the others alone, otherwise it is a hardlink
+func link(oldName, newName string) (reflinked bool, err error) {
+	if err := reflink(oldName, newName); err == nil {
+		return true, nil
+	} else {
+		slog.Debug("reflink not available, using a hardlink", "file_name", newName, "error_msg", err)
+	}
+	return false, os.Link(oldName, newName)
+}
+
+func hashFile(fileName string) (string, int64, error) {
+	f, err := os.Open(filepath.Clean(fileName))
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to read file '%v' due to error '%v'", fileName, err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Debug("unable to close file, since this is a cleanup operation it is usually safe to ignore", "file_name", fileName, "error_msg", err)
+		}
+	}()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to hash file '%v' due to error '%v'", fileName, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
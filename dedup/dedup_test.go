@@ -0,0 +1,232 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// dedup package stores every completed download once by the hash of its content, files with the same content as one
+// already stored are replaced with a link to it
+package dedup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddLinksDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	s := New(filepath.Join(dir, DirName))
+	first := filepath.Join(dir, "tickets", "1", "server.log")
+	second := filepath.Join(dir, "tickets", "2", "server.log")
+	other := filepath.Join(dir, "tickets", "2", "other.log")
+	writeFile(t, first, "same content")
+	writeFile(t, second, "same content")
+	writeFile(t, other, "different content")
+
+	for _, f := range []string{first, other} {
+		saved, err := s.Add(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved != 0 {
+			t.Errorf("expected nothing saved for new content %v but was %v", f, saved)
+		}
+	}
+	saved, err := s.Add(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != int64(len("same content")) {
+		t.Errorf("expected %v bytes saved but was %v", len("same content"), saved)
+	}
+	b, err := os.ReadFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "same content" {
+		t.Errorf("expected the content to be kept but was '%v'", string(b))
+	}
+	if _, err := os.Stat(second + ".inprogress"); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary link to be gone but stat returned %v", err)
+	}
+
+	// adding a file that already shares the stored copy saves nothing more
+	saved, err = s.Add(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != 0 {
+		t.Errorf("expected nothing saved for a file already linked but was %v", saved)
+	}
+}
+
+func TestAddNilStore(t *testing.T) {
+	var s *Store
+	saved, err := s.Add(filepath.Join(t.TempDir(), "missing"))
+	if err != nil || saved != 0 {
+		t.Errorf("expected a nil store to do nothing but saved %v with error %v", saved, err)
+	}
+}
+
+func TestAddMissingFile(t *testing.T) {
+	s := New(filepath.Join(t.TempDir(), DirName))
+	if _, err := s.Add(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func objectName(t *testing.T, s *Store, name string) string {
+	t.Helper()
+	sum, _, err := hashFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(s.dir, sum[:2], sum)
+}
+
+func TestAddHardlinksNewContentIntoStore(t *testing.T) {
+	dir := t.TempDir()
+	s := New(filepath.Join(dir, DirName))
+	first := filepath.Join(dir, "tickets", "1", "server.log")
+	writeFile(t, first, "same content")
+	before, err := os.Stat(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(first); err != nil {
+		t.Fatal(err)
+	}
+	objectInfo, err := os.Stat(objectName(t, s, first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(objectInfo, after) {
+		t.Error("expected the download to be hardlinked into the store instead of copied")
+	}
+	if after.Mode() != before.Mode() {
+		t.Errorf("expected the download to keep mode %v but was %v", before.Mode(), after.Mode())
+	}
+	if _, err := os.Stat(objectName(t, s, first) + ".inprogress"); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary link to be gone but stat returned %v", err)
+	}
+}
+
+func TestPruneKeepsCopiesWithReflinkedFiles(t *testing.T) {
+	dir := t.TempDir()
+	s := New(filepath.Join(dir, DirName))
+	first := filepath.Join(dir, "tickets", "1", "server.log")
+	reflinked := filepath.Join(dir, "tickets", "2", "server.log")
+	writeFile(t, first, "same content")
+	writeFile(t, reflinked, "same content")
+	if _, err := s.Add(first); err != nil {
+		t.Fatal(err)
+	}
+	object := objectName(t, s, first)
+	if links, ok := linkCount(mustStat(t, object)); !ok || links < 2 {
+		t.Skip("link counts are not available on this platform")
+	}
+	// reflinks are not available on every filesystem the tests run on, so the reflink is only written down
+	if err := s.addRef(object, reflinked); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "tickets", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if removed, _, err := s.Prune(); err != nil || removed != 0 {
+		t.Fatalf("expected the copy a reflinked file uses to be kept but removed %v with error %v", removed, err)
+	}
+	if _, err := os.Stat(object); err != nil {
+		t.Fatalf("expected the copy to be kept but stat returned %v", err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(dir, "tickets", "2")); err != nil {
+		t.Fatal(err)
+	}
+	if removed, _, err := s.Prune(); err != nil || removed != 1 {
+		t.Fatalf("expected the copy to be pruned once the reflinked file is gone but removed %v with error %v", removed, err)
+	}
+	for _, name := range []string{object, object + RefsSuffix} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("expected %v to be removed but stat returned %v", name, err)
+		}
+	}
+}
+
+func mustStat(t *testing.T, name string) os.FileInfo {
+	t.Helper()
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi
+}
+
+func TestPruneRemovesUnlinkedCopies(t *testing.T) {
+	dir := t.TempDir()
+	s := New(filepath.Join(dir, DirName))
+	deleted := filepath.Join(dir, "tickets", "1", "server.log")
+	kept := filepath.Join(dir, "tickets", "2", "other.log")
+	writeFile(t, deleted, "deleted content")
+	writeFile(t, kept, "kept content")
+	for _, f := range []string{deleted, kept} {
+		if _, err := s.Add(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi, err := os.Stat(objectName(t, s, kept))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if links, ok := linkCount(fi); !ok || links < 2 {
+		t.Skip("downloads are not hardlinked to the store on this filesystem")
+	}
+	deletedObject := objectName(t, s, deleted)
+	if err := os.RemoveAll(filepath.Join(dir, "tickets", "1")); err != nil {
+		t.Fatal(err)
+	}
+	removed, freed, err := s.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || freed != int64(len("deleted content")) {
+		t.Errorf("expected 1 copy of %v bytes pruned but was %v copies of %v bytes", len("deleted content"), removed, freed)
+	}
+	if _, err := os.Stat(deletedObject); !os.IsNotExist(err) {
+		t.Errorf("expected the copy of the deleted ticket to be pruned but stat returned %v", err)
+	}
+	if _, err := os.Stat(objectName(t, s, kept)); err != nil {
+		t.Errorf("expected the copy still linked to be kept but stat returned %v", err)
+	}
+}
+
+func TestPruneMissingStore(t *testing.T) {
+	s := New(filepath.Join(t.TempDir(), DirName))
+	if removed, _, err := s.Prune(); err != nil || removed != 0 {
+		t.Errorf("expected nothing to prune without a store but removed %v with error %v", removed, err)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !unix
+
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// dedup package stores every completed download once by the hash of its content, files with the same content as one
+// already stored are replaced with a link to it
+package dedup
+
+import "os"
+
+// linkCount is not known outside of unix so nothing is pruned
+func linkCount(_ os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,54 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// dedup package stores every completed download once by the hash of its content, files with the same content as one
+// already stored are replaced with a link to it
+package dedup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink clones oldName to newName with FICLONE, this works on btrfs, xfs and other filesystems with shared extents
+func reflink(oldName, newName string) (err error) {
+	src, err := os.Open(filepath.Clean(oldName))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := src.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+	dst, err := os.OpenFile(filepath.Clean(newName), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err != nil {
+		if closeErr := dst.Close(); closeErr != nil {
+			return fmt.Errorf("clone failed with '%v' and close failed with '%v'", err, closeErr)
+		}
+		if removeErr := os.Remove(newName); removeErr != nil {
+			return fmt.Errorf("clone failed with '%v' and remove failed with '%v'", err, removeErr)
+		}
+		return err
+	}
+	return dst.Close()
+}
@@ -18,14 +18,29 @@
 package downloader
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net/http"
-	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rsvihladremio/ssdownloader/retry"
+	"github.com/rsvihladremio/ssdownloader/storage"
 )
 
+// PartialSuffix is added to the file name while a download is in progress, the file is only
+// renamed to the final name once the download is complete
+const PartialSuffix = ".partial"
+
+// validatorSuffix is the file that stores the ETag or Last-Modified value of the response that started the
+// partial download, this is what is sent in the If-Range header so we never append a different file to the partial
+const validatorSuffix = ".partial.validator"
+
 type IllegalBufferSize struct {
 	BufferSizeKB int
 }
@@ -34,62 +49,281 @@ func (e IllegalBufferSize) Error() string {
 	return fmt.Sprintf("buffer size kb was %v and cannot be smaller than 1 please initialize the downloader with the NewGenericDownloader() function to guard against this happending", e.BufferSizeKB)
 }
 
-func NewGenericDownloader(bufferSizeKB int) GenericDownloader {
+// ContentLengthErr is returned when the number of bytes received does not match the Content-Length header,
+// the file written is removed since it cannot be trusted
+type ContentLengthErr struct {
+	URL      string
+	Expected int64
+	Written  int64
+}
+
+func (e ContentLengthErr) Error() string {
+	return fmt.Sprintf("url '%v' reported a content length of %v bytes but %v bytes were received", e.URL, e.Expected, e.Written)
+}
+
+// NewGenericDownloader builds a downloader using httpClient, which should be the client built by the transport package
+// so proxy and tls settings apply to downloads too. Files are written to store
+func NewGenericDownloader(bufferSizeKB int, httpClient *http.Client, store storage.Storage, policy retry.Policy) GenericDownloader {
 	if bufferSizeKB < 1 {
 		slog.Debug("buffer size cannot be smaller than 1 setting to default of 4096")
 		bufferSizeKB = 4096
 	}
-	return &HTTPGenericDownloader{bufferSizeKB: bufferSizeKB}
+	return &HTTPGenericDownloader{bufferSizeKB: bufferSizeKB, client: httpClient, store: store, policy: policy}
 }
 
 type GenericDownloader interface {
-	DownloadFile(fileName, url string) error
+	// DownloadFile downloads the url to fileName, resumed is true when an existing partial download
+	// was continued instead of starting from the first byte
+	DownloadFile(ctx context.Context, fileName, url string) (resumed bool, err error)
+	// StreamFile hands the body of the url to consume instead of writing it to a file. consume is called again
+	// from the start on every retry so it has to throw away anything written during a failed attempt
+	StreamFile(ctx context.Context, url string, consume func(body io.Reader) error) error
 }
 
 type HTTPGenericDownloader struct {
 	bufferSizeKB int
+	client       *http.Client
+	store        storage.Storage
+	policy       retry.Policy
 }
 
-func (d *HTTPGenericDownloader) DownloadFile(fileName, url string) error {
+// DownloadFile downloads the url to fileName, when the context is cancelled the partial file is left behind
+// so the download can be resumed on the next run
+func (d *HTTPGenericDownloader) DownloadFile(ctx context.Context, fileName, url string) (resumed bool, err error) {
 	if d.bufferSizeKB < 1 {
-		return IllegalBufferSize{BufferSizeKB: d.bufferSizeKB}
+		return false, IllegalBufferSize{BufferSizeKB: d.bufferSizeKB}
 	}
+	// a failed attempt leaves the partial file behind so the next attempt picks up where it left off
+	err = retry.Do(ctx, d.policy, "download "+filepath.Base(fileName), func() error {
+		attemptResumed, err := d.downloadOnce(ctx, fileName, url)
+		resumed = resumed || attemptResumed
+		return err
+	})
+	return resumed, err
+}
 
+func (d *HTTPGenericDownloader) downloadOnce(ctx context.Context, fileName, url string) (resumed bool, err error) {
 	// making sure there are no goofy file names that overwrite critical files
 	cleanedFileName := filepath.Clean(fileName)
-	f, err := os.Create(cleanedFileName)
+	partialFileName := cleanedFileName + PartialSuffix
+	validatorFileName := cleanedFileName + validatorSuffix
+
+	offset, validator := d.existingPartial(ctx, partialFileName, validatorFileName)
+	resp, err := d.get(ctx, url, offset, validator)
 	if err != nil {
-		return fmt.Errorf("unable to create the destination file '%v' due to error '%v'", cleanedFileName, err)
+		return false, err
 	}
-	defer func() {
-		err := f.Close()
+	if offset > 0 && (resp.StatusCode == http.StatusRequestedRangeNotSatisfiable ||
+		(resp.StatusCode == http.StatusPartialContent && !rangeStartsAt(resp.Header.Get("Content-Range"), offset))) {
+		// the partial file does not line up with what the server has, throw it away and start over
+		slog.Debug("server rejected range request, restarting download", "file_name", cleanedFileName, "offset", offset, "status_code", resp.StatusCode)
+		closeBody(resp, url)
+		if err := d.removePartial(ctx, partialFileName, validatorFileName); err != nil {
+			// resuming again would only be rejected again
+			return false, retry.PermanentErr{BaseErr: fmt.Errorf("unable to remove the partial download '%v' the server cannot resume due to error '%w'", partialFileName, err)}
+		}
+		// restarted only once without a range, a server still answering with the wrong range fails below
+		offset = 0
+		resp, err = d.get(ctx, url, 0, "")
 		if err != nil {
-			slog.Debug("unable to close file handle for file on cleanup. This is safe to ignore usually", "file_name", cleanedFileName, "error_msg", err)
+			return false, err
 		}
-	}()
-	// is technically a security violation according to https://securego.io/docs/rules/g107.html
-	// but in reality based on the application is unavoidable and a risk of using SendSafely
-	// ignoring the rule in the ./script/audit file. Used suggestion from
-	// https://stackoverflow.com/questions/70281883/golang-untaint-url-†variable-to-fix-gosec-warning-g107
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("unable to retrieve url '%v' due to error '%v'", url, err)
 	}
-	defer func() {
-		err = resp.Body.Close()
+	defer closeBody(resp, url)
+	var f storage.Writer
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		slog.Debug("resuming partial download", "file_name", cleanedFileName, "offset", offset)
+		f, err = d.store.Append(ctx, partialFileName)
 		if err != nil {
-			slog.Warn("unable to close body handle for url", "url", url, "error_msg", err)
+			return false, fmt.Errorf("unable to open the partial file '%v' due to error '%v'", partialFileName, err)
 		}
-	}()
+		resumed = true
+	case resp.StatusCode != http.StatusOK:
+		// error pages (expired presigned urls, zendesk 403s) must never be written out as if they were the file,
+		// the partial file is left alone since a fresh url may still be able to resume it
+		return false, retry.NewHTTPStatusErr(resp, url)
+	default:
+		if offset > 0 {
+			slog.Debug("server does not support resuming this download, starting from the beginning", "file_name", cleanedFileName, "status_code", resp.StatusCode)
+		}
+		f, err = d.store.Create(ctx, partialFileName)
+		if err != nil {
+			return false, fmt.Errorf("unable to create the destination file '%v' due to error '%v'", partialFileName, err)
+		}
+		d.saveValidator(ctx, validatorFileName, resp)
+	}
 
 	buf := make([]byte, d.bufferSizeKB*1024)
-	_, err = io.CopyBuffer(f, resp.Body, buf)
+	written, err := io.CopyBuffer(f, resp.Body, buf)
 	if err != nil {
-		return fmt.Errorf("unable to write to filename '%v' due to error '%v'", cleanedFileName, err)
+		// closing keeps what was received so the next attempt can resume from it
+		if closeErr := f.Close(); closeErr != nil {
+			slog.Debug("unable to close file handle for file on cleanup. This is safe to ignore usually", "file_name", partialFileName, "error_msg", closeErr)
+		}
+		return resumed, fmt.Errorf("unable to write to filename '%v' due to error '%w'", partialFileName, err)
+	}
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		if abortErr := f.Abort(); abortErr != nil {
+			slog.Debug("unable to abort write of file on cleanup. This is safe to ignore usually", "file_name", partialFileName, "error_msg", abortErr)
+		}
+		if err := d.removePartial(ctx, partialFileName, validatorFileName); err != nil {
+			slog.Debug("unable to remove partial download file", "file_name", partialFileName, "error_msg", err)
+		}
+		return resumed, retry.RetryableErr{BaseErr: ContentLengthErr{URL: url, Expected: resp.ContentLength, Written: written}}
 	}
 
 	if err := f.Close(); err != nil {
-		return fmt.Errorf("unable to close file %v due to error %v", cleanedFileName, err)
+		return resumed, fmt.Errorf("unable to close file %v due to error %v", partialFileName, err)
+	}
+	if err := d.store.Rename(ctx, partialFileName, cleanedFileName); err != nil {
+		return resumed, fmt.Errorf("unable to rename file '%v' to '%v' due to error '%v'", partialFileName, cleanedFileName, err)
+	}
+	if err := d.store.Remove(ctx, validatorFileName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Debug("unable to remove validator file, this is safe to ignore", "file_name", validatorFileName, "error_msg", err)
+	}
+	return resumed, nil
+}
+
+func (d *HTTPGenericDownloader) StreamFile(ctx context.Context, url string, consume func(body io.Reader) error) error {
+	return retry.Do(ctx, d.policy, "stream download", func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return fmt.Errorf("unable to create request for url '%v' due to error '%v'", url, err)
+		}
+		resp, err := d.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("unable to retrieve url '%v' due to error '%w'", url, err)
+		}
+		defer closeBody(resp, url)
+		if resp.StatusCode != http.StatusOK {
+			return retry.NewHTTPStatusErr(resp, url)
+		}
+		body := &countingReader{r: resp.Body}
+		if err := consume(body); err != nil {
+			// a connection dropped part way through usually reaches the consumer as a parse error, retry it as the
+			// read error it really is
+			if body.err != nil && !errors.Is(body.err, io.EOF) {
+				return fmt.Errorf("unable to read url '%v' due to error '%w'", url, body.err)
+			}
+			return err
+		}
+		// the consumer may stop at the end of what it needed, anything left over still has to be accounted for
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return fmt.Errorf("unable to read the rest of url '%v' due to error '%w'", url, err)
+		}
+		if resp.ContentLength >= 0 && body.n != resp.ContentLength {
+			return retry.RetryableErr{BaseErr: ContentLengthErr{URL: url, Expected: resp.ContentLength, Written: body.n}}
+		}
+		return nil
+	})
+}
+
+// countingReader tracks how many bytes have been read through it and the last error reading them
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// existingPartial returns the size of a previous partial download and the validator that was saved with it.
+// A partial without a validator cannot be safely resumed so it is reported as not existing
+func (d *HTTPGenericDownloader) existingPartial(ctx context.Context, partialFileName, validatorFileName string) (int64, string) {
+	fi, err := d.store.Stat(ctx, partialFileName)
+	if err != nil || fi.Size == 0 {
+		return 0, ""
+	}
+	b, err := storage.ReadFile(ctx, d.store, validatorFileName)
+	if err != nil {
+		slog.Debug("partial download found without a validator, it will be downloaded again", "file_name", partialFileName, "error_msg", err)
+		return 0, ""
+	}
+	validator := strings.TrimSpace(string(b))
+	if validator == "" {
+		return 0, ""
+	}
+	return fi.Size, validator
+}
+
+// saveValidator stores the strong ETag, or failing that the Last-Modified header, so a later run can
+// send it in If-Range. Nothing is stored when the server does not advertise byte range support
+func (d *HTTPGenericDownloader) saveValidator(ctx context.Context, validatorFileName string, resp *http.Response) {
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		return
+	}
+	validator := resp.Header.Get("ETag")
+	// weak etags are not allowed in If-Range
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if validator == "" {
+		return
+	}
+	if err := storage.WriteFile(ctx, d.store, validatorFileName, []byte(validator)); err != nil {
+		slog.Debug("unable to save validator, the download will not be resumable", "file_name", validatorFileName, "error_msg", err)
+	}
+}
+
+// removePartial removes the partial download and its validator, files that are already gone are not an error
+func (d *HTTPGenericDownloader) removePartial(ctx context.Context, partialFileName, validatorFileName string) error {
+	var errs []error
+	for _, f := range []string{partialFileName, validatorFileName} {
+		if err := d.store.Remove(ctx, f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// get requests the url, from offset on when it is greater than 0 and only if the file still matches validator
+func (d *HTTPGenericDownloader) get(ctx context.Context, url string, offset int64, validator string) (*http.Response, error) {
+	// is technically a security violation according to https://securego.io/docs/rules/g107.html
+	// but in reality based on the application is unavoidable and a risk of using SendSafely
+	// ignoring the rule in the ./script/audit file. Used suggestion from
+	// https://stackoverflow.com/questions/70281883/golang-untaint-url-†variable-to-fix-gosec-warning-g107
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request for url '%v' due to error '%v'", url, err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+		req.Header.Set("If-Range", validator)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve url '%v' due to error '%w'", url, err)
+	}
+	return resp, nil
+}
+
+func closeBody(resp *http.Response, url string) {
+	if err := resp.Body.Close(); err != nil {
+		slog.Warn("unable to close body handle for url", "url", url, "error_msg", err)
+	}
+}
+
+// rangeStartsAt verifies a Content-Range header such as "bytes 100-199/200" starts at the expected offset
+func rangeStartsAt(contentRange string, offset int64) bool {
+	unit, rest, found := strings.Cut(contentRange, " ")
+	if !found || unit != "bytes" {
+		return false
+	}
+	start, _, found := strings.Cut(rest, "-")
+	if !found {
+		return false
+	}
+	i, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return false
 	}
-	return nil
+	return i == offset
 }
@@ -18,14 +18,31 @@
 package downloader
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/jarcoal/httpmock"
+	"github.com/rsvihladremio/ssdownloader/retry"
+	"github.com/rsvihladremio/ssdownloader/storage"
 )
 
+// testPolicy retries quickly so tests covering retries do not slow the suite down
+func testPolicy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	}
+}
+
 func TestDownloadFile(t *testing.T) {
 
 	// pass in the resty httpy client that the SendSafelyClient uses so that
@@ -41,11 +58,14 @@ func TestDownloadFile(t *testing.T) {
 
 	httpmock.RegisterResponder("GET", url, responder)
 	fileName := fmt.Sprintf("%v/testFile.json", t.TempDir())
-	d := NewGenericDownloader(4096)
-	err := d.DownloadFile(fileName, url)
+	d := NewGenericDownloader(4096, http.DefaultClient, storage.NewLocal(), testPolicy())
+	resumed, err := d.DownloadFile(context.Background(), fileName, url)
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
+	if resumed {
+		t.Error("expected a fresh download but it was resumed")
+	}
 	b, err := os.ReadFile(fileName)
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
@@ -57,12 +77,12 @@ func TestDownloadFile(t *testing.T) {
 }
 
 func TestInvalidBufferSizeResultsInDefault(t *testing.T) {
-	d := NewGenericDownloader(-1).(*HTTPGenericDownloader)
+	d := NewGenericDownloader(-1, http.DefaultClient, storage.NewLocal(), testPolicy()).(*HTTPGenericDownloader)
 	if d.bufferSizeKB != 4096 {
 		t.Errorf("expected 4096 but was %v", d.bufferSizeKB)
 	}
 
-	d = NewGenericDownloader(0).(*HTTPGenericDownloader)
+	d = NewGenericDownloader(0, http.DefaultClient, storage.NewLocal(), testPolicy()).(*HTTPGenericDownloader)
 	if d.bufferSizeKB != 4096 {
 		t.Errorf("expected 4096 but was %v", d.bufferSizeKB)
 	}
@@ -70,7 +90,7 @@ func TestInvalidBufferSizeResultsInDefault(t *testing.T) {
 
 func TestUsingDefaultBufferSizeResultsInError(t *testing.T) {
 	d := HTTPGenericDownloader{}
-	err := d.DownloadFile("", "")
+	_, err := d.DownloadFile(context.Background(), "", "")
 	if err == nil {
 		t.Error("expected an error but there was none")
 	}
@@ -78,3 +98,346 @@ func TestUsingDefaultBufferSizeResultsInError(t *testing.T) {
 		t.Errorf("expected error of %v but was %v", IllegalBufferSize{}, err)
 	}
 }
+
+func TestDownloadFileResumesPartial(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	url := "http://example.com/resume"
+	var rangeHeader, ifRangeHeader string
+	httpmock.RegisterResponder("GET", url, func(req *http.Request) (*http.Response, error) {
+		rangeHeader = req.Header.Get("Range")
+		ifRangeHeader = req.Header.Get("If-Range")
+		resp := httpmock.NewStringResponse(http.StatusPartialContent, "world")
+		resp.Header.Set("Content-Range", "bytes 6-10/11")
+		return resp, nil
+	})
+	fileName := fmt.Sprintf("%v/resume.txt", t.TempDir())
+	if err := os.WriteFile(fileName+PartialSuffix, []byte("hello "), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fileName+validatorSuffix, []byte(`"abc"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := NewGenericDownloader(4096, http.DefaultClient, storage.NewLocal(), testPolicy())
+	resumed, err := d.DownloadFile(context.Background(), fileName, url)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !resumed {
+		t.Error("expected download to be resumed")
+	}
+	if rangeHeader != "bytes=6-" {
+		t.Errorf("expected range header 'bytes=6-' but was '%v'", rangeHeader)
+	}
+	if ifRangeHeader != `"abc"` {
+		t.Errorf("expected if-range header '\"abc\"' but was '%v'", ifRangeHeader)
+	}
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if string(b) != "hello world" {
+		t.Errorf("expected 'hello world' but was '%v'", string(b))
+	}
+	if _, err := os.Stat(fileName + PartialSuffix); !os.IsNotExist(err) {
+		t.Errorf("expected partial file to be removed but stat returned %v", err)
+	}
+	if _, err := os.Stat(fileName + validatorSuffix); !os.IsNotExist(err) {
+		t.Errorf("expected validator file to be removed but stat returned %v", err)
+	}
+}
+
+func TestDownloadFileFallsBackWhenRangeIsIgnored(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	url := "http://example.com/norange"
+	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(200, "hello world"))
+	fileName := fmt.Sprintf("%v/norange.txt", t.TempDir())
+	if err := os.WriteFile(fileName+PartialSuffix, []byte("goodbye"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fileName+validatorSuffix, []byte(`"abc"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := NewGenericDownloader(4096, http.DefaultClient, storage.NewLocal(), testPolicy())
+	resumed, err := d.DownloadFile(context.Background(), fileName, url)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if resumed {
+		t.Error("expected a full download since the server ignored the range")
+	}
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if string(b) != "hello world" {
+		t.Errorf("expected 'hello world' but was '%v'", string(b))
+	}
+}
+
+func TestDownloadFileRestartsOnceWhenRangeDoesNotMatch(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	url := "http://example.com/wrongrange"
+	var ranges []string
+	httpmock.RegisterResponder("GET", url, func(req *http.Request) (*http.Response, error) {
+		ranges = append(ranges, req.Header.Get("Range"))
+		resp := httpmock.NewStringResponse(http.StatusPartialContent, "world")
+		resp.Header.Set("Content-Range", "bytes 0-4/5")
+		return resp, nil
+	})
+	fileName := fmt.Sprintf("%v/wrongrange.txt", t.TempDir())
+	if err := os.WriteFile(fileName+PartialSuffix, []byte("hello "), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fileName+validatorSuffix, []byte(`"abc"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := NewGenericDownloader(4096, http.DefaultClient, storage.NewLocal(), retry.Policy{MaxAttempts: 1})
+	if _, err := d.DownloadFile(context.Background(), fileName, url); err == nil {
+		t.Fatal("expected an error since the server never answers with the whole file")
+	}
+	if len(ranges) != 2 || ranges[0] != "bytes=6-" || ranges[1] != "" {
+		t.Errorf("expected one range request and one restart without a range but the ranges were %q", ranges)
+	}
+	if _, err := os.Stat(fileName + PartialSuffix); !os.IsNotExist(err) {
+		t.Errorf("expected the partial that did not line up to be removed but stat returned %v", err)
+	}
+}
+
+// failingRemove is local storage that cannot remove anything
+type failingRemove struct {
+	storage.Storage
+}
+
+func (failingRemove) Remove(_ context.Context, name string) error {
+	return fmt.Errorf("permission denied removing %v", name)
+}
+
+func TestDownloadFileFailsWhenMismatchedPartialCannotBeRemoved(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	url := "http://example.com/unsatisfiable"
+	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(http.StatusRequestedRangeNotSatisfiable, ""))
+	fileName := fmt.Sprintf("%v/unsatisfiable.txt", t.TempDir())
+	if err := os.WriteFile(fileName+PartialSuffix, []byte("hello "), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fileName+validatorSuffix, []byte(`"abc"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := NewGenericDownloader(4096, http.DefaultClient, failingRemove{storage.NewLocal()}, testPolicy())
+	_, err := d.DownloadFile(context.Background(), fileName, url)
+	if retry.Classify(err) != retry.Permanent || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected a permanent error about removing the partial but was %v", err)
+	}
+	if calls := httpmock.GetTotalCallCount(); calls != 1 {
+		t.Errorf("expected a single request but there were %v", calls)
+	}
+}
+
+func TestDownloadFileWithoutValidatorDoesNotResume(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	url := "http://example.com/novalidator"
+	var rangeHeader string
+	httpmock.RegisterResponder("GET", url, func(req *http.Request) (*http.Response, error) {
+		rangeHeader = req.Header.Get("Range")
+		return httpmock.NewStringResponse(200, "hello world"), nil
+	})
+	fileName := fmt.Sprintf("%v/novalidator.txt", t.TempDir())
+	if err := os.WriteFile(fileName+PartialSuffix, []byte("hello "), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := NewGenericDownloader(4096, http.DefaultClient, storage.NewLocal(), testPolicy())
+	resumed, err := d.DownloadFile(context.Background(), fileName, url)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if resumed {
+		t.Error("expected a full download since there was no validator")
+	}
+	if rangeHeader != "" {
+		t.Errorf("expected no range header but was '%v'", rangeHeader)
+	}
+}
+
+func TestRangeStartsAt(t *testing.T) {
+	if !rangeStartsAt("bytes 100-199/200", 100) {
+		t.Error("expected range to start at 100")
+	}
+	if rangeStartsAt("bytes 0-199/200", 100) {
+		t.Error("expected range to not start at 100")
+	}
+	if rangeStartsAt("", 100) {
+		t.Error("expected empty range to not match")
+	}
+}
+
+func TestDownloadFileRetriesServerErrors(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	url := "http://example.com/flaky"
+	httpmock.RegisterResponder("GET", url, httpmock.ResponderFromMultipleResponses(
+		[]*http.Response{
+			httpmock.NewStringResponse(503, "unavailable"),
+			httpmock.NewStringResponse(200, "hello world"),
+		},
+	))
+	fileName := fmt.Sprintf("%v/flaky.txt", t.TempDir())
+	d := NewGenericDownloader(4096, http.DefaultClient, storage.NewLocal(), testPolicy())
+	if _, err := d.DownloadFile(context.Background(), fileName, url); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if string(b) != "hello world" {
+		t.Errorf("expected 'hello world' but was '%v'", string(b))
+	}
+	if calls := httpmock.GetTotalCallCount(); calls != 2 {
+		t.Errorf("expected 2 calls but there were %v", calls)
+	}
+}
+
+func TestStreamFileRetriesAndRestartsConsume(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	url := "http://example.com/stream"
+	httpmock.RegisterResponder("GET", url, httpmock.ResponderFromMultipleResponses(
+		[]*http.Response{
+			httpmock.NewStringResponse(503, "unavailable"),
+			httpmock.NewStringResponse(200, "hello world"),
+		},
+	))
+	d := NewGenericDownloader(4096, http.DefaultClient, storage.NewLocal(), testPolicy())
+	var bodies []string
+	err := d.StreamFile(context.Background(), url, func(body io.Reader) error {
+		b, err := io.ReadAll(body)
+		bodies = append(bodies, string(b))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(bodies) != 1 || bodies[0] != "hello world" {
+		t.Errorf("expected consume to only see 'hello world' but saw %#v", bodies)
+	}
+	if calls := httpmock.GetTotalCallCount(); calls != 2 {
+		t.Errorf("expected 2 calls but there were %v", calls)
+	}
+}
+
+func TestDownloadFileDoesNotWriteErrorPages(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	url := "http://example.com/expired"
+	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(403, "<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>"))
+	fileName := fmt.Sprintf("%v/expired.txt", t.TempDir())
+	d := NewGenericDownloader(4096, http.DefaultClient, storage.NewLocal(), testPolicy())
+	_, err := d.DownloadFile(context.Background(), fileName, url)
+	var statusErr retry.HTTPStatusErr
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("expected an HTTPStatusErr but was %v", err)
+	}
+	if statusErr.Code != 403 {
+		t.Errorf("expected status 403 but was %v", statusErr.Code)
+	}
+	if !strings.Contains(statusErr.BodySnippet, "Request has expired") {
+		t.Errorf("expected the body snippet to explain the error but was '%v'", statusErr.BodySnippet)
+	}
+	for _, f := range []string{fileName, fileName + PartialSuffix} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("expected %v to not exist but stat returned %v", f, err)
+		}
+	}
+	if calls := httpmock.GetTotalCallCount(); calls != 1 {
+		t.Errorf("expected 403 to not be retried but there were %v calls", calls)
+	}
+}
+
+func TestDownloadFileRemovesShortDownloads(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	url := "http://example.com/short"
+	resp := httpmock.NewStringResponse(200, "hello")
+	resp.ContentLength = 100
+	httpmock.RegisterResponder("GET", url, httpmock.ResponderFromResponse(resp))
+	fileName := fmt.Sprintf("%v/short.txt", t.TempDir())
+	d := NewGenericDownloader(4096, http.DefaultClient, storage.NewLocal(), retry.Policy{MaxAttempts: 1})
+	_, err := d.DownloadFile(context.Background(), fileName, url)
+	var lengthErr ContentLengthErr
+	if !errors.As(err, &lengthErr) {
+		t.Fatalf("expected a ContentLengthErr but was %v", err)
+	}
+	if lengthErr.Expected != 100 || lengthErr.Written != 5 {
+		t.Errorf("expected 100 expected and 5 written but was %v and %v", lengthErr.Expected, lengthErr.Written)
+	}
+	for _, f := range []string{fileName, fileName + PartialSuffix} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("expected %v to be removed but stat returned %v", f, err)
+		}
+	}
+}
+
+func TestStreamFileChecksStatus(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	url := "http://example.com/missing"
+	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(404, "not found"))
+	d := NewGenericDownloader(4096, http.DefaultClient, storage.NewLocal(), testPolicy())
+	consumed := false
+	err := d.StreamFile(context.Background(), url, func(_ io.Reader) error {
+		consumed = true
+		return nil
+	})
+	var statusErr retry.HTTPStatusErr
+	if !errors.As(err, &statusErr) || statusErr.Code != 404 {
+		t.Errorf("expected a 404 HTTPStatusErr but was %v", err)
+	}
+	if consumed {
+		t.Error("error page should never be handed to consume")
+	}
+}
+
+func TestStreamFileRetriesDroppedConnections(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	url := "http://example.com/stream"
+	httpmock.RegisterResponder("GET", url, httpmock.ResponderFromMultipleResponses(
+		[]*http.Response{
+			{StatusCode: 200, Body: io.NopCloser(io.MultiReader(strings.NewReader("hello"), iotest.ErrReader(io.ErrUnexpectedEOF))), ContentLength: 11},
+			httpmock.NewStringResponse(200, "hello world"),
+		},
+	))
+	d := NewGenericDownloader(4096, http.DefaultClient, storage.NewLocal(), testPolicy())
+	var bodies []string
+	err := d.StreamFile(context.Background(), url, func(body io.Reader) error {
+		b, err := io.ReadAll(body)
+		if err != nil {
+			// consumers like the pgp reader hide the read error behind their own
+			return errors.New("malformed message")
+		}
+		bodies = append(bodies, string(b))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(bodies) != 1 || bodies[0] != "hello world" {
+		t.Errorf("expected consume to only see 'hello world' but saw %#v", bodies)
+	}
+}
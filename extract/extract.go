@@ -0,0 +1,380 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// extract package unpacks downloaded archives next to them, guarding against entries that escape the
+// extract dir and against archives that expand to far more than they look like they will
+package extract
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rsvihladremio/ssdownloader/storage"
+)
+
+// minRatioCheckBytes is how much an archive can expand to before the compression ratio is checked, small
+// text files compress extremely well and are no danger
+const minRatioCheckBytes = 1 << 20
+
+// Limits protect against zip bombs, a zero value means no limit
+type Limits struct {
+	// MaxBytes is the most that one downloaded archive can expand to, nested archives included
+	MaxBytes int64
+	// MaxEntries is the most files and dirs one downloaded archive can have, nested archives included
+	MaxEntries int
+	// MaxRatio is the most an archive can expand compared to its own size
+	MaxRatio int64
+	// MaxDepth is how many levels of archives inside the downloaded archive are extracted, 0 only extracts the downloaded one
+	MaxDepth int
+}
+
+// Result counts what one downloaded archive expanded to
+type Result struct {
+	Archives int
+	Files    int
+	Bytes    int64
+}
+
+// LimitErr is returned when an archive goes over one of the Limits, everything extracted from it is removed
+type LimitErr struct {
+	Archive string
+	Limit   string
+	Max     int64
+}
+
+func (e LimitErr) Error() string {
+	return fmt.Sprintf("archive '%v' goes over the %v limit of %v, refusing to extract it since it may be a zip bomb", e.Archive, e.Limit, e.Max)
+}
+
+// UnsafePathErr is returned for an entry that would be written outside the extract dir (zip-slip)
+type UnsafePathErr struct {
+	Archive string
+	Entry   string
+}
+
+func (e UnsafePathErr) Error() string {
+	return fmt.Sprintf("archive '%v' has entry '%v' that would be written outside of the extract dir, refusing to extract it", e.Archive, e.Entry)
+}
+
+// extensions are the supported archives, longest first so .tar.gz is not mistaken for .gz
+var extensions = []string{".tar.gz", ".tgz", ".zip"}
+
+func extension(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range extensions {
+		if strings.HasSuffix(lower, ext) && len(name) > len(ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// Supported is true for the archive formats that can be extracted
+func Supported(name string) bool {
+	return extension(name) != ""
+}
+
+// Dir is the sibling dir an archive is extracted to, the archive name without its extension
+func Dir(name string) string {
+	return name[:len(name)-len(extension(name))]
+}
+
+// Extractor unpacks archives on the local filesystem within its limits
+type Extractor struct {
+	limits Limits
+}
+
+// New returns an extractor enforcing limits
+func New(limits Limits) *Extractor {
+	return &Extractor{limits: limits}
+}
+
+// Extract unpacks fileName into Dir(fileName) along with any archives inside it up to the depth limit. Files that are
+// not archives and archives already extracted are left alone. The dir only appears once everything is extracted
+func (e *Extractor) Extract(ctx context.Context, fileName string) (Result, error) {
+	if e == nil || !Supported(fileName) {
+		return Result{}, nil
+	}
+	dir := Dir(fileName)
+	if fi, err := os.Stat(dir); err == nil {
+		if !fi.IsDir() {
+			return Result{}, fmt.Errorf("unable to extract '%v' since '%v' already exists and is not a dir", fileName, dir)
+		}
+		slog.Debug("archive already extracted skipping", "file_name", fileName, "dir", dir)
+		return Result{}, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return Result{}, fmt.Errorf("unable to check extract dir '%v' due to error '%v'", dir, err)
+	}
+	// left behind when an earlier run was killed part way through
+	tmpDir := dir + storage.InProgressSuffix
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return Result{}, fmt.Errorf("unable to remove incomplete extract dir '%v' due to error '%v'", tmpDir, err)
+	}
+	r := &run{ctx: ctx, limits: e.limits}
+	if err := r.extract(fileName, tmpDir, 0); err != nil {
+		if removeErr := os.RemoveAll(tmpDir); removeErr != nil {
+			slog.Warn("unable to remove incomplete extract dir so you will need to manually clean this up", "dir", tmpDir, "error_msg", removeErr)
+		}
+		return Result{}, err
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		return Result{}, fmt.Errorf("unable to move extracted files to '%v' due to error '%v'", dir, err)
+	}
+	return r.result, nil
+}
+
+// run tracks one downloaded archive and everything nested in it since the limits apply to all of it
+type run struct {
+	ctx     context.Context
+	limits  Limits
+	entries int
+	result  Result
+}
+
+func (r *run) extract(archive, dir string, depth int) error {
+	fi, err := os.Stat(archive)
+	if err != nil {
+		return fmt.Errorf("unable to read archive '%v' due to error '%v'", archive, err)
+	}
+	a := &archiveWriter{run: r, archive: archive, size: fi.Size()}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("unable to make dir %v due to error %v", dir, err)
+	}
+	if extension(archive) == ".zip" {
+		err = a.extractZip(dir)
+	} else {
+		err = a.extractTarGz(dir)
+	}
+	if err != nil {
+		return err
+	}
+	r.result.Archives++
+	if depth >= r.limits.MaxDepth {
+		return nil
+	}
+	var nested []string
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && Supported(path) {
+			nested = append(nested, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to look for nested archives in '%v' due to error '%v'", dir, err)
+	}
+	for _, n := range nested {
+		nestedDir := Dir(n)
+		if _, err := os.Stat(nestedDir); err == nil {
+			slog.Debug("not extracting nested archive since its dir is already taken", "file_name", n, "dir", nestedDir)
+			continue
+		}
+		if err := r.extract(n, nestedDir, depth+1); err != nil {
+			var limitErr LimitErr
+			var unsafeErr UnsafePathErr
+			if errors.As(err, &limitErr) || errors.As(err, &unsafeErr) || r.ctx.Err() != nil {
+				return err
+			}
+			// a nested file that only looks like an archive should not throw away everything else
+			slog.Warn("unable to extract nested archive, leaving it as is", "file_name", n, "error_msg", err)
+			if removeErr := os.RemoveAll(nestedDir); removeErr != nil {
+				slog.Warn("unable to remove incomplete extract dir so you will need to manually clean this up", "dir", nestedDir, "error_msg", removeErr)
+			}
+		}
+	}
+	return nil
+}
+
+// archiveWriter writes the entries of one archive, counting them against the limits as they are written
+type archiveWriter struct {
+	*run
+	archive string
+	size    int64
+	written int64
+}
+
+// target is where an entry is written, entries that would escape dir are refused
+func (a *archiveWriter) target(dir, entry string) (string, error) {
+	name := filepath.FromSlash(entry)
+	if !filepath.IsLocal(name) {
+		return "", UnsafePathErr{Archive: a.archive, Entry: entry}
+	}
+	return filepath.Join(dir, name), nil
+}
+
+func (a *archiveWriter) addEntry() error {
+	if err := a.ctx.Err(); err != nil {
+		return err
+	}
+	a.entries++
+	if a.limits.MaxEntries > 0 && a.entries > a.limits.MaxEntries {
+		return LimitErr{Archive: a.archive, Limit: "entry count", Max: int64(a.limits.MaxEntries)}
+	}
+	return nil
+}
+
+func (a *archiveWriter) mkdir(dir, entry string) error {
+	if err := a.addEntry(); err != nil {
+		return err
+	}
+	target, err := a.target(dir, entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return fmt.Errorf("unable to make dir %v due to error %v", target, err)
+	}
+	return nil
+}
+
+func (a *archiveWriter) writeFile(dir, entry string, r io.Reader) error {
+	if err := a.addEntry(); err != nil {
+		return err
+	}
+	target, err := a.target(dir, entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return fmt.Errorf("unable to make dir %v due to error %v", filepath.Dir(target), err)
+	}
+	f, err := os.OpenFile(filepath.Clean(target), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to create file '%v' due to error '%v'", target, err)
+	}
+	_, err = io.Copy(&limitWriter{a: a, w: f}, r)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("unable to close file '%v' due to error '%v'", target, closeErr)
+	}
+	if err != nil {
+		return err
+	}
+	a.result.Files++
+	return nil
+}
+
+// limitWriter stops writing as soon as the limits are passed, the sizes an archive claims for its entries are
+// not trusted since a bomb can lie about them
+type limitWriter struct {
+	a *archiveWriter
+	w io.Writer
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	a := l.a
+	a.written += int64(len(p))
+	a.result.Bytes += int64(len(p))
+	if a.limits.MaxBytes > 0 && a.result.Bytes > a.limits.MaxBytes {
+		return 0, LimitErr{Archive: a.archive, Limit: "total size", Max: a.limits.MaxBytes}
+	}
+	if a.limits.MaxRatio > 0 && a.written > minRatioCheckBytes && a.written > a.size*a.limits.MaxRatio {
+		return 0, LimitErr{Archive: a.archive, Limit: "compression ratio", Max: a.limits.MaxRatio}
+	}
+	return l.w.Write(p)
+}
+
+func (a *archiveWriter) extractZip(dir string) error {
+	zr, err := zip.OpenReader(a.archive)
+	if err != nil {
+		return fmt.Errorf("unable to open zip '%v' due to error '%v'", a.archive, err)
+	}
+	defer func() {
+		if err := zr.Close(); err != nil {
+			slog.Debug("unable to close zip, since this is a cleanup operation it is usually safe to ignore", "file_name", a.archive, "error_msg", err)
+		}
+	}()
+	for _, f := range zr.File {
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			if err := a.mkdir(dir, f.Name); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err := a.extractZipFile(dir, f); err != nil {
+				return err
+			}
+		default:
+			// links could point anywhere so they are never created
+			slog.Debug("skipping zip entry that is not a file or dir", "file_name", a.archive, "entry", f.Name, "mode", mode)
+		}
+	}
+	return nil
+}
+
+func (a *archiveWriter) extractZipFile(dir string, f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("unable to read entry '%v' of zip '%v' due to error '%v'", f.Name, a.archive, err)
+	}
+	defer func() {
+		if err := rc.Close(); err != nil {
+			slog.Debug("unable to close zip entry, since this is a cleanup operation it is usually safe to ignore", "file_name", a.archive, "entry", f.Name, "error_msg", err)
+		}
+	}()
+	return a.writeFile(dir, f.Name, rc)
+}
+
+func (a *archiveWriter) extractTarGz(dir string) error {
+	file, err := os.Open(filepath.Clean(a.archive))
+	if err != nil {
+		return fmt.Errorf("unable to open archive '%v' due to error '%v'", a.archive, err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			slog.Debug("unable to close archive, since this is a cleanup operation it is usually safe to ignore", "file_name", a.archive, "error_msg", err)
+		}
+	}()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("unable to read gzip '%v' due to error '%v'", a.archive, err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read tar '%v' due to error '%v'", a.archive, err)
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := a.mkdir(dir, h.Name); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := a.writeFile(dir, h.Name, tr); err != nil {
+				return err
+			}
+		default:
+			// links could point anywhere so they are never created
+			slog.Debug("skipping tar entry that is not a file or dir", "file_name", a.archive, "entry", h.Name, "type", string(h.Typeflag))
+		}
+	}
+}
@@ -0,0 +1,210 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// extract package unpacks downloaded archives next to them, guarding against entries that escape the
+// extract dir and against archives that expand to far more than they look like they will
+package extract
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type entry struct {
+	name    string
+	content []byte
+}
+
+func zipBytes(t *testing.T, entries []entry) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(e.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func tarGzBytes(t *testing.T, entries []entry) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0600, Size: int64(len(e.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func writeArchive(t *testing.T, name string, b []byte) string {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fileName, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func assertContent(t *testing.T, fileName, expected string) {
+	t.Helper()
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected {
+		t.Errorf("expected '%v' in %v but was '%v'", expected, fileName, string(b))
+	}
+}
+
+func TestExtractNested(t *testing.T) {
+	inner := tarGzBytes(t, []entry{{name: "logs/server.log", content: []byte("inner log")}})
+	fileName := writeArchive(t, "bundle.zip", zipBytes(t, []entry{
+		{name: "readme.txt", content: []byte("readme")},
+		{name: "node1/logs.tgz", content: inner},
+	}))
+	result, err := New(Limits{MaxDepth: 1}).Extract(context.Background(), fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(filepath.Dir(fileName), "bundle")
+	assertContent(t, filepath.Join(dir, "readme.txt"), "readme")
+	assertContent(t, filepath.Join(dir, "node1", "logs", "logs", "server.log"), "inner log")
+	if result.Archives != 2 || result.Files != 3 {
+		t.Errorf("expected 2 archives and 3 files but was %#v", result)
+	}
+	if _, err := os.Stat(dir + ".inprogress"); !os.IsNotExist(err) {
+		t.Errorf("expected the in progress dir to be gone but stat returned %v", err)
+	}
+
+	// a second run leaves the extracted dir alone
+	result, err = New(Limits{MaxDepth: 1}).Extract(context.Background(), fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Archives != 0 {
+		t.Errorf("expected nothing extracted the second time but was %#v", result)
+	}
+}
+
+func TestExtractDepthLimit(t *testing.T) {
+	inner := zipBytes(t, []entry{{name: "server.log", content: []byte("inner log")}})
+	fileName := writeArchive(t, "bundle.tar.gz", tarGzBytes(t, []entry{{name: "inner.zip", content: inner}}))
+	result, err := New(Limits{}).Extract(context.Background(), fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Archives != 1 {
+		t.Errorf("expected only the downloaded archive to be extracted but was %#v", result)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(fileName), "bundle", "inner")); !os.IsNotExist(err) {
+		t.Errorf("expected the nested archive to be left alone but stat returned %v", err)
+	}
+}
+
+func TestExtractZipSlip(t *testing.T) {
+	for _, name := range []string{"../evil.txt", "a/../../evil.txt", "/etc/evil.txt"} {
+		t.Run(name, func(t *testing.T) {
+			fileName := writeArchive(t, "bundle.zip", zipBytes(t, []entry{{name: "ok.txt", content: []byte("ok")}, {name: name, content: []byte("evil")}}))
+			_, err := New(Limits{}).Extract(context.Background(), fileName)
+			var unsafeErr UnsafePathErr
+			if !errors.As(err, &unsafeErr) {
+				t.Fatalf("expected UnsafePathErr but was %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(fileName), "evil.txt")); !os.IsNotExist(err) {
+				t.Errorf("expected nothing written outside the extract dir but stat returned %v", err)
+			}
+			for _, dir := range []string{"bundle", "bundle.inprogress"} {
+				if _, err := os.Stat(filepath.Join(filepath.Dir(fileName), dir)); !os.IsNotExist(err) {
+					t.Errorf("expected %v to be removed but stat returned %v", dir, err)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	zeros := make([]byte, 4<<20)
+	testCases := []struct {
+		name    string
+		limits  Limits
+		entries []entry
+		limit   string
+	}{
+		{name: "total size", limits: Limits{MaxBytes: 10}, entries: []entry{{name: "a.txt", content: []byte("more than ten bytes")}}, limit: "total size"},
+		{name: "entry count", limits: Limits{MaxEntries: 1}, entries: []entry{{name: "a.txt"}, {name: "b.txt"}}, limit: "entry count"},
+		{name: "ratio", limits: Limits{MaxRatio: 10}, entries: []entry{{name: "zeros", content: zeros}}, limit: "compression ratio"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fileName := writeArchive(t, "bundle.zip", zipBytes(t, tc.entries))
+			_, err := New(tc.limits).Extract(context.Background(), fileName)
+			var limitErr LimitErr
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("expected LimitErr but was %v", err)
+			}
+			if limitErr.Limit != tc.limit {
+				t.Errorf("expected the %v limit but was %v", tc.limit, limitErr.Limit)
+			}
+		})
+	}
+}
+
+func TestExtractNotAnArchive(t *testing.T) {
+	fileName := writeArchive(t, "server.log", []byte("not an archive"))
+	result, err := New(Limits{}).Extract(context.Background(), fileName)
+	if err != nil || result.Archives != 0 {
+		t.Errorf("expected a plain file to be left alone but was %#v with error %v", result, err)
+	}
+	var e *Extractor
+	if _, err := e.Extract(context.Background(), fileName); err != nil {
+		t.Errorf("expected a nil extractor to do nothing but was %v", err)
+	}
+}
+
+func TestDir(t *testing.T) {
+	for name, expected := range map[string]string{"a/b.zip": "a/b", "b.TGZ": "b", "b.tar.gz": "b", "b.gz": "b.gz", ".zip": ".zip"} {
+		if Dir(name) != expected {
+			t.Errorf("expected %v for %v but was %v", expected, name, Dir(name))
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// filter package selects which SendSafely files and zendesk attachments are downloaded by name, file id and uploader
+package filter
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Filter keeps the files matching every selection it was given, nil keeps every file
+type Filter struct {
+	include    []string
+	exclude    []string
+	fileIDs    []string
+	uploadedBy []string
+}
+
+// New returns a filter for the given selections, nil when there are none. include and exclude are globs as understood
+// by path.Match, a glob without a / is matched against the file name and one with a / against the slash separated path
+// of the file. uploadedBy is matched against the email of the uploader ignoring case
+func New(include, exclude, fileIDs, uploadedBy []string) (*Filter, error) {
+	if len(include) == 0 && len(exclude) == 0 && len(fileIDs) == 0 && len(uploadedBy) == 0 {
+		return nil, nil
+	}
+	for _, pattern := range slices.Concat(include, exclude) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob '%v': %w", pattern, err)
+		}
+	}
+	return &Filter{include: include, exclude: exclude, fileIDs: fileIDs, uploadedBy: uploadedBy}, nil
+}
+
+// Skip returns why the file is not selected, empty when it is. name is the slash separated path of the file
+func (f *Filter) Skip(name, fileID, uploadedBy string) string {
+	if f == nil {
+		return ""
+	}
+	if len(f.fileIDs) > 0 && !slices.Contains(f.fileIDs, fileID) {
+		return "not in --file-id"
+	}
+	if len(f.uploadedBy) > 0 && !slices.ContainsFunc(f.uploadedBy, func(u string) bool {
+		return strings.EqualFold(u, uploadedBy)
+	}) {
+		return "not uploaded by --uploaded-by"
+	}
+	if len(f.include) > 0 && !matchAny(f.include, name) {
+		return "not matched by --include"
+	}
+	if matchAny(f.exclude, name) {
+		return "matched by --exclude"
+	}
+	return ""
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		target := path.Base(name)
+		if strings.Contains(pattern, "/") {
+			target = name
+		}
+		// the patterns were checked by New
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
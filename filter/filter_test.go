@@ -0,0 +1,78 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// filter package selects which SendSafely files and zendesk attachments are downloaded by name, file id and uploader
+package filter
+
+import "testing"
+
+func TestNilFilterKeepsEverything(t *testing.T) {
+	f, err := New(nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != nil {
+		t.Fatalf("expected no filter without selections but was %#v", f)
+	}
+	if reason := f.Skip("heap.hprof", "id", "a@example.com"); reason != "" {
+		t.Errorf("expected a nil filter to keep the file but it was skipped for %v", reason)
+	}
+}
+
+func TestInvalidGlob(t *testing.T) {
+	if _, err := New([]string{"[a"}, nil, nil, nil); err == nil {
+		t.Error("expected an invalid glob to be refused")
+	}
+}
+
+func TestSkip(t *testing.T) {
+	f, err := New([]string{"*.log", "conf/*.yaml"}, []string{"gc*.log"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		reason string
+	}{
+		{"server.log", ""},
+		{"logs/node1/server.log", ""},
+		{"logs/node1/gc.log", "matched by --exclude"},
+		{"conf/dremio.yaml", ""},
+		{"other/conf/dremio.yaml", "not matched by --include"},
+		{"heap.hprof", "not matched by --include"},
+	}
+	for _, tt := range tests {
+		if reason := f.Skip(tt.name, "id", ""); reason != tt.reason {
+			t.Errorf("expected '%v' for %v but was '%v'", tt.reason, tt.name, reason)
+		}
+	}
+}
+
+func TestSkipByFileIDAndUploader(t *testing.T) {
+	f, err := New(nil, nil, []string{"f1", "f2"}, []string{"Support@Example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := f.Skip("a.txt", "f3", "support@example.com"); reason != "not in --file-id" {
+		t.Errorf("expected f3 to be skipped for its id but was '%v'", reason)
+	}
+	if reason := f.Skip("a.txt", "f1", "someone@example.com"); reason != "not uploaded by --uploaded-by" {
+		t.Errorf("expected f1 to be skipped for its uploader but was '%v'", reason)
+	}
+	if reason := f.Skip("a.txt", "f2", "support@example.com"); reason != "" {
+		t.Errorf("expected f2 to be kept but was skipped for '%v'", reason)
+	}
+}
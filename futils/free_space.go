@@ -0,0 +1,86 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// package futils provides file utilities for very common ops
+package futils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrFreeSpaceUnsupported is returned by FreeSpace on platforms where we do not know how to ask for it
+var ErrFreeSpaceUnsupported = errors.New("checking free space is not supported on this platform")
+
+// InsufficientSpaceErr is returned when a download will not fit on the volume
+type InsufficientSpaceErr struct {
+	Dir    string
+	Needed int64
+	Free   int64
+}
+
+func (i InsufficientSpaceErr) Error() string {
+	return fmt.Sprintf("not enough free space in '%v', %v bytes are needed but only %v bytes are free", i.Dir, i.Needed, i.Free)
+}
+
+// FreeSpace returns the bytes available to the current user on the volume holding dir, the directory
+// does not have to exist yet, the closest parent that does is used instead
+func FreeSpace(dir string) (int64, error) {
+	existing, err := closestExisting(dir)
+	if err != nil {
+		return 0, err
+	}
+	return freeSpace(existing)
+}
+
+// CheckFreeSpace returns an InsufficientSpaceErr when needed is more than what is free on the volume holding dir
+func CheckFreeSpace(dir string, needed int64) error {
+	free, err := FreeSpace(dir)
+	if err != nil {
+		return err
+	}
+	if needed > free {
+		return InsufficientSpaceErr{
+			Dir:    dir,
+			Needed: needed,
+			Free:   free,
+		}
+	}
+	return nil
+}
+
+func closestExisting(dir string) (string, error) {
+	current, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("unable to find absolute path of %v due to error %v", dir, err)
+	}
+	for {
+		_, err := os.Stat(current)
+		if err == nil {
+			return current, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("trying to check dir %v resulted in error %v", current, err)
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return "", fmt.Errorf("no part of %v exists", dir)
+		}
+		current = parent
+	}
+}
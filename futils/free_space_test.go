@@ -0,0 +1,61 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// package futils provides file utilities for very common ops
+package futils
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestFreeSpaceOfMissingDirUsesParent(t *testing.T) {
+	dir := t.TempDir()
+	expected, err := FreeSpace(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected <= 0 {
+		t.Fatalf("expected free space in %v but was %v", dir, expected)
+	}
+	free, err := FreeSpace(filepath.Join(dir, "not", "made", "yet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free <= 0 {
+		t.Errorf("expected the free space of the parent but was %v", free)
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	if err := CheckFreeSpace(dir, 1); err != nil {
+		t.Errorf("expected 1 byte to fit but got %v", err)
+	}
+	err := CheckFreeSpace(dir, math.MaxInt64)
+	var spaceErr InsufficientSpaceErr
+	if !errors.As(err, &spaceErr) {
+		t.Fatalf("expected InsufficientSpaceErr but was %T %v", err, err)
+	}
+	if spaceErr.Needed != math.MaxInt64 {
+		t.Errorf("expected %v but was %v", int64(math.MaxInt64), spaceErr.Needed)
+	}
+	if spaceErr.Free <= 0 {
+		t.Errorf("expected free space to be reported but was %v", spaceErr.Free)
+	}
+}
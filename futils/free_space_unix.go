@@ -0,0 +1,35 @@
+//go:build linux || darwin
+
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// package futils provides file utilities for very common ops
+package futils
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+func freeSpace(dir string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, fmt.Errorf("unable to read free space of %v due to error %v", dir, err)
+	}
+	// Bavail is what is left for unprivileged users, Bfree includes the blocks reserved for root
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,38 @@
+//go:build windows
+
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// package futils provides file utilities for very common ops
+package futils
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+func freeSpace(dir string) (int64, error) {
+	dirPtr, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, fmt.Errorf("invalid dir %v due to error %v", dir, err)
+	}
+	var freeToCaller, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(dirPtr, &freeToCaller, &total, &totalFree); err != nil {
+		return 0, fmt.Errorf("unable to read free space of %v due to error %v", dir, err)
+	}
+	return int64(freeToCaller), nil
+}
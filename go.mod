@@ -12,6 +12,7 @@ require (
 	github.com/valyala/fastjson v1.6.4
 	golang.org/x/crypto v0.37.0
 	golang.org/x/net v0.39.0
+	golang.org/x/sys v0.32.0
 	golang.org/x/term v0.31.0
 )
 
@@ -22,6 +23,5 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.6 // indirect
 	golang.org/x/sync v0.13.0 // indirect
-	golang.org/x/sys v0.32.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
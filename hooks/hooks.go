@@ -0,0 +1,236 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// hooks package runs external commands when files, packages and tickets finish downloading or fail
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// the events a hook can run on
+const (
+	FileComplete    = "file_complete"
+	PackageComplete = "package_complete"
+	TicketComplete  = "ticket_complete"
+	Failure         = "failure"
+)
+
+// the sources of a downloaded file
+const (
+	SourceSendSafely = "sendsafely"
+	SourceZendesk    = "zendesk"
+)
+
+// the failure policies, what happens when a hook exits non zero or times out
+const (
+	// PolicyIgnore only logs the failure in verbose mode
+	PolicyIgnore = "ignore"
+	// PolicyWarn logs the failure and carries on, this is the default
+	PolicyWarn = "warn"
+	// PolicyAbort stops the run as if it was interrupted, partial downloads are kept so it can be resumed
+	PolicyAbort = "abort"
+)
+
+// DefaultTimeout is used for hooks without a timeout
+const DefaultTimeout = 60 * time.Second
+
+// maxOutput is how much of the output of a failed hook is logged
+const maxOutput = 4096
+
+// Hook is an external command run on an event, it is read from the config file so the fields are the json keys
+type Hook struct {
+	// Event is one of file_complete, package_complete, ticket_complete or failure
+	Event string
+	// Command is run with sh -c, or cmd /C on windows, the event is written to its stdin as json
+	Command string
+	// TimeoutSeconds is how long the command can run before it is killed, 0 uses DefaultTimeout
+	TimeoutSeconds int
+	// FailurePolicy is one of ignore, warn or abort, empty is warn
+	FailurePolicy string
+}
+
+// Event is what happened, it is written to the stdin of the hook as json and also passed as SSDOWNLOADER_ env vars
+type Event struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Source    string    `json:"source,omitempty"`
+	TicketID  string    `json:"ticket_id,omitempty"`
+	PackageID string    `json:"package_id,omitempty"`
+	FileID    string    `json:"file_id,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Env is the event as env vars, empty fields are left out
+func (e Event) Env() []string {
+	env := []string{"SSDOWNLOADER_EVENT=" + e.Event}
+	add := func(name, value string) {
+		if value != "" {
+			env = append(env, "SSDOWNLOADER_"+name+"="+value)
+		}
+	}
+	add("SOURCE", e.Source)
+	add("TICKET_ID", e.TicketID)
+	add("PACKAGE_ID", e.PackageID)
+	add("FILE_ID", e.FileID)
+	add("PATH", e.Path)
+	if e.Size > 0 {
+		add("SIZE", strconv.FormatInt(e.Size, 10))
+	}
+	add("ERROR", e.Error)
+	return env
+}
+
+// InvalidHookErr is returned by New for a hook that could never run
+type InvalidHookErr struct {
+	Hook   Hook
+	Reason string
+}
+
+func (e InvalidHookErr) Error() string {
+	return fmt.Sprintf("invalid hook '%v' for event '%v': %v", e.Hook.Command, e.Hook.Event, e.Reason)
+}
+
+// Runner runs the hooks for each event in the order they were configured
+type Runner struct {
+	hooks map[string][]Hook
+	abort func()
+}
+
+// New checks the hooks and returns a runner for them, abort is called by a hook with the abort failure policy
+// when it fails and should stop the run. When there are no hooks nil is returned
+func New(hooks []Hook, abort func()) (*Runner, error) {
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+	r := &Runner{hooks: make(map[string][]Hook), abort: abort}
+	for _, h := range hooks {
+		switch h.Event {
+		case FileComplete, PackageComplete, TicketComplete, Failure:
+		default:
+			return nil, InvalidHookErr{Hook: h, Reason: "the event has to be file_complete, package_complete, ticket_complete or failure"}
+		}
+		switch h.FailurePolicy {
+		case "", PolicyIgnore, PolicyWarn, PolicyAbort:
+		default:
+			return nil, InvalidHookErr{Hook: h, Reason: "the failure policy has to be ignore, warn or abort"}
+		}
+		if h.Command == "" {
+			return nil, InvalidHookErr{Hook: h, Reason: "the command is empty"}
+		}
+		if h.TimeoutSeconds < 0 {
+			return nil, InvalidHookErr{Hook: h, Reason: "the timeout cannot be negative"}
+		}
+		r.hooks[h.Event] = append(r.hooks[h.Event], h)
+	}
+	return r, nil
+}
+
+// Run runs every hook for the event and waits for them, failures are handled by the failure policy of each hook
+func (r *Runner) Run(ctx context.Context, e Event) {
+	if r == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, h := range r.hooks[e.Event] {
+		err := run(ctx, h, e)
+		if err == nil {
+			continue
+		}
+		switch h.FailurePolicy {
+		case PolicyIgnore:
+			slog.Debug("hook failed, ignoring as configured", "event", e.Event, "command", h.Command, "path", e.Path, "error_msg", err)
+		case PolicyAbort:
+			slog.Error("hook failed, stopping the run as configured", "event", e.Event, "command", h.Command, "path", e.Path, "error_msg", err)
+			if r.abort != nil {
+				r.abort()
+			}
+		default:
+			slog.Warn("hook failed", "event", e.Event, "command", h.Command, "path", e.Path, "error_msg", err)
+		}
+	}
+}
+
+func run(ctx context.Context, h Hook, e Event) error {
+	stdin, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("unable to convert event to json due to error '%v'", err)
+	}
+	timeout := DefaultTimeout
+	if h.TimeoutSeconds > 0 {
+		timeout = time.Duration(h.TimeoutSeconds) * time.Second
+	}
+	// a hook that already started gets to finish even when the run is interrupted, only the timeout stops it
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+	name, args := shell(h.Command)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Env = append(os.Environ(), e.Env()...)
+	var output cappedBuffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// background processes started by the hook can hold the output open, this stops Wait blocking on them
+	cmd.WaitDelay = time.Second
+	slog.Debug("running hook", "event", e.Event, "command", h.Command, "path", e.Path)
+	err = cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %v with output '%v'", timeout, output.String())
+	}
+	if err != nil {
+		return fmt.Errorf("'%v' with output '%v'", err, output.String())
+	}
+	slog.Debug("hook complete", "event", e.Event, "command", h.Command, "output", output.String())
+	return nil
+}
+
+func shell(command string) (string, []string) {
+	if runtime.GOOS == "windows" {
+		return "cmd", []string{"/C", command}
+	}
+	return "sh", []string{"-c", command}
+}
+
+// cappedBuffer keeps the start of the output of a hook so a chatty one cannot use up memory
+type cappedBuffer struct {
+	bytes.Buffer
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if room := maxOutput - c.Len(); room > 0 {
+		if len(p) > room {
+			c.Buffer.Write(p[:room])
+		} else {
+			c.Buffer.Write(p)
+		}
+	}
+	// the rest is thrown away but the hook has to be told it was written or it gets a broken pipe
+	return len(p), nil
+}
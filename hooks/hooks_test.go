@@ -0,0 +1,115 @@
+//go:build linux || darwin
+
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// hooks package runs external commands when files, packages and tickets finish downloading or fail
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunPassesEvent(t *testing.T) {
+	dir := t.TempDir()
+	stdinFile := filepath.Join(dir, "stdin.json")
+	envFile := filepath.Join(dir, "env.txt")
+	r, err := New([]Hook{{
+		Event:   FileComplete,
+		Command: "cat > '" + stdinFile + "' && env | grep ^SSDOWNLOADER_ > '" + envFile + "'",
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Run(context.Background(), Event{Event: FileComplete, Source: SourceSendSafely, TicketID: "1", PackageID: "pkg", FileID: "file", Path: "/tmp/server.log", Size: 10})
+	// hooks for other events are not run
+	r.Run(context.Background(), Event{Event: Failure, Path: "/tmp/other.log"})
+
+	b, err := os.ReadFile(stdinFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Event
+	if err := json.Unmarshal(b, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Event != FileComplete || e.Path != "/tmp/server.log" || e.Size != 10 || e.Source != SourceSendSafely || e.Time.IsZero() {
+		t.Errorf("unexpected event on stdin %#v", e)
+	}
+	b, err = os.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"SSDOWNLOADER_EVENT=file_complete", "SSDOWNLOADER_TICKET_ID=1", "SSDOWNLOADER_PACKAGE_ID=pkg", "SSDOWNLOADER_FILE_ID=file", "SSDOWNLOADER_PATH=/tmp/server.log", "SSDOWNLOADER_SIZE=10", "SSDOWNLOADER_SOURCE=sendsafely"} {
+		if !strings.Contains(string(b), expected) {
+			t.Errorf("expected %v in env but was\n%v", expected, string(b))
+		}
+	}
+}
+
+func TestRunFailurePolicy(t *testing.T) {
+	testCases := []struct {
+		name    string
+		hook    Hook
+		aborted bool
+	}{
+		{name: "abort on exit code", hook: Hook{Event: Failure, Command: "exit 3", FailurePolicy: PolicyAbort}, aborted: true},
+		{name: "abort on timeout", hook: Hook{Event: Failure, Command: "sleep 10", TimeoutSeconds: 1, FailurePolicy: PolicyAbort}, aborted: true},
+		{name: "warn", hook: Hook{Event: Failure, Command: "exit 3", FailurePolicy: PolicyWarn}},
+		{name: "ignore", hook: Hook{Event: Failure, Command: "exit 3", FailurePolicy: PolicyIgnore}},
+		{name: "success", hook: Hook{Event: Failure, Command: "true", FailurePolicy: PolicyAbort}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			aborted := false
+			r, err := New([]Hook{tc.hook}, func() { aborted = true })
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Run(context.Background(), Event{Event: Failure})
+			if aborted != tc.aborted {
+				t.Errorf("expected aborted to be %v", tc.aborted)
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidHooks(t *testing.T) {
+	for _, h := range []Hook{
+		{Event: "file_done", Command: "true"},
+		{Event: FileComplete, Command: "true", FailurePolicy: "retry"},
+		{Event: FileComplete},
+		{Event: FileComplete, Command: "true", TimeoutSeconds: -1},
+	} {
+		_, err := New([]Hook{h}, nil)
+		var invalidErr InvalidHookErr
+		if !errors.As(err, &invalidErr) {
+			t.Errorf("expected InvalidHookErr for %#v but was %v", h, err)
+		}
+	}
+	r, err := New(nil, nil)
+	if err != nil || r != nil {
+		t.Errorf("expected no runner without hooks but was %v with error %v", r, err)
+	}
+	// a nil runner does nothing
+	r.Run(context.Background(), Event{Event: FileComplete})
+}
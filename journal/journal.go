@@ -0,0 +1,329 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// journal package records what a ticket download has finished so an interrupted run can resume part by part
+package journal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rsvihladremio/ssdownloader/storage"
+)
+
+// FileName is the name of the journal inside the ticket directory
+const FileName = ".ssdownloader-journal.json"
+
+// version is bumped when the layout changes in a way older journals cannot be read with, version 1 stored absolute
+// file names and is converted when it is opened
+const version = 2
+
+// FlushInterval is the most often changes are written to storage, Flush writes whatever is left at the end of a run
+const FlushInterval = 5 * time.Second
+
+// File is the progress of one SendSafely file
+type File struct {
+	// Parts are the parts downloaded and decrypted to their own file, only used when parts are not streamed
+	Parts []int `json:"parts,omitempty"`
+	// InProgress is the temporary file parts are streamed into relative to the ticket dir, StreamedParts and StreamedBytes are how many
+	// parts have been appended to it in order and how big it was after the last one
+	InProgress    string `json:"inProgress,omitempty"`
+	StreamedParts int    `json:"streamedParts,omitempty"`
+	StreamedBytes int64  `json:"streamedBytes,omitempty"`
+	Complete      bool   `json:"complete,omitempty"`
+}
+
+// Package is the progress of the files of one SendSafely package keyed by file id
+type Package struct {
+	Files map[string]*File `json:"files"`
+}
+
+type state struct {
+	Version  int                 `json:"version"`
+	Packages map[string]*Package `json:"packages"`
+	// Attachments are the zendesk attachments that finished downloading keyed by file name relative to the ticket dir
+	Attachments map[string]bool `json:"attachments"`
+}
+
+// Journal is the download progress of one ticket, changes are written to storage at most every FlushInterval and by Flush
+type Journal struct {
+	lock  sync.Mutex
+	store storage.Storage
+	name  string
+	state state
+	// dirty is set when there are changes storage does not have yet, saved is when they were last written
+	dirty bool
+	saved time.Time
+	// flushInterval is FlushInterval outside of tests
+	flushInterval time.Duration
+	// saveLock is held while writing so only one write runs at a time
+	saveLock sync.Mutex
+}
+
+// Open loads the journal at name, a missing journal is a new one. When restart is true any existing journal
+// is ignored and replaced the first time something is recorded
+func Open(ctx context.Context, store storage.Storage, name string, restart bool) (*Journal, error) {
+	j := &Journal{
+		store:         store,
+		name:          name,
+		flushInterval: FlushInterval,
+		state: state{
+			Version:     version,
+			Packages:    make(map[string]*Package),
+			Attachments: make(map[string]bool),
+		},
+	}
+	if restart {
+		return j, nil
+	}
+	b, err := storage.ReadFile(ctx, store, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return j, nil
+		}
+		return nil, fmt.Errorf("unable to read journal '%v' due to error '%v'", name, err)
+	}
+	var s state
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("unable to parse journal '%v' due to error '%v', use --restart to start over", name, err)
+	}
+	if s.Version != version && s.Version != 1 {
+		return nil, fmt.Errorf("journal '%v' is version %v but only versions 1 and %v are supported, use --restart to start over", name, s.Version, version)
+	}
+	if s.Packages != nil {
+		j.state.Packages = s.Packages
+	}
+	if s.Attachments != nil {
+		j.state.Attachments = s.Attachments
+	}
+	if s.Version == 1 {
+		attachments := make(map[string]bool, len(j.state.Attachments))
+		for a, complete := range j.state.Attachments {
+			attachments[j.rel(a)] = complete
+		}
+		j.state.Attachments = attachments
+		for _, p := range j.state.Packages {
+			for _, f := range p.Files {
+				if f.InProgress != "" {
+					f.InProgress = j.rel(f.InProgress)
+				}
+			}
+		}
+	}
+	return j, nil
+}
+
+// rel is name relative to the ticket dir the journal is in so a download dir that was moved can still be resumed,
+// names outside of the ticket dir are kept as they are
+func (j *Journal) rel(name string) string {
+	r, err := filepath.Rel(filepath.Dir(j.name), name)
+	if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return name
+	}
+	return filepath.ToSlash(r)
+}
+
+// file returns the entry for the file, creating it when create is true. The lock has to be held
+func (j *Journal) file(packageID, fileID string, create bool) *File {
+	p, ok := j.state.Packages[packageID]
+	if !ok {
+		if !create {
+			return nil
+		}
+		p = &Package{Files: make(map[string]*File)}
+		j.state.Packages[packageID] = p
+	}
+	f, ok := p.Files[fileID]
+	if !ok {
+		if !create {
+			return nil
+		}
+		f = &File{}
+		p.Files[fileID] = f
+	}
+	return f
+}
+
+// update applies change and writes the journal when it was last written more than flushInterval ago. Writing happens
+// outside of the lock so downloads recording progress do not wait on storage
+func (j *Journal) update(ctx context.Context, change func()) error {
+	j.lock.Lock()
+	change()
+	j.dirty = true
+	due := time.Since(j.saved) >= j.flushInterval
+	j.lock.Unlock()
+	// a write already running leaves this change to the next one
+	if !due || !j.saveLock.TryLock() {
+		return nil
+	}
+	defer j.saveLock.Unlock()
+	return j.save(ctx)
+}
+
+// Flush writes any changes storage does not have yet, call it once the downloads of the ticket are done
+func (j *Journal) Flush(ctx context.Context) error {
+	if j == nil {
+		return nil
+	}
+	j.saveLock.Lock()
+	defer j.saveLock.Unlock()
+	return j.save(ctx)
+}
+
+// save writes the journal under a temporary name and renames it so a crash never leaves half a journal. The saveLock has to be held
+func (j *Journal) save(ctx context.Context) error {
+	j.lock.Lock()
+	if !j.dirty {
+		j.lock.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(j.state)
+	j.dirty = false
+	j.saved = time.Now()
+	j.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to encode journal due to error '%v'", err)
+	}
+	// the last record has to make it to disk even when the run is being interrupted
+	if err := storage.WriteFile(context.WithoutCancel(ctx), j.store, j.name, b); err != nil {
+		j.lock.Lock()
+		j.dirty = true
+		j.lock.Unlock()
+		return fmt.Errorf("unable to write journal '%v' due to error '%v'", j.name, err)
+	}
+	return nil
+}
+
+// FileComplete is true when the file finished downloading
+func (j *Journal) FileComplete(packageID, fileID string) bool {
+	if j == nil {
+		return false
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	f := j.file(packageID, fileID, false)
+	return f != nil && f.Complete
+}
+
+// CompleteFile records the file finished downloading, the progress of its parts is no longer needed
+func (j *Journal) CompleteFile(ctx context.Context, packageID, fileID string) error {
+	if j == nil {
+		return nil
+	}
+	return j.update(ctx, func() {
+		*j.file(packageID, fileID, true) = File{Complete: true}
+	})
+}
+
+// PartDone is true when the part was downloaded and decrypted to its own file
+func (j *Journal) PartDone(packageID, fileID string, part int) bool {
+	if j == nil {
+		return false
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	f := j.file(packageID, fileID, false)
+	return f != nil && slices.Contains(f.Parts, part)
+}
+
+// DonePart records the part was downloaded and decrypted to its own file
+func (j *Journal) DonePart(ctx context.Context, packageID, fileID string, part int) error {
+	if j == nil {
+		return nil
+	}
+	return j.update(ctx, func() {
+		f := j.file(packageID, fileID, true)
+		if !slices.Contains(f.Parts, part) {
+			f.Parts = append(f.Parts, part)
+			slices.Sort(f.Parts)
+		}
+	})
+}
+
+// Streamed returns how many parts have been streamed in order into inProgress and the size it had after the last one
+func (j *Journal) Streamed(packageID, fileID, inProgress string) (parts int, bytes int64) {
+	if j == nil {
+		return 0, 0
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	f := j.file(packageID, fileID, false)
+	if f == nil || f.InProgress != j.rel(inProgress) {
+		return 0, 0
+	}
+	return f.StreamedParts, f.StreamedBytes
+}
+
+// StreamedPart records that parts have now been streamed into inProgress which is now size bytes, parts is 0
+// when starting over
+func (j *Journal) StreamedPart(ctx context.Context, packageID, fileID, inProgress string, parts int, size int64) error {
+	if j == nil {
+		return nil
+	}
+	return j.update(ctx, func() {
+		f := j.file(packageID, fileID, true)
+		f.InProgress = j.rel(inProgress)
+		f.StreamedParts = parts
+		f.StreamedBytes = size
+	})
+}
+
+// Resumable is true when name is a temporary file the journal can resume from, these have to survive the
+// cleanup of files left over from crashed runs
+func (j *Journal) Resumable(name string) bool {
+	if j == nil {
+		return false
+	}
+	name = j.rel(name)
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for _, p := range j.state.Packages {
+		for _, f := range p.Files {
+			if f.InProgress == name && f.StreamedParts > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AttachmentComplete is true when the attachment saved to name finished downloading
+func (j *Journal) AttachmentComplete(name string) bool {
+	if j == nil {
+		return false
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.state.Attachments[j.rel(name)]
+}
+
+// CompleteAttachment records the attachment saved to name finished downloading
+func (j *Journal) CompleteAttachment(ctx context.Context, name string) error {
+	if j == nil {
+		return nil
+	}
+	return j.update(ctx, func() {
+		j.state.Attachments[j.rel(name)] = true
+	})
+}
@@ -0,0 +1,234 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// journal package records what a ticket download has finished so an interrupted run can resume part by part
+package journal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rsvihladremio/ssdownloader/storage"
+)
+
+func TestJournalSurvivesReopen(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewLocal()
+	name := filepath.Join(t.TempDir(), "tickets", "1", FileName)
+	j, err := Open(ctx, store, name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.DonePart(ctx, "pkg", "file1", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.StreamedPart(ctx, "pkg", "file2", "file2.inprogress", 3, 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.CompleteFile(ctx, "pkg", "file3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.CompleteAttachment(ctx, "attachment.log"); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = Open(ctx, store, name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.PartDone("pkg", "file1", 2) || j.PartDone("pkg", "file1", 1) {
+		t.Error("expected only part 2 of file1 to be done")
+	}
+	if parts, size := j.Streamed("pkg", "file2", "file2.inprogress"); parts != 3 || size != 300 {
+		t.Errorf("expected 3 parts and 300 bytes but was %v and %v", parts, size)
+	}
+	if parts, _ := j.Streamed("pkg", "file2", "other.inprogress"); parts != 0 {
+		t.Errorf("expected nothing streamed to a different file but was %v parts", parts)
+	}
+	if !j.Resumable("file2.inprogress") || j.Resumable("other.inprogress") {
+		t.Error("expected only file2.inprogress to be resumable")
+	}
+	if !j.FileComplete("pkg", "file3") || j.FileComplete("pkg", "file1") {
+		t.Error("expected only file3 to be complete")
+	}
+	if !j.AttachmentComplete("attachment.log") {
+		t.Error("expected the attachment to be complete")
+	}
+	if _, err := os.Stat(name + storage.InProgressSuffix); !os.IsNotExist(err) {
+		t.Errorf("expected no temporary journal to be left behind but stat returned %v", err)
+	}
+}
+
+func TestJournalBatchesWrites(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewLocal()
+	name := filepath.Join(t.TempDir(), FileName)
+	j, err := Open(ctx, store, name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.flushInterval = time.Hour
+	// the first change is written straight away, the rest wait for the interval or Flush
+	for part := 1; part <= 3; part++ {
+		if err := j.DonePart(ctx, "pkg", "file1", part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopened, err := Open(ctx, store, name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.PartDone("pkg", "file1", 1) || reopened.PartDone("pkg", "file1", 3) {
+		t.Error("expected only the first part to have been written before the flush")
+	}
+	if err := j.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err = Open(ctx, store, name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.PartDone("pkg", "file1", 3) {
+		t.Error("expected the flush to write every part")
+	}
+}
+
+func TestJournalResumesMovedDir(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewLocal()
+	oldDir := filepath.Join(t.TempDir(), "tickets", "1")
+	j, err := Open(ctx, store, filepath.Join(oldDir, FileName), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.StreamedPart(ctx, "pkg", "file1", filepath.Join(oldDir, "pkg", "file1.inprogress"), 2, 200); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.CompleteAttachment(ctx, filepath.Join(oldDir, "attachments", "a.log")); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	newDir := filepath.Join(t.TempDir(), "moved")
+	if err := os.Rename(oldDir, newDir); err != nil {
+		t.Fatal(err)
+	}
+	j, err = Open(ctx, store, filepath.Join(newDir, FileName), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parts, _ := j.Streamed("pkg", "file1", filepath.Join(newDir, "pkg", "file1.inprogress")); parts != 2 {
+		t.Errorf("expected 2 parts to resume in the moved dir but was %v", parts)
+	}
+	if !j.Resumable(filepath.Join(newDir, "pkg", "file1.inprogress")) {
+		t.Error("expected the in progress file in the moved dir to be resumable")
+	}
+	if !j.AttachmentComplete(filepath.Join(newDir, "attachments", "a.log")) {
+		t.Error("expected the attachment in the moved dir to be complete")
+	}
+}
+
+func TestOpenConvertsVersion1(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, FileName)
+	inProgress := filepath.Join(dir, "pkg", "file1.inprogress")
+	attachment := filepath.Join(dir, "attachments", "a.log")
+	v1 := fmt.Sprintf(`{"version":1,"packages":{"pkg":{"files":{"file1":{"inProgress":%q,"streamedParts":2,"streamedBytes":200}}}},"attachments":{%q:true}}`, inProgress, attachment)
+	if err := os.WriteFile(name, []byte(v1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	j, err := Open(context.Background(), storage.NewLocal(), name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parts, _ := j.Streamed("pkg", "file1", inProgress); parts != 2 {
+		t.Errorf("expected 2 parts from the version 1 journal but was %v", parts)
+	}
+	if !j.AttachmentComplete(attachment) {
+		t.Error("expected the attachment from the version 1 journal to be complete")
+	}
+}
+
+func TestCompleteFileForgetsParts(t *testing.T) {
+	ctx := context.Background()
+	j, err := Open(ctx, storage.NewLocal(), filepath.Join(t.TempDir(), FileName), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.StreamedPart(ctx, "pkg", "file1", "file1.inprogress", 1, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.CompleteFile(ctx, "pkg", "file1"); err != nil {
+		t.Fatal(err)
+	}
+	if j.Resumable("file1.inprogress") {
+		t.Error("expected a complete file to have nothing to resume")
+	}
+}
+
+func TestRestartIgnoresJournal(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewLocal()
+	name := filepath.Join(t.TempDir(), FileName)
+	j, err := Open(ctx, store, name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.CompleteAttachment(ctx, "attachment.log"); err != nil {
+		t.Fatal(err)
+	}
+	j, err = Open(ctx, store, name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.AttachmentComplete("attachment.log") {
+		t.Error("expected restart to ignore what was recorded")
+	}
+}
+
+func TestOpenRejectsUnknownVersion(t *testing.T) {
+	name := filepath.Join(t.TempDir(), FileName)
+	if err := os.WriteFile(name, []byte(`{"version":99}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Open(context.Background(), storage.NewLocal(), name, false)
+	if err == nil || !strings.Contains(err.Error(), "--restart") {
+		t.Errorf("expected an error pointing at --restart but was %v", err)
+	}
+}
+
+func TestNilJournal(t *testing.T) {
+	var j *Journal
+	ctx := context.Background()
+	if err := j.DonePart(ctx, "pkg", "file1", 1); err != nil {
+		t.Error(err)
+	}
+	if err := j.CompleteAttachment(ctx, "attachment.log"); err != nil {
+		t.Error(err)
+	}
+	if j.PartDone("pkg", "file1", 1) || j.AttachmentComplete("attachment.log") || j.Resumable("file1.inprogress") {
+		t.Error("expected a nil journal to report nothing as done")
+	}
+}
@@ -19,6 +19,7 @@ package link
 
 import (
 	"fmt"
+	"net"
 	"net/url"
 	"strings"
 )
@@ -26,6 +27,34 @@ import (
 type Parts struct {
 	PackageCode string
 	KeyCode     string
+	// host is the host of an https link, links over http never have their api used
+	host string
+}
+
+// TrustedAPIURL is the SendSafely api on the host of the link when that is sendsafely.com or one of the enterprise
+// hosts given, empty for any other host. Links come from ticket comments anyone can write and the requests to the api
+// carry our api key, so the default api is used for hosts that are not trusted
+func (p Parts) TrustedAPIURL(hosts []string) string {
+	if p.host == "" {
+		return ""
+	}
+	hostname := strings.ToLower(p.host)
+	if h, _, err := net.SplitHostPort(p.host); err == nil {
+		hostname = strings.ToLower(h)
+	}
+	if hostname == DefaultHost || strings.HasSuffix(hostname, "."+DefaultHost) || isConfigured(hostname, hosts) {
+		return "https://" + p.host + "/api/v2.0"
+	}
+	return ""
+}
+
+func isConfigured(hostname string, hosts []string) bool {
+	for _, h := range hosts {
+		if strings.EqualFold(hostname, strings.TrimSpace(h)) {
+			return true
+		}
+	}
+	return false
 }
 
 type KeyCodeIsMissingErr struct {
@@ -62,35 +91,69 @@ func (u URLParseErr) Error() string {
 	return fmt.Sprintf("unable to parse url '%v' due to error '%v'", u.URL, u.BaseErr)
 }
 
-// ParseLink splits up a SendSafely package download URL into it's important parts
-// This allows us to download the package
-func ParseLink(inputURL string) (Parts, error) {
+// DefaultHost is the SendSafely host, links to it and its subdomains are always recognized
+const DefaultHost = "sendsafely.com"
+
+// unwrap returns the link google wraps around urls in emails, other urls are returned as is
+func unwrap(inputURL string) (string, error) {
 	//escape url since google in email links will add things
-	if strings.HasPrefix(inputURL, "https://www.google.com/url") {
-		//pasting into the terminal will escape all the query parameters on mac
-		// so we are going to remove them
-		unescaped := strings.ReplaceAll(inputURL, "\\", "")
-		googleURL, err := url.Parse(unescaped)
-		if err != nil {
-			return Parts{}, URLParseErr{
-				BaseErr: err,
-				URL:     unescaped,
-			}
+	if !strings.HasPrefix(inputURL, "https://www.google.com/url") {
+		return inputURL, nil
+	}
+	//pasting into the terminal will escape all the query parameters on mac
+	// so we are going to remove them
+	unescaped := strings.ReplaceAll(inputURL, "\\", "")
+	googleURL, err := url.Parse(unescaped)
+	if err != nil {
+		return "", URLParseErr{
+			BaseErr: err,
+			URL:     unescaped,
 		}
-		googleQuery := googleURL.Query()
-		if !googleQuery.Has("q") {
-			return Parts{}, QIsMissingErr{
-				InputURL: unescaped,
-			}
+	}
+	googleQuery := googleURL.Query()
+	if !googleQuery.Has("q") {
+		return "", QIsMissingErr{
+			InputURL: unescaped,
 		}
-		inputURL, err = url.PathUnescape(googleQuery.Get("q"))
-		if err != nil {
-			return Parts{}, URLParseErr{
-				BaseErr: err,
-				URL:     unescaped,
-			}
+	}
+	inputURL, err = url.PathUnescape(googleQuery.Get("q"))
+	if err != nil {
+		return "", URLParseErr{
+			BaseErr: err,
+			URL:     unescaped,
 		}
+	}
+	return inputURL, nil
+}
+
+// IsSendSafely is true for https links to sendsafely.com, hosts whose name starts with sendsafely such as
+// sendsafely.customer.com, and the enterprise hosts given, ie files.customer.com
+func IsSendSafely(inputURL string, hosts []string) bool {
+	unwrapped, err := unwrap(inputURL)
+	if err != nil {
+		return false
+	}
+	u, err := url.Parse(unwrapped)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == DefaultHost || strings.HasSuffix(host, "."+DefaultHost) {
+		return true
+	}
+	// what was followed before enterprise hosts could be configured, their api is only used when configured
+	if strings.HasPrefix(host, "sendsafely") {
+		return true
+	}
+	return isConfigured(host, hosts)
+}
 
+// ParseLink splits up a SendSafely package download URL into it's important parts
+// This allows us to download the package
+func ParseLink(inputURL string) (Parts, error) {
+	inputURL, err := unwrap(inputURL)
+	if err != nil {
+		return Parts{}, err
 	}
 
 	// attempt to parse this as a valid url, will fail if it is malformed
@@ -119,8 +182,28 @@ func ParseLink(inputURL string) (Parts, error) {
 	if pkgCode == "" {
 		pkgCode = query.Get("packagecode")
 	}
-	return Parts{
+	parts := Parts{
 		PackageCode: pkgCode,
 		KeyCode:     keyCodeRaw[8:], //throwing away keyCode= and only keeping the rest of the string
-	}, nil
+	}
+	if u.Scheme == "https" {
+		parts.host = u.Host
+	}
+	return parts, nil
+}
+
+// Redact drops the fragment from a link, the keyCode in it is enough to decrypt the package so it must not be
+// printed or logged. Google wrapped links are unwrapped first since they carry the fragment escaped in q=
+func Redact(inputURL string) string {
+	if unwrapped, err := unwrap(inputURL); err == nil {
+		inputURL = unwrapped
+	}
+	u, err := url.Parse(inputURL)
+	if err != nil {
+		redacted, _, _ := strings.Cut(inputURL, "#")
+		return redacted
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
 }
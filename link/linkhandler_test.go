@@ -163,3 +163,59 @@ func TestInvalidURL(t *testing.T) {
 		t.Errorf("expected '%v' but got '%v'", expectedError, err)
 	}
 }
+
+func TestLinkHandlerTrustedAPIURL(t *testing.T) {
+	hosts := []string{"files.customer.com"}
+	for url, expected := range map[string]string{
+		"https://app.sendsafely.com/receive/?thread=MYTHREAD&packageCode=MYPKGCODE#keyCode=MYKEYCODE":                                 "https://app.sendsafely.com/api/v2.0",
+		"https://files.customer.com/receive/?thread=MYTHREAD&packageCode=MYPKGCODE#keyCode=MYKEYCODE":                                 "https://files.customer.com/api/v2.0",
+		"https://www.google.com/url?q=https://files.customer.com/receive/?packageCode%3DMYPKGCODE%23keyCode%3DMYKEYCODE&source=gmail": "https://files.customer.com/api/v2.0",
+		// customers write the links, hosts that are not trusted never see the api key
+		"https://sendsafely.attacker.net/receive/?thread=MYTHREAD&packageCode=MYPKGCODE#keyCode=MYKEYCODE": "",
+		"https://app.sendsafely.com.attacker.net/receive/?packageCode=MYPKGCODE#keyCode=MYKEYCODE":         "",
+		"http://files.customer.com/receive/?thread=MYTHREAD&packageCode=MYPKGCODE#keyCode=MYKEYCODE":       "",
+		"http://127.0.0.1:8080/receive/?thread=MYTHREAD&packageCode=MYPKGCODE#keyCode=MYKEYCODE":           "",
+		"https://files.customer.com:8443/receive/?thread=MYTHREAD&packageCode=MYPKGCODE#keyCode=MYKEYCODE": "https://files.customer.com:8443/api/v2.0",
+	} {
+		linkParts, err := ParseLink(url)
+		if err != nil {
+			t.Fatalf("unexected error '%v'", err)
+		}
+		if apiURL := linkParts.TrustedAPIURL(hosts); apiURL != expected {
+			t.Errorf("expected api url '%v' for '%v' but got '%v'", expected, url, apiURL)
+		}
+	}
+}
+
+func TestIsSendSafely(t *testing.T) {
+	hosts := []string{"files.customer.com"}
+	for url, expected := range map[string]bool{
+		"https://app.sendsafely.com/receive/?packageCode=A#keyCode=B":      true,
+		"https://sendsafely.tester.com/receive/?packageCode=A#keyCode=B":   true,
+		"https://FILES.customer.com/receive/?packageCode=A#keyCode=B":      true,
+		"https://files.other.com/receive/?packageCode=A#keyCode=B":         false,
+		"https://evil.com/sendsafely.com/receive/?packageCode=A#keyCode=B": false,
+		"ftp://app.sendsafely.com/receive/":                                false,
+		"https://www.google.com/url?q=https://files.customer.com/receive/": true,
+		"mailto:support@sendsafely.com":                                    false,
+		"http://files.customer.com/receive/?packageCode=A#keyCode=B":       false,
+		"http://app.sendsafely.com/receive/?packageCode=A#keyCode=B":       false,
+	} {
+		if IsSendSafely(url, hosts) != expected {
+			t.Errorf("expected %v for '%v'", expected, url)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for url, expected := range map[string]string{
+		"https://app.sendsafely.com/receive/?thread=MYTHREAD&packageCode=MYPKGCODE#keyCode=MYKEYCODE":                                 "https://app.sendsafely.com/receive/?thread=MYTHREAD&packageCode=MYPKGCODE",
+		"https://www.google.com/url?q=https://files.customer.com/receive/?packageCode%3DMYPKGCODE%23keyCode%3DMYKEYCODE&source=gmail": "https://files.customer.com/receive/?packageCode=MYPKGCODE",
+		"https://app.sendsafely.com/receive/?packageCode=%zz#keyCode=MYKEYCODE":                                                       "https://app.sendsafely.com/receive/?packageCode=%zz",
+		"https://app.sendsafely.com/receive/?packageCode=MYPKGCODE":                                                                   "https://app.sendsafely.com/receive/?packageCode=MYPKGCODE",
+	} {
+		if redacted := Redact(url); redacted != expected {
+			t.Errorf("expected '%v' for '%v' but got '%v'", expected, url, redacted)
+		}
+	}
+}
@@ -27,6 +27,13 @@ var totalSkippedLock sync.Mutex
 var totalBytes int64
 var totalBytesLock sync.Mutex
 var maxFileSize int64
+var totalDeduplicated int
+var totalDeduplicatedBytes int64
+var totalDeduplicatedLock sync.Mutex
+var totalExtracted int
+var totalExtractedFiles int
+var totalExtractFailed int
+var totalExtractedLock sync.Mutex
 
 func AddFile() {
 	totalFilesLock.Lock()
@@ -84,3 +91,55 @@ func GetMaxFileSizeBytes() int64 {
 	defer totalBytesLock.Unlock()
 	return maxFileSize
 }
+
+// AddDeduplicated counts a file replaced with a link to an identical one and the bytes that saved
+func AddDeduplicated(i int64) {
+	totalDeduplicatedLock.Lock()
+	totalDeduplicated++
+	totalDeduplicatedBytes += i
+	totalDeduplicatedLock.Unlock()
+}
+
+func GetTotalDeduplicated() int {
+	totalDeduplicatedLock.Lock()
+	defer totalDeduplicatedLock.Unlock()
+	return totalDeduplicated
+}
+
+func GetTotalDeduplicatedBytes() int64 {
+	totalDeduplicatedLock.Lock()
+	defer totalDeduplicatedLock.Unlock()
+	return totalDeduplicatedBytes
+}
+
+// AddExtracted counts the archives and files unpacked from one downloaded archive, nested archives included
+func AddExtracted(archives, files int) {
+	totalExtractedLock.Lock()
+	totalExtracted += archives
+	totalExtractedFiles += files
+	totalExtractedLock.Unlock()
+}
+
+func GetTotalExtracted() int {
+	totalExtractedLock.Lock()
+	defer totalExtractedLock.Unlock()
+	return totalExtracted
+}
+
+func GetTotalExtractedFiles() int {
+	totalExtractedLock.Lock()
+	defer totalExtractedLock.Unlock()
+	return totalExtractedFiles
+}
+
+func AddExtractFailed() {
+	totalExtractedLock.Lock()
+	totalExtractFailed++
+	totalExtractedLock.Unlock()
+}
+
+func GetTotalExtractFailed() int {
+	totalExtractedLock.Lock()
+	defer totalExtractedLock.Unlock()
+	return totalExtractFailed
+}
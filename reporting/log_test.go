@@ -30,6 +30,11 @@ func TestNonThreaded(t *testing.T) {
 		totalBytes = 0
 		totalSkipped = 0
 		maxFileSize = 0
+		totalDeduplicated = 0
+		totalDeduplicatedBytes = 0
+		totalExtracted = 0
+		totalExtractedFiles = 0
+		totalExtractFailed = 0
 	}()
 	AddFile()
 	assert.Equal(t, 1, GetTotalFiles())
@@ -41,6 +46,15 @@ func TestNonThreaded(t *testing.T) {
 	AddBytes(101)
 	assert.Equal(t, int64(200), GetTotalBytes())
 	assert.Equal(t, int64(101), GetMaxFileSizeBytes())
+	AddDeduplicated(50)
+	AddDeduplicated(25)
+	assert.Equal(t, 2, GetTotalDeduplicated())
+	assert.Equal(t, int64(75), GetTotalDeduplicatedBytes())
+	AddExtracted(2, 10)
+	AddExtractFailed()
+	assert.Equal(t, 2, GetTotalExtracted())
+	assert.Equal(t, 10, GetTotalExtractedFiles())
+	assert.Equal(t, 1, GetTotalExtractFailed())
 }
 
 func TestThreadSafeCounts(t *testing.T) {
@@ -50,6 +64,11 @@ func TestThreadSafeCounts(t *testing.T) {
 		totalBytes = 0
 		totalSkipped = 0
 		maxFileSize = 0
+		totalDeduplicated = 0
+		totalDeduplicatedBytes = 0
+		totalExtracted = 0
+		totalExtractedFiles = 0
+		totalExtractFailed = 0
 	}()
 	total := 10000
 	var wg sync.WaitGroup
@@ -81,10 +100,19 @@ func TestThreadSafeCounts(t *testing.T) {
 			wg.Done()
 		}()
 	}
+	for i := 0; i < total; i++ {
+		wg.Add(1)
+		go func() {
+			AddDeduplicated(10)
+			wg.Done()
+		}()
+	}
 	wg.Wait()
 	assert.Equal(t, total, GetTotalFiles())
 	assert.Equal(t, total, GetTotalSkipped())
 	assert.Equal(t, total, GetTotalFailed())
 	assert.Equal(t, int64(10*total), GetTotalBytes())
 	assert.Equal(t, int64(10), GetMaxFileSizeBytes())
+	assert.Equal(t, total, GetTotalDeduplicated())
+	assert.Equal(t, int64(10*total), GetTotalDeduplicatedBytes())
 }
@@ -0,0 +1,253 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// retry package provides the retry policy shared by all network calls, it handles exponential backoff with jitter,
+// honors Retry-After and sorts errors into ones worth retrying and ones that will never succeed
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Kind is the classification of an error
+type Kind int
+
+const (
+	// Permanent errors will fail the same way no matter how many times they are tried (401, 404, decrypt failures)
+	Permanent Kind = iota
+	// Retryable errors are usually transient (5xx, connection resets, timeouts)
+	Retryable
+)
+
+func (k Kind) String() string {
+	if k == Retryable {
+		return "retryable"
+	}
+	return "permanent"
+}
+
+// Policy controls how many times an operation is attempted and how long to wait between attempts
+type Policy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// MaxRetryAfter is the longest we wait when a server asks us to with Retry-After, an operation told to wait longer
+// gives up instead of sleeping for hours on a bad or hostile header
+const MaxRetryAfter = 5 * time.Minute
+
+// DefaultPolicy is used when no policy is configured
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+	}
+}
+
+// HTTPStatusErr is returned when a server responds with a status code we do not expect. BodySnippet holds the start
+// of the response body since that is usually where the server explains itself (an expired presigned url for example)
+type HTTPStatusErr struct {
+	Code        int
+	URL         string
+	RetryAfter  time.Duration
+	BodySnippet string
+}
+
+func (e HTTPStatusErr) Error() string {
+	if e.BodySnippet != "" {
+		return fmt.Sprintf("url '%v' returned unexpected http status %v with body '%v'", e.URL, e.Code, e.BodySnippet)
+	}
+	return fmt.Sprintf("url '%v' returned unexpected http status %v", e.URL, e.Code)
+}
+
+// maxBodySnippet is how much of an error response body is kept in HTTPStatusErr
+const maxBodySnippet = 512
+
+// NewHTTPStatusErr builds an HTTPStatusErr from the response, reading the start of the body and the Retry-After header
+func NewHTTPStatusErr(resp *http.Response, url string) HTTPStatusErr {
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySnippet))
+	if err != nil {
+		slog.Debug("unable to read error response body", "url", url, "error_msg", err)
+	}
+	return HTTPStatusErr{
+		Code:        resp.StatusCode,
+		URL:         url,
+		RetryAfter:  ParseRetryAfter(resp.Header.Get("Retry-After")),
+		BodySnippet: strings.TrimSpace(string(b)),
+	}
+}
+
+// PermanentErr marks an error that should never be retried regardless of what it wraps
+type PermanentErr struct {
+	BaseErr error
+}
+
+func (p PermanentErr) Error() string {
+	return p.BaseErr.Error()
+}
+
+func (p PermanentErr) Unwrap() error {
+	return p.BaseErr
+}
+
+// RetryableErr marks an error that is worth trying again even though Classify would not recognize it
+type RetryableErr struct {
+	BaseErr error
+}
+
+func (r RetryableErr) Error() string {
+	return r.BaseErr.Error()
+}
+
+func (r RetryableErr) Unwrap() error {
+	return r.BaseErr
+}
+
+// RetryableStatus is true for the http status codes that are worth trying again
+func RetryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
+
+// ParseRetryAfter reads the Retry-After header which is either a number of seconds or an http date,
+// 0 is returned when the header is missing or unreadable
+func ParseRetryAfter(header string) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// Classify sorts an error into Retryable or Permanent, anything not recognized is Permanent
+func Classify(err error) Kind {
+	if err == nil {
+		return Permanent
+	}
+	// checked first since context.DeadlineExceeded also reports itself as a timeout
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return Permanent
+	}
+	var permanentErr PermanentErr
+	if errors.As(err, &permanentErr) {
+		return Permanent
+	}
+	var retryableErr RetryableErr
+	if errors.As(err, &retryableErr) {
+		return Retryable
+	}
+	var statusErr HTTPStatusErr
+	if errors.As(err, &statusErr) {
+		if RetryableStatus(statusErr.Code) {
+			return Retryable
+		}
+		return Permanent
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return Retryable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return Retryable
+	}
+	return Permanent
+}
+
+// Do runs fn until it succeeds, returns a Permanent error, runs out of attempts or the context is cancelled.
+// operation is only used for logging
+func Do(ctx context.Context, p Policy, operation string, fn func() error) error {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if Classify(err) == Permanent {
+			return err
+		}
+		if attempt == maxAttempts {
+			break
+		}
+		delay, ok := p.delay(attempt, err)
+		if !ok {
+			return fmt.Errorf("giving up since the server asked to retry after %v which is more than the %v we wait at most: %w", delay, MaxRetryAfter, err)
+		}
+		slog.Warn("retrying after error", "operation", operation, "attempt", attempt, "max_attempts", maxAttempts, "delay", delay.String(), "error_msg", err)
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return err
+}
+
+// delay is the exponential backoff for the attempt with jitter applied, unless the server told us how long to wait.
+// ok is false when the server asked for more than MaxRetryAfter
+func (p Policy) delay(attempt int, err error) (d time.Duration, ok bool) {
+	var statusErr HTTPStatusErr
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		return statusErr.RetryAfter, statusErr.RetryAfter <= MaxRetryAfter
+	}
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0, true
+	}
+	// keep half the backoff and randomize the rest so parallel downloads do not all retry at the same moment
+	half := backoff / 2
+	return half + rand.N(backoff-half+1), true
+}
@@ -0,0 +1,160 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// retry package provides the retry policy shared by all network calls, it handles exponential backoff with jitter,
+// honors Retry-After and sorts errors into ones worth retrying and ones that will never succeed
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fastPolicy() Policy {
+	return Policy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     2 * time.Millisecond,
+	}
+}
+
+func TestClassify(t *testing.T) {
+	assert.Equal(t, Retryable, Classify(HTTPStatusErr{Code: http.StatusServiceUnavailable}))
+	assert.Equal(t, Retryable, Classify(HTTPStatusErr{Code: http.StatusTooManyRequests}))
+	assert.Equal(t, Permanent, Classify(HTTPStatusErr{Code: http.StatusUnauthorized}))
+	assert.Equal(t, Permanent, Classify(HTTPStatusErr{Code: http.StatusForbidden}))
+	assert.Equal(t, Permanent, Classify(HTTPStatusErr{Code: http.StatusNotFound}))
+	assert.Equal(t, Retryable, Classify(fmt.Errorf("reading body: %w", syscall.ECONNRESET)))
+	assert.Equal(t, Retryable, Classify(fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF)))
+	assert.Equal(t, Permanent, Classify(PermanentErr{BaseErr: io.ErrUnexpectedEOF}))
+	assert.Equal(t, Permanent, Classify(errors.New("wrong password")))
+	assert.Equal(t, Retryable, Classify(fmt.Errorf("short body: %w", RetryableErr{BaseErr: errors.New("truncated")})))
+	assert.Equal(t, Permanent, Classify(fmt.Errorf("download stopped: %w", context.Canceled)))
+	assert.Equal(t, Permanent, Classify(fmt.Errorf("download stopped: %w", context.DeadlineExceeded)))
+}
+
+func TestDoRetriesUntilSuccess(t *testing.T) {
+	attempts := 0
+	err := Do(context.Background(), fastPolicy(), "test", func() error {
+		attempts++
+		if attempts < 3 {
+			return HTTPStatusErr{Code: http.StatusBadGateway}
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestDoStopsAtMaxAttempts(t *testing.T) {
+	attempts := 0
+	err := Do(context.Background(), fastPolicy(), "test", func() error {
+		attempts++
+		return HTTPStatusErr{Code: http.StatusInternalServerError}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestDoDoesNotRetryPermanentErrors(t *testing.T) {
+	attempts := 0
+	err := Do(context.Background(), fastPolicy(), "test", func() error {
+		attempts++
+		return HTTPStatusErr{Code: http.StatusNotFound}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestDelayHonorsRetryAfter(t *testing.T) {
+	p := Policy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Second}
+	d, ok := p.delay(1, HTTPStatusErr{Code: http.StatusTooManyRequests, RetryAfter: 7 * time.Second})
+	assert.True(t, ok)
+	assert.Equal(t, 7*time.Second, d)
+}
+
+func TestDoGivesUpWhenRetryAfterIsTooLong(t *testing.T) {
+	attempts := 0
+	err := Do(context.Background(), fastPolicy(), "test", func() error {
+		attempts++
+		return HTTPStatusErr{Code: http.StatusServiceUnavailable, RetryAfter: MaxRetryAfter + time.Second}
+	})
+	var statusErr HTTPStatusErr
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, 1, attempts)
+}
+
+func TestDelayIsCappedAndJittered(t *testing.T) {
+	p := Policy{MaxAttempts: 10, InitialBackoff: time.Second, MaxBackoff: 4 * time.Second}
+	for attempt := 1; attempt < 10; attempt++ {
+		d, _ := p.delay(attempt, errors.New("timeout"))
+		if d > 4*time.Second {
+			t.Errorf("attempt %v had a delay of %v which is over the max backoff", attempt, d)
+		}
+		if d < 500*time.Millisecond {
+			t.Errorf("attempt %v had a delay of %v which is under half the initial backoff", attempt, d)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 120*time.Second, ParseRetryAfter("120"))
+	assert.Equal(t, time.Duration(0), ParseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), ParseRetryAfter("not a date"))
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	d := ParseRetryAfter(future)
+	if d < 59*time.Minute || d > time.Hour {
+		t.Errorf("expected about an hour but was %v", d)
+	}
+}
+
+func TestDoStopsWhenContextIsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	p := Policy{MaxAttempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+	err := Do(ctx, p, "test", func() error {
+		attempts++
+		cancel()
+		return HTTPStatusErr{Code: http.StatusServiceUnavailable}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled but was %v", err)
+	}
+	assert.Equal(t, 1, attempts)
+}
+
+func TestNewHTTPStatusErrKeepsStartOfBody(t *testing.T) {
+	body := "<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>" + strings.Repeat("x", 1024)
+	resp := &http.Response{
+		StatusCode: http.StatusForbidden,
+		Header:     http.Header{"Retry-After": []string{"3"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+	err := NewHTTPStatusErr(resp, "http://example.com/part1")
+	assert.Equal(t, http.StatusForbidden, err.Code)
+	assert.Equal(t, 3*time.Second, err.RetryAfter)
+	assert.Equal(t, body[:maxBodySnippet], err.BodySnippet)
+	assert.Contains(t, err.Error(), "Request has expired")
+}
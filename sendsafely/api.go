@@ -19,6 +19,7 @@ package sendsafely
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -26,49 +27,84 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/rsvihladremio/ssdownloader/retry"
 	"golang.org/x/crypto/pbkdf2"
 )
 
+// URL is the api of app.sendsafely.com, enterprise hosts serve the same api under their own host
 const URL = "https://app.sendsafely.com/api/v2.0"
 
 type Client interface {
-	RetrievePackageByID(packageID string) (Package, error)
-	GetDownloadUrlsForFile(p Package, fileID, keyCode string, start, end int) ([]DownloadURL, error)
+	RetrievePackageByID(ctx context.Context, packageID string) (Package, error)
+	GetDownloadUrlsForFile(ctx context.Context, p Package, fileID, keyCode string, start, end int) ([]DownloadURL, error)
+	GetDirectory(ctx context.Context, p Package, directoryID string) (Directory, error)
+	GetPackageMessage(ctx context.Context, p Package, keyCode string) (string, error)
 }
 
 // Client uses the SendSafely REST Api to
 // enable automation of SendSafely in Go
 type DownloadClient struct {
+	// baseURL is where requests are sent and basePath is its path, which is what gets signed
+	baseURL     string
+	basePath    string
 	parser      *APIParser
 	client      *resty.Client
+	policy      retry.Policy
 	ssAPIKey    string
 	ssAPISecret string
 	verbose     bool
 }
 
-// NewClient is the preferred way to initialize SendSafelyClient
-func NewClient(ssAPIKey, ssAPISecret string, verbose bool) Client {
-	client := resty.New()
+// NewClient is the preferred way to initialize SendSafelyClient, apiURL is the api of the SendSafely host the links
+// point to, empty uses URL. httpClient should be the client built by the transport package
+func NewClient(apiURL, ssAPIKey, ssAPISecret string, httpClient *http.Client, policy retry.Policy, verbose bool) Client {
+	client := resty.NewWithClient(httpClient)
+	if apiURL == "" {
+		apiURL = URL
+	}
+	apiURL = strings.TrimSuffix(apiURL, "/")
+	basePath := "/api/v2.0"
+	if u, err := url.Parse(apiURL); err == nil && u.Path != "" {
+		basePath = u.Path
+	}
 
 	return &DownloadClient{
+		baseURL:     apiURL,
+		basePath:    basePath,
 		ssAPIKey:    ssAPIKey,
 		ssAPISecret: ssAPISecret,
 		client:      client,
 		parser:      &APIParser{},
+		policy:      policy,
 		verbose:     verbose,
 	}
 }
 
-func (s *DownloadClient) RetrievePackageByID(packageID string) (Package, error) {
-	now := time.Now()
+// RetrievePackageByID retrieves the package information, transient failures are retried according to the retry policy
+func (s *DownloadClient) RetrievePackageByID(ctx context.Context, packageID string) (Package, error) {
+	var p Package
+	err := retry.Do(ctx, s.policy, "retrieve package "+packageID, func() error {
+		return withClockRetry(func() error {
+			var err error
+			p, err = s.retrievePackageByID(ctx, packageID)
+			return err
+		})
+	})
+	return p, err
+}
+
+func (s *DownloadClient) retrievePackageByID(ctx context.Context, packageID string) (Package, error) {
+	now := getNow()
 	//2019-01-14T22:24:00+0000 as documented in https://sendsafely.zendesk.com/hc/en-us/articles/360027599232-SendSafely-REST-API
 	ts := now.Format("2006-01-02T15:04:05-0700")
 	// adding package and packageId to the base send safely URL. This is a quirk documented under URL_PATH in the sendsafely docs above
-	urlPath := strings.Join([]string{"/api", "v2.0", "package", packageID}, "/")
+	urlPath := strings.Join([]string{s.basePath, "package", packageID}, "/")
 	sig, err := s.generateRequestSignature(ts, urlPath, "")
 	if err != nil {
 		return Package{}, fmt.Errorf("unexpected error generating request signature '%v'", err)
@@ -79,17 +115,21 @@ func (s *DownloadClient) RetrievePackageByID(packageID string) (Package, error)
 	}
 
 	//this is actually usable by the rest api unlike the urlPath
-	requestPath := strings.Join([]string{URL, "package", packageID}, "/")
+	requestPath := strings.Join([]string{s.baseURL, "package", packageID}, "/")
 	// add the required sendsafely headers to the request is accepted and then submit the request
 
 	slog.Debug("retrieving package by id", "api_key", s.ssAPIKey, "request_ts_header", ts, "request_sig_header", sig, "url_path", urlPath, "request_path", requestPath)
 	r, err := s.client.R().
+		SetContext(ctx).
 		SetHeader("ss-api-key", s.ssAPIKey).
 		SetHeader("ss-request-timestamp", ts).
 		SetHeader("ss-request-signature", sig).
 		Get(requestPath)
 	if err != nil {
-		return Package{}, fmt.Errorf("unexpected error '%v' while retrieving request '%v' error code was '%v'", err, requestPath, r.StatusCode())
+		return Package{}, fmt.Errorf("unexpected error '%w' while retrieving request '%v' error code was '%v'", err, requestPath, r.StatusCode())
+	}
+	if err := s.statusErr(packageID, requestPath, r); err != nil {
+		return Package{}, err
 	}
 	rawResponseBody := r.Body()
 	if s.verbose {
@@ -169,16 +209,28 @@ func (s *DownloadClient) sign(data string) (string, error) {
 //	  "startSegment": 1,
 //	  "endSegment": 25
 //	}
-func (s *DownloadClient) GetDownloadUrlsForFile(p Package, fileID, keyCode string, start, end int) ([]DownloadURL, error) {
+func (s *DownloadClient) GetDownloadUrlsForFile(ctx context.Context, p Package, fileID, keyCode string, start, end int) ([]DownloadURL, error) {
+	var urls []DownloadURL
+	err := retry.Do(ctx, s.policy, fmt.Sprintf("get download urls for file %v parts %v-%v", fileID, start, end), func() error {
+		return withClockRetry(func() error {
+			var err error
+			urls, err = s.getDownloadUrlsForFile(ctx, p, fileID, keyCode, start, end)
+			return err
+		})
+	})
+	return urls, checksumErr(p, err)
+}
+
+func (s *DownloadClient) getDownloadUrlsForFile(ctx context.Context, p Package, fileID, keyCode string, start, end int) ([]DownloadURL, error) {
 	// validating client is set in the first place
 	if s.client == nil {
 		return []DownloadURL{}, errors.New("client was never initialized. Please use NewSendSafelyClient to initialize SendSafelyClient")
 	}
-	now := time.Now()
+	now := getNow()
 	//2019-01-14T22:24:00+0000 as documented in https://sendsafely.zendesk.com/hc/en-us/articles/360027599232-SendSafely-REST-API
 	ts := now.Format("2006-01-02T15:04:05-0700")
 	// adding package and packageId to the base send safely URL. This is a quirk documented under URL_PATH in the sendsafely docs above
-	urlPath := strings.Join([]string{"/api", "v2.0", "package", p.PackageID, "file", fileID, "download-urls/"}, "/")
+	urlPath := strings.Join(append([]string{s.basePath}, fileURLParts(p, fileID)...), "/")
 	//generate the check sum
 	checkSum := s.generateChecksum(keyCode, p.PackageCode)
 	body := fmt.Sprintf("{\"checksum\":\"%v\",\"startSegment\":%v,\"endSegment\":%v}", checkSum, start, end)
@@ -188,10 +240,11 @@ func (s *DownloadClient) GetDownloadUrlsForFile(p Package, fileID, keyCode strin
 		return []DownloadURL{}, fmt.Errorf("unexpected error generating request signature '%v'", err)
 	}
 	//this is actually usable by the rest api unlike the urlPath
-	requestPath := strings.Join([]string{URL, "package", p.PackageID, "file", fileID, "download-urls/"}, "/")
+	requestPath := strings.Join(append([]string{s.baseURL}, fileURLParts(p, fileID)...), "/")
 	// add the required sendsafely headers to the request is accepted and then submit the request
 
 	r, err := s.client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("ss-api-key", s.ssAPIKey).
 		SetHeader("ss-request-timestamp", ts).
@@ -199,7 +252,10 @@ func (s *DownloadClient) GetDownloadUrlsForFile(p Package, fileID, keyCode strin
 		SetBody(body).
 		Post(requestPath)
 	if err != nil {
-		return []DownloadURL{}, fmt.Errorf("unexpected error '%v' while retrieving request '%v'", err, requestPath)
+		return []DownloadURL{}, fmt.Errorf("unexpected error '%w' while retrieving request '%v'", err, requestPath)
+	}
+	if err := s.statusErr(p.PackageID, requestPath, r); err != nil {
+		return []DownloadURL{}, err
 	}
 	rawResponseBody := r.Body()
 	if s.verbose {
@@ -212,3 +268,148 @@ func (s *DownloadClient) GetDownloadUrlsForFile(p Package, fileID, keyCode strin
 	}
 	return s.parser.ParseDownloadUrls(string(rawResponseBody))
 }
+
+// fileURLParts is the path of the download urls of a file after the api, files found in a directory of the
+// package are requested through that directory
+func fileURLParts(p Package, fileID string) []string {
+	for _, f := range p.Files {
+		if f.FileID == fileID && f.DirectoryID != "" {
+			return []string{"package", p.PackageID, "directory", f.DirectoryID, "file", fileID, "download-urls/"}
+		}
+	}
+	return []string{"package", p.PackageID, "file", fileID, "download-urls/"}
+}
+
+// GetDirectory retrieves the files and sub directories of a directory of the package, transient failures are
+// retried according to the retry policy
+func (s *DownloadClient) GetDirectory(ctx context.Context, p Package, directoryID string) (Directory, error) {
+	var d Directory
+	err := retry.Do(ctx, s.policy, fmt.Sprintf("get directory %v of package %v", directoryID, p.PackageID), func() error {
+		return withClockRetry(func() error {
+			var err error
+			d, err = s.getDirectory(ctx, p, directoryID)
+			return err
+		})
+	})
+	return d, err
+}
+
+func (s *DownloadClient) getDirectory(ctx context.Context, p Package, directoryID string) (Directory, error) {
+	// validating client is set in the first place
+	if s.client == nil {
+		return Directory{}, errors.New("client was never initialized. Please use NewSendSafelyClient to initialize SendSafelyClient")
+	}
+	ts := getNow().Format("2006-01-02T15:04:05-0700")
+	urlPath := strings.Join([]string{s.basePath, "package", p.PackageID, "directory", directoryID + "/"}, "/")
+	sig, err := s.generateRequestSignature(ts, urlPath, "")
+	if err != nil {
+		return Directory{}, fmt.Errorf("unexpected error generating request signature '%v'", err)
+	}
+	requestPath := strings.Join([]string{s.baseURL, "package", p.PackageID, "directory", directoryID + "/"}, "/")
+	r, err := s.client.R().
+		SetContext(ctx).
+		SetHeader("ss-api-key", s.ssAPIKey).
+		SetHeader("ss-request-timestamp", ts).
+		SetHeader("ss-request-signature", sig).
+		Get(requestPath)
+	if err != nil {
+		return Directory{}, fmt.Errorf("unexpected error '%w' while retrieving request '%v'", err, requestPath)
+	}
+	if err := s.statusErr(p.PackageID, requestPath, r); err != nil {
+		return Directory{}, err
+	}
+	if s.verbose {
+		slog.Debug("package directory", "package_id", p.PackageID, "directory_id", directoryID, "http_response_body", string(r.Body()))
+	}
+	return s.parser.ParseDirectory(p.PackageID, string(r.Body()))
+}
+
+// GetPackageMessage retrieves the encrypted secure message of the package, see DecryptMessage. keyCode is used for
+// the checksum the same as for the download urls. Transient failures are retried according to the retry policy
+func (s *DownloadClient) GetPackageMessage(ctx context.Context, p Package, keyCode string) (string, error) {
+	var message string
+	err := retry.Do(ctx, s.policy, "get message of package "+p.PackageID, func() error {
+		return withClockRetry(func() error {
+			var err error
+			message, err = s.getPackageMessage(ctx, p, keyCode)
+			return err
+		})
+	})
+	return message, checksumErr(p, err)
+}
+
+func (s *DownloadClient) getPackageMessage(ctx context.Context, p Package, keyCode string) (string, error) {
+	// validating client is set in the first place
+	if s.client == nil {
+		return "", errors.New("client was never initialized. Please use NewSendSafelyClient to initialize SendSafelyClient")
+	}
+	ts := getNow().Format("2006-01-02T15:04:05-0700")
+	checkSum := s.generateChecksum(keyCode, p.PackageCode)
+	urlPath := strings.Join([]string{s.basePath, "package", p.PackageID, "message", checkSum}, "/")
+	sig, err := s.generateRequestSignature(ts, urlPath, "")
+	if err != nil {
+		return "", fmt.Errorf("unexpected error generating request signature '%v'", err)
+	}
+	requestPath := strings.Join([]string{s.baseURL, "package", p.PackageID, "message", checkSum}, "/")
+	r, err := s.client.R().
+		SetContext(ctx).
+		SetHeader("ss-api-key", s.ssAPIKey).
+		SetHeader("ss-request-timestamp", ts).
+		SetHeader("ss-request-signature", sig).
+		Get(requestPath)
+	if err != nil {
+		return "", fmt.Errorf("unexpected error '%w' while retrieving request '%v'", err, requestPath)
+	}
+	if err := s.statusErr(p.PackageID, requestPath, r); err != nil {
+		return "", err
+	}
+	return s.parser.ParseMessage(p.PackageID, string(r.Body()))
+}
+
+// withClockRetry runs fn once more when SendSafely rejected the request timestamp, statusErr has learned the server
+// time from the rejection by then so the second request is signed with a timestamp the server accepts
+func withClockRetry(fn func() error) error {
+	err := fn()
+	var clockSkewErr ClockSkewErr
+	if errors.As(err, &clockSkewErr) {
+		slog.Warn("sendsafely rejected the request timestamp, trying again with the server time", "package_id", clockSkewErr.PackageID, "skew", clockSkewErr.Skew.Round(time.Second).String())
+		return fn()
+	}
+	return err
+}
+
+// statusErr turns a failed reply into one of the typed SendSafely errors, server errors are returned as
+// retry.HTTPStatusErr so they are retried. nil is returned when the reply looks successful and can be parsed,
+// the server time is learned from the Date header of every reply
+func (s *DownloadClient) statusErr(packageID, requestPath string, r *resty.Response) error {
+	skew := learnServerTime(r.Header().Get("Date"))
+	retryAfter := retry.ParseRetryAfter(r.Header().Get("Retry-After"))
+	if r.StatusCode() == http.StatusTooManyRequests {
+		return RateLimitedErr{PackageID: packageID, Message: r.Status(), URL: requestPath, RetryAfter: retryAfter}
+	}
+	if retry.RetryableStatus(r.StatusCode()) {
+		return retry.HTTPStatusErr{
+			Code:       r.StatusCode(),
+			URL:        requestPath,
+			RetryAfter: retryAfter,
+		}
+	}
+	err := s.parser.ParseResponseErr(packageID, r.StatusCode(), string(r.Body()))
+	var authFailedErr AuthFailedErr
+	if errors.As(err, &authFailedErr) && skew.Abs() >= minClockSkew {
+		// a timestamp outside what the server accepts fails the signature like a wrong secret does
+		return ClockSkewErr{PackageID: packageID, Skew: skew, Message: authFailedErr.Message}
+	}
+	var clockSkewErr ClockSkewErr
+	if errors.As(err, &clockSkewErr) {
+		clockSkewErr.Skew = skew
+		return clockSkewErr
+	}
+	var rateLimitedErr RateLimitedErr
+	if errors.As(err, &rateLimitedErr) {
+		rateLimitedErr.URL = requestPath
+		rateLimitedErr.RetryAfter = retryAfter
+		return rateLimitedErr
+	}
+	return err
+}
@@ -18,17 +18,30 @@
 package sendsafely
 
 import (
+	"context"
+	"errors"
+	"net/http"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/jarcoal/httpmock"
+	"github.com/rsvihladremio/ssdownloader/retry"
 )
 
+// testPolicy retries quickly so tests covering retries do not slow the suite down
+func testPolicy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	}
+}
+
 // This is the default happy path test, no errors
 func TestRetrievePackgeById(t *testing.T) {
 	// since we are using a mock http api we can use any api secret we feel like
-	ssClient := NewClient("myApiKey", "mySecret", false).(*DownloadClient)
+	ssClient := NewClient(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
 
 	// pass in the resty httpy client that the SendSafelyClient uses so that
 	// httpmock can replace it's transport parameter with a mock one
@@ -105,7 +118,7 @@ func TestRetrievePackgeById(t *testing.T) {
 	// we are expecting a GET request with the exact url specified above, if that exact match happens
 	// the json body setup in the responder will return instead of hitting the remote sendsafely server
 	httpmock.RegisterResponder("GET", url, responder)
-	pkg, err := ssClient.RetrievePackageByID(packageID)
+	pkg, err := ssClient.RetrievePackageByID(context.Background(), packageID)
 	if err != nil {
 		t.Fatalf("unexpected error retrieving id '%v'", err)
 	}
@@ -119,7 +132,7 @@ func TestRetrievePackgeById(t *testing.T) {
 // the missing package case, this mimics the actual production api as of 2022-07-12
 func TestRetrievePackageIsMissing(t *testing.T) {
 	// since we are using a mock http api we can use any api secret we feel like
-	ssClient := NewClient("myApiKey", "mySecret", false).(*DownloadClient)
+	ssClient := NewClient(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
 
 	// pass in the resty httpy client that the SendSafelyClient uses so that
 	// httpmock can replace it's transport parameter with a mock one
@@ -134,7 +147,7 @@ func TestRetrievePackageIsMissing(t *testing.T) {
 	responder := httpmock.NewStringResponder(200, resp) //yes they really log 200 when you get an error
 
 	httpmock.RegisterResponder("GET", url, responder)
-	_, err := ssClient.RetrievePackageByID(packageID)
+	_, err := ssClient.RetrievePackageByID(context.Background(), packageID)
 	if err == nil {
 		t.Fatal("expected error retrieving id")
 	}
@@ -147,7 +160,7 @@ func TestRetrievePackageIsMissing(t *testing.T) {
 // the bad auth case, this mimics the actual production api as of 2022-06-20
 func TestRetrievePackageHasBadAuth(t *testing.T) {
 	// since we are using a mock http api we can use any api secret we feel like
-	ssClient := NewClient("myApiKey", "mySecret", false).(*DownloadClient)
+	ssClient := NewClient(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
 
 	// pass in the resty httpy client that the SendSafelyClient uses so that
 	// httpmock can replace it's transport parameter with a mock one
@@ -162,7 +175,7 @@ func TestRetrievePackageHasBadAuth(t *testing.T) {
 	responder := httpmock.NewStringResponder(200, resp) //yes they really log 200 when you get an error
 
 	httpmock.RegisterResponder("GET", url, responder)
-	_, err := ssClient.RetrievePackageByID(packageID)
+	_, err := ssClient.RetrievePackageByID(context.Background(), packageID)
 	if err == nil {
 		t.Fatal("expected error retrieving id")
 	}
@@ -176,7 +189,7 @@ func TestRetrievePackageHasBadAuth(t *testing.T) {
 // the main purpose of this test is not to explain the function but to lock in time the behavior
 // so that if there is a breaking change we will catch it
 func TestGenerateSignature(t *testing.T) {
-	ssClient := NewClient("", "", false).(*DownloadClient)
+	ssClient := NewClient(URL, "", "", &http.Client{}, testPolicy(), false).(*DownloadClient)
 	ts, err := time.Parse(time.RFC3339, "2022-05-31T18:11:21Z")
 	if err != nil {
 		t.Fatalf("bad test setup since we were not able to use our datetime due to error '%v'", err)
@@ -205,7 +218,7 @@ func TestGenerateSignature(t *testing.T) {
 // the main purpose of this test is not to explain the function but to lock in time the behavior
 // so that if there is a breaking change we will catch it
 func TestGenerateCheckSum(t *testing.T) {
-	ssClient := NewClient("", "", false).(*DownloadClient)
+	ssClient := NewClient(URL, "", "", &http.Client{}, testPolicy(), false).(*DownloadClient)
 	checkSum := ssClient.generateChecksum("abc", "def")
 
 	// calculated this, not very meaningful to read, but this will lock the tested behavior and guard against
@@ -221,3 +234,262 @@ func TestGenerateCheckSum(t *testing.T) {
 		t.Error("signature changed and is not deterministic")
 	}
 }
+
+// a 503 from the api is transient and should be retried until the package is returned
+func TestRetrievePackageRetriesServerErrors(t *testing.T) {
+	ssClient := NewClient(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
+	httpmock.ActivateNonDefault(ssClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+	packageID := "ABDC-DDFAF"
+	resp := `{"packageId":"ABDC-DDFAF","packageCode":"code","serverSecret":"secret","files":[],"directories":[],"state":"PACKAGE_STATE_IN_PROGRESS","packageTimestamp":"Feb 1, 2019 2:07:28 PM","response":"SUCCESS"}`
+	url := strings.Join([]string{URL, "package", packageID}, "/")
+	httpmock.RegisterResponder("GET", url, httpmock.ResponderFromMultipleResponses(
+		[]*http.Response{
+			httpmock.NewStringResponse(503, "unavailable"),
+			httpmock.NewStringResponse(200, resp),
+		},
+	))
+	pkg, err := ssClient.RetrievePackageByID(context.Background(), packageID)
+	if err != nil {
+		t.Fatalf("unexpected error retrieving id '%v'", err)
+	}
+	if pkg.PackageID != packageID {
+		t.Errorf("expected packageId '%v' but was '%v'", packageID, pkg.PackageID)
+	}
+	if calls := httpmock.GetTotalCallCount(); calls != 2 {
+		t.Errorf("expected 2 calls but there were %v", calls)
+	}
+}
+
+// failed authentication will never succeed so it should only be tried once
+func TestRetrievePackageDoesNotRetryBadAuth(t *testing.T) {
+	ssClient := NewClient(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
+	httpmock.ActivateNonDefault(ssClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+	packageID := "ABDC-DDFAF"
+	url := strings.Join([]string{URL, "package", packageID}, "/")
+	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(401, `{"response":"AUTHENTICATION_FAILED","message":"Invalid API Key"}`))
+	if _, err := ssClient.RetrievePackageByID(context.Background(), packageID); err == nil {
+		t.Fatal("expected error retrieving id")
+	}
+	if calls := httpmock.GetTotalCallCount(); calls != 1 {
+		t.Errorf("expected 1 call but there were %v", calls)
+	}
+}
+
+// SendSafely explains failures in the response and message fields, usually with a 200
+func TestRetrievePackageTypedErrors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		status int
+		body   string
+		target any
+		reason string
+	}{
+		{name: "expired", status: 200, body: `{"response":"UNKNOWN_PACKAGE","message":"Package ID does not exist"}`, target: &PackageExpiredErr{}, reason: "package expired"},
+		{name: "deleted", status: 200, body: `{"response":"FAIL","message":"This package has been deleted"}`, target: &PackageDeletedErr{}, reason: "package deleted"},
+		{name: "bad auth status", status: 403, body: `<html>forbidden</html>`, target: &AuthFailedErr{}, reason: "authentication failed"},
+		{name: "rate limited", status: 200, body: `{"response":"TOO_MANY_REQUESTS","message":"Slow down"}`, target: &RateLimitedErr{}, reason: "rate limited"},
+		{name: "unknown", status: 200, body: `{"response":"PACKAGE_NEEDS_APPROVAL","message":"Waiting"}`, target: &APIErr{}, reason: "package needs approval"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ssClient := NewClient(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
+			httpmock.ActivateNonDefault(ssClient.client.GetClient())
+			defer httpmock.DeactivateAndReset()
+			packageID := "ABDC-DDFAF"
+			url := strings.Join([]string{URL, "package", packageID}, "/")
+			httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(tc.status, tc.body))
+			_, err := ssClient.RetrievePackageByID(context.Background(), packageID)
+			if !errors.As(err, tc.target) {
+				t.Fatalf("expected %T but was %v", tc.target, err)
+			}
+			if reason := FailureReason(err); reason != tc.reason {
+				t.Errorf("expected reason '%v' but was '%v'", tc.reason, reason)
+			}
+		})
+	}
+}
+
+// a 429 is retried and reported as rate limited once the attempts run out
+func TestRetrievePackageRateLimited(t *testing.T) {
+	ssClient := NewClient(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
+	httpmock.ActivateNonDefault(ssClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+	packageID := "ABDC-DDFAF"
+	url := strings.Join([]string{URL, "package", packageID}, "/")
+	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(429, "slow down"))
+	_, err := ssClient.RetrievePackageByID(context.Background(), packageID)
+	var rateLimitedErr RateLimitedErr
+	if !errors.As(err, &rateLimitedErr) {
+		t.Fatalf("expected RateLimitedErr but was %v", err)
+	}
+	if calls := httpmock.GetTotalCallCount(); calls != 3 {
+		t.Errorf("expected 3 calls but there were %v", calls)
+	}
+}
+
+func TestGetDownloadUrlsInvalidKeyCode(t *testing.T) {
+	ssClient := NewClient(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
+	httpmock.ActivateNonDefault(ssClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+	p := Package{PackageID: "ABDC-DDFAF", PackageCode: "code"}
+	url := strings.Join([]string{URL, "package", p.PackageID, "file", "fileID", "download-urls/"}, "/")
+	httpmock.RegisterResponder("POST", url, httpmock.NewStringResponder(200, `{"response":"FAIL","message":"Invalid checksum"}`))
+	_, err := ssClient.GetDownloadUrlsForFile(context.Background(), p, "fileID", "keyCode", 1, 1)
+	var keyCodeErr InvalidKeyCodeErr
+	if !errors.As(err, &keyCodeErr) {
+		t.Fatalf("expected InvalidKeyCodeErr but was %v", err)
+	}
+	if keyCodeErr.PackageID != p.PackageID {
+		t.Errorf("expected package id %v but was %v", p.PackageID, keyCodeErr.PackageID)
+	}
+	if calls := httpmock.GetTotalCallCount(); calls != 1 {
+		t.Errorf("expected 1 call but there were %v", calls)
+	}
+}
+
+// links to enterprise hosts use the api on that host
+func TestRetrievePackageFromEnterpriseHost(t *testing.T) {
+	ssClient := NewClient("https://files.customer.com/api/v2.0/", "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
+	httpmock.ActivateNonDefault(ssClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+	packageID := "ABDC-DDFAF"
+	resp := `{"packageId":"ABDC-DDFAF","packageCode":"code","serverSecret":"secret","files":[],"directories":[],"state":"PACKAGE_STATE_IN_PROGRESS","packageTimestamp":"Feb 1, 2019 2:07:28 PM","response":"SUCCESS"}`
+	var signature, ts string
+	httpmock.RegisterResponder("GET", "https://files.customer.com/api/v2.0/package/"+packageID, func(req *http.Request) (*http.Response, error) {
+		signature = req.Header.Get("ss-request-signature")
+		ts = req.Header.Get("ss-request-timestamp")
+		return httpmock.NewStringResponse(200, resp), nil
+	})
+	if _, err := ssClient.RetrievePackageByID(context.Background(), packageID); err != nil {
+		t.Fatalf("unexpected error retrieving id '%v'", err)
+	}
+	expected, err := ssClient.generateRequestSignature(ts, "/api/v2.0/package/"+packageID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature != expected {
+		t.Errorf("expected the path on the enterprise host to be signed, signature was '%v' but expected '%v'", signature, expected)
+	}
+}
+
+func TestGetDirectoryAndDownloadUrlsOfItsFiles(t *testing.T) {
+	ssClient := NewClient(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
+	httpmock.ActivateNonDefault(ssClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+	p := Package{PackageID: "ABDC-DDFAF", PackageCode: "code"}
+	resp := `{"directory":{"directoryId":"logsdir","directoryName":"logs","files":[{"fileId":"abcfile","fileName":"server.log","fileSize":"12","parts":1,"createdByEmail":"test@test.com","fileUploaded":"Jun 9, 2022 1:32:34 PM","fileUploadedStr":"Jun 9, 2022 1:32:34 PM","fileVersion":"1"}],"subDirectories":[]},"response":"SUCCESS"}`
+	var signature, ts string
+	httpmock.RegisterResponder("GET", URL+"/package/ABDC-DDFAF/directory/logsdir/", func(req *http.Request) (*http.Response, error) {
+		signature = req.Header.Get("ss-request-signature")
+		ts = req.Header.Get("ss-request-timestamp")
+		return httpmock.NewStringResponse(200, resp), nil
+	})
+	httpmock.RegisterResponder("POST", URL+"/package/ABDC-DDFAF/directory/logsdir/file/abcfile/download-urls/",
+		httpmock.NewStringResponder(200, `{"downloadUrls":[{"part":1,"url":"https://example.com/part1"}],"response":"SUCCESS"}`))
+	d, err := ssClient.GetDirectory(context.Background(), p, "logsdir")
+	if err != nil {
+		t.Fatalf("unexpected error getting directory '%v'", err)
+	}
+	expected, err := ssClient.generateRequestSignature(ts, "/api/v2.0/package/ABDC-DDFAF/directory/logsdir/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature != expected {
+		t.Errorf("signature was '%v' but expected '%v'", signature, expected)
+	}
+	p.Files = d.Files
+	urls, err := ssClient.GetDownloadUrlsForFile(context.Background(), p, "abcfile", "keyCode", 1, 1)
+	if err != nil {
+		t.Fatalf("expected the download urls to be requested through the directory but was '%v'", err)
+	}
+	if len(urls) != 1 || urls[0].URL != "https://example.com/part1" {
+		t.Errorf("unexpected urls %#v", urls)
+	}
+}
+
+func TestGetPackageMessage(t *testing.T) {
+	ssClient := NewClient(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
+	httpmock.ActivateNonDefault(ssClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+	p := Package{PackageID: "ABDC-DDFAF", PackageCode: "code"}
+	checksum := ssClient.generateChecksum("keyCode", p.PackageCode)
+	httpmock.RegisterResponder("GET", URL+"/package/ABDC-DDFAF/message/"+checksum,
+		httpmock.NewStringResponder(200, `{"message":"-----BEGIN PGP MESSAGE-----","response":"SUCCESS"}`))
+	message, err := ssClient.GetPackageMessage(context.Background(), p, "keyCode")
+	if err != nil {
+		t.Fatalf("unexpected error getting message '%v'", err)
+	}
+	if message != "-----BEGIN PGP MESSAGE-----" {
+		t.Errorf("unexpected message '%v'", message)
+	}
+}
+
+// a clock an hour behind fails the signature, the Date header of the rejection gives away the server time
+func TestClockSkewIsRetriedWithServerTime(t *testing.T) {
+	defer resetServerTime()
+	resetServerTime()
+	ssClient := NewClient(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
+	httpmock.ActivateNonDefault(ssClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+	serverTime := time.Now().Add(time.Hour)
+	var timestamps []time.Time
+	httpmock.RegisterResponder("GET", URL+"/package/ABDC-DDFAF", func(r *http.Request) (*http.Response, error) {
+		ts, err := time.Parse("2006-01-02T15:04:05-0700", r.Header.Get("ss-request-timestamp"))
+		if err != nil {
+			return nil, err
+		}
+		timestamps = append(timestamps, ts)
+		resp := httpmock.NewStringResponse(200, `{"response":"AUTHENTICATION_FAILED","message":"Invalid request signature"}`)
+		if ts.Sub(serverTime).Abs() < time.Minute {
+			resp = httpmock.NewStringResponse(200, `{"packageId":"ABDC-DDFAF","packageCode":"code","serverSecret":"secret","files":[],"directories":[],"state":"PACKAGE_STATE_IN_PROGRESS","packageTimestamp":"Feb 1, 2019 2:07:28 PM","response":"SUCCESS"}`)
+		}
+		resp.Header.Set("Date", serverTime.Format(http.TimeFormat))
+		return resp, nil
+	})
+	p, err := ssClient.RetrievePackageByID(context.Background(), "ABDC-DDFAF")
+	if err != nil {
+		t.Fatalf("expected the request to be signed again with the server time but was %v", err)
+	}
+	if p.PackageID != "ABDC-DDFAF" || len(timestamps) != 2 {
+		t.Errorf("expected the package after 2 requests but had %v after %v", p.PackageID, len(timestamps))
+	}
+}
+
+func TestClockSkewIsOnlyRetriedOnce(t *testing.T) {
+	defer resetServerTime()
+	resetServerTime()
+	ssClient := NewClient(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
+	httpmock.ActivateNonDefault(ssClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", URL+"/package/ABDC-DDFAF", httpmock.NewStringResponder(200, `{"response":"INVALID_TIMESTAMP","message":"The request timestamp is outside the allowed window"}`))
+	_, err := ssClient.RetrievePackageByID(context.Background(), "ABDC-DDFAF")
+	var clockSkewErr ClockSkewErr
+	if !errors.As(err, &clockSkewErr) {
+		t.Errorf("expected ClockSkewErr but was %v", err)
+	}
+	if calls := httpmock.GetTotalCallCount(); calls != 2 {
+		t.Errorf("expected 2 calls but there were %v", calls)
+	}
+}
+
+func TestGetDownloadUrlsPasswordRejected(t *testing.T) {
+	ssClient := NewClient(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
+	httpmock.ActivateNonDefault(ssClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+	p := Package{PackageID: "ABDC-DDFAF", PackageCode: "code", PasswordRequired: true}
+	url := strings.Join([]string{URL, "package", p.PackageID, "file", "fileID", "download-urls/"}, "/")
+	httpmock.RegisterResponder("POST", url, httpmock.NewStringResponder(200, `{"response":"FAIL","message":"Invalid checksum"}`))
+	_, err := ssClient.GetDownloadUrlsForFile(context.Background(), p, "fileID", PackageSecret(p, "keyCode", "wrong password"), 1, 1)
+	var passwordErr PasswordRejectedErr
+	if !errors.As(err, &passwordErr) {
+		t.Fatalf("expected PasswordRejectedErr but was %v", err)
+	}
+	if reason := FailureReason(err); reason != "package password was rejected" {
+		t.Errorf("expected the reason to point at the password but was '%v'", reason)
+	}
+	if calls := httpmock.GetTotalCallCount(); calls != 1 {
+		t.Errorf("expected 1 call but there were %v", calls)
+	}
+}
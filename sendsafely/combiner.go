@@ -18,16 +18,19 @@
 package sendsafely
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
-	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/rsvihladremio/ssdownloader/storage"
 )
 
 func RemoveAnySuffix(fileName string) string {
@@ -63,7 +66,18 @@ func (s SortingErr) Error() string {
 	return fmt.Sprintf("unable to sort due to the following error '%v'", s.BaseErr)
 }
 
-func CombineFiles(fileNames []string, verbose bool) (totalBytesWritten int64, newFileName string, err error) {
+// CombinedSizeErr is returned when the combined file is not the size of all of its parts added up
+type CombinedSizeErr struct {
+	FileName string
+	Expected int64
+	Written  int64
+}
+
+func (c CombinedSizeErr) Error() string {
+	return fmt.Sprintf("combined file '%v' should be %v bytes from its parts but was %v bytes", c.FileName, c.Expected, c.Written)
+}
+
+func CombineFiles(ctx context.Context, store storage.Storage, fileNames []string, verbose bool) (totalBytesWritten int64, newFileName string, err error) {
 	if len(fileNames) == 0 {
 		return 0, "", fmt.Errorf("tried to combine 0 files")
 	}
@@ -110,54 +124,80 @@ func CombineFiles(fileNames []string, verbose bool) (totalBytesWritten int64, ne
 	newFileName = RemoveAnySuffix(firstFile)
 	if len(fileNames) == 1 {
 		//optimize and skip the copy step
-		if err := os.Rename(firstFile, newFileName); err != nil {
+		if err := store.Rename(ctx, firstFile, newFileName); err != nil {
 			return -1, "", fmt.Errorf("unable to rename file '%v' to '%v' due to error '%v'", firstFile, newFileName, err)
 		}
-		fileInfo, err := os.Stat(newFileName)
+		fileInfo, err := store.Stat(ctx, newFileName)
 		if err != nil {
 			return -1, "", fmt.Errorf("unable to get file information for %v due to error %v", firstFile, err)
 		}
-		return fileInfo.Size(), newFileName, nil
+		return fileInfo.Size, newFileName, nil
 	}
-	newFileHandle, err := os.Create(filepath.Clean(newFileName))
+	// the parts are combined under a temporary name and only renamed once every part is in and the size is
+	// verified, the parts are removed last so a crash at any point leaves either the parts or the complete file
+	tmpName := filepath.Clean(newFileName) + InProgressSuffix
+	newFileHandle, err := store.Create(ctx, tmpName)
 	if err != nil {
-		return -1, "", fmt.Errorf("cannot create file '%v' due to error '%v'", newFileName, err)
+		return -1, "", fmt.Errorf("cannot create file '%v' due to error '%v'", tmpName, err)
 	}
-	// cleanup in case of errors so we don't leak descriptors
+	closed := false
+	// cleanup in case of errors so we don't leak descriptors or leave the incomplete file behind
 	defer func() {
-		if err := newFileHandle.Close(); err != nil {
-			slog.Debug("unable to close file, since this is a cleanup operation it is usually safe to ignore", "file_name", newFileName, "error_msg", err)
+		if err == nil {
+			return
+		}
+		if !closed {
+			if err := newFileHandle.Abort(); err != nil {
+				slog.Debug("unable to close file, since this is a cleanup operation it is usually safe to ignore", "file_name", tmpName, "error_msg", err)
+			}
+		}
+		if err := store.Remove(context.WithoutCancel(ctx), tmpName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("unable to remove incomplete file so you will need to manually clean this file up", "file_name", tmpName, "error_msg", err)
 		}
 	}()
+	var expectedBytes int64
+	buf := make([]byte, 8192*1024)
 	for _, f := range fileNames {
-		fileHandle, err := os.Open(filepath.Clean(f))
+		fi, err := store.Stat(ctx, filepath.Clean(f))
+		if err != nil {
+			return -1, "", fmt.Errorf("unable to get file information for %v due to error %v", f, err)
+		}
+		expectedBytes += fi.Size
+		fileHandle, err := store.Open(ctx, filepath.Clean(f))
 		if err != nil {
 			return -1, "", fmt.Errorf("unable to read file '%v' due to error '%v'", f, err)
 		}
-		// cleanup in case of errors
-		defer func() {
+		bytesWritten, err := io.CopyBuffer(newFileHandle, fileHandle, buf)
+		if err != nil {
 			if err := fileHandle.Close(); err != nil {
 				slog.Debug("unable to close file handle, since this is a cleanup operation it is usually safe to ignore", "file_name", f, "error_msg", err)
 			}
-		}()
-		buf := make([]byte, 8192*1024)
-		bytesWritten, err := io.CopyBuffer(newFileHandle, fileHandle, buf)
-		if err != nil {
-			return -1, "", fmt.Errorf("unable to copy file '%v' to file '%v' due to error '%v'", f, newFileName, err)
+			return -1, "", fmt.Errorf("unable to copy file '%v' to file '%v' due to error '%v'", f, tmpName, err)
 		}
 		totalBytesWritten += bytesWritten
 		if err := fileHandle.Close(); err != nil {
 			return -1, "", fmt.Errorf("unable to close old file %v due to error %v", filepath.Clean(f), err)
 		}
-
-		err = os.Remove(f)
-		if err != nil {
-			slog.Warn("unable to remove old file after copying it's contents to the new file and it will have to be manually deleted", "file_name", f, "error_msg", err)
-		}
 	}
+	closed = true
 	if err := newFileHandle.Close(); err != nil {
-		return -1, "", fmt.Errorf("unable to close newfile %v due to error %v, not succesfully written this means", filepath.Clean(newFileName), err)
+		return -1, "", fmt.Errorf("unable to close newfile %v due to error %v, not succesfully written this means", tmpName, err)
+	}
+	fi, err := store.Stat(ctx, tmpName)
+	if err != nil {
+		return -1, "", fmt.Errorf("unable to get file information for %v due to error %v", tmpName, err)
+	}
+	if totalBytesWritten != expectedBytes || fi.Size != expectedBytes {
+		err = CombinedSizeErr{FileName: newFileName, Expected: expectedBytes, Written: fi.Size}
+		return -1, "", err
+	}
+	if err := store.Rename(ctx, tmpName, newFileName); err != nil {
+		return -1, "", fmt.Errorf("unable to rename file '%v' to '%v' due to error '%v'", tmpName, newFileName, err)
+	}
+	for _, f := range fileNames {
+		if err := store.Remove(ctx, f); err != nil {
+			slog.Warn("unable to remove old file after copying it's contents to the new file and it will have to be manually deleted", "file_name", f, "error_msg", err)
+		}
 	}
-
 	return totalBytesWritten, newFileName, nil
 }
@@ -18,6 +18,7 @@
 package sendsafely
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -25,6 +26,8 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/rsvihladremio/ssdownloader/storage"
 )
 
 func init() {
@@ -122,7 +125,7 @@ func TestCombiningMoreThanTheFirstPart(t *testing.T) {
 		files = append(files, filepath.Join(dirToGenerate, e.Name()))
 	}
 	slog.Info("files to combine", "file_list", strings.Join(files, ", "))
-	w, f, err := CombineFiles(files, false)
+	w, f, err := CombineFiles(context.Background(), storage.NewLocal(), files, false)
 	if err != nil {
 		t.Fatalf("unexpected error combining files %v", err)
 	}
@@ -153,7 +156,7 @@ func TestCombiningMoreThanTheFirstPart(t *testing.T) {
 }
 
 func TestNoOpCombiningNoFiles(t *testing.T) {
-	_, _, err := CombineFiles([]string{}, false)
+	_, _, err := CombineFiles(context.Background(), storage.NewLocal(), []string{}, false)
 	if err == nil {
 		t.Fatal("expected error combining files")
 	}
@@ -192,7 +195,7 @@ func TestNoOpCombining(t *testing.T) {
 	for _, e := range entries {
 		files = append(files, filepath.Join(dirToGenerate, e.Name()))
 	}
-	_, f, err := CombineFiles(files, false)
+	_, f, err := CombineFiles(context.Background(), storage.NewLocal(), files, false)
 	if err != nil {
 		t.Fatalf("unexpected error combining files %v", err)
 	}
@@ -230,7 +233,7 @@ func TestCombiningOneBadSuffix(t *testing.T) {
 		t.Fatalf("unable to create file %v due to error %v", newFile, err)
 	}
 
-	_, _, err = CombineFiles([]string{newFile}, false)
+	_, _, err = CombineFiles(context.Background(), storage.NewLocal(), []string{newFile}, false)
 	if err == nil {
 		t.Fatalf("expected error but did not have one")
 	}
@@ -261,7 +264,7 @@ func TestCombiningSeveralBadSuffixes(t *testing.T) {
 		t.Fatalf("unable to create file %v due to error %v", newFile2, err)
 	}
 
-	_, _, err = CombineFiles([]string{newFile, newFile2}, false)
+	_, _, err = CombineFiles(context.Background(), storage.NewLocal(), []string{newFile, newFile2}, false)
 	if err == nil {
 		t.Fatalf("expected error but did not have one")
 	}
@@ -288,7 +291,7 @@ func TestCombiningSeveralBadSuffixesReverseOrder(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unable to create file %v due to error %v", newFile2, err)
 	}
-	_, _, err = CombineFiles([]string{newFile, newFile2}, false)
+	_, _, err = CombineFiles(context.Background(), storage.NewLocal(), []string{newFile, newFile2}, false)
 	if err == nil {
 		t.Fatalf("expected error but did not have one")
 	}
@@ -297,3 +300,55 @@ func TestCombiningSeveralBadSuffixesReverseOrder(t *testing.T) {
 	}
 
 }
+
+func TestCombineFilesKeepsPartsUntilComplete(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 1; i < 4; i++ {
+		newFile := filepath.Join(dir, fmt.Sprintf("mylog.txt.%v", i))
+		files = append(files, newFile)
+		// the last part is missing like it would be after a crash
+		if i == 3 {
+			continue
+		}
+		if err := os.WriteFile(newFile, []byte(fmt.Sprintf("row %v\n", i)), 0600); err != nil {
+			t.Fatalf("unable to create file %v due to error %v", i, err)
+		}
+	}
+	if _, _, err := CombineFiles(context.Background(), storage.NewLocal(), files, false); err == nil {
+		t.Fatal("expected an error combining with a missing part")
+	}
+	for _, name := range []string{"mylog.txt", "mylog.txt" + InProgressSuffix} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected %v to not exist but got %v", name, err)
+		}
+	}
+	for _, f := range files[:2] {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("expected part %v to be kept but got %v", f, err)
+		}
+	}
+}
+
+func TestCombineFilesRemovesPartsAfterRename(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 1; i < 3; i++ {
+		newFile := filepath.Join(dir, fmt.Sprintf("mylog.txt.%v", i))
+		files = append(files, newFile)
+		if err := os.WriteFile(newFile, []byte(fmt.Sprintf("row %v\n", i)), 0600); err != nil {
+			t.Fatalf("unable to create file %v due to error %v", i, err)
+		}
+	}
+	_, f, err := CombineFiles(context.Background(), storage.NewLocal(), files, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(f) {
+		t.Errorf("expected only the combined file %v to be left but was %v", f, entries)
+	}
+}
@@ -18,21 +18,23 @@
 package sendsafely
 
 import (
-	"bytes"
+	"context"
 	"crypto"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"os"
+	"net/http"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
 	pgpErrors "github.com/ProtonMail/go-crypto/openpgp/errors"
 	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/rsvihladremio/ssdownloader/storage"
 )
 
 // DecryptPart decrypts one of the file parts using the gpp protocol with the following logic from the sendsafely docs
@@ -48,7 +50,86 @@ import (
 // * Passphrase:  Server Secret concatenated with a random 256-bit Client Secret
 // * S2k-count: 65535
 // * Mode: b (62)
-func DecryptPart(filePart, serverSecret, keyCode string) (string, error) {
+func DecryptPart(ctx context.Context, store storage.Storage, filePart, serverSecret, keyCode string) (string, error) {
+	cleanedFilePart := filepath.Clean(filePart)
+	encryptedIO, err := store.Open(ctx, cleanedFilePart)
+	if err != nil {
+		return "", fmt.Errorf("unable to read %v due to error %v", cleanedFilePart, err)
+	}
+	defer func() {
+		//verify we got to the close since we may have errored out trying to copy
+		err = encryptedIO.Close()
+		if err != nil {
+			slog.Debug("encrypted io handler for file failed to close, but this is safe to ignore on a cleanup operation", "file_name", cleanedFilePart, "error_msg", err)
+		}
+	}()
+
+	//remove the "encrypted" suffix
+	newFileName := strings.TrimSuffix(cleanedFilePart, ".encrypted")
+	slog.Debug("new name for unencrypted file", "file_name", newFileName, "old_file_name", cleanedFilePart)
+	// decrypted under a temporary name so a crash never leaves a truncated part that looks complete
+	tmpName := newFileName + InProgressSuffix
+	newFile, err := store.Create(ctx, tmpName)
+	if err != nil {
+		return "", fmt.Errorf("unable to create file '%v' due to error '%v'", tmpName, err)
+	}
+	if _, err := DecryptStream(encryptedIO, newFile, serverSecret, keyCode); err != nil {
+		if err := newFile.Abort(); err != nil {
+			slog.Debug("unable to close file, since this is a cleanup operation it is usually safe to ignore", "file_name", tmpName, "error_msg", err)
+		}
+		if err := store.Remove(ctx, tmpName); err != nil {
+			slog.Debug("unable to remove partially decrypted file", "file_name", tmpName, "error_msg", err)
+		}
+		return "", err
+	}
+	if err := newFile.Close(); err != nil {
+		return "", fmt.Errorf("unable to write file '%v' due to error '%v'", tmpName, err)
+	}
+	if err := store.Rename(ctx, tmpName, newFileName); err != nil {
+		return "", fmt.Errorf("unable to rename file '%v' to '%v' due to error '%v'", tmpName, newFileName, err)
+	}
+
+	//now safe to close the file
+	err = encryptedIO.Close()
+	if err != nil {
+		return "", fmt.Errorf("encrypted io handler for file '%v' failed to close due to '%v'", cleanedFilePart, err)
+	}
+	if err := store.Remove(ctx, cleanedFilePart); err != nil {
+		slog.Warn("unable to delete file so you will need to manually clean this file up", "file_name", filePart, "error_msg", err)
+	}
+	return newFileName, nil
+}
+
+// PackageSecret is what is used in place of the keycode for the download url checksum and the decryption passphrase,
+// the password of a package protected with one is appended to the keycode
+func PackageSecret(p Package, keyCode, password string) string {
+	if !p.PasswordRequired {
+		return keyCode
+	}
+	return keyCode + password
+}
+
+// DecryptMessage decrypts the secure message of a package with the same passphrase as the file parts, SendSafely
+// returns it ascii armored
+func DecryptMessage(encrypted, serverSecret, keyCode string) (string, error) {
+	var r io.Reader = strings.NewReader(encrypted)
+	if strings.HasPrefix(strings.TrimSpace(encrypted), "-----BEGIN") {
+		block, err := armor.Decode(strings.NewReader(strings.TrimSpace(encrypted)))
+		if err != nil {
+			return "", fmt.Errorf("unable to read armored message due to error '%v'", err)
+		}
+		r = block.Body
+	}
+	var message strings.Builder
+	if _, err := DecryptStream(r, &message, serverSecret, keyCode); err != nil {
+		return "", err
+	}
+	return message.String(), nil
+}
+
+// DecryptStream decrypts one file part read from encrypted and writes the plain text to w as it is read, so
+// memory use stays flat no matter the part size. It uses the same pgp options documented on DecryptPart
+func DecryptStream(encrypted io.Reader, w io.Writer, serverSecret, keyCode string) (int64, error) {
 	//super super quirky docs and implementation here
 	password := serverSecret + keyCode
 	firstTimeCalled := true
@@ -72,58 +153,27 @@ func DecryptPart(filePart, serverSecret, keyCode string) (string, error) {
 	}
 
 	var emptyKeyRing openpgp.EntityList
-	cleanedFilePart := filepath.Clean(filePart)
-	encryptedIO, err := os.Open(cleanedFilePart)
-	if err != nil {
-		return "", fmt.Errorf("unable to read %v due to error %v", cleanedFilePart, err)
-	}
-	md, err := openpgp.ReadMessage(encryptedIO, emptyKeyRing, prompt, config)
+	md, err := openpgp.ReadMessage(encrypted, emptyKeyRing, prompt, config)
 	if err != nil {
 		// Parsing errors when reading the message are most likely caused by incorrect password, but we cannot know for sure
-		return "", fmt.Errorf("gopenpgp: error in reading password protected message: wrong password or malformed message %v", err)
+		return 0, fmt.Errorf("gopenpgp: error in reading password protected message: wrong password or malformed message %w", err)
 	}
 
-	defer func() {
-		//verify we got to the close since we may have errored out trying to copy
-		err = encryptedIO.Close()
-		if err != nil {
-			slog.Debug("encrypted io handler for file failed to close, but this is safe to ignore on a cleanup operation", "file_name", cleanedFilePart, "error_msg", err)
-		}
-	}()
-
-	messageBuf := bytes.NewBuffer(nil)
 	buf := make([]byte, 4096*1024)
-	_, err = io.CopyBuffer(messageBuf, md.UnverifiedBody, buf)
+	written, err := io.CopyBuffer(w, md.UnverifiedBody, buf)
 	if errors.Is(err, pgpErrors.ErrMDCHashMismatch) {
 		// This MDC error may also be triggered if the password is correct, but the encrypted data was corrupted.
 		// To avoid confusion, we do not inform the user about the second possibility.
-		return "", errors.New("gopenpgp: wrong password in symmetric decryption")
+		return written, errors.New("gopenpgp: wrong password in symmetric decryption")
 	} else if err != nil {
 		// Parsing errors after decryption, triggered before parsing the MDC packet, are also usually the result of wrong password
-		return "", fmt.Errorf("gopenpgp: error in reading password protected message: wrong password or malformed message this is happening during parsing after decryption. %v", err)
+		return written, fmt.Errorf("gopenpgp: error in reading password protected message: wrong password or malformed message this is happening during parsing after decryption. %w", err)
 	}
-
-	//now safe to close the file and reclaim some memory
-	err = encryptedIO.Close()
-	if err != nil {
-		return "", fmt.Errorf("encrypted io handler for file '%v' failed to close due to '%v'", cleanedFilePart, err)
-	}
-
-	//remove the "encrypted" suffix
-	newFileName := strings.TrimSuffix(cleanedFilePart, ".encrypted")
-
-	slog.Debug("new name for unencrypted file", "file_name", newFileName, "old_file_name", cleanedFilePart)
-	err = os.WriteFile(newFileName, messageBuf.Bytes(), 0600)
-	if err != nil {
-		return "", fmt.Errorf("unable to write file '%v' due to error '%v'", newFileName, err)
-	}
-	if err := os.Remove(cleanedFilePart); err != nil {
-		slog.Warn("unable to delete file so you will need to manually clean this file up", "file_name", filePart, "error_msg", err)
-	}
-	return newFileName, nil
+	return written, nil
 }
 
-// getNow returns the latest server time.
+// getNow returns the time on the SendSafely servers, our clock is used as is until a response told us theirs.
+// It is used for the ss-request-timestamp of every request as well as for pgp
 func getNow() time.Time {
 	pgp.lock.RLock()
 	defer pgp.lock.RUnlock()
@@ -132,7 +182,33 @@ func getNow() time.Time {
 		return time.Now()
 	}
 
-	return time.Unix(pgp.latestServerTime, 0)
+	return time.Now().Add(time.Duration(pgp.generationOffset) * time.Second)
+}
+
+// minClockSkew is how far our clock has to be from the server before the offset is changed, the Date header only
+// has a resolution of a second and arrives after some latency so anything closer than this is noise
+const minClockSkew = 2 * time.Second
+
+// learnServerTime reads the server time from the Date header of a response, the first one sets the offset of
+// our clock to the server and later ones only move it when our clock has drifted by minClockSkew or more since.
+// The returned skew is how far the server was from getNow before the update, zero when the header is missing
+func learnServerTime(date string) time.Duration {
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		return 0
+	}
+	now := time.Now()
+	pgp.lock.Lock()
+	defer pgp.lock.Unlock()
+	skew := serverTime.Sub(now.Add(time.Duration(pgp.generationOffset) * time.Second))
+	if pgp.latestServerTime == 0 || skew.Abs() >= minClockSkew {
+		pgp.generationOffset = int64(serverTime.Sub(now).Round(time.Second) / time.Second)
+		if skew.Abs() >= minClockSkew {
+			slog.Warn("local clock differs from the sendsafely server, requests are signed with the server time instead", "offset_seconds", pgp.generationOffset)
+		}
+	}
+	pgp.latestServerTime = max(pgp.latestServerTime, serverTime.Unix())
+	return skew
 }
 
 // getTimeGenerator Returns a time generator function.
@@ -149,7 +225,9 @@ var pgp = GopenPGP{
 // GopenPGP is used as a "namespace" for many of the functions in this package.
 // It is a struct that keeps track of time skew between server and client.
 type GopenPGP struct {
+	// latestServerTime is the latest Date header of a SendSafely response in unix seconds, 0 until there is one
 	latestServerTime int64
+	// generationOffset is how many seconds the server clock is ahead of ours
 	generationOffset int64
 	lock             *sync.RWMutex
 }
@@ -18,10 +18,13 @@
 package sendsafely
 
 import (
+	"bytes"
+	"context"
 	"crypto"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -29,15 +32,59 @@ import (
 	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
 	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/rsvihladremio/ssdownloader/storage"
 )
 
-// verify the pgp server time function we wrapped here
+// resetServerTime forgets the server time learned by earlier tests
+func resetServerTime() {
+	pgp.lock.Lock()
+	defer pgp.lock.Unlock()
+	pgp.latestServerTime = 0
+	pgp.generationOffset = 0
+}
+
+// verify the pgp server time function we wrapped here follows the server clock once it is known
 func TestGetNow(t *testing.T) {
+	defer resetServerTime()
 	pgp.latestServerTime = 1000
+	pgp.generationOffset = 3600
 	now := getNow()
-	if now.Unix() != pgp.latestServerTime {
-		t.Errorf("unexpected time of '%v', expected was '%v'", now.Unix(), 1000)
+	expected := time.Now().Add(time.Hour)
+	if now.Sub(expected).Abs() > 2*time.Second {
+		t.Errorf("unexpected time of '%v', expected was '%v'", now, expected)
+	}
+}
+
+func TestLearnServerTime(t *testing.T) {
+	defer resetServerTime()
+	resetServerTime()
+	if skew := learnServerTime(""); skew != 0 || pgp.latestServerTime != 0 {
+		t.Errorf("a missing Date header should be ignored but skew was %v", skew)
+	}
+	ahead := time.Now().Add(time.Hour)
+	if skew := learnServerTime(ahead.Format(http.TimeFormat)); skew.Round(time.Minute) != time.Hour {
+		t.Errorf("expected a skew of an hour but was %v", skew)
+	}
+	if pgp.generationOffset < 3598 || pgp.generationOffset > 3600 {
+		t.Errorf("expected an offset of an hour but was %v seconds", pgp.generationOffset)
+	}
+	offset := pgp.generationOffset
+	// a second of difference is the resolution of the header, not drift
+	learnServerTime(time.Now().Add(time.Hour + time.Second).Format(http.TimeFormat))
+	if pgp.generationOffset != offset {
+		t.Errorf("expected the offset to stay %v but was %v", offset, pgp.generationOffset)
+	}
+	// the clock was fixed
+	if skew := learnServerTime(time.Now().Format(http.TimeFormat)); skew.Round(time.Minute) != -time.Hour {
+		t.Errorf("expected a skew of minus an hour but was %v", skew)
+	}
+	if pgp.generationOffset < -1 || pgp.generationOffset > 0 {
+		t.Errorf("expected no offset but was %v seconds", pgp.generationOffset)
+	}
+	if pgp.latestServerTime < ahead.Unix() {
+		t.Errorf("expected the latest server time to stay at least %v but was %v", ahead.Unix(), pgp.latestServerTime)
 	}
 }
 
@@ -83,7 +130,7 @@ func TestDecrypt(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error setting up test file due to '%v'", err)
 	}
-	unecryptedFile, err := DecryptPart(newFile, "serverSecret", "keyCode")
+	unecryptedFile, err := DecryptPart(context.Background(), storage.NewLocal(), newFile, "serverSecret", "keyCode")
 	if err != nil {
 		t.Fatalf("unable to decrypt newly encrypted file '%v' error was '%v'", newFile, err)
 	}
@@ -192,3 +239,120 @@ func EncryptFile(fileName, password string) (string, error) {
 	}
 	return newFileName, nil
 }
+
+// EncryptBytes is the in memory version of EncryptFile
+func EncryptBytes(plainText []byte, password string) ([]byte, error) {
+	config := &packet.Config{
+		DefaultCipher:     packet.CipherAES256,
+		DefaultHash:       crypto.Hash(crypto.SHA256),
+		Time:              getTimeGenerator(),
+		S2KCount:          65535,
+		CompressionConfig: &packet.CompressionConfig{Level: 0},
+	}
+	var encrypted bytes.Buffer
+	md, err := openpgp.SymmetricallyEncrypt(&encrypted, []byte(password), &openpgp.FileHints{IsBinary: true}, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to setup encryption due to error '%v'", err)
+	}
+	if _, err := md.Write(plainText); err != nil {
+		return nil, fmt.Errorf("unable to encrypt due to error '%v'", err)
+	}
+	if err := md.Close(); err != nil {
+		return nil, fmt.Errorf("unable to close encrypted writer due to error '%v'", err)
+	}
+	return encrypted.Bytes(), nil
+}
+
+func TestDecryptStream(t *testing.T) {
+	encrypted, err := EncryptBytes([]byte("my streamed text"), "serverSecretkeyCode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	written, err := DecryptStream(bytes.NewReader(encrypted), &out, "serverSecret", "keyCode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "my streamed text" {
+		t.Errorf("expected 'my streamed text' but was '%v'", out.String())
+	}
+	if written != int64(out.Len()) {
+		t.Errorf("expected %v bytes written but was %v", out.Len(), written)
+	}
+}
+
+func TestDecryptStreamWithWrongPassword(t *testing.T) {
+	encrypted, err := EncryptBytes([]byte("my streamed text"), "serverSecretkeyCode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if _, err := DecryptStream(bytes.NewReader(encrypted), &out, "serverSecret", "wrongKeyCode"); err == nil {
+		t.Error("expected an error with the wrong key code")
+	}
+}
+
+func TestDecryptPartFailureLeavesNoPart(t *testing.T) {
+	dir := t.TempDir()
+	encrypted := filepath.Join(dir, "file.txt.1.encrypted")
+	if err := os.WriteFile(encrypted, []byte("not encrypted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptPart(context.Background(), storage.NewLocal(), encrypted, "serverSecret", "keyCode"); err == nil {
+		t.Fatal("expected an error decrypting garbage")
+	}
+	for _, name := range []string{"file.txt.1", "file.txt.1" + InProgressSuffix} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %v to not exist but got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(encrypted); err != nil {
+		t.Errorf("expected the encrypted part to be kept but got %v", err)
+	}
+}
+
+// ArmorMessage encrypts the message and armors it the way SendSafely returns a secure message
+func ArmorMessage(message, password string) (string, error) {
+	encrypted, err := EncryptBytes([]byte(message), password)
+	if err != nil {
+		return "", err
+	}
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, "PGP MESSAGE", nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(encrypted); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return armored.String(), nil
+}
+
+func TestDecryptMessage(t *testing.T) {
+	armored, err := ArmorMessage("the logs are in node1.tgz", "serverSecretkeyCode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := DecryptMessage(armored, "serverSecret", "keyCode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message != "the logs are in node1.tgz" {
+		t.Errorf("unexpected message '%v'", message)
+	}
+	if _, err := DecryptMessage(armored, "serverSecret", "wrongKeyCode"); err == nil {
+		t.Error("expected the wrong keycode to fail")
+	}
+}
+
+func TestPackageSecret(t *testing.T) {
+	if secret := PackageSecret(Package{}, "keyCode", "hunter2"); secret != "keyCode" {
+		t.Errorf("expected the password to be ignored for a package without one but was %v", secret)
+	}
+	if secret := PackageSecret(Package{PasswordRequired: true}, "keyCode", "hunter2"); secret != "keyCodehunter2" {
+		t.Errorf("expected the password to be appended to the keycode but was %v", secret)
+	}
+}
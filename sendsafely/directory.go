@@ -0,0 +1,140 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// sendsafely package decrypts files, combines file parts into whole files, and handles api access to the sendsafely rest api
+package sendsafely
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// UnsafeDirectoryErr is returned for a directory whose name would put its files outside of the package dir
+type UnsafeDirectoryErr struct {
+	PackageID   string
+	DirectoryID string
+	Name        string
+}
+
+func (u UnsafeDirectoryErr) Error() string {
+	return fmt.Sprintf("directory %v of package %v has the name '%v' which is not a single local path element", u.DirectoryID, u.PackageID, u.Name)
+}
+
+// RetrievePackage retrieves the package and adds the files of its directories, see WalkDirectories
+func RetrievePackage(ctx context.Context, client Client, packageID, dirPrefix string) (Package, error) {
+	p, err := client.RetrievePackageByID(ctx, packageID)
+	if err != nil {
+		return Package{}, err
+	}
+	return WalkDirectories(ctx, client, p, dirPrefix)
+}
+
+// WalkDirectories adds the files of every directory of the package to p.Files with the path of the directory they
+// are in so they are downloaded into matching sub directories. The walk starts at the directories listed on the package
+// or at the root directory of a workspace when none are listed, whose files stay at the top level. When dirPrefix is
+// set only the files under that directory path are kept, including the files listed on the package itself
+func WalkDirectories(ctx context.Context, client Client, p Package, dirPrefix string) (Package, error) {
+	dirPrefix = strings.Trim(filepath.ToSlash(dirPrefix), "/")
+	type pending struct {
+		id   string
+		path string
+		// name is what the parent listed it as, used when the directory itself does not say
+		name string
+		// root is the workspace root whose name is not part of the path
+		root bool
+	}
+	var queue []pending
+	for _, id := range p.DirectoryIDs {
+		queue = append(queue, pending{id: id})
+	}
+	if len(queue) == 0 && p.RootDirectoryID != "" {
+		queue = append(queue, pending{id: p.RootDirectoryID, root: true})
+	}
+	files := make([]File, 0, len(p.Files))
+	seen := make(map[string]bool)
+	for _, f := range p.Files {
+		seen[f.FileID] = true
+		if InDirPrefix(f.Path, dirPrefix) {
+			files = append(files, f)
+		}
+	}
+	visited := make(map[string]bool)
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if visited[next.id] {
+			continue
+		}
+		visited[next.id] = true
+		d, err := client.GetDirectory(ctx, p, next.id)
+		if err != nil {
+			return Package{}, fmt.Errorf("unable to get directory %v of package %v: %w", next.id, p.PackageID, err)
+		}
+		dirPath := next.path
+		if !next.root {
+			name := d.Name
+			if name == "" {
+				name = next.name
+			}
+			if !safeDirName(name) {
+				return Package{}, UnsafeDirectoryErr{PackageID: p.PackageID, DirectoryID: next.id, Name: name}
+			}
+			dirPath = path.Join(next.path, name)
+		}
+		if !mayContain(dirPath, dirPrefix) {
+			slog.Debug("skipping directory outside of the directory prefix", "package_id", p.PackageID, "directory", dirPath, "dir_prefix", dirPrefix)
+			continue
+		}
+		for _, f := range d.Files {
+			if seen[f.FileID] {
+				continue
+			}
+			seen[f.FileID] = true
+			f.Path = dirPath
+			if InDirPrefix(f.Path, dirPrefix) {
+				files = append(files, f)
+			}
+		}
+		for _, sub := range d.SubDirectories {
+			// the name listed by the parent is enough to skip a directory without asking for it
+			if sub.Name != "" && !mayContain(path.Join(dirPath, sub.Name), dirPrefix) {
+				continue
+			}
+			queue = append(queue, pending{id: sub.DirectoryID, path: dirPath, name: sub.Name})
+		}
+	}
+	p.Files = files
+	return p, nil
+}
+
+// InDirPrefix is true when the directory path is the prefix or under it, an empty prefix matches everything
+func InDirPrefix(dirPath, dirPrefix string) bool {
+	return dirPrefix == "" || dirPath == dirPrefix || strings.HasPrefix(dirPath, dirPrefix+"/")
+}
+
+// mayContain is true when the directory or one of its sub directories is in the prefix
+func mayContain(dirPath, dirPrefix string) bool {
+	return dirPath == "" || InDirPrefix(dirPath, dirPrefix) || strings.HasPrefix(dirPrefix, dirPath+"/")
+}
+
+// safeDirName is true for a name that is a single element that stays inside of the dir it is in
+func safeDirName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\`) && filepath.IsLocal(name)
+}
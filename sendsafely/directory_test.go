@@ -0,0 +1,139 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// sendsafely package decrypts files, combines file parts into whole files, and handles api access to the sendsafely rest api
+package sendsafely
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rsvihladremio/ssdownloader/storage"
+)
+
+// workspaceClient returns a workspace package whose root has a file, a logs dir with a file and a logs/node1 dir with a file
+func workspaceClient() *MockClient {
+	return &MockClient{
+		RetrieveByPackagePackage: Package{PackageID: "packageID1213", ServerSecret: "serverSecretPassword", RootDirectoryID: "root"},
+		Directories: map[string]Directory{
+			"root": {
+				DirectoryID:    "root",
+				Name:           "ignored",
+				Files:          []File{{FileID: "top", FileName: "top.txt", Parts: 1, FileSize: 10, DirectoryID: "root"}},
+				SubDirectories: []Directory{{DirectoryID: "logs", Name: "logs"}},
+			},
+			"logs": {
+				DirectoryID:    "logs",
+				Name:           "logs",
+				Files:          []File{{FileID: "server", FileName: "server.log", Parts: 1, FileSize: 10, DirectoryID: "logs"}},
+				SubDirectories: []Directory{{DirectoryID: "node1", Name: "node1"}},
+			},
+			// the name is left to what the parent listed it as
+			"node1": {
+				DirectoryID: "node1",
+				Files:       []File{{FileID: "node", FileName: "node.log", Parts: 1, FileSize: 10, DirectoryID: "node1"}},
+			},
+		},
+	}
+}
+
+func TestWalkDirectories(t *testing.T) {
+	c := workspaceClient()
+	p, err := RetrievePackage(context.Background(), c, "packageID1213", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range p.Files {
+		paths = append(paths, filepath.ToSlash(f.RelPath()))
+	}
+	expected := []string{"top.txt", "logs/server.log", "logs/node1/node.log"}
+	if len(paths) != len(expected) {
+		t.Fatalf("expected %v but was %v", expected, paths)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Errorf("expected %v but was %v", expected, paths)
+		}
+	}
+}
+
+func TestWalkDirectoriesWithPrefix(t *testing.T) {
+	for _, prefix := range []string{"logs/node1", "/logs/node1/"} {
+		c := workspaceClient()
+		p, err := RetrievePackage(context.Background(), c, "packageID1213", prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p.Files) != 1 || p.Files[0].FileID != "node" {
+			t.Errorf("expected only the file in logs/node1 for prefix %v but was %#v", prefix, p.Files)
+		}
+	}
+	c := workspaceClient()
+	p, err := RetrievePackage(context.Background(), c, "packageID1213", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Files) != 0 {
+		t.Errorf("expected the prefix to only match whole directory names but was %#v", p.Files)
+	}
+	if len(c.DirectoryIDs) != 1 {
+		t.Errorf("expected directories outside of the prefix to not be walked but walked %v", c.DirectoryIDs)
+	}
+}
+
+func TestWalkDirectoriesRejectsUnsafeNames(t *testing.T) {
+	for _, name := range []string{"..", "../etc", `a\b`, ""} {
+		c := &MockClient{Directories: map[string]Directory{"d": {DirectoryID: "d", Name: name}}}
+		_, err := WalkDirectories(context.Background(), c, Package{PackageID: "p", DirectoryIDs: []string{"d"}}, "")
+		var unsafeErr UnsafeDirectoryErr
+		if !errors.As(err, &unsafeErr) {
+			t.Errorf("expected an UnsafeDirectoryErr for '%v' but was %v", name, err)
+		}
+	}
+}
+
+func TestDownloadFilesIntoDirectories(t *testing.T) {
+	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
+		DownloadDir:      t.TempDir(),
+		KeyCode:          "keyCode",
+		PackageID:        "packageID1213",
+		SubDirToDownload: "testpackages",
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+		StreamParts:      true,
+		DirPrefix:        "logs",
+	}
+	c := workspaceClient()
+	c.GetDownloadUrlsForFileDownloadUrls = []DownloadURL{{Part: 1, URL: "http://localhost:1999/part1"}}
+	d := &MockDownloader{Pass: "serverSecretPassword", KeyCode: a.KeyCode}
+	outDir, _, err := DownloadFilesFromPackage(context.Background(), c, d, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filepath.Join("logs", "server.log"), filepath.Join("logs", "node1", "node.log")} {
+		if _, err := os.Stat(filepath.Join(outDir, name)); err != nil {
+			t.Errorf("expected %v to be downloaded: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "top.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected top.txt outside of the prefix to not be downloaded: %v", err)
+	}
+}
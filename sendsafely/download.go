@@ -18,16 +18,26 @@
 package sendsafely
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
-	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/rsvihladremio/ssdownloader/dedup"
 	"github.com/rsvihladremio/ssdownloader/downloader"
-	"github.com/rsvihladremio/ssdownloader/futils"
+	"github.com/rsvihladremio/ssdownloader/extract"
+	"github.com/rsvihladremio/ssdownloader/filter"
+	"github.com/rsvihladremio/ssdownloader/hooks"
+	"github.com/rsvihladremio/ssdownloader/journal"
 	"github.com/rsvihladremio/ssdownloader/reporting"
+	"github.com/rsvihladremio/ssdownloader/retry"
+	"github.com/rsvihladremio/ssdownloader/storage"
 )
 
 type PartRequests struct {
@@ -37,14 +47,14 @@ type PartRequests struct {
 
 // FileSizeCheck this is to help us be aware of future patterns in the sendsafely api, often it will return a different size
 // than it actually encountered in reality, these files are so far always usable so we are just going to log the difference
-func FileSizeCheck(fileName string, fileSize int64) error {
-	fi, err := os.Stat(fileName)
+func FileSizeCheck(ctx context.Context, store storage.Storage, fileName string, fileSize int64) error {
+	fi, err := store.Stat(ctx, fileName)
 	if err != nil {
 		return fmt.Errorf("unable to check file size %v", fileName)
 	}
 
-	if fi.Size() != fileSize {
-		slog.Warn("file size in sendsafely and reality do not match, this is often not a real issue", "current_file_size_bytes", fi.Size(), "file_to_download_bytes", fileSize)
+	if fi.Size != fileSize {
+		slog.Warn("file size in sendsafely and reality do not match, this is often not a real issue", "current_file_size_bytes", fi.Size, "file_to_download_bytes", fileSize)
 	}
 	return nil
 }
@@ -57,6 +67,70 @@ type DownloadArgs struct {
 	MaxFileSizeByte  int64
 	SkipList         []string
 	Verbose          bool
+	// StreamParts decrypts each part as it is downloaded straight into the final file instead of
+	// writing encrypted and decrypted part files and combining them at the end
+	StreamParts bool
+	// PartThreads is how many parts of a single file are downloaded at once
+	PartThreads int
+	// Storage is where the files are written, directories are created by the storage as needed
+	Storage storage.Storage
+	// Package is used instead of retrieving the package again when it was already retrieved, ie for the disk space check
+	Package *Package
+	// Journal records the progress of every file so an interrupted run can resume part by part, nil disables it
+	Journal *journal.Journal
+	// Dedup replaces every completed file with a link to an identical one already downloaded, nil disables it
+	Dedup *dedup.Store
+	// Extract unpacks every completed archive into a sibling dir, nil disables it
+	Extract *extract.Extractor
+	// Hooks are run as each file and the package completes or a file fails, nil disables them
+	Hooks *hooks.Runner
+	// TicketID is passed to the hooks when the package was linked from a ticket
+	TicketID string
+	// DirPrefix limits the download to the files under this directory path of the package, empty downloads everything
+	DirPrefix string
+	// Filter selects the files to download by name, file id and uploader, nil downloads every file
+	Filter *filter.Filter
+	// PackagePassword is only used for packages that require a password in addition to the keycode
+	PackagePassword string
+}
+
+// LegacyScratchFactor is how many times the size of a file can be on disk at once when the parts are
+// written, decrypted and then combined, streamed parts only ever write the file once
+const LegacyScratchFactor = 3
+
+// ScratchFactor is how many times the size of a file has to be free to download it
+func ScratchFactor(streamParts bool) int64 {
+	if streamParts {
+		return 1
+	}
+	return LegacyScratchFactor
+}
+
+// PackageDir is the directory the files of the package are written to
+func PackageDir(p Package, a DownloadArgs) string {
+	//Add timestamp for sorting
+	fullPackageName := fmt.Sprintf("%v_%v", p.PackageTimestamp.Format("20060102T150405"), p.PackageID)
+	return filepath.Join(a.DownloadDir, a.SubDirToDownload, fullPackageName)
+}
+
+// PlannedFileSizes returns the size of every file DownloadFilesFromPackage would download, files that are
+// skipped, over the max file size or already downloaded are left out
+func PlannedFileSizes(ctx context.Context, p Package, a DownloadArgs) ([]int64, error) {
+	outDir := PackageDir(p, a)
+	var sizes []int64
+	for _, f := range p.Files {
+		if SkipFile(a.SkipList, f.FileID) || f.FileSize > a.MaxFileSizeByte || a.filterSkip(f) != "" {
+			continue
+		}
+		exists, err := storage.Exists(ctx, a.Storage, filepath.Join(outDir, f.RelPath()))
+		if err != nil {
+			return sizes, err
+		}
+		if !exists {
+			sizes = append(sizes, f.FileSize)
+		}
+	}
+	return sizes, nil
 }
 
 func SkipFile(skipList []string, fileID string) bool {
@@ -68,46 +142,66 @@ func SkipFile(skipList []string, fileID string) bool {
 	return false
 }
 
+// DownloadFilesFromPackage downloads, decrypts and combines every file in the package. When the context is cancelled
+// the parts of the file in progress are removed, except for partial downloads which are kept so they can be resumed
 func DownloadFilesFromPackage(
+	ctx context.Context,
 	client Client,
 	d downloader.GenericDownloader,
 	a DownloadArgs,
 ) (outDir string, invalidFiles []string, err error) {
 	packageID := a.PackageID
 	keyCode := a.KeyCode
-	downloadDir := a.DownloadDir
-	subDirToDownload := a.SubDirToDownload
 	verbose := a.Verbose
 	maxFileSizeBytes := a.MaxFileSizeByte
 	fileIDListToSkip := a.SkipList
-	p, err := client.RetrievePackageByID(packageID)
-	if err != nil {
-		return "", []string{}, err
+	store := a.Storage
+	partThreads := a.PartThreads
+	if partThreads < 1 {
+		partThreads = 1
 	}
-	//making top level download directory if it does not exist
-	_, err = os.Stat(downloadDir)
-	if err != nil && errors.Is(err, os.ErrNotExist) {
-		configDir := filepath.Dir(downloadDir)
-		slog.Debug("making download dir since it is not present", "dir", downloadDir)
-		err = os.Mkdir(downloadDir, 0700)
+	var p Package
+	if a.Package != nil {
+		p = *a.Package
+	} else {
+		p, err = RetrievePackage(ctx, client, packageID, a.DirPrefix)
 		if err != nil {
-			return "", []string{}, fmt.Errorf("unable to create download dir '%v' due to error '%v'", configDir, err)
+			e := a.hookEvent(hooks.Failure, packageID)
+			e.Error = err.Error()
+			a.Hooks.Run(ctx, e)
+			return "", []string{}, err
 		}
 	}
-
-	shortPackageID := p.PackageID
-	//Add timestamp for sorting
-	fullPackageName := fmt.Sprintf("%v_%v", p.PackageTimestamp.Format("20060102T150405"), shortPackageID)
-	//make config directory for this package code if it does not exist
-	outDir = filepath.Join(downloadDir, subDirToDownload, fullPackageName)
-
-	_, err = os.Stat(outDir)
-	if err != nil && errors.Is(err, os.ErrNotExist) {
-		configDir := filepath.Dir(outDir)
-		slog.Debug("making package directory since it does not exist", "dir", outDir)
-		err = os.MkdirAll(outDir, 0700)
-		if err != nil {
-			return "", []string{}, fmt.Errorf("unable to create download dir '%v' due to error '%v'", configDir, err)
+	if p.PasswordRequired && a.PackagePassword == "" {
+		err := PasswordRequiredErr{PackageID: p.PackageID}
+		e := a.hookEvent(hooks.Failure, p.PackageID)
+		e.Error = err.Error()
+		a.Hooks.Run(ctx, e)
+		return "", []string{}, err
+	}
+	keyCode = PackageSecret(p, keyCode, a.PackagePassword)
+	// the package is only complete when none of its files failed
+	var anyFailed bool
+	fileFailed := func(fileID, path string, err error) {
+		anyFailed = true
+		e := a.hookEvent(hooks.Failure, p.PackageID)
+		e.FileID = fileID
+		e.Path = path
+		e.Error = err.Error()
+		a.Hooks.Run(ctx, e)
+	}
+	// the storage creates the directory for this package when the first file is written
+	outDir = PackageDir(p, a)
+	if p.ContainsMessage {
+		saveMessage(ctx, client, store, p, keyCode, outDir)
+	}
+	// what an earlier run left in the package directory, used to clean up parts of files that were completed
+	present := make(map[string]bool)
+	if existing, err := store.List(ctx, outDir); err == nil {
+		for _, e := range existing {
+			if rel, err := filepath.Rel(outDir, e.Name); err == nil {
+				present[rel] = true
+			}
 		}
 	}
 	var fileIDs []string
@@ -118,35 +212,49 @@ func DownloadFilesFromPackage(
 		slog.Info("found files in package", "num-files", len(fileIDs), "file-ids", strings.Join(fileIDs, ","))
 	}
 	for _, f := range p.Files {
+		if err := ctx.Err(); err != nil {
+			return outDir, invalidFiles, err
+		}
 		fileID := f.FileID
 		slog.Info("file in package", "fileID", fileID)
 		if SkipFile(fileIDListToSkip, fileID) {
 			slog.Info("skipping file id in package as requested", "fileID", fileID, "packageID", packageID, "skip-list", strings.Join(fileIDListToSkip, ","))
 			continue
 		}
+		if reason := a.filterSkip(f); reason != "" {
+			slog.Info("skipping file as it was not selected", "fileID", fileID, "file_name", f.RelPath(), "reason", reason)
+			continue
+		}
 		fileSize := f.FileSize
 		if fileSize > maxFileSizeBytes {
 			slog.Info("skipping file ID due to file size", "fileID", fileID, "maxFileSizeBytes", maxFileSizeBytes, "fileSize", fileSize)
 			continue
 		}
 		reporting.AddFile()
-		fileName := f.FileName
+		// files in a directory of the package keep the directory path
+		fileName := f.RelPath()
 		parts := f.Parts
 
 		fullPath := filepath.Join(outDir, fileName)
-		exists, err := futils.FileExists(fullPath)
+		exists, err := storage.Exists(ctx, store, fullPath)
 		if err != nil {
 			reporting.AddFailed()
 			slog.Error("unable to check if file exists. Skipping file to prevent overwriting existing one.", "file_name", fullPath, "error_msg", err)
+			fileFailed(fileID, fullPath, err)
 			continue
 		}
-		if exists {
-			if err := FileSizeCheck(fullPath, fileSize); err != nil {
+		// the size was already checked by the run that recorded it as complete
+		if exists && !a.Journal.FileComplete(p.PackageID, fileID) {
+			if err := FileSizeCheck(ctx, store, fullPath, fileSize); err != nil {
 				reporting.AddFailed()
 				invalidFiles = append(invalidFiles, fullPath)
 				slog.Error("unable to validate new file", "file_name", fullPath, "err", err)
+				fileFailed(fileID, fullPath, err)
 				continue
 			}
+		}
+		if exists {
+			removeLeftoverParts(ctx, store, p, f, outDir, present)
 			reporting.AddSkip()
 			slog.Debug("file already downloaded skipping", "file_name", fullPath)
 			continue
@@ -155,79 +263,253 @@ func DownloadFilesFromPackage(
 		fmt.Print(".")
 		slog.Debug("downloading", "file_name", fullPath)
 
-		var fileNames []string
-		var failedFiles []string
-		segmentRequestInformation := calculateExecutionCalls(parts)
-		for _, s := range segmentRequestInformation {
-			segment := s
-			start := segment.StartSegment
-			end := segment.EndSegment
-
-			urls, err := client.GetDownloadUrlsForFile(
-				p,
-				fileID,
-				keyCode,
-				start,
-				end,
-			)
+		var written int64
+		var newFile string
+		if a.StreamParts {
+			written, err = StreamFileParts(ctx, client, d, store, a.Journal, p, f, keyCode, fullPath, partThreads)
 			if err != nil {
+				if ctx.Err() != nil {
+					return outDir, invalidFiles, ctx.Err()
+				}
 				reporting.AddFailed()
-				slog.Error("while attempting to get the download url we encountered an error, skipping file", "file_name", fileName, "error_msg", err)
+				slog.Error("unable to download file, skipping", "file_name", fileName, "error_msg", err)
+				fileFailed(fileID, fullPath, err)
 				continue
 			}
-			for i := range urls {
-				index := i
-
-				url := urls[index]
-				downloadURL := url.URL
-				filePart := url.Part
-				// we add the encrypted value here to make it obvious on reading the directory what step in the download process it is at
-				tmpName := fmt.Sprintf("%v.%v.encrypted", fileName, filePart)
-				downloadLoc := filepath.Join(outDir, tmpName)
-				err = d.DownloadFile(downloadLoc, downloadURL)
-				if err != nil {
-					reporting.AddFailed()
-					slog.Debug("unable to download file", "file_name", downloadLoc, "error_msg", err)
-					continue
+			newFile = fullPath
+		} else {
+			var fileNames []string
+			var failedFiles []string
+			var lock sync.Mutex
+			var wg sync.WaitGroup
+			slots := make(chan struct{}, partThreads)
+			// parts an earlier run downloaded and decrypted, only trusted while the part is still there
+			partDone := func(part int) bool {
+				return present[fmt.Sprintf("%v.%v", fileName, part)] && a.Journal.PartDone(p.PackageID, fileID, part)
+			}
+			for part := 1; part <= parts; part++ {
+				if partDone(part) {
+					fileNames = append(fileNames, filepath.Join(outDir, fmt.Sprintf("%v.%v", fileName, part)))
 				}
-				newFileName, err := DecryptPart(downloadLoc, p.ServerSecret, keyCode)
-				if err != nil {
+			}
+			if len(fileNames) > 0 {
+				slog.Info("resuming file from the download journal", "file_name", fileName, "parts_done", len(fileNames), "total_parts", parts)
+			}
+			for batch := range prefetchDownloadURLs(ctx, client, p, fileID, keyCode, parts, partDone) {
+				if batch.err != nil {
+					if ctx.Err() != nil {
+						break
+					}
 					reporting.AddFailed()
-					failedFiles = append(failedFiles, newFileName)
-					slog.Debug("unable to decrypt file", "file_name", downloadLoc, "error_msg", err)
+					slog.Error("while attempting to get the download url we encountered an error, skipping file", "file_name", fileName, "error_msg", batch.err)
 					continue
 				}
-				fileNames = append(fileNames, newFileName)
-				slog.Debug("file decrypted", "file_name", newFileName)
+				for _, url := range batch.urls {
+					downloadURL := url.URL
+					filePart := url.Part
+					// we add the encrypted value here to make it obvious on reading the directory what step in the download process it is at
+					tmpName := fmt.Sprintf("%v.%v.encrypted", fileName, filePart)
+					downloadLoc := filepath.Join(outDir, tmpName)
+					slots <- struct{}{}
+					wg.Add(1)
+					go func() {
+						defer func() {
+							<-slots
+							wg.Done()
+						}()
+						// the .partial download is kept on cancel so the next run can resume it
+						var resumed bool
+						err := withFreshURL(ctx, client, p, fileID, keyCode, filePart, downloadURL, func(url string) error {
+							var err error
+							resumed, err = d.DownloadFile(ctx, downloadLoc, url)
+							return err
+						})
+						if err != nil {
+							if ctx.Err() != nil {
+								return
+							}
+							reporting.AddFailed()
+							lock.Lock()
+							failedFiles = append(failedFiles, downloadLoc)
+							lock.Unlock()
+							slog.Debug("unable to download file", "file_name", downloadLoc, "error_msg", err)
+							return
+						}
+						if resumed {
+							slog.Debug("resumed partial download of file part", "file_name", downloadLoc)
+						}
+						newFileName, err := DecryptPart(ctx, store, downloadLoc, p.ServerSecret, keyCode)
+						if err == nil {
+							if err := a.Journal.DonePart(ctx, p.PackageID, fileID, filePart); err != nil {
+								slog.Warn("unable to update download journal, this part will be downloaded again if interrupted", "file_name", newFileName, "error_msg", err)
+							}
+						}
+						lock.Lock()
+						defer lock.Unlock()
+						if err != nil {
+							reporting.AddFailed()
+							failedFiles = append(failedFiles, newFileName)
+							slog.Debug("unable to decrypt file", "file_name", downloadLoc, "error_msg", err)
+							return
+						}
+						fileNames = append(fileNames, newFileName)
+						slog.Debug("file decrypted", "file_name", newFileName)
+					}()
+				}
+			}
+			wg.Wait()
+			// parts in the journal are kept for the next run to pick up from
+			if ctx.Err() != nil {
+				if a.Journal == nil {
+					removeParts(ctx, store, fileNames)
+				}
+				return outDir, invalidFiles, ctx.Err()
 			}
 			if len(failedFiles) > 0 {
 				reporting.AddFailed()
 				slog.Error("there were failed downloads of parts of the file skipping", "failed_file_parts_count", len(failedFiles), "file_name", fileName)
+				fileFailed(fileID, fullPath, fmt.Errorf("%v parts failed to download or decrypt", len(failedFiles)))
+				if a.Journal == nil {
+					removeParts(ctx, store, fileNames)
+				}
 				continue
 			}
+			// parts whose download url could not be retrieved are only logged, combining without them would give a file
+			// with a hole in it
+			if len(fileNames) != parts {
+				reporting.AddFailed()
+				slog.Error("not every part of the file was downloaded skipping", "parts_downloaded", len(fileNames), "total_parts", parts, "file_name", fileName)
+				fileFailed(fileID, fullPath, fmt.Errorf("only %v of %v parts were downloaded", len(fileNames), parts))
+				if a.Journal == nil {
+					removeParts(ctx, store, fileNames)
+				}
+				continue
+			}
+			// a file without parts has nothing to download
+			if len(fileNames) == 0 {
+				reporting.AddSkip()
+				continue
+			}
+			written, newFile, err = CombineFiles(ctx, store, fileNames, verbose)
+			if err != nil {
+				reporting.AddFailed()
+				fileFailed(fileID, fullPath, err)
+				return "", invalidFiles, fmt.Errorf("unable to combine downloaded parts for file %v: %v", fileName, err)
+			}
 		}
-		// no files to download everything was skipped
-		if len(fileNames) == 0 && len(invalidFiles) == 0 {
-			reporting.AddSkip()
-			return outDir, invalidFiles, nil
-		}
-		written, newFile, err := CombineFiles(fileNames, verbose)
-		if err != nil {
-			reporting.AddFailed()
-			return "", invalidFiles, fmt.Errorf("unable to combine downloaded parts for file %v: %v", fileName, err)
-		}
-		if err := FileSizeCheck(fullPath, fileSize); err != nil {
+		if err := FileSizeCheck(ctx, store, fullPath, fileSize); err != nil {
 			reporting.AddFailed()
+			fileFailed(fileID, fullPath, err)
 			return "", invalidFiles, fmt.Errorf("unable to validate new file: %v: %v", fileName, err)
 		}
+		if err := a.Journal.CompleteFile(ctx, p.PackageID, fileID); err != nil {
+			slog.Warn("unable to update download journal", "file_name", fullPath, "error_msg", err)
+		}
+		if saved, err := a.Dedup.Add(fullPath); err != nil {
+			slog.Warn("unable to deduplicate file, keeping the downloaded copy", "file_name", fullPath, "error_msg", err)
+		} else if saved > 0 {
+			reporting.AddDeduplicated(saved)
+		}
+		if result, err := a.Extract.Extract(ctx, fullPath); err != nil {
+			reporting.AddExtractFailed()
+			slog.Warn("unable to extract archive, keeping the downloaded archive", "file_name", fullPath, "error_msg", err)
+		} else if result.Archives > 0 {
+			reporting.AddExtracted(result.Archives, result.Files)
+		}
+		e := a.hookEvent(hooks.FileComplete, p.PackageID)
+		e.FileID = fileID
+		e.Path = fullPath
+		e.Size = fileSize
+		a.Hooks.Run(ctx, e)
 		fmt.Print(".")
 		slog.Debug("file is complete", "file_name", newFile, "file_size", Human(written), "file_size_in_bytes", written)
 		reporting.AddBytes(fileSize)
 
 	}
+	if !anyFailed {
+		a.packageComplete(ctx, p.PackageID, outDir)
+	}
 	return outDir, invalidFiles, nil
 }
 
+// filterSkip is why the filter does not select the file, empty when it does
+func (a DownloadArgs) filterSkip(f File) string {
+	return a.Filter.Skip(filepath.ToSlash(f.RelPath()), f.FileID, f.CreatedByEmail)
+}
+
+// MessageFileName is what the decrypted secure message of a package is saved as in the package dir
+const MessageFileName = "message.txt"
+
+// PackageMessage retrieves and decrypts the secure message of the package, keyCode is the one from PackageSecret
+func PackageMessage(ctx context.Context, client Client, p Package, keyCode string) (string, error) {
+	encrypted, err := client.GetPackageMessage(ctx, p, keyCode)
+	if err != nil {
+		return "", err
+	}
+	return DecryptMessage(encrypted, p.ServerSecret, keyCode)
+}
+
+// saveMessage writes the secure message of the package to MessageFileName, failures are only logged as the files
+// of the package can still be downloaded without it
+func saveMessage(ctx context.Context, client Client, store storage.Storage, p Package, keyCode, outDir string) {
+	fileName := filepath.Join(outDir, MessageFileName)
+	if exists, err := storage.Exists(ctx, store, fileName); err != nil || exists {
+		return
+	}
+	message, err := PackageMessage(ctx, client, p, keyCode)
+	if err != nil {
+		slog.Warn("unable to get the secure message of the package", "package_id", p.PackageID, "error_msg", err)
+		return
+	}
+	if err := storage.WriteFile(ctx, store, fileName, []byte(message)); err != nil {
+		slog.Warn("unable to save the secure message of the package", "package_id", p.PackageID, "file_name", fileName, "error_msg", err)
+	}
+}
+
+// hookEvent fills in what every hook event for a package has in common
+func (a DownloadArgs) hookEvent(event, packageID string) hooks.Event {
+	return hooks.Event{Event: event, Source: hooks.SourceSendSafely, TicketID: a.TicketID, PackageID: packageID}
+}
+
+func (a DownloadArgs) packageComplete(ctx context.Context, packageID, outDir string) {
+	e := a.hookEvent(hooks.PackageComplete, packageID)
+	e.Path = outDir
+	a.Hooks.Run(ctx, e)
+}
+
+// removeParts cleans up the decrypted parts of a file that will not be combined
+func removeParts(ctx context.Context, store storage.Storage, fileNames []string) {
+	// the context may already be cancelled and the parts still need to go
+	ctx = context.WithoutCancel(ctx)
+	for _, f := range fileNames {
+		if err := store.Remove(ctx, f); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("unable to remove file part so you will need to manually clean this file up", "file_name", f, "error_msg", err)
+		}
+	}
+}
+
+// removeLeftoverParts removes the parts of a file that is already complete, a run that is stopped after the parts are
+// combined but before they are removed leaves them behind. Only names in present are removed and names that are files
+// of the package themselves are kept
+func removeLeftoverParts(ctx context.Context, store storage.Storage, p Package, f File, outDir string, present map[string]bool) {
+	packageFiles := make(map[string]bool)
+	for _, pf := range p.Files {
+		packageFiles[pf.RelPath()] = true
+	}
+	for part := 1; part <= f.Parts; part++ {
+		for _, name := range []string{fmt.Sprintf("%v.%v", f.RelPath(), part), fmt.Sprintf("%v.%v.encrypted", f.RelPath(), part)} {
+			if !present[name] || packageFiles[name] {
+				continue
+			}
+			if err := store.Remove(ctx, filepath.Join(outDir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				slog.Warn("unable to remove leftover part of completed file so you will need to manually clean this file up", "file_name", name, "error_msg", err)
+				continue
+			}
+			slog.Debug("removed leftover part of completed file", "file_name", name)
+		}
+	}
+}
+
 func Human(bytes int64) string {
 	if bytes > 1024*1024*1024 {
 		return fmt.Sprintf("%.2f gb", float64(bytes)/(1024.0*1024.0*1024.0))
@@ -239,6 +521,75 @@ func Human(bytes int64) string {
 	return fmt.Sprintf("%v bytes", bytes)
 }
 
+// withFreshURL runs download with the url and when the server rejects it with an http status error, which is
+// how S3 reports an expired presigned url, asks sendsafely for a new url for just that part and tries once more
+func withFreshURL(ctx context.Context, client Client, p Package, fileID, keyCode string, part int, url string, download func(url string) error) error {
+	err := download(url)
+	var statusErr retry.HTTPStatusErr
+	if err == nil || ctx.Err() != nil || !errors.As(err, &statusErr) {
+		return err
+	}
+	slog.Info("download url was rejected, requesting a new one", "file_id", fileID, "part", part, "status_code", statusErr.Code)
+	urls, urlErr := client.GetDownloadUrlsForFile(ctx, p, fileID, keyCode, part, part)
+	if urlErr != nil {
+		return fmt.Errorf("unable to get a new download url for part %v after '%v': %w", part, err, urlErr)
+	}
+	for _, u := range urls {
+		if u.Part == part {
+			return download(u.URL)
+		}
+	}
+	return fmt.Errorf("sendsafely did not return a new download url for part %v after: %w", part, err)
+}
+
+// urlBatch is the result of one GetDownloadUrlsForFile call with the urls sorted by part
+type urlBatch struct {
+	start int
+	end   int
+	urls  []DownloadURL
+	err   error
+}
+
+// prefetchDownloadURLs requests the urls for the file one batch at a time. The channel is unbuffered so the next batch
+// is requested while the current one is downloading but we never get further ahead than that, otherwise the urls
+// could expire before we get to them. Parts done reports as finished are left out and batches with nothing left are
+// never requested. The channel is closed once every batch is sent or the context is done
+func prefetchDownloadURLs(ctx context.Context, client Client, p Package, fileID, keyCode string, parts int, done func(part int) bool) <-chan urlBatch {
+	batches := make(chan urlBatch)
+	go func() {
+		defer close(batches)
+		for _, s := range calculateExecutionCalls(parts) {
+			if allDone(s, done) {
+				continue
+			}
+			urls, err := client.GetDownloadUrlsForFile(ctx, p, fileID, keyCode, s.StartSegment, s.EndSegment)
+			// parts finished by an earlier run are left out
+			urls = slices.DeleteFunc(urls, func(u DownloadURL) bool {
+				return done(u.Part)
+			})
+			sort.Slice(urls, func(i, j int) bool {
+				return urls[i].Part < urls[j].Part
+			})
+			select {
+			case batches <- urlBatch{start: s.StartSegment, end: s.EndSegment, urls: urls, err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return batches
+}
+
+// allDone is true when every part in the request was finished by an earlier run
+func allDone(r PartRequests, done func(part int) bool) bool {
+	for part := r.StartSegment; part <= r.EndSegment; part++ {
+		if !done(part) {
+			return false
+		}
+	}
+	return true
+}
+
 func calculateExecutionCalls(parts int) []PartRequests {
 	var requests []PartRequests
 	if parts == 0 {
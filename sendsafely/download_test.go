@@ -18,12 +18,28 @@
 package sendsafely
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/rsvihladremio/ssdownloader/filter"
+	"github.com/rsvihladremio/ssdownloader/hooks"
+	"github.com/rsvihladremio/ssdownloader/journal"
+	"github.com/rsvihladremio/ssdownloader/retry"
+	"github.com/rsvihladremio/ssdownloader/storage"
 )
 
 // This is the default happy path test, no errors
@@ -128,6 +144,7 @@ func TestHumanProvidesAccurateAggregation(t *testing.T) {
 }
 
 type MockClient struct {
+	lock                               sync.Mutex
 	RetrieveByPackagePackage           Package
 	RetrieveByPackageErr               error
 	GetDownloadUrlsForFileErr          error
@@ -138,32 +155,101 @@ type MockClient struct {
 	KeyCodes                           []string
 	Starts                             []int
 	Ends                               []int
+	// URLsByPart ignores GetDownloadUrlsForFileDownloadUrls and returns a url for every part from start to end in reverse order
+	URLsByPart bool
+	// FileURLs are the urls returned for a file by its id, used before URLsByPart
+	FileURLs map[string][]DownloadURL
+	// Directories are returned by GetDirectory by id, an unknown id is an error
+	Directories  map[string]Directory
+	DirectoryIDs []string
+	// Message is the encrypted secure message returned by GetPackageMessage
+	Message         string
+	MessageErr      error
+	MessageKeyCodes []string
+}
+
+func (m *MockClient) GetPackageMessage(_ context.Context, _ Package, keyCode string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.MessageKeyCodes = append(m.MessageKeyCodes, keyCode)
+	return m.Message, m.MessageErr
+}
+
+func (m *MockClient) GetDirectory(_ context.Context, p Package, directoryID string) (Directory, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.DirectoryIDs = append(m.DirectoryIDs, directoryID)
+	d, ok := m.Directories[directoryID]
+	if !ok {
+		return Directory{}, fmt.Errorf("unknown directory %v in package %v", directoryID, p.PackageID)
+	}
+	return d, nil
 }
 
-func (m *MockClient) RetrievePackageByID(packageID string) (Package, error) {
+func (m *MockClient) RetrievePackageByID(_ context.Context, packageID string) (Package, error) {
 	m.PackageIDs = append(m.PackageIDs, packageID)
 	return m.RetrieveByPackagePackage, m.RetrieveByPackageErr
 }
 
-func (m *MockClient) GetDownloadUrlsForFile(p Package, fileID, keyCode string, start, end int) ([]DownloadURL, error) {
+func (m *MockClient) GetDownloadUrlsForFile(_ context.Context, p Package, fileID, keyCode string, start, end int) ([]DownloadURL, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.Packages = append(m.Packages, p)
 	m.FileIDs = append(m.FileIDs, fileID)
 	m.KeyCodes = append(m.KeyCodes, keyCode)
 	m.Starts = append(m.Starts, start)
 	m.Ends = append(m.Ends, end)
+	if urls, ok := m.FileURLs[fileID]; ok {
+		return urls, m.GetDownloadUrlsForFileErr
+	}
+	if m.URLsByPart {
+		var urls []DownloadURL
+		for i := end; i >= start; i-- {
+			urls = append(urls, DownloadURL{Part: i, URL: fmt.Sprintf("http://localhost:1999/part%v", i)})
+		}
+		return urls, m.GetDownloadUrlsForFileErr
+	}
 	return m.GetDownloadUrlsForFileDownloadUrls, m.GetDownloadUrlsForFileErr
 }
 
 type MockDownloader struct {
+	lock             sync.Mutex
 	FileNames        []string
 	Urls             []string
 	Err              error
 	SubDirToDownload string
 	Pass             string
 	KeyCode          string
+	// FailFirstStream hands half of the encrypted body to consume and then retries with the whole body
+	FailFirstStream bool
+	// Delays slows down specific urls so parts finish out of order
+	Delays map[string]time.Duration
+	// Expired urls fail once with a 403 like an expired S3 presigned url
+	Expired map[string]bool
+	// URLErrs fail the url with the error every time it is downloaded or streamed
+	URLErrs map[string]error
 }
 
-func (m *MockDownloader) DownloadFile(fileName, url string) error {
+// expired reports if the url should fail with a 403, it only fails the first time
+func (m *MockDownloader) expired(url string) bool {
+	if m.Expired[url] {
+		delete(m.Expired, url)
+		return true
+	}
+	return false
+}
+
+func (m *MockDownloader) DownloadFile(_ context.Context, fileName, url string) (bool, error) {
+	m.lock.Lock()
+	expired := m.expired(url)
+	urlErr := m.URLErrs[url]
+	m.lock.Unlock()
+	if expired {
+		return false, retry.HTTPStatusErr{Code: 403, URL: url}
+	}
+	if urlErr != nil {
+		return false, urlErr
+	}
 	//file1 := filepath.Join(m.SubDirToDownload, "00010101T000000_", fileName)
 	tmpFileName := strings.TrimSuffix(fileName, ".encrypted")
 	token := make([]byte, 128)
@@ -171,6 +257,10 @@ func (m *MockDownloader) DownloadFile(fileName, url string) error {
 	if err != nil {
 		log.Fatalf("unable to readBytes %v", err)
 	}
+	// the real downloader writes through the storage, which creates the directories
+	if err := os.MkdirAll(filepath.Dir(tmpFileName), 0700); err != nil {
+		log.Fatalf("unable to make dir %v", err)
+	}
 	if err := os.WriteFile(tmpFileName, token, 0600); err != nil {
 		log.Fatalf("unable to write %v", err)
 	}
@@ -178,9 +268,43 @@ func (m *MockDownloader) DownloadFile(fileName, url string) error {
 	if err != nil {
 		log.Fatalf("unable to encrypt %v", err)
 	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.FileNames = append(m.FileNames, fileName)
 	m.Urls = append(m.Urls, url)
-	return m.Err
+	return false, m.Err
+}
+
+// StreamFile encrypts "content of <url>" so tests can verify which part ended up where
+func (m *MockDownloader) StreamFile(_ context.Context, url string, consume func(body io.Reader) error) error {
+	m.lock.Lock()
+	m.Urls = append(m.Urls, url)
+	failFirst := m.FailFirstStream
+	m.FailFirstStream = false
+	delay := m.Delays[url]
+	expired := m.expired(url)
+	urlErr := m.URLErrs[url]
+	m.lock.Unlock()
+	if expired {
+		return retry.HTTPStatusErr{Code: 403, URL: url}
+	}
+	time.Sleep(delay)
+	if m.Err != nil {
+		return m.Err
+	}
+	if urlErr != nil {
+		return urlErr
+	}
+	encrypted, err := EncryptBytes([]byte("content of "+url), m.Pass+m.KeyCode)
+	if err != nil {
+		log.Fatalf("unable to encrypt %v", err)
+	}
+	if failFirst {
+		if err := consume(bytes.NewReader(encrypted[:len(encrypted)/2])); err == nil {
+			log.Fatal("expected a truncated body to fail")
+		}
+	}
+	return consume(bytes.NewReader(encrypted))
 }
 
 func TestDownloadFiles(t *testing.T) {
@@ -188,6 +312,7 @@ func TestDownloadFiles(t *testing.T) {
 	expectedPackageID := "packageID1213"
 
 	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
 		DownloadDir:      t.TempDir(),
 		KeyCode:          expectedKeyCode,
 		PackageID:        expectedPackageID,
@@ -215,7 +340,7 @@ func TestDownloadFiles(t *testing.T) {
 	mockDownloader.Pass = p.ServerSecret
 	mockDownloader.KeyCode = expectedKeyCode
 	mockDownloader.SubDirToDownload = a.SubDirToDownload
-	_, invalidFiles, err := DownloadFilesFromPackage(mockClient, mockDownloader, a)
+	_, invalidFiles, err := DownloadFilesFromPackage(context.Background(), mockClient, mockDownloader, a)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -227,11 +352,127 @@ func TestDownloadFiles(t *testing.T) {
 	}
 }
 
+func TestDownloadFilesWithFilter(t *testing.T) {
+	f, err := filter.New([]string{"*.log"}, nil, nil, []string{"customer@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Package{PackageID: "packageID1213", ServerSecret: "serverSecretPassword"}
+	p.Files = []File{
+		{FileID: "fileID1", FileName: "server.log", Parts: 1, FileSize: 10, CreatedByEmail: "customer@example.com"},
+		{FileID: "fileID2", FileName: "heap.hprof", Parts: 1, FileSize: 10, CreatedByEmail: "customer@example.com"},
+		{FileID: "fileID3", FileName: "agent.log", Parts: 1, FileSize: 10, CreatedByEmail: "agent@example.com"},
+	}
+	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
+		DownloadDir:      t.TempDir(),
+		KeyCode:          "keyCode",
+		PackageID:        p.PackageID,
+		SubDirToDownload: "testpackages",
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+		StreamParts:      true,
+		Package:          &p,
+		Filter:           f,
+	}
+	sizes, err := PlannedFileSizes(context.Background(), p, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 1 {
+		t.Errorf("expected only the selected file to be planned but was %v", sizes)
+	}
+	mockClient := &MockClient{GetDownloadUrlsForFileDownloadUrls: []DownloadURL{{Part: 1, URL: "http://localhost:1999/part1"}}}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: a.KeyCode}
+	if _, _, err := DownloadFilesFromPackage(context.Background(), mockClient, mockDownloader, a); err != nil {
+		t.Fatal(err)
+	}
+	if len(mockClient.FileIDs) != 1 || mockClient.FileIDs[0] != "fileID1" {
+		t.Errorf("expected only fileID1 to be downloaded but was %v", mockClient.FileIDs)
+	}
+}
+
+func TestDownloadPasswordProtectedPackage(t *testing.T) {
+	p := Package{PackageID: "packageID1213", ServerSecret: "serverSecretPassword", PasswordRequired: true}
+	p.Files = []File{{FileID: "fileID1", FileName: "server.log", Parts: 1, FileSize: 10}}
+	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
+		DownloadDir:      t.TempDir(),
+		KeyCode:          "keyCode",
+		PackageID:        p.PackageID,
+		SubDirToDownload: "testpackages",
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+		StreamParts:      true,
+		Package:          &p,
+	}
+	mockClient := &MockClient{GetDownloadUrlsForFileDownloadUrls: []DownloadURL{{Part: 1, URL: "http://localhost:1999/part1"}}}
+	// the password is part of the decryption passphrase
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: a.KeyCode + "hunter2"}
+	_, _, err := DownloadFilesFromPackage(context.Background(), mockClient, mockDownloader, a)
+	var passwordErr PasswordRequiredErr
+	if !errors.As(err, &passwordErr) {
+		t.Fatalf("expected a PasswordRequiredErr without a password but was %v", err)
+	}
+	if len(mockClient.FileIDs) != 0 {
+		t.Errorf("expected nothing to be requested without a password but was %v", mockClient.FileIDs)
+	}
+	a.PackagePassword = "hunter2"
+	outDir, _, err := DownloadFilesFromPackage(context.Background(), mockClient, mockDownloader, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mockClient.KeyCodes) != 1 || mockClient.KeyCodes[0] != "keyCodehunter2" {
+		t.Errorf("expected the password to be used for the checksum but the keycodes were %v", mockClient.KeyCodes)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "server.log")); err != nil {
+		t.Errorf("expected the file to be decrypted with the password: %v", err)
+	}
+}
+
+func TestDownloadSavesPackageMessage(t *testing.T) {
+	p := Package{PackageID: "packageID1213", ServerSecret: "serverSecretPassword", ContainsMessage: true}
+	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
+		DownloadDir:      t.TempDir(),
+		KeyCode:          "keyCode",
+		PackageID:        p.PackageID,
+		SubDirToDownload: "testpackages",
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+		Package:          &p,
+	}
+	message, err := ArmorMessage("the logs are in node1.tgz", p.ServerSecret+a.KeyCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockClient := &MockClient{Message: message}
+	outDir, _, err := DownloadFilesFromPackage(context.Background(), mockClient, &MockDownloader{}, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(outDir, MessageFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "the logs are in node1.tgz" {
+		t.Errorf("unexpected message '%v'", string(b))
+	}
+	// an existing message is not retrieved again
+	if _, _, err := DownloadFilesFromPackage(context.Background(), mockClient, &MockDownloader{}, a); err != nil {
+		t.Fatal(err)
+	}
+	if len(mockClient.MessageKeyCodes) != 1 {
+		t.Errorf("expected the message to be retrieved once but was %v times", len(mockClient.MessageKeyCodes))
+	}
+}
+
 func TestSkipFilesOnDownload(t *testing.T) {
 	expectedKeyCode := "keyCode"
 	expectedPackageID := "packageID1213"
 
 	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
 		DownloadDir:      t.TempDir(),
 		KeyCode:          expectedKeyCode,
 		PackageID:        expectedPackageID,
@@ -259,7 +500,7 @@ func TestSkipFilesOnDownload(t *testing.T) {
 	mockDownloader.Pass = p.ServerSecret
 	mockDownloader.KeyCode = expectedKeyCode
 	mockDownloader.SubDirToDownload = a.SubDirToDownload
-	_, invalidFiles, err := DownloadFilesFromPackage(mockClient, mockDownloader, a)
+	_, invalidFiles, err := DownloadFilesFromPackage(context.Background(), mockClient, mockDownloader, a)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -276,6 +517,7 @@ func TestSkipFilesOnDownloadWithOnlyOneSkip(t *testing.T) {
 	expectedPackageID := "packageID1213"
 
 	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
 		DownloadDir:      t.TempDir(),
 		KeyCode:          expectedKeyCode,
 		PackageID:        expectedPackageID,
@@ -303,7 +545,7 @@ func TestSkipFilesOnDownloadWithOnlyOneSkip(t *testing.T) {
 	mockDownloader.Pass = p.ServerSecret
 	mockDownloader.KeyCode = expectedKeyCode
 	mockDownloader.SubDirToDownload = a.SubDirToDownload
-	_, invalidFiles, err := DownloadFilesFromPackage(mockClient, mockDownloader, a)
+	_, invalidFiles, err := DownloadFilesFromPackage(context.Background(), mockClient, mockDownloader, a)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -320,6 +562,7 @@ func TestSkipFilesOverLimit(t *testing.T) {
 	expectedPackageID := "packageID1213"
 
 	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
 		DownloadDir:      t.TempDir(),
 		KeyCode:          expectedKeyCode,
 		PackageID:        expectedPackageID,
@@ -347,7 +590,7 @@ func TestSkipFilesOverLimit(t *testing.T) {
 	mockDownloader.Pass = p.ServerSecret
 	mockDownloader.KeyCode = expectedKeyCode
 	mockDownloader.SubDirToDownload = a.SubDirToDownload
-	_, invalidFiles, err := DownloadFilesFromPackage(mockClient, mockDownloader, a)
+	_, invalidFiles, err := DownloadFilesFromPackage(context.Background(), mockClient, mockDownloader, a)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -358,3 +601,445 @@ func TestSkipFilesOverLimit(t *testing.T) {
 		t.Errorf("expected no entries but had %v", len(mockDownloader.FileNames))
 	}
 }
+
+func TestDownloadFilesStopsWhenCancelled(t *testing.T) {
+	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
+		DownloadDir:      t.TempDir(),
+		KeyCode:          "keyCode",
+		PackageID:        "packageID1213",
+		SubDirToDownload: filepath.Join(t.TempDir(), "testpackages"),
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+	}
+	mockClient := &MockClient{}
+	p := Package{}
+	p.ServerSecret = "serverSecretPassword"
+	p.Files = []File{
+		{FileID: "fileID1", FileName: "filename1.txt", Parts: 1, FileSize: 10},
+	}
+	mockClient.RetrieveByPackagePackage = p
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: a.KeyCode}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := DownloadFilesFromPackage(ctx, mockClient, mockDownloader, a)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled but was %v", err)
+	}
+	if len(mockDownloader.FileNames) != 0 {
+		t.Errorf("expected no downloads but had %v", len(mockDownloader.FileNames))
+	}
+}
+
+func TestDownloadFilesWithStreamParts(t *testing.T) {
+	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
+		DownloadDir:      t.TempDir(),
+		KeyCode:          "keyCode",
+		PackageID:        "packageID1213",
+		SubDirToDownload: filepath.Join(t.TempDir(), "testpackages"),
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+		StreamParts:      true,
+	}
+	mockClient := &MockClient{}
+	p := Package{}
+	p.ServerSecret = "serverSecretPassword"
+	p.Files = []File{
+		{FileID: "fileID1", FileName: "filename1.txt", Parts: 1, FileSize: 10},
+		{FileID: "fileID2", FileName: "filename2.txt", Parts: 1, FileSize: 10},
+	}
+	mockClient.RetrieveByPackagePackage = p
+	mockClient.GetDownloadUrlsForFileDownloadUrls = []DownloadURL{{Part: 1, URL: "http://localhost:1999/part1"}}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: a.KeyCode}
+	outDir, _, err := DownloadFilesFromPackage(context.Background(), mockClient, mockDownloader, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mockDownloader.FileNames) != 0 {
+		t.Errorf("expected no part files to be written but had %v", len(mockDownloader.FileNames))
+	}
+	if len(mockDownloader.Urls) != 2 {
+		t.Errorf("expected 2 streamed urls but had %v", len(mockDownloader.Urls))
+	}
+	for _, f := range p.Files {
+		b, err := os.ReadFile(filepath.Join(outDir, f.FileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "content of http://localhost:1999/part1" {
+			t.Errorf("unexpected content for %v: '%v'", f.FileName, string(b))
+		}
+	}
+}
+
+func TestDownloadFilesDownloadsPartsInParallel(t *testing.T) {
+	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
+		DownloadDir:      t.TempDir(),
+		KeyCode:          "keyCode",
+		PackageID:        "packageID1213",
+		SubDirToDownload: filepath.Join(t.TempDir(), "testpackages"),
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+		PartThreads:      4,
+	}
+	p := Package{}
+	p.ServerSecret = "serverSecretPassword"
+	p.Files = []File{
+		{FileID: "fileID1", FileName: "filename1.txt", Parts: 30, FileSize: 30 * 128},
+	}
+	mockClient := &MockClient{RetrieveByPackagePackage: p, URLsByPart: true}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: a.KeyCode}
+	outDir, _, err := DownloadFilesFromPackage(context.Background(), mockClient, mockDownloader, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mockDownloader.FileNames) != 30 {
+		t.Errorf("expected 30 parts downloaded but had %v", len(mockDownloader.FileNames))
+	}
+	fi, err := os.Stat(filepath.Join(outDir, "filename1.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 30*128 {
+		t.Errorf("expected %v bytes but was %v", 30*128, fi.Size())
+	}
+}
+
+func TestDownloadFilesRefreshesExpiredURLs(t *testing.T) {
+	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
+		DownloadDir:      t.TempDir(),
+		KeyCode:          "keyCode",
+		PackageID:        "packageID1213",
+		SubDirToDownload: filepath.Join(t.TempDir(), "testpackages"),
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+	}
+	p := Package{}
+	p.ServerSecret = "serverSecretPassword"
+	p.Files = []File{
+		{FileID: "fileID1", FileName: "filename1.txt", Parts: 3, FileSize: 3 * 128},
+	}
+	mockClient := &MockClient{RetrieveByPackagePackage: p, URLsByPart: true}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: a.KeyCode, Expired: map[string]bool{"http://localhost:1999/part2": true}}
+	outDir, _, err := DownloadFilesFromPackage(context.Background(), mockClient, mockDownloader, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mockClient.Starts, []int{1, 2}) || !reflect.DeepEqual(mockClient.Ends, []int{3, 2}) {
+		t.Errorf("expected a url request for parts 1-3 and then only part 2 but was starts %v and ends %v", mockClient.Starts, mockClient.Ends)
+	}
+	fi, err := os.Stat(filepath.Join(outDir, "filename1.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 3*128 {
+		t.Errorf("expected %v bytes but was %v", 3*128, fi.Size())
+	}
+}
+
+func TestDownloadFilesContinuesWhenEveryPartOfAFileFails(t *testing.T) {
+	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
+		DownloadDir:      t.TempDir(),
+		KeyCode:          "keyCode",
+		PackageID:        "packageID1213",
+		SubDirToDownload: filepath.Join(t.TempDir(), "testpackages"),
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+	}
+	p := Package{}
+	p.ServerSecret = "serverSecretPassword"
+	p.Files = []File{
+		{FileID: "fileID1", FileName: "filename1.txt", Parts: 2, FileSize: 2 * 128},
+		{FileID: "fileID2", FileName: "filename2.txt", Parts: 1, FileSize: 128},
+	}
+	mockClient := &MockClient{RetrieveByPackagePackage: p, FileURLs: map[string][]DownloadURL{
+		"fileID1": {{Part: 1, URL: "http://localhost:1999/file1/part1"}, {Part: 2, URL: "http://localhost:1999/file1/part2"}},
+		"fileID2": {{Part: 1, URL: "http://localhost:1999/file2/part1"}},
+	}}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: a.KeyCode, URLErrs: map[string]error{
+		"http://localhost:1999/file1/part1": retry.PermanentErr{BaseErr: errors.New("gone")},
+		"http://localhost:1999/file1/part2": retry.PermanentErr{BaseErr: errors.New("gone")},
+	}}
+	outDir, _, err := DownloadFilesFromPackage(context.Background(), mockClient, mockDownloader, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "filename1.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the failed file to be missing but was %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(outDir, "filename2.txt"))
+	if err != nil {
+		t.Fatalf("expected the file after the failed one to be downloaded: %v", err)
+	}
+	if fi.Size() != 128 {
+		t.Errorf("expected %v bytes but was %v", 128, fi.Size())
+	}
+}
+
+func TestDownloadFilesRunsFailureHookInsteadOfPackageComplete(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hook is a shell command")
+	}
+	eventsFile := filepath.Join(t.TempDir(), "events.txt")
+	r, err := hooks.New([]hooks.Hook{
+		{Event: hooks.FileComplete, Command: `echo "$SSDOWNLOADER_EVENT $SSDOWNLOADER_FILE_ID" >> '` + eventsFile + `'`},
+		{Event: hooks.Failure, Command: `echo "$SSDOWNLOADER_EVENT $SSDOWNLOADER_FILE_ID" >> '` + eventsFile + `'`},
+		{Event: hooks.PackageComplete, Command: `echo "$SSDOWNLOADER_EVENT $SSDOWNLOADER_PACKAGE_ID" >> '` + eventsFile + `'`},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Package{PackageID: "packageID1213", ServerSecret: "serverSecretPassword"}
+	p.Files = []File{
+		{FileID: "fileID1", FileName: "filename1.txt", Parts: 1, FileSize: 128},
+		{FileID: "fileID2", FileName: "filename2.txt", Parts: 1, FileSize: 128},
+	}
+	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
+		DownloadDir:      t.TempDir(),
+		KeyCode:          "keyCode",
+		PackageID:        p.PackageID,
+		SubDirToDownload: "testpackages",
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+		Package:          &p,
+		Hooks:            r,
+	}
+	mockClient := &MockClient{FileURLs: map[string][]DownloadURL{
+		"fileID1": {{Part: 1, URL: "http://localhost:1999/file1/part1"}},
+		"fileID2": {{Part: 1, URL: "http://localhost:1999/file2/part1"}},
+	}}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: a.KeyCode, URLErrs: map[string]error{
+		"http://localhost:1999/file1/part1": retry.PermanentErr{BaseErr: errors.New("gone")},
+	}}
+	if _, _, err := DownloadFilesFromPackage(context.Background(), mockClient, mockDownloader, a); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(eventsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "failure fileID1\nfile_complete fileID2\n"
+	if string(b) != expected {
+		t.Errorf("expected hooks to run in order\n%v\nbut was\n%v", expected, string(b))
+	}
+}
+
+func TestPlannedFileSizes(t *testing.T) {
+	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
+		DownloadDir:      t.TempDir(),
+		SubDirToDownload: "packages",
+		MaxFileSizeByte:  1000,
+		SkipList:         []string{"fileID2"},
+	}
+	p := Package{PackageID: "packageID1213"}
+	p.Files = []File{
+		{FileID: "fileID1", FileName: "filename1.txt", FileSize: 10},
+		{FileID: "fileID2", FileName: "filename2.txt", FileSize: 20},
+		{FileID: "fileID3", FileName: "filename3.txt", FileSize: 2000},
+		{FileID: "fileID4", FileName: "filename4.txt", FileSize: 40},
+		{FileID: "fileID5", FileName: "filename5.txt", FileSize: 50},
+	}
+	if err := os.MkdirAll(PackageDir(p, a), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(PackageDir(p, a), "filename4.txt"), []byte("already here"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sizes, err := PlannedFileSizes(context.Background(), p, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int64{10, 50}
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("expected %v but was %v", expected, sizes)
+	}
+}
+
+func TestDownloadFilesUsesAlreadyRetrievedPackage(t *testing.T) {
+	p := Package{PackageID: "packageID1213", ServerSecret: "serverSecretPassword"}
+	p.Files = []File{
+		{FileID: "fileID1", FileName: "filename1.txt", Parts: 1, FileSize: 10},
+	}
+	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
+		DownloadDir:      t.TempDir(),
+		KeyCode:          "keyCode",
+		PackageID:        p.PackageID,
+		SubDirToDownload: "testpackages",
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+		Package:          &p,
+	}
+	mockClient := &MockClient{}
+	mockClient.GetDownloadUrlsForFileDownloadUrls = []DownloadURL{{URL: "http://localhost:1999/filename1.txt"}}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: a.KeyCode}
+	outDir, _, err := DownloadFilesFromPackage(context.Background(), mockClient, mockDownloader, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mockClient.PackageIDs) != 0 {
+		t.Errorf("expected the package to not be retrieved again but was retrieved for %v", mockClient.PackageIDs)
+	}
+	if outDir != PackageDir(p, a) {
+		t.Errorf("expected %v but was %v", PackageDir(p, a), outDir)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "filename1.txt")); err != nil {
+		t.Errorf("expected file to be downloaded %v", err)
+	}
+}
+
+func TestDownloadFilesRemovesLeftoverPartsOfCompletedFiles(t *testing.T) {
+	p := Package{PackageID: "packageID1213"}
+	// filename1.txt.1 is a real file and must not be mistaken for a part
+	p.Files = []File{
+		{FileID: "fileID1", FileName: "filename1.txt", Parts: 2, FileSize: 8},
+		{FileID: "fileID2", FileName: "filename1.txt.1", Parts: 1, FileSize: 4},
+	}
+	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
+		DownloadDir:      t.TempDir(),
+		PackageID:        p.PackageID,
+		SubDirToDownload: "testpackages",
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+		Package:          &p,
+	}
+	outDir := PackageDir(p, a)
+	if err := os.MkdirAll(outDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"filename1.txt":             "complete",
+		"filename1.txt.1":           "real",
+		"filename1.txt.2":           "left",
+		"filename1.txt.2.encrypted": "left",
+	} {
+		if err := os.WriteFile(filepath.Join(outDir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mockDownloader := &MockDownloader{}
+	if _, _, err := DownloadFilesFromPackage(context.Background(), &MockClient{}, mockDownloader, a); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	expected := []string{"filename1.txt", "filename1.txt.1"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v but was %v", expected, names)
+	}
+	if len(mockDownloader.FileNames) != 0 {
+		t.Errorf("expected nothing to be downloaded but was %v", mockDownloader.FileNames)
+	}
+}
+
+func TestDownloadFilesResumesPartsFromJournal(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewLocal()
+	p := Package{PackageID: "packageID1213", ServerSecret: "serverSecretPassword"}
+	p.Files = []File{
+		{FileID: "fileID1", FileName: "filename1.txt", Parts: 2, FileSize: 10},
+	}
+	a := DownloadArgs{
+		Storage:          store,
+		DownloadDir:      t.TempDir(),
+		KeyCode:          "keyCode",
+		PackageID:        p.PackageID,
+		SubDirToDownload: "testpackages",
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+		Package:          &p,
+	}
+	outDir := PackageDir(p, a)
+	j, err := journal.Open(ctx, store, filepath.Join(a.DownloadDir, journal.FileName), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Journal = j
+	// part 1 was finished by the run that was interrupted
+	if err := os.MkdirAll(outDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outDir, "filename1.txt.1"), []byte("first part"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.DonePart(ctx, p.PackageID, "fileID1", 1); err != nil {
+		t.Fatal(err)
+	}
+	mockClient := &MockClient{URLsByPart: true}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: a.KeyCode}
+	if _, _, err := DownloadFilesFromPackage(ctx, mockClient, mockDownloader, a); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(outDir, "filename1.txt.2.encrypted")}
+	if !reflect.DeepEqual(mockDownloader.FileNames, expected) {
+		t.Errorf("expected only part 2 to be downloaded %v but was %v", expected, mockDownloader.FileNames)
+	}
+	b, err := os.ReadFile(filepath.Join(outDir, "filename1.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("first part")) || len(b) != len("first part")+128 {
+		t.Errorf("expected the first part followed by the 128 bytes of the second but was %v bytes", len(b))
+	}
+	if !j.FileComplete(p.PackageID, "fileID1") {
+		t.Error("expected the file to be recorded as complete")
+	}
+}
+
+func TestDownloadFilesRunsHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hook is a shell command")
+	}
+	eventsFile := filepath.Join(t.TempDir(), "events.txt")
+	r, err := hooks.New([]hooks.Hook{
+		{Event: hooks.FileComplete, Command: `echo "$SSDOWNLOADER_EVENT $SSDOWNLOADER_TICKET_ID $SSDOWNLOADER_FILE_ID" >> '` + eventsFile + `'`},
+		{Event: hooks.PackageComplete, Command: `echo "$SSDOWNLOADER_EVENT $SSDOWNLOADER_TICKET_ID $SSDOWNLOADER_PACKAGE_ID" >> '` + eventsFile + `'`},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Package{PackageID: "packageID1213", ServerSecret: "serverSecretPassword"}
+	p.Files = []File{
+		{FileID: "fileID1", FileName: "filename1.txt", Parts: 1, FileSize: 10},
+		{FileID: "fileID2", FileName: "filename2.txt", Parts: 1, FileSize: 10},
+	}
+	a := DownloadArgs{
+		Storage:          storage.NewLocal(),
+		DownloadDir:      t.TempDir(),
+		KeyCode:          "keyCode",
+		PackageID:        p.PackageID,
+		SubDirToDownload: "testpackages",
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+		StreamParts:      true,
+		Package:          &p,
+		Hooks:            r,
+		TicketID:         "1111",
+	}
+	mockClient := &MockClient{GetDownloadUrlsForFileDownloadUrls: []DownloadURL{{Part: 1, URL: "http://localhost:1999/part1"}}}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: a.KeyCode}
+	if _, _, err := DownloadFilesFromPackage(context.Background(), mockClient, mockDownloader, a); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(eventsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "file_complete 1111 fileID1\nfile_complete 1111 fileID2\npackage_complete 1111 packageID1213\n"
+	if string(b) != expected {
+		t.Errorf("expected hooks to run in order\n%v\nbut was\n%v", expected, string(b))
+	}
+}
@@ -0,0 +1,215 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// sendsafely package decrypts files, combines file parts into whole files, and handles api access to the sendsafely rest api
+package sendsafely
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rsvihladremio/ssdownloader/retry"
+)
+
+// PackageExpiredErr is returned when SendSafely no longer knows the package, this is almost always because it expired
+type PackageExpiredErr struct {
+	PackageID string
+	Message   string
+}
+
+func (e PackageExpiredErr) Error() string {
+	return fmt.Sprintf("unable to find package %v as it is likely expired", e.PackageID)
+}
+
+func (e PackageExpiredErr) Reason() string {
+	return "package expired"
+}
+
+// PackageDeletedErr is returned for a package the sender deleted
+type PackageDeletedErr struct {
+	PackageID string
+	Message   string
+}
+
+func (e PackageDeletedErr) Error() string {
+	return fmt.Sprintf("package %v has been deleted by the sender due to '%v'", e.PackageID, e.Message)
+}
+
+func (e PackageDeletedErr) Reason() string {
+	return "package deleted"
+}
+
+// InvalidKeyCodeErr is returned when the checksum made from the keycode in the link is rejected, usually the link
+// was cut short when it was pasted
+type InvalidKeyCodeErr struct {
+	PackageID string
+	Message   string
+}
+
+func (e InvalidKeyCodeErr) Error() string {
+	return fmt.Sprintf("the keycode for package %v was rejected, check the link is complete, due to '%v'", e.PackageID, e.Message)
+}
+
+func (e InvalidKeyCodeErr) Reason() string {
+	return "invalid keycode"
+}
+
+// AuthFailedErr is returned when the api key or secret are wrong or not allowed to see the package
+type AuthFailedErr struct {
+	PackageID  string
+	StatusCode int
+	Message    string
+}
+
+func (e AuthFailedErr) Error() string {
+	return fmt.Sprintf("failed authentication for package %v due to '%v'", e.PackageID, e.Message)
+}
+
+func (e AuthFailedErr) Reason() string {
+	return "authentication failed"
+}
+
+// RateLimitedErr is returned when SendSafely asks us to slow down, it unwraps to a 429 retry.HTTPStatusErr
+// so it is retried after the Retry-After the server sent
+type RateLimitedErr struct {
+	PackageID  string
+	Message    string
+	URL        string
+	RetryAfter time.Duration
+}
+
+func (e RateLimitedErr) Error() string {
+	return fmt.Sprintf("sendsafely rate limited requests for package %v due to '%v'", e.PackageID, e.Message)
+}
+
+func (e RateLimitedErr) Reason() string {
+	return "rate limited"
+}
+
+func (e RateLimitedErr) Unwrap() error {
+	return retry.HTTPStatusErr{Code: http.StatusTooManyRequests, URL: e.URL, RetryAfter: e.RetryAfter}
+}
+
+// ClockSkewErr is returned when SendSafely rejected the ss-request-timestamp, either it said so or the Date header of
+// the rejection shows our clock is off. The offset to the server clock has been learned by then so the request is
+// tried once more
+type ClockSkewErr struct {
+	PackageID string
+	// Skew is how far the server clock was ahead of the one the request was signed with, zero when unknown
+	Skew    time.Duration
+	Message string
+}
+
+func (e ClockSkewErr) Error() string {
+	return fmt.Sprintf("sendsafely rejected the request timestamp for package %v, the local clock is %v off, due to '%v'", e.PackageID, e.Skew.Round(time.Second), e.Message)
+}
+
+func (e ClockSkewErr) Reason() string {
+	return "clock skew"
+}
+
+// PasswordRequiredErr is returned for a package protected with a password when no password was given
+type PasswordRequiredErr struct {
+	PackageID string
+}
+
+func (e PasswordRequiredErr) Error() string {
+	return fmt.Sprintf("package %v is protected with a password, pass it with --package-password or --package-password-stdin or run from a terminal to be prompted for it", e.PackageID)
+}
+
+func (e PasswordRequiredErr) Reason() string {
+	return "package password required"
+}
+
+// PasswordRejectedErr is returned when the checksum of a package protected with a password is rejected, the password
+// is part of the checksum and far more likely to be wrong than the keycode
+type PasswordRejectedErr struct {
+	PackageID string
+	Message   string
+}
+
+func (e PasswordRejectedErr) Error() string {
+	return fmt.Sprintf("the password for package %v was rejected, check --package-password, due to '%v'", e.PackageID, e.Message)
+}
+
+func (e PasswordRejectedErr) Reason() string {
+	return "package password was rejected"
+}
+
+// APIErr is a failed response from SendSafely that none of the other errors describe
+type APIErr struct {
+	PackageID  string
+	StatusCode int
+	Response   string
+	Message    string
+}
+
+func (e APIErr) Error() string {
+	return fmt.Sprintf("sendsafely refused the request for package %v with http status %v, response '%v' and message '%v'", e.PackageID, e.StatusCode, e.Response, e.Message)
+}
+
+func (e APIErr) Reason() string {
+	if e.Response != "" {
+		return strings.ToLower(strings.ReplaceAll(e.Response, "_", " "))
+	}
+	return fmt.Sprintf("http status %v", e.StatusCode)
+}
+
+// FailureReason is a short description of why a request failed for summaries, the full error is used
+// when it is not one of the SendSafely errors
+func FailureReason(err error) string {
+	var r interface{ Reason() string }
+	if errors.As(err, &r) {
+		return r.Reason()
+	}
+	return err.Error()
+}
+
+// checksumErr turns a rejected checksum of a package protected with a password into a PasswordRejectedErr
+func checksumErr(p Package, err error) error {
+	var keyCodeErr InvalidKeyCodeErr
+	if p.PasswordRequired && errors.As(err, &keyCodeErr) {
+		return PasswordRejectedErr{PackageID: keyCodeErr.PackageID, Message: keyCodeErr.Message}
+	}
+	return err
+}
+
+// responseErr turns the http status and the response and message fields of a SendSafely reply into one of the errors
+// above, nil is returned for a successful reply. A status of 0 means it is unknown and only the fields are used.
+// SendSafely usually answers 200 even when it fails so the response field is checked first
+func responseErr(packageID string, status int, response, message string) error {
+	upperMessage := strings.ToUpper(message)
+	switch {
+	case response == "SUCCESS" || (response == "" && status < 300):
+		return nil
+	case strings.Contains(response, "TIMESTAMP") || strings.Contains(upperMessage, "TIMESTAMP"):
+		return ClockSkewErr{PackageID: packageID, Message: message}
+	case response == "AUTHENTICATION_FAILED" || response == "INVALID_API_KEY" || status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return AuthFailedErr{PackageID: packageID, StatusCode: status, Message: message}
+	case response == "TOO_MANY_REQUESTS" || response == "RATE_LIMIT_EXCEEDED" || status == http.StatusTooManyRequests:
+		return RateLimitedErr{PackageID: packageID, Message: message}
+	case strings.Contains(response, "DELETED") || strings.Contains(upperMessage, "DELETED"):
+		return PackageDeletedErr{PackageID: packageID, Message: message}
+	case response == "UNKNOWN_PACKAGE" || strings.Contains(response, "EXPIRED") || strings.Contains(upperMessage, "EXPIRED") || status == http.StatusNotFound:
+		return PackageExpiredErr{PackageID: packageID, Message: message}
+	case strings.Contains(response, "KEYCODE") || strings.Contains(response, "CHECKSUM") || strings.Contains(upperMessage, "KEYCODE") || strings.Contains(upperMessage, "CHECKSUM"):
+		return InvalidKeyCodeErr{PackageID: packageID, Message: message}
+	}
+	return APIErr{PackageID: packageID, StatusCode: status, Response: response, Message: message}
+}
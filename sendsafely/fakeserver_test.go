@@ -0,0 +1,183 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// sendsafely package decrypts files, combines file parts into whole files, and handles api access to the sendsafely rest api
+package sendsafely
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rsvihladremio/ssdownloader/downloader"
+	"github.com/rsvihladremio/ssdownloader/sendsafelytest"
+	"github.com/rsvihladremio/ssdownloader/storage"
+)
+
+// fakePackage is added to a fake server by the tests below, diag.tar.gz is split into 4 parts
+func fakePackage() sendsafelytest.Package {
+	return sendsafelytest.Package{
+		PackageID:    "GYL4-DVZN",
+		PackageCode:  "pkgCode",
+		ServerSecret: "serverSecret",
+		KeyCode:      "keyCode",
+		Files: []sendsafelytest.File{
+			{FileID: "file-1", Name: "diag.tar.gz", Content: bytes.Repeat([]byte("0123456789"), 20), PartSize: 64, UploadedBy: "customer@example.com"},
+			{FileID: "file-2", Name: "notes.txt", Content: []byte("small file")},
+		},
+	}
+}
+
+// TestDownloadFromFakeServer runs the whole download, decrypt and combine flow against the fake api with every
+// scripted fault the download is expected to recover from
+func TestDownloadFromFakeServer(t *testing.T) {
+	for _, streamParts := range []bool{false, true} {
+		server := sendsafelytest.NewServer("myApiKey", "mySecret")
+		defer server.Close()
+		fp := fakePackage()
+		if _, err := server.AddPackage(fp); err != nil {
+			t.Fatal(err)
+		}
+		server.FailRequests("/api/v2.0/package/GYL4-DVZN/file/file-1/download-urls/", http.StatusInternalServerError, 1)
+		server.TruncatePart("file-1", 2, 1)
+		server.ExpirePartURL("file-1", 3, 1)
+
+		store := storage.NewLocal()
+		client := NewClient(server.APIURL(), "myApiKey", "mySecret", &http.Client{}, testPolicy(), false)
+		d := downloader.NewGenericDownloader(4, &http.Client{}, store, testPolicy())
+		outDir, invalidFiles, err := DownloadFilesFromPackage(context.Background(), client, d, DownloadArgs{
+			Storage:          store,
+			DownloadDir:      t.TempDir(),
+			KeyCode:          fp.KeyCode,
+			PackageID:        fp.PackageCode,
+			SubDirToDownload: "packages",
+			MaxFileSizeByte:  1000000000,
+			SkipList:         []string{},
+			StreamParts:      streamParts,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error downloading with stream parts %v '%v'", streamParts, err)
+		}
+		if len(invalidFiles) > 0 {
+			t.Errorf("expected no invalid files but had %v", invalidFiles)
+		}
+		for _, f := range fp.Files {
+			content, err := os.ReadFile(filepath.Join(outDir, f.Name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, f.Content) {
+				t.Errorf("expected %v to be '%s' with stream parts %v but was '%s'", f.Name, f.Content, streamParts, content)
+			}
+		}
+		requests := server.Requests()
+		if !slices.Contains(requests, "GET /parts/file-1/4") {
+			t.Errorf("expected every part to be downloaded but requests were %v", requests)
+		}
+	}
+}
+
+func TestFakeServerExpiredPackage(t *testing.T) {
+	server := sendsafelytest.NewServer("myApiKey", "mySecret")
+	defer server.Close()
+	if _, err := server.AddPackage(fakePackage()); err != nil {
+		t.Fatal(err)
+	}
+	server.ExpirePackage("GYL4-DVZN")
+	client := NewClient(server.APIURL(), "myApiKey", "mySecret", &http.Client{}, testPolicy(), false)
+	_, err := client.RetrievePackageByID(context.Background(), "pkgCode")
+	var expired PackageExpiredErr
+	if !errors.As(err, &expired) {
+		t.Errorf("expected PackageExpiredErr but was %v", err)
+	}
+}
+
+func TestFakeServerRejectsWrongKeyCode(t *testing.T) {
+	server := sendsafelytest.NewServer("myApiKey", "mySecret")
+	defer server.Close()
+	if _, err := server.AddPackage(fakePackage()); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(server.APIURL(), "myApiKey", "mySecret", &http.Client{}, testPolicy(), false)
+	p, err := client.RetrievePackageByID(context.Background(), "pkgCode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetDownloadUrlsForFile(context.Background(), p, "file-1", "truncatedKey", 1, 4)
+	var invalid InvalidKeyCodeErr
+	if !errors.As(err, &invalid) {
+		t.Errorf("expected InvalidKeyCodeErr but was %v", err)
+	}
+}
+
+func TestFakeServerRejectsWrongSecret(t *testing.T) {
+	server := sendsafelytest.NewServer("myApiKey", "mySecret")
+	defer server.Close()
+	if _, err := server.AddPackage(fakePackage()); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(server.APIURL(), "myApiKey", "wrongSecret", &http.Client{}, testPolicy(), false)
+	_, err := client.RetrievePackageByID(context.Background(), "pkgCode")
+	var authFailed AuthFailedErr
+	if !errors.As(err, &authFailed) {
+		t.Errorf("expected AuthFailedErr but was %v", err)
+	}
+}
+
+func TestDownloadFromFakeServerWithClockSkew(t *testing.T) {
+	defer resetServerTime()
+	resetServerTime()
+	server := sendsafelytest.NewServer("myApiKey", "mySecret")
+	defer server.Close()
+	server.ClockSkew = -2 * time.Hour
+	fp := fakePackage()
+	if _, err := server.AddPackage(fp); err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewLocal()
+	client := NewClient(server.APIURL(), "myApiKey", "mySecret", &http.Client{}, testPolicy(), false)
+	d := downloader.NewGenericDownloader(4, &http.Client{}, store, testPolicy())
+	outDir, _, err := DownloadFilesFromPackage(context.Background(), client, d, DownloadArgs{
+		Storage:          store,
+		DownloadDir:      t.TempDir(),
+		KeyCode:          fp.KeyCode,
+		PackageID:        fp.PackageCode,
+		SubDirToDownload: "packages",
+		MaxFileSizeByte:  1000000000,
+		SkipList:         []string{},
+		StreamParts:      true,
+	})
+	if err != nil {
+		t.Fatalf("expected the requests to be signed with the server time but was '%v'", err)
+	}
+	content, err := os.ReadFile(filepath.Join(outDir, "diag.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, fp.Files[0].Content) {
+		t.Errorf("unexpected content '%s'", content)
+	}
+	// only the first request is rejected, every later one is signed with the learned offset
+	if requests := server.Requests(); requests[0] != requests[1] || requests[1] == requests[2] {
+		t.Errorf("expected only the first request to be repeated but requests were %v", requests)
+	}
+}
@@ -19,15 +19,21 @@ package sendsafely
 
 import (
 	"fmt"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/valyala/fastjson"
 )
 
 // APIParser stores the jsonParser so it can be shared between
-// operations, this mainly benefits the parsing of the file parts
+// operations, this mainly benefits the parsing of the file parts.
+// fastjson.Parser is not safe for concurrent use so access is serialized
+// with lock
 type APIParser struct {
+	lock       sync.Mutex
 	jsonParser fastjson.Parser
 }
 
@@ -42,20 +48,44 @@ type File struct {
 	FileUploadedStr string
 	FileVersion     string
 	CreatedByEmail  string
+	// DirectoryID is the directory the file was found in, empty for the files listed on the package itself
+	DirectoryID string
+	// Path is the slash separated path of the directory the file is in relative to the package, empty for the top level
+	Path string
+}
+
+// RelPath is where the file goes relative to the package dir
+func (f File) RelPath() string {
+	return filepath.Join(filepath.FromSlash(f.Path), f.FileName)
 }
 
 // Package is the struct we need that maps to the fields here:
 // https://bump.sh/doc/sendsafely-rest-api#operation-getpackageinformation
 // this is intentionally not complete as we do nto need all the fields
 type Package struct {
-	PackageID        string
-	PackageCode      string
-	Files            []File
-	DirectoryIDs     []string
-	State            string
+	PackageID       string
+	PackageCode     string
+	Files           []File
+	DirectoryIDs    []string
+	RootDirectoryID string
+	State           string
+	// PasswordRequired is set when the sender protected the package with a password on top of the keycode
+	PasswordRequired bool
+	// ContainsMessage is set when the sender wrote a secure message with the package
+	ContainsMessage  bool
 	PackageTimestamp time.Time
-	Response         string
-	ServerSecret     string
+	// Life is how many days the package is kept after PackageTimestamp, 0 keeps it until it is deleted
+	Life         int
+	Response     string
+	ServerSecret string
+}
+
+// Expires is when SendSafely removes the package, zero when it does not expire
+func (p Package) Expires() time.Time {
+	if p.Life <= 0 {
+		return time.Time{}
+	}
+	return p.PackageTimestamp.AddDate(0, 0, p.Life)
 }
 
 // DownloadURL provides the part id and the actual url to get the file
@@ -126,6 +156,8 @@ func missingFieldError(fieldName, jsonBody string) error {
 //	 "response": "SUCCESS"
 //	}
 func (s *APIParser) ParsePackage(originalPackageID, packageJSON string) (Package, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	var ssp Package
 
 	// if we were parsing lots of these we want to reuse the jsonParser to minimize allocations
@@ -141,11 +173,8 @@ func (s *APIParser) ParsePackage(originalPackageID, packageJSON string) (Package
 		if messageValue.Exists() {
 			message = string(messageValue.GetStringBytes())
 		}
-		switch response {
-		case "UNKNOWN_PACKAGE":
-			return Package{}, fmt.Errorf("unable to find package %v as it is likely expired", originalPackageID)
-		case "AUTHENTICATION_FAILED":
-			return Package{}, fmt.Errorf("failed authentication for package %v due to '%v'", originalPackageID, message)
+		if err := responseErr(originalPackageID, 0, response, message); err != nil {
+			return Package{}, err
 		}
 	}
 	packageID := v.Get("packageId")
@@ -170,65 +199,11 @@ func (s *APIParser) ParsePackage(originalPackageID, packageJSON string) (Package
 	var fileIDs []File
 	filesArray := v.GetArray("files")
 	for i, e := range filesArray {
-		fileElement := e.Get("fileId")
-		if !fileElement.Exists() {
-			return Package{}, fmt.Errorf("missing id in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
-		}
-
-		fileName := e.Get("fileName")
-		if !fileName.Exists() {
-			return Package{}, fmt.Errorf("missing fileName in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
-		}
-
-		fileSize := e.Get("fileSize")
-		if !fileSize.Exists() {
-			return Package{}, fmt.Errorf("missing fileSize in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
-		}
-
-		parts := e.Get("parts")
-		if !parts.Exists() {
-			return Package{}, fmt.Errorf("missing parts in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
-		}
-
-		createdByEmail := e.Get("createdByEmail")
-		if !createdByEmail.Exists() {
-			return Package{}, fmt.Errorf("missing createdByEmail in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
-		}
-
-		fileUploadedRaw := e.Get("fileUploaded")
-		if !fileUploadedRaw.Exists() {
-			return Package{}, fmt.Errorf("missing fileUploaded in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
-		}
-
-		// comes back in this format Jun 9, 2022 1:32:34 PM
-		fileUploaded, err := time.Parse(DateFmt, string(fileUploadedRaw.GetStringBytes()))
-		if err != nil {
-			return Package{}, fmt.Errorf("fileUploaded has the incorrect format and caused error '%v' in the %v element of the files array (indexed at 1). Array was '%v' and raw string was '%v'", err, i+1, filesArray, fileUploadedRaw)
-		}
-
-		fileUploadedStr := e.Get("fileUploadedStr")
-		if !fileUploadedStr.Exists() {
-			return Package{}, fmt.Errorf("missing fileUploadedStr in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
-		}
-
-		fileVersion := e.Get("fileVersion")
-		if !fileVersion.Exists() {
-			return Package{}, fmt.Errorf("missing fileVersion in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
-		}
-		fileSizeInt, err := strconv.ParseInt(string(fileSize.GetStringBytes()), 10, 64)
+		f, err := parseFile(e, i, filesArray)
 		if err != nil {
-			return Package{}, fmt.Errorf("unable to convert fileSize field with value '%v' into int due to error '%v'", string(fileSize.GetStringBytes()), err)
+			return Package{}, err
 		}
-		fileIDs = append(fileIDs, File{
-			FileID:          string(fileElement.GetStringBytes()),
-			FileName:        string(fileName.GetStringBytes()),
-			FileSize:        fileSizeInt,
-			Parts:           int(parts.GetInt64()),
-			CreatedByEmail:  string(createdByEmail.GetStringBytes()),
-			FileUploaded:    fileUploaded,
-			FileUploadedStr: string(fileUploadedStr.GetStringBytes()),
-			FileVersion:     string(fileVersion.GetStringBytes()),
-		})
+		fileIDs = append(fileIDs, f)
 	}
 	ssp.Files = fileIDs
 
@@ -244,6 +219,8 @@ func (s *APIParser) ParsePackage(originalPackageID, packageJSON string) (Package
 		directoryIDs = append(directoryIDs, string(directoryElement.GetStringBytes()))
 	}
 	ssp.DirectoryIDs = directoryIDs
+	// only workspace packages and packages with folders have a root directory
+	ssp.RootDirectoryID = string(v.GetStringBytes("rootDirectoryId"))
 
 	// this is the package state, we may or may not need this, at minimum it should be useful for logging
 	state := v.Get("state")
@@ -251,6 +228,8 @@ func (s *APIParser) ParsePackage(originalPackageID, packageJSON string) (Package
 		return Package{}, missingFieldError("state", packageJSON)
 	}
 	ssp.State = string(state.GetStringBytes())
+	ssp.PasswordRequired = v.GetBool("passwordRequired")
+	ssp.ContainsMessage = v.GetBool("packageContainsMessage")
 
 	// this is the packageTimestamp also primarily intended for logging
 	packageTimestamp := v.Get("packageTimestamp")
@@ -265,6 +244,7 @@ func (s *APIParser) ParsePackage(originalPackageID, packageJSON string) (Package
 		return Package{}, fmt.Errorf("unparsable packageTimestamp '%v'", err)
 	}
 	ssp.PackageTimestamp = ts
+	ssp.Life = v.GetInt("life")
 
 	// response success or failure, also primarily useful logging and longer term I can see this being used for
 	response := v.Get("response")
@@ -275,8 +255,201 @@ func (s *APIParser) ParsePackage(originalPackageID, packageJSON string) (Package
 	return ssp, nil
 }
 
+// parseFile reads the i element of the files array, the same fields are returned for the files of a package and of a directory
+func parseFile(e *fastjson.Value, i int, filesArray []*fastjson.Value) (File, error) {
+	fileElement := e.Get("fileId")
+	if !fileElement.Exists() {
+		return File{}, fmt.Errorf("missing id in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
+	}
+
+	fileName := e.Get("fileName")
+	if !fileName.Exists() {
+		return File{}, fmt.Errorf("missing fileName in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
+	}
+
+	fileSize := e.Get("fileSize")
+	if !fileSize.Exists() {
+		return File{}, fmt.Errorf("missing fileSize in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
+	}
+
+	parts := e.Get("parts")
+	if !parts.Exists() {
+		return File{}, fmt.Errorf("missing parts in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
+	}
+
+	createdByEmail := e.Get("createdByEmail")
+	if !createdByEmail.Exists() {
+		return File{}, fmt.Errorf("missing createdByEmail in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
+	}
+
+	fileUploadedRaw := e.Get("fileUploaded")
+	if !fileUploadedRaw.Exists() {
+		return File{}, fmt.Errorf("missing fileUploaded in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
+	}
+
+	// comes back in this format Jun 9, 2022 1:32:34 PM
+	fileUploaded, err := time.Parse(DateFmt, string(fileUploadedRaw.GetStringBytes()))
+	if err != nil {
+		return File{}, fmt.Errorf("fileUploaded has the incorrect format and caused error '%v' in the %v element of the files array (indexed at 1). Array was '%v' and raw string was '%v'", err, i+1, filesArray, fileUploadedRaw)
+	}
+
+	fileUploadedStr := e.Get("fileUploadedStr")
+	if !fileUploadedStr.Exists() {
+		return File{}, fmt.Errorf("missing fileUploadedStr in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
+	}
+
+	fileVersion := e.Get("fileVersion")
+	if !fileVersion.Exists() {
+		return File{}, fmt.Errorf("missing fileVersion in the %v element of the files array (indexed at 1). Array was '%v'", i+1, filesArray)
+	}
+	fileSizeInt, err := strconv.ParseInt(string(fileSize.GetStringBytes()), 10, 64)
+	if err != nil {
+		return File{}, fmt.Errorf("unable to convert fileSize field with value '%v' into int due to error '%v'", string(fileSize.GetStringBytes()), err)
+	}
+	return File{
+		FileID:          string(fileElement.GetStringBytes()),
+		FileName:        string(fileName.GetStringBytes()),
+		FileSize:        fileSizeInt,
+		Parts:           int(parts.GetInt64()),
+		CreatedByEmail:  string(createdByEmail.GetStringBytes()),
+		FileUploaded:    fileUploaded,
+		FileUploadedStr: string(fileUploadedStr.GetStringBytes()),
+		FileVersion:     string(fileVersion.GetStringBytes()),
+	}, nil
+}
+
 const DateFmt = "Jan 2, 2006 3:04:05 PM"
 
+// Directory is a folder of a package with the files directly in it and the ids and names of its sub directories
+type Directory struct {
+	DirectoryID    string
+	Name           string
+	Files          []File
+	SubDirectories []Directory
+}
+
+// ParseDirectory reads the json returned for a directory of a package which looks like the following, older hosts
+// return the fields at the top level instead of under directory and name instead of directoryName
+//
+//	{
+//	  "directory": {
+//	    "directoryId": "8c3c2184-e73e-4137-be92-e9c5b5661258",
+//	    "directoryName": "logs",
+//	    "files": [
+//	      { see ParsePackage for the fields of a file }
+//	    ],
+//	    "subDirectories": [
+//	      {
+//	        "directoryId": "0e4d31b2-5d8c-4b36-8a1e-0c6b7a4f3d11",
+//	        "directoryName": "node1"
+//	      }
+//	    ]
+//	  },
+//	  "response": "SUCCESS"
+//	}
+func (s *APIParser) ParseDirectory(packageID, directoryJSON string) (Directory, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v, err := s.jsonParser.Parse(directoryJSON)
+	if err != nil {
+		return Directory{}, fmt.Errorf("unexpected error parsing directory json string '%v' with error '%v'", directoryJSON, err)
+	}
+	if err := responseErr(packageID, 0, string(v.GetStringBytes("response")), string(v.GetStringBytes("message"))); err != nil {
+		return Directory{}, err
+	}
+	if d := v.Get("directory"); d != nil && d.Type() == fastjson.TypeObject {
+		v = d
+	}
+	dir := parseDirectoryRef(v)
+	if dir.DirectoryID == "" {
+		return Directory{}, missingFieldError("directoryId", directoryJSON)
+	}
+	filesArray := v.GetArray("files")
+	for i, e := range filesArray {
+		f, err := parseFile(e, i, filesArray)
+		if err != nil {
+			return Directory{}, err
+		}
+		f.DirectoryID = dir.DirectoryID
+		dir.Files = append(dir.Files, f)
+	}
+	subDirectories := v.GetArray("subDirectories")
+	if subDirectories == nil {
+		subDirectories = v.GetArray("subdirectories")
+	}
+	for i, e := range subDirectories {
+		sub := parseDirectoryRef(e)
+		if sub.DirectoryID == "" {
+			return Directory{}, fmt.Errorf("missing directoryId in the %v element of the subDirectories array (indexed at 1)", i+1)
+		}
+		dir.SubDirectories = append(dir.SubDirectories, sub)
+	}
+	return dir, nil
+}
+
+// parseDirectoryRef reads the id and name of a directory under either of the names SendSafely uses for them
+func parseDirectoryRef(v *fastjson.Value) Directory {
+	id := string(v.GetStringBytes("directoryId"))
+	if id == "" {
+		id = string(v.GetStringBytes("id"))
+	}
+	name := string(v.GetStringBytes("directoryName"))
+	if name == "" {
+		name = string(v.GetStringBytes("name"))
+	}
+	return Directory{DirectoryID: id, Name: name}
+}
+
+// maxErrBodySnippet is how much of a reply that is not json is kept in an error
+const maxErrBodySnippet = 512
+
+// ParseResponseErr reads the response and message fields SendSafely adds to every reply and returns the matching
+// error for a failure along with the http status, nil is returned for a success. A body that is not json is only an
+// error when the status says so, otherwise it is left for the caller to parse and report
+func (s *APIParser) ParseResponseErr(packageID string, status int, body string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v, err := s.jsonParser.Parse(body)
+	if err != nil {
+		if status >= 300 {
+			// usually an html error page from a proxy, the start is enough to recognize it
+			snippet := strings.TrimSpace(body)
+			if len(snippet) > maxErrBodySnippet {
+				snippet = snippet[:maxErrBodySnippet]
+			}
+			return responseErr(packageID, status, "", snippet)
+		}
+		return nil
+	}
+	return responseErr(packageID, status, string(v.GetStringBytes("response")), string(v.GetStringBytes("message")))
+}
+
+// ParseMessage reads the encrypted secure message of a package from the json returned for it, which looks like
+//
+//	{
+//	  "message": "-----BEGIN PGP MESSAGE-----\n...\n-----END PGP MESSAGE-----",
+//	  "response": "SUCCESS"
+//	}
+func (s *APIParser) ParseMessage(packageID, messageJSON string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v, err := s.jsonParser.Parse(messageJSON)
+	if err != nil {
+		return "", fmt.Errorf("unexpected error parsing message json string '%v' with error '%v'", messageJSON, err)
+	}
+	response := string(v.GetStringBytes("response"))
+	if response != "SUCCESS" {
+		if err := responseErr(packageID, 0, response, string(v.GetStringBytes("message"))); err != nil {
+			return "", err
+		}
+	}
+	message := v.Get("message")
+	if !message.Exists() {
+		return "", missingFieldError("message", messageJSON)
+	}
+	return string(message.GetStringBytes()), nil
+}
+
 // ParseDownloadUrls reads the json response provided here https://bump.sh/doc/sendsafely-rest-api#operation-post-package-parameter-file-parameter-download-urls
 // here is an example
 //
@@ -290,6 +463,8 @@ const DateFmt = "Jan 2, 2006 3:04:05 PM"
 //	  "response": "SUCCESS"
 //	}
 func (s *APIParser) ParseDownloadUrls(downloadJSON string) ([]DownloadURL, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	var response []DownloadURL
 	v, err := s.jsonParser.Parse(downloadJSON)
 	if err != nil {
@@ -301,6 +476,9 @@ func (s *APIParser) ParseDownloadUrls(downloadJSON string) ([]DownloadURL, error
 		if !message.Exists() {
 			return []DownloadURL{}, fmt.Errorf("unexpected response from json with response status '%v', full json was '%v'", string(responseStatus), downloadJSON)
 		}
+		if err := responseErr("", 0, string(responseStatus), string(message.GetStringBytes())); err != nil {
+			return []DownloadURL{}, err
+		}
 		return []DownloadURL{}, fmt.Errorf("failed download due to %v %v", string(responseStatus), message)
 	}
 
@@ -318,3 +496,88 @@ func (s *APIParser) ParseDownloadUrls(downloadJSON string) ([]DownloadURL, error
 	}
 	return response, nil
 }
+
+// ParseCreatedPackage reads the json returned when a package is created, which looks like
+//
+//	{
+//	  "packageId": "GYL4-DVZN",
+//	  "packageCode": "Ny4EAvw7BmQfiRO5KiECs1A2iKLnLzbsHAdtqUN4bQs",
+//	  "serverSecret": "RzRaSkQ1V0lCVE1CS0ZPTkQ3TEFBNjVYRzZXQjRaUUQ=",
+//	  "response": "SUCCESS"
+//	}
+func (s *APIParser) ParseCreatedPackage(packageJSON string) (Package, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v, err := s.jsonParser.Parse(packageJSON)
+	if err != nil {
+		return Package{}, fmt.Errorf("unexpected error parsing created package json string '%v' with error '%v'", packageJSON, err)
+	}
+	p := Package{
+		PackageID:    string(v.GetStringBytes("packageId")),
+		PackageCode:  string(v.GetStringBytes("packageCode")),
+		ServerSecret: string(v.GetStringBytes("serverSecret")),
+	}
+	if p.PackageID == "" {
+		return Package{}, missingFieldError("packageId", packageJSON)
+	}
+	if p.PackageCode == "" {
+		return Package{}, missingFieldError("packageCode", packageJSON)
+	}
+	if p.ServerSecret == "" {
+		return Package{}, missingFieldError("serverSecret", packageJSON)
+	}
+	return p, nil
+}
+
+// ParseFileID reads the id of the file from the json returned when a file is added to a package
+func (s *APIParser) ParseFileID(fileJSON string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v, err := s.jsonParser.Parse(fileJSON)
+	if err != nil {
+		return "", fmt.Errorf("unexpected error parsing file json string '%v' with error '%v'", fileJSON, err)
+	}
+	fileID := string(v.GetStringBytes("fileId"))
+	if fileID == "" {
+		return "", missingFieldError("fileId", fileJSON)
+	}
+	return fileID, nil
+}
+
+// ParseUploadURLs reads the json returned for the upload urls of a file, which looks like
+//
+//	{
+//	  "uploadUrls": [{"part": 1, "url": "https://sendsafely-us-west-2.s3-accelerate.amazonaws.com/..."}],
+//	  "response": "SUCCESS"
+//	}
+func (s *APIParser) ParseUploadURLs(uploadJSON string) ([]UploadURL, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v, err := s.jsonParser.Parse(uploadJSON)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error parsing uploadUrls json string '%v' with error '%v'", uploadJSON, err)
+	}
+	var urls []UploadURL
+	for _, e := range v.GetArray("uploadUrls") {
+		urls = append(urls, UploadURL{
+			Part: e.GetInt("part"),
+			URL:  string(e.GetStringBytes("url")),
+		})
+	}
+	return urls, nil
+}
+
+// ParseLink reads the link of a finalized package, SendSafely returns it in the message field
+func (s *APIParser) ParseLink(finalizeJSON string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	v, err := s.jsonParser.Parse(finalizeJSON)
+	if err != nil {
+		return "", fmt.Errorf("unexpected error parsing finalize json string '%v' with error '%v'", finalizeJSON, err)
+	}
+	link := string(v.GetStringBytes("message"))
+	if !strings.HasPrefix(link, "http") {
+		return "", missingFieldError("message", finalizeJSON)
+	}
+	return link, nil
+}
@@ -18,6 +18,7 @@
 package sendsafely
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -145,6 +146,18 @@ func TestParsingPackage(t *testing.T) {
 		}
 	}
 
+	if expires := p.Expires().String(); expires != "2019-02-11 14:07:28 +0000 UTC" {
+		t.Errorf("unexpected expiration %v", expires)
+	}
+
+	if p.PasswordRequired {
+		t.Error("expected the package to not require a password")
+	}
+
+	if p.RootDirectoryID != "8c3c2184-e73e-4137-be92-e9c5b5661258" {
+		t.Errorf("unexpected root directory id %v", p.RootDirectoryID)
+	}
+
 	ts := p.PackageTimestamp.String()
 	//original format Feb 1, 2019 2:07:28 PM",
 	if ts != "2019-02-01 14:07:28 +0000 UTC" {
@@ -161,3 +174,67 @@ func TestParsingPackage(t *testing.T) {
 		t.Errorf("unexpected state, expected PACKAGE_STATE_IN_PROGRESS but got %v", state)
 	}
 }
+
+func TestParsingDirectory(t *testing.T) {
+	parser := APIParser{}
+	d, err := parser.ParseDirectory("GVG2-MNZT", `{
+		"directory": {
+		  "directoryId": "logsdir",
+		  "directoryName": "logs",
+		  "files": [
+		    {
+		      "fileId": "abcfile",
+		      "fileName": "server.log",
+		      "fileSize": "12",
+		      "parts": 1,
+		      "createdByEmail": "test@test.com",
+		      "fileUploaded": "Jun 9, 2022 1:32:34 PM",
+		      "fileUploadedStr": "Jun 9, 2022 1:32:34 PM",
+		      "fileVersion" : "1"
+		    }
+		  ],
+		  "subDirectories": [
+		    {
+		      "directoryId": "node1dir",
+		      "directoryName": "node1"
+		    }
+		  ]
+		},
+		"response": "SUCCESS"
+	  }`)
+	if err != nil {
+		t.Fatalf("unable to parse with error %v", err)
+	}
+	if d.DirectoryID != "logsdir" || d.Name != "logs" {
+		t.Errorf("unexpected directory %v %v", d.DirectoryID, d.Name)
+	}
+	if len(d.Files) != 1 || d.Files[0].FileID != "abcfile" || d.Files[0].DirectoryID != "logsdir" || d.Files[0].FileSize != 12 {
+		t.Errorf("unexpected files %#v", d.Files)
+	}
+	if len(d.SubDirectories) != 1 || d.SubDirectories[0].DirectoryID != "node1dir" || d.SubDirectories[0].Name != "node1" {
+		t.Errorf("unexpected sub directories %#v", d.SubDirectories)
+	}
+}
+
+func TestParsingDirectoryAtTopLevel(t *testing.T) {
+	parser := APIParser{}
+	d, err := parser.ParseDirectory("GVG2-MNZT", `{"id":"logsdir","name":"logs","files":[],"subdirectories":[{"id":"node1dir","name":"node1"}],"response":"SUCCESS"}`)
+	if err != nil {
+		t.Fatalf("unable to parse with error %v", err)
+	}
+	if d.DirectoryID != "logsdir" || d.Name != "logs" {
+		t.Errorf("unexpected directory %v %v", d.DirectoryID, d.Name)
+	}
+	if len(d.SubDirectories) != 1 || d.SubDirectories[0].DirectoryID != "node1dir" || d.SubDirectories[0].Name != "node1" {
+		t.Errorf("unexpected sub directories %#v", d.SubDirectories)
+	}
+}
+
+func TestParsingDirectoryFailure(t *testing.T) {
+	parser := APIParser{}
+	_, err := parser.ParseDirectory("GVG2-MNZT", `{"response":"UNKNOWN_PACKAGE","message":"package not found"}`)
+	var expired PackageExpiredErr
+	if !errors.As(err, &expired) {
+		t.Errorf("expected a PackageExpiredErr but was %v", err)
+	}
+}
@@ -0,0 +1,305 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// sendsafely package decrypts files, combines file parts into whole files, and handles api access to the sendsafely rest api
+package sendsafely
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sync"
+
+	"github.com/rsvihladremio/ssdownloader/downloader"
+	"github.com/rsvihladremio/ssdownloader/journal"
+	"github.com/rsvihladremio/ssdownloader/storage"
+)
+
+// InProgressSuffix is added to the file name while parts are being streamed into it, it is only
+// renamed to the final name once every part has been decrypted
+const InProgressSuffix = storage.InProgressSuffix
+
+// reorderBufferBytes is how much decrypted data of the parts waiting for the parts before them is held in memory at
+// most, shared between the parts downloading at once
+var reorderBufferBytes = 64 * 1024 * 1024
+
+// streamedPart is the decrypted contents of one part. Until every part before it has been written it is held in memory,
+// up to limit bytes after which the download waits, and once it is the next part to write it goes straight to the file
+type streamedPart struct {
+	part  int
+	limit int
+	lock  sync.Mutex
+	cond  *sync.Cond
+	buf   bytes.Buffer
+	out   io.Writer
+	// accepted is every byte of the part decrypted so far, written counts the ones already in the file
+	accepted int64
+	written  int64
+	// skip is what a new attempt decrypts again that an earlier attempt already accepted
+	skip      int64
+	cancelled bool
+	err       error
+	done      chan struct{}
+}
+
+func newStreamedPart(part, limit int) *streamedPart {
+	sp := &streamedPart{part: part, limit: limit, done: make(chan struct{})}
+	sp.cond = sync.NewCond(&sp.lock)
+	return sp
+}
+
+// Write takes the decrypted contents of the part, an attempt after a failed one starts from the beginning of the part
+// and what an earlier attempt already accepted is dropped since it decrypts to the same bytes
+func (sp *streamedPart) Write(b []byte) (int, error) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	n := len(b)
+	if sp.skip > 0 {
+		skipped := min(sp.skip, int64(len(b)))
+		sp.skip -= skipped
+		b = b[skipped:]
+	}
+	for sp.out == nil && !sp.cancelled && sp.buf.Len()+len(b) > sp.limit {
+		sp.cond.Wait()
+	}
+	if sp.cancelled {
+		return 0, context.Canceled
+	}
+	if sp.out == nil {
+		sp.buf.Write(b)
+		sp.accepted += int64(len(b))
+		return n, nil
+	}
+	written, err := sp.out.Write(b)
+	sp.accepted += int64(written)
+	sp.written += int64(written)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// retry starts a new attempt at the part
+func (sp *streamedPart) retry() {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	sp.skip = sp.accepted
+}
+
+// attach writes what the part holds in memory to out and sends the rest of it straight there
+func (sp *streamedPart) attach(out io.Writer) error {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	defer sp.cond.Broadcast()
+	n, err := sp.buf.WriteTo(out)
+	sp.written += n
+	if err != nil {
+		return err
+	}
+	sp.out = out
+	return nil
+}
+
+// cancel wakes a download waiting for room in the buffer so it can give up
+func (sp *streamedPart) cancel() {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	sp.cancelled = true
+	sp.cond.Broadcast()
+}
+
+// StreamFileParts downloads the parts of the file, decrypting the http body as it arrives and appending the plain text
+// to the end of the file. Up to partThreads parts are downloaded at once, the next part to write goes straight to the
+// file and the ones after it are decrypted into memory until it is their turn, holding at most reorderBufferBytes
+// between them. Compared to writing the encrypted part, the decrypted part and then the combined file, every byte is
+// only written once.
+// With a journal every part written is recorded and the next run appends to the file from the next part on
+func StreamFileParts(ctx context.Context, client Client, d downloader.GenericDownloader, store storage.Storage, j *journal.Journal, p Package, f File, keyCode, fullPath string, partThreads int) (written int64, err error) {
+	tmpName := filepath.Clean(fullPath + InProgressSuffix)
+	out, streamedParts, written, err := openStream(ctx, store, j, p, f, tmpName)
+	if err != nil {
+		return 0, err
+	}
+	closed := false
+	// the part being written to the file, it is waited for before the file is closed
+	var head *streamedPart
+	defer func() {
+		if err == nil {
+			return
+		}
+		if head != nil {
+			<-head.done
+		}
+		if !closed {
+			// with parts recorded in the journal what was written is kept for the next run to append to
+			if streamedParts > 0 && j != nil {
+				if closeErr := out.Close(); closeErr == nil {
+					slog.Info("keeping incomplete file to resume on the next run", "file_name", tmpName, "parts_written", streamedParts, "total_parts", f.Parts)
+					return
+				}
+			}
+			if abortErr := out.Abort(); abortErr != nil {
+				slog.Debug("unable to close file, since this is a cleanup operation it is usually safe to ignore", "file_name", tmpName, "error_msg", abortErr)
+			}
+		}
+		if journalErr := j.StreamedPart(ctx, p.PackageID, f.FileID, tmpName, 0, 0); journalErr != nil {
+			slog.Warn("unable to update download journal", "file_name", tmpName, "error_msg", journalErr)
+		}
+		// the context may be the reason we failed, the incomplete file still needs to go
+		if removeErr := store.Remove(context.WithoutCancel(ctx), tmpName); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			slog.Warn("unable to remove incomplete file so you will need to manually clean this file up", "file_name", tmpName, "error_msg", removeErr)
+		}
+	}()
+
+	// stops the dispatcher and any parts still downloading when we return early
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if partThreads < 1 {
+		partThreads = 1
+	}
+	// a slot is taken before a part starts downloading and given back once it has been written to the file
+	slots := make(chan struct{}, partThreads)
+	// parts in the order they have to be written
+	pending := make(chan *streamedPart, partThreads)
+	go dispatchParts(streamCtx, client, d, p, f, keyCode, streamedParts+1, reorderBufferBytes/partThreads, slots, pending)
+
+	for sp := range pending {
+		head = sp
+		attachErr := sp.attach(out)
+		if attachErr != nil {
+			cancel()
+		}
+		select {
+		case <-sp.done:
+		case <-streamCtx.Done():
+			cancel()
+			return written, streamCtx.Err()
+		}
+		written += sp.written
+		if attachErr != nil {
+			return written, fmt.Errorf("unable to write part %v to file '%v' due to error '%v'", sp.part, tmpName, attachErr)
+		}
+		if sp.err != nil {
+			return written, sp.err
+		}
+		head = nil
+		slog.Debug("file part decrypted", "file_name", tmpName, "part", sp.part, "bytes_written", written)
+		streamedParts = sp.part
+		if err := j.StreamedPart(ctx, p.PackageID, f.FileID, tmpName, streamedParts, written); err != nil {
+			slog.Warn("unable to update download journal, this file will start over if interrupted", "file_name", tmpName, "error_msg", err)
+		}
+		<-slots
+	}
+	if err := streamCtx.Err(); err != nil {
+		return written, err
+	}
+	closed = true
+	if err := out.Close(); err != nil {
+		return written, fmt.Errorf("unable to close file '%v' due to error '%v'", tmpName, err)
+	}
+	if err := store.Rename(ctx, tmpName, fullPath); err != nil {
+		return written, fmt.Errorf("unable to rename file '%v' to '%v' due to error '%v'", tmpName, fullPath, err)
+	}
+	return written, nil
+}
+
+// openStream opens the temporary file parts are streamed into. When the journal has parts recorded for it and the file
+// is still the size it was after the last of them it is appended to, otherwise it is started over
+func openStream(ctx context.Context, store storage.Storage, j *journal.Journal, p Package, f File, tmpName string) (out storage.Writer, streamedParts int, written int64, err error) {
+	streamedParts, written = j.Streamed(p.PackageID, f.FileID, tmpName)
+	if streamedParts > 0 {
+		fi, err := store.Stat(ctx, tmpName)
+		if err == nil && fi.Size == written {
+			out, err := store.Append(ctx, tmpName)
+			if err == nil {
+				slog.Info("resuming file from the download journal", "file_name", tmpName, "parts_written", streamedParts, "total_parts", f.Parts)
+				return out, streamedParts, written, nil
+			}
+			slog.Debug("unable to append to incomplete file, starting over", "file_name", tmpName, "error_msg", err)
+		} else {
+			slog.Debug("incomplete file does not match the download journal, starting over", "file_name", tmpName, "journal_bytes", written, "error_msg", err)
+		}
+	}
+	if err := j.StreamedPart(ctx, p.PackageID, f.FileID, tmpName, 0, 0); err != nil {
+		slog.Warn("unable to update download journal", "file_name", tmpName, "error_msg", err)
+	}
+	out, err = store.Create(ctx, tmpName)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("unable to create file '%v' due to error '%v'", tmpName, err)
+	}
+	return out, 0, 0, nil
+}
+
+// dispatchParts starts a download for every part of the file from first on as slots free up, queuing them on pending in
+// part order. Any problem with the urls is queued as a failed part so the writer sees it in order, pending is always closed when done
+func dispatchParts(ctx context.Context, client Client, d downloader.GenericDownloader, p Package, f File, keyCode string, first, limit int, slots chan struct{}, pending chan *streamedPart) {
+	defer close(pending)
+	failed := func(err error) {
+		sp := newStreamedPart(0, limit)
+		sp.err = err
+		close(sp.done)
+		select {
+		case pending <- sp:
+		case <-ctx.Done():
+		}
+	}
+	nextPart := first
+	done := func(part int) bool { return part < first }
+	for batch := range prefetchDownloadURLs(ctx, client, p, f.FileID, keyCode, f.Parts, done) {
+		if batch.err != nil {
+			failed(fmt.Errorf("unable to get download urls for parts %v-%v: %w", batch.start, batch.end, batch.err))
+			return
+		}
+		for _, u := range batch.urls {
+			if u.Part != nextPart {
+				failed(fmt.Errorf("expected part %v but sendsafely returned part %v", nextPart, u.Part))
+				return
+			}
+			nextPart++
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			sp := newStreamedPart(u.Part, limit)
+			pending <- sp
+			go func(url string) {
+				defer close(sp.done)
+				stop := context.AfterFunc(ctx, sp.cancel)
+				defer stop()
+				err := withFreshURL(ctx, client, p, f.FileID, keyCode, sp.part, url, func(url string) error {
+					return d.StreamFile(ctx, url, func(body io.Reader) error {
+						// a failed attempt may have decrypted some of the part already
+						sp.retry()
+						_, err := DecryptStream(body, sp, p.ServerSecret, keyCode)
+						return err
+					})
+				})
+				if err != nil {
+					sp.err = fmt.Errorf("unable to stream part %v: %w", sp.part, err)
+				}
+			}(u.URL)
+		}
+	}
+	if ctx.Err() == nil && nextPart <= f.Parts {
+		failed(fmt.Errorf("only received %v of %v parts", nextPart-1, f.Parts))
+	}
+}
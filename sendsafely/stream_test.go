@@ -0,0 +1,276 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// sendsafely package decrypts files, combines file parts into whole files, and handles api access to the sendsafely rest api
+package sendsafely
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rsvihladremio/ssdownloader/journal"
+	"github.com/rsvihladremio/ssdownloader/retry"
+	"github.com/rsvihladremio/ssdownloader/storage"
+)
+
+func TestStreamFileParts(t *testing.T) {
+	p := Package{ServerSecret: "serverSecretPassword"}
+	f := File{FileID: "fileID1", FileName: "filename1.txt", Parts: 2}
+	mockClient := &MockClient{}
+	// sendsafely does not promise any order so make sure we sort them
+	mockClient.GetDownloadUrlsForFileDownloadUrls = []DownloadURL{
+		{Part: 2, URL: "http://localhost:1999/part2"},
+		{Part: 1, URL: "http://localhost:1999/part1"},
+	}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: "keyCode", FailFirstStream: true}
+	fullPath := filepath.Join(t.TempDir(), f.FileName)
+	written, err := StreamFileParts(context.Background(), mockClient, mockDownloader, storage.NewLocal(), nil, p, f, "keyCode", fullPath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "content of http://localhost:1999/part1content of http://localhost:1999/part2"
+	b, err := os.ReadFile(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected {
+		t.Errorf("expected '%v' but was '%v'", expected, string(b))
+	}
+	if written != int64(len(expected)) {
+		t.Errorf("expected %v bytes written but was %v", len(expected), written)
+	}
+	if _, err := os.Stat(fullPath + InProgressSuffix); !os.IsNotExist(err) {
+		t.Errorf("expected in progress file to be renamed but stat returned %v", err)
+	}
+}
+
+func TestStreamFilePartsRemovesIncompleteFile(t *testing.T) {
+	p := Package{ServerSecret: "serverSecretPassword"}
+	f := File{FileID: "fileID1", FileName: "filename1.txt", Parts: 1}
+	mockClient := &MockClient{}
+	mockClient.GetDownloadUrlsForFileDownloadUrls = []DownloadURL{{Part: 1, URL: "http://localhost:1999/part1"}}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: "keyCode", Err: errors.New("connection refused")}
+	fullPath := filepath.Join(t.TempDir(), f.FileName)
+	if _, err := StreamFileParts(context.Background(), mockClient, mockDownloader, storage.NewLocal(), nil, p, f, "keyCode", fullPath, 1); err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, name := range []string{fullPath, fullPath + InProgressSuffix} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("expected %v to not exist but stat returned %v", name, err)
+		}
+	}
+}
+
+func TestStreamFilePartsWithMissingPart(t *testing.T) {
+	p := Package{ServerSecret: "serverSecretPassword"}
+	f := File{FileID: "fileID1", FileName: "filename1.txt", Parts: 2}
+	mockClient := &MockClient{}
+	mockClient.GetDownloadUrlsForFileDownloadUrls = []DownloadURL{{Part: 2, URL: "http://localhost:1999/part2"}}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: "keyCode"}
+	fullPath := filepath.Join(t.TempDir(), f.FileName)
+	if _, err := StreamFileParts(context.Background(), mockClient, mockDownloader, storage.NewLocal(), nil, p, f, "keyCode", fullPath, 1); err == nil {
+		t.Fatal("expected an error for the missing first part")
+	}
+}
+
+func TestStreamFilePartsInParallelKeepsPartOrder(t *testing.T) {
+	p := Package{ServerSecret: "serverSecretPassword"}
+	f := File{FileID: "fileID1", FileName: "filename1.txt", Parts: 60}
+	mockClient := &MockClient{URLsByPart: true}
+	// the first parts finish last
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: "keyCode", Delays: map[string]time.Duration{
+		"http://localhost:1999/part1": 50 * time.Millisecond,
+		"http://localhost:1999/part2": 20 * time.Millisecond,
+	}}
+	fullPath := filepath.Join(t.TempDir(), f.FileName)
+	if _, err := StreamFileParts(context.Background(), mockClient, mockDownloader, storage.NewLocal(), nil, p, f, "keyCode", fullPath, 4); err != nil {
+		t.Fatal(err)
+	}
+	var expected strings.Builder
+	for i := 1; i <= f.Parts; i++ {
+		expected.WriteString(fmt.Sprintf("content of http://localhost:1999/part%v", i))
+	}
+	b, err := os.ReadFile(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected.String() {
+		t.Errorf("parts were written out of order '%v'", string(b))
+	}
+	if !reflect.DeepEqual(mockClient.Starts, []int{1, 26, 51}) {
+		t.Errorf("expected url batches starting at 1, 26 and 51 but was %v", mockClient.Starts)
+	}
+}
+
+func TestStreamFilePartsWaitsWhenReorderBufferIsFull(t *testing.T) {
+	old := reorderBufferBytes
+	defer func() {
+		reorderBufferBytes = old
+	}()
+	// too small for any part, the parts after the first can only be written once it is their turn
+	reorderBufferBytes = 4
+	p := Package{ServerSecret: "serverSecretPassword"}
+	f := File{FileID: "fileID1", FileName: "filename1.txt", Parts: 8}
+	mockClient := &MockClient{URLsByPart: true}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: "keyCode", Delays: map[string]time.Duration{
+		"http://localhost:1999/part1": 50 * time.Millisecond,
+	}}
+	fullPath := filepath.Join(t.TempDir(), f.FileName)
+	if _, err := StreamFileParts(context.Background(), mockClient, mockDownloader, storage.NewLocal(), nil, p, f, "keyCode", fullPath, 4); err != nil {
+		t.Fatal(err)
+	}
+	var expected strings.Builder
+	for i := 1; i <= f.Parts; i++ {
+		expected.WriteString(fmt.Sprintf("content of http://localhost:1999/part%v", i))
+	}
+	b, err := os.ReadFile(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected.String() {
+		t.Errorf("parts were written out of order '%v'", string(b))
+	}
+}
+
+func TestStreamedPartSkipsWhatAnEarlierAttemptWrote(t *testing.T) {
+	var out strings.Builder
+	sp := newStreamedPart(1, 0)
+	if err := sp.attach(&out); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sp.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	sp.retry()
+	if _, err := sp.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hello world" || sp.written != int64(len("hello world")) {
+		t.Errorf("expected 'hello world' written once but was '%v' with %v bytes counted", out.String(), sp.written)
+	}
+}
+
+func TestStreamFilePartsRefreshesExpiredURLs(t *testing.T) {
+	p := Package{ServerSecret: "serverSecretPassword"}
+	f := File{FileID: "fileID1", FileName: "filename1.txt", Parts: 2}
+	mockClient := &MockClient{URLsByPart: true}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: "keyCode", Expired: map[string]bool{"http://localhost:1999/part1": true}}
+	fullPath := filepath.Join(t.TempDir(), f.FileName)
+	if _, err := StreamFileParts(context.Background(), mockClient, mockDownloader, storage.NewLocal(), nil, p, f, "keyCode", fullPath, 2); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mockClient.Starts, []int{1, 1}) || !reflect.DeepEqual(mockClient.Ends, []int{2, 1}) {
+		t.Errorf("expected a url request for parts 1-2 and then only part 1 but was starts %v and ends %v", mockClient.Starts, mockClient.Ends)
+	}
+	b, err := os.ReadFile(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "content of http://localhost:1999/part1content of http://localhost:1999/part2"
+	if string(b) != expected {
+		t.Errorf("expected '%v' but was '%v'", expected, string(b))
+	}
+}
+
+func TestStreamFilePartsResumesFromJournal(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewLocal()
+	dir := t.TempDir()
+	j, err := journal.Open(ctx, store, filepath.Join(dir, journal.FileName), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Package{PackageID: "packageID", ServerSecret: "serverSecretPassword"}
+	f := File{FileID: "fileID1", FileName: "filename1.txt", Parts: 30}
+	fullPath := filepath.Join(dir, f.FileName)
+	mockClient := &MockClient{URLsByPart: true}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: "keyCode", URLErrs: map[string]error{
+		"http://localhost:1999/part28": retry.PermanentErr{BaseErr: errors.New("connection refused")},
+	}}
+	if _, err := StreamFileParts(ctx, mockClient, mockDownloader, store, j, p, f, "keyCode", fullPath, 1); err == nil {
+		t.Fatal("expected part 28 to fail")
+	}
+	if parts, _ := j.Streamed(p.PackageID, f.FileID, fullPath+InProgressSuffix); parts != 27 {
+		t.Fatalf("expected 27 parts in the journal but was %v", parts)
+	}
+
+	// the next run picks up at part 28 and never asks for the urls of the first batch
+	mockClient = &MockClient{URLsByPart: true}
+	mockDownloader = &MockDownloader{Pass: p.ServerSecret, KeyCode: "keyCode"}
+	if _, err := StreamFileParts(ctx, mockClient, mockDownloader, store, j, p, f, "keyCode", fullPath, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mockClient.Starts, []int{26}) {
+		t.Errorf("expected only the url batch starting at 26 but was %v", mockClient.Starts)
+	}
+	expectedURLs := []string{"http://localhost:1999/part28", "http://localhost:1999/part29", "http://localhost:1999/part30"}
+	if !reflect.DeepEqual(mockDownloader.Urls, expectedURLs) {
+		t.Errorf("expected %v but was %v", expectedURLs, mockDownloader.Urls)
+	}
+	var expected strings.Builder
+	for i := 1; i <= f.Parts; i++ {
+		expected.WriteString(fmt.Sprintf("content of http://localhost:1999/part%v", i))
+	}
+	b, err := os.ReadFile(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected.String() {
+		t.Errorf("expected '%v' but was '%v'", expected.String(), string(b))
+	}
+}
+
+func TestStreamFilePartsStartsOverWhenFileDoesNotMatchJournal(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewLocal()
+	dir := t.TempDir()
+	j, err := journal.Open(ctx, store, filepath.Join(dir, journal.FileName), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Package{PackageID: "packageID", ServerSecret: "serverSecretPassword"}
+	f := File{FileID: "fileID1", FileName: "filename1.txt", Parts: 2}
+	fullPath := filepath.Join(dir, f.FileName)
+	// a crash between writing a part and recording it leaves more in the file than the journal knows about
+	if err := os.WriteFile(fullPath+InProgressSuffix, []byte("content of part 1 and then some"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.StreamedPart(ctx, p.PackageID, f.FileID, fullPath+InProgressSuffix, 1, 5); err != nil {
+		t.Fatal(err)
+	}
+	mockDownloader := &MockDownloader{Pass: p.ServerSecret, KeyCode: "keyCode"}
+	if _, err := StreamFileParts(ctx, &MockClient{URLsByPart: true}, mockDownloader, store, j, p, f, "keyCode", fullPath, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(mockDownloader.Urls) != 2 {
+		t.Errorf("expected both parts to be downloaded again but was %v", mockDownloader.Urls)
+	}
+	b, err := os.ReadFile(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "content of http://localhost:1999/part1content of http://localhost:1999/part2"
+	if string(b) != expected {
+		t.Errorf("expected '%v' but was '%v'", expected, string(b))
+	}
+}
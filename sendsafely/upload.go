@@ -0,0 +1,368 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// sendsafely package decrypts files, combines file parts into whole files, and handles api access to the sendsafely rest api
+package sendsafely
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/rsvihladremio/ssdownloader/retry"
+)
+
+// UploadPartSize is how much of a file goes into each encrypted part, the same as the SendSafely clients use
+const UploadPartSize = 2621440
+
+// UploadURL is where a part of a file is uploaded to
+type UploadURL struct {
+	Part int
+	URL  string
+}
+
+// Sender is the part of the api used to create a package and upload files to it
+type Sender interface {
+	CreatePackage(ctx context.Context) (Package, error)
+	AddRecipient(ctx context.Context, p Package, email string) error
+	CreateFile(ctx context.Context, p Package, fileName string, fileSize int64, parts int) (string, error)
+	GetUploadURLs(ctx context.Context, p Package, fileID string, start, end int) ([]UploadURL, error)
+	UploadPart(ctx context.Context, url string, encrypted []byte) error
+	CompleteFile(ctx context.Context, p Package, fileID string) error
+	FinalizePackage(ctx context.Context, p Package, keyCode string) (string, error)
+}
+
+// NewSender is NewClient for sending files, the arguments are the same
+func NewSender(apiURL, ssAPIKey, ssAPISecret string, httpClient *http.Client, policy retry.Policy, verbose bool) Sender {
+	return NewClient(apiURL, ssAPIKey, ssAPISecret, httpClient, policy, verbose).(*DownloadClient)
+}
+
+// SendArgs are the files to send and who to send them to
+type SendArgs struct {
+	Files      []string
+	Recipients []string
+	// PartSize is how much of a file goes in each part, 0 uses UploadPartSize
+	PartSize int64
+}
+
+// SendFiles creates a package for the recipients, encrypts and uploads every file to it part by part and finalizes
+// it. The returned link has the keycode in it the same as the links SendSafely sends and is the only place the
+// keycode is kept, so anyone with the link can download the files
+func SendFiles(ctx context.Context, s Sender, a SendArgs) (string, error) {
+	if len(a.Files) == 0 {
+		return "", errors.New("no files to send")
+	}
+	if len(a.Recipients) == 0 {
+		return "", errors.New("at least one recipient is required")
+	}
+	partSize := a.PartSize
+	if partSize <= 0 {
+		partSize = UploadPartSize
+	}
+	keyCode, err := NewKeyCode()
+	if err != nil {
+		return "", err
+	}
+	p, err := s.CreatePackage(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unable to create package: %w", err)
+	}
+	slog.Debug("created package", "package_id", p.PackageID)
+	for _, email := range a.Recipients {
+		if err := s.AddRecipient(ctx, p, email); err != nil {
+			return "", fmt.Errorf("unable to add recipient %v to package %v: %w", email, p.PackageID, err)
+		}
+	}
+	for _, fileName := range a.Files {
+		if err := sendFile(ctx, s, p, keyCode, fileName, partSize); err != nil {
+			return "", err
+		}
+	}
+	link, err := s.FinalizePackage(ctx, p, keyCode)
+	if err != nil {
+		return "", fmt.Errorf("unable to finalize package %v: %w", p.PackageID, err)
+	}
+	return link + "#keyCode=" + keyCode, nil
+}
+
+func sendFile(ctx context.Context, s Sender, p Package, keyCode, fileName string, partSize int64) error {
+	f, err := os.Open(filepath.Clean(fileName))
+	if err != nil {
+		return fmt.Errorf("unable to read %v due to error %v", fileName, err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Debug("unable to close file, since this is a cleanup operation it is usually safe to ignore", "file_name", fileName, "error_msg", err)
+		}
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to read %v due to error %v", fileName, err)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%v is a directory, only files can be sent", fileName)
+	}
+	// an empty file is still sent as one empty part
+	parts := max(int((fi.Size()+partSize-1)/partSize), 1)
+	fileID, err := s.CreateFile(ctx, p, filepath.Base(fileName), fi.Size(), parts)
+	if err != nil {
+		return fmt.Errorf("unable to add file %v to package %v: %w", fileName, p.PackageID, err)
+	}
+	buf := make([]byte, partSize)
+	for _, r := range calculateExecutionCalls(parts) {
+		urls, err := s.GetUploadURLs(ctx, p, fileID, r.StartSegment, r.EndSegment)
+		if err != nil {
+			return fmt.Errorf("unable to get upload urls for file %v: %w", fileName, err)
+		}
+		for _, u := range urls {
+			n, err := f.ReadAt(buf, int64(u.Part-1)*partSize)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return fmt.Errorf("unable to read part %v of %v due to error %v", u.Part, fileName, err)
+			}
+			var encrypted bytes.Buffer
+			if err := EncryptStream(bytes.NewReader(buf[:n]), &encrypted, p.ServerSecret, keyCode); err != nil {
+				return fmt.Errorf("unable to encrypt part %v of %v due to error %v", u.Part, fileName, err)
+			}
+			if err := s.UploadPart(ctx, u.URL, encrypted.Bytes()); err != nil {
+				return fmt.Errorf("unable to upload part %v of %v: %w", u.Part, fileName, err)
+			}
+			fmt.Print(".")
+			slog.Debug("uploaded part", "file_name", fileName, "part", u.Part, "total_parts", parts)
+		}
+	}
+	if err := s.CompleteFile(ctx, p, fileID); err != nil {
+		return fmt.Errorf("unable to complete upload of %v: %w", fileName, err)
+	}
+	return nil
+}
+
+// NewKeyCode makes the random 256 bit client secret of a new package
+func NewKeyCode() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate keycode due to error %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// EncryptStream encrypts a file part with the pgp options documented on DecryptPart so SendSafely and DecryptPart
+// can decrypt it
+func EncryptStream(r io.Reader, w io.Writer, serverSecret, keyCode string) error {
+	config := &packet.Config{
+		DefaultCipher:     packet.CipherAES256,
+		DefaultHash:       crypto.Hash(crypto.SHA256),
+		Time:              getTimeGenerator(),
+		S2KCount:          65535,
+		CompressionConfig: &packet.CompressionConfig{Level: 0},
+	}
+	pt, err := openpgp.SymmetricallyEncrypt(w, []byte(serverSecret+keyCode), &openpgp.FileHints{IsBinary: true}, config)
+	if err != nil {
+		return fmt.Errorf("unable to setup encryption due to error '%v'", err)
+	}
+	if _, err := io.Copy(pt, r); err != nil {
+		return fmt.Errorf("unable to encrypt due to error '%v'", err)
+	}
+	return pt.Close()
+}
+
+// CreatePackage starts a new package, the package id, code and server secret of the reply are returned
+func (s *DownloadClient) CreatePackage(ctx context.Context) (Package, error) {
+	body, err := s.signedCreate(ctx, http.MethodPut, "", []string{"package/"}, map[string]any{"vdr": false})
+	if err != nil {
+		return Package{}, err
+	}
+	return s.parser.ParseCreatedPackage(string(body))
+}
+
+// AddRecipient shares the package with the email
+func (s *DownloadClient) AddRecipient(ctx context.Context, p Package, email string) error {
+	_, err := s.signedRequest(ctx, http.MethodPut, p.PackageID, []string{"package", p.PackageID, "recipient/"}, map[string]any{"email": email})
+	return err
+}
+
+// CreateFile adds a file to the package and returns its id, the parts are uploaded with GetUploadURLs and UploadPart
+func (s *DownloadClient) CreateFile(ctx context.Context, p Package, fileName string, fileSize int64, parts int) (string, error) {
+	body, err := s.signedCreate(ctx, http.MethodPut, p.PackageID, []string{"package", p.PackageID, "file/"}, map[string]any{
+		"filename":   fileName,
+		"uploadType": "JAVA_API",
+		"parts":      parts,
+		"filesize":   fileSize,
+	})
+	if err != nil {
+		return "", err
+	}
+	return s.parser.ParseFileID(string(body))
+}
+
+// GetUploadURLs retrieves the urls to upload parts start to end of the file to, at most 25 at a time
+func (s *DownloadClient) GetUploadURLs(ctx context.Context, p Package, fileID string, start, end int) ([]UploadURL, error) {
+	body, err := s.signedRequest(ctx, http.MethodPost, p.PackageID, []string{"package", p.PackageID, "file", fileID, "upload-urls/"}, map[string]any{
+		"part":         start,
+		"startSegment": start,
+		"endSegment":   end,
+	})
+	if err != nil {
+		return nil, err
+	}
+	urls, err := s.parser.ParseUploadURLs(string(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(urls) != end-start+1 {
+		return nil, fmt.Errorf("expected %v upload urls for parts %v-%v but sendsafely returned %v", end-start+1, start, end, len(urls))
+	}
+	return urls, nil
+}
+
+// UploadPart puts an encrypted part to the presigned url, transient failures are retried according to the retry policy
+func (s *DownloadClient) UploadPart(ctx context.Context, url string, encrypted []byte) error {
+	return retry.Do(ctx, s.policy, "upload part", func() error {
+		r, err := s.client.R().
+			SetContext(ctx).
+			SetBody(encrypted).
+			Put(url)
+		if err != nil {
+			return fmt.Errorf("unexpected error '%w' while uploading part", err)
+		}
+		if r.StatusCode() > 299 {
+			return retry.HTTPStatusErr{Code: r.StatusCode(), URL: url, RetryAfter: retry.ParseRetryAfter(r.Header().Get("Retry-After"))}
+		}
+		return nil
+	})
+}
+
+// CompleteFile marks every part of the file as uploaded
+func (s *DownloadClient) CompleteFile(ctx context.Context, p Package, fileID string) error {
+	_, err := s.signedRequest(ctx, http.MethodPost, p.PackageID, []string{"package", p.PackageID, "file", fileID, "upload-complete/"}, map[string]any{"complete": true})
+	return err
+}
+
+// FinalizePackage makes the package available to the recipients and returns its link without the keycode
+func (s *DownloadClient) FinalizePackage(ctx context.Context, p Package, keyCode string) (string, error) {
+	body, err := s.signedRequest(ctx, http.MethodPost, p.PackageID, []string{"package", p.PackageID, "finalize/"}, map[string]any{
+		"checksum": s.generateChecksum(keyCode, p.PackageCode),
+	})
+	if err != nil {
+		return "", err
+	}
+	return s.parser.ParseLink(string(body))
+}
+
+// signedRequest sends the json body to the api path made of pathParts with the ss-request-signature header and
+// returns the reply once the response field says it succeeded. Transient failures are retried according to the
+// retry policy
+func (s *DownloadClient) signedRequest(ctx context.Context, method, packageID string, pathParts []string, payload map[string]any) ([]byte, error) {
+	return s.signed(ctx, method, packageID, pathParts, payload, nil)
+}
+
+// signedCreate is signedRequest for the requests that create a package or a file, sending one of them again after
+// SendSafely acted on it would create a second one. It is only tried again when the request never left or SendSafely
+// turned it away with a 429 or 503
+func (s *DownloadClient) signedCreate(ctx context.Context, method, packageID string, pathParts []string, payload map[string]any) ([]byte, error) {
+	return s.signed(ctx, method, packageID, pathParts, payload, notCreated)
+}
+
+// signed sends the request, retrying it with the policy of the client. When resendable is set an error it does not
+// accept is not retried
+func (s *DownloadClient) signed(ctx context.Context, method, packageID string, pathParts []string, payload map[string]any, resendable func(error) bool) ([]byte, error) {
+	// validating client is set in the first place
+	if s.client == nil {
+		return nil, errors.New("client was never initialized. Please use NewSendSafelyClient to initialize SendSafelyClient")
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("unable to write request body due to error '%v'", err)
+	}
+	body := string(b)
+	urlPath := strings.Join(append([]string{s.basePath}, pathParts...), "/")
+	requestPath := strings.Join(append([]string{s.baseURL}, pathParts...), "/")
+	var reply []byte
+	err = retry.Do(ctx, s.policy, method+" "+requestPath, func() error {
+		return withClockRetry(func() error {
+			var err error
+			reply, err = s.sendSigned(ctx, method, packageID, urlPath, requestPath, body)
+			if err != nil && resendable != nil && !resendable(err) {
+				return retry.PermanentErr{BaseErr: err}
+			}
+			return err
+		})
+	})
+	return reply, err
+}
+
+// notCreated is true for the errors that show SendSafely did not act on the request: the connection was never made,
+// the request was rate limited or the service was unavailable. The timestamp rejections withClockRetry handles are
+// not acted on either
+func notCreated(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var clockSkewErr ClockSkewErr
+	if errors.As(err, &clockSkewErr) {
+		return true
+	}
+	var statusErr retry.HTTPStatusErr
+	if errors.As(err, &statusErr) {
+		return statusErr.Code == http.StatusTooManyRequests || statusErr.Code == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// sendSigned sends the request once and returns the reply when it succeeded
+func (s *DownloadClient) sendSigned(ctx context.Context, method, packageID, urlPath, requestPath, body string) ([]byte, error) {
+	ts := getNow().Format("2006-01-02T15:04:05-0700")
+	sig, err := s.generateRequestSignature(ts, urlPath, body)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error generating request signature '%v'", err)
+	}
+	r, err := s.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("ss-api-key", s.ssAPIKey).
+		SetHeader("ss-request-timestamp", ts).
+		SetHeader("ss-request-signature", sig).
+		SetBody(body).
+		Execute(method, requestPath)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error '%w' while sending request '%v'", err, requestPath)
+	}
+	if err := s.statusErr(packageID, requestPath, r); err != nil {
+		return nil, err
+	}
+	if s.verbose {
+		slog.Debug("sendsafely response", "request_path", requestPath, "http_response_body", string(r.Body()))
+	}
+	return r.Body(), nil
+}
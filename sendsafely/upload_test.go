@@ -0,0 +1,217 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// sendsafely package decrypts files, combines file parts into whole files, and handles api access to the sendsafely rest api
+package sendsafely
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+)
+
+func TestEncryptStreamRoundTrip(t *testing.T) {
+	var encrypted bytes.Buffer
+	if err := EncryptStream(strings.NewReader("my uploaded text"), &encrypted, "serverSecret", "keyCode"); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if _, err := DecryptStream(&encrypted, &out, "serverSecret", "keyCode"); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "my uploaded text" {
+		t.Errorf("expected 'my uploaded text' but was '%v'", out.String())
+	}
+}
+
+func TestNewKeyCode(t *testing.T) {
+	a, err := NewKeyCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewKeyCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 43 || a == b {
+		t.Errorf("expected two different 43 character keycodes but had '%v' and '%v'", a, b)
+	}
+}
+
+// TestSendFiles runs the whole upload against a mocked api and decrypts the uploaded parts to check they are the file
+func TestSendFiles(t *testing.T) {
+	ssClient := NewSender(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
+	httpmock.ActivateNonDefault(ssClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+
+	var lock sync.Mutex
+	var requests []string
+	var recipients []string
+	var createdFile map[string]any
+	var finalized map[string]any
+	parts := make(map[string][]byte)
+	signed := func(reply string, into *map[string]any) httpmock.Responder {
+		return func(r *http.Request) (*http.Response, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				return nil, err
+			}
+			sig, err := ssClient.generateRequestSignature(r.Header.Get("ss-request-timestamp"), r.URL.Path, string(body))
+			if err != nil {
+				return nil, err
+			}
+			if r.Header.Get("ss-api-key") != "myApiKey" || r.Header.Get("ss-request-signature") != sig {
+				return httpmock.NewStringResponse(401, `{"response":"AUTHENTICATION_FAILED","message":"bad signature"}`), nil
+			}
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			if into != nil {
+				if err := json.Unmarshal(body, into); err != nil {
+					return nil, err
+				}
+			}
+			return httpmock.NewStringResponse(200, reply), nil
+		}
+	}
+	var recipient map[string]any
+	httpmock.RegisterResponder("PUT", URL+"/package/", signed(`{"packageId":"GYL4-DVZN","packageCode":"pkgCode","serverSecret":"secret","response":"SUCCESS"}`, nil))
+	httpmock.RegisterResponder("PUT", URL+"/package/GYL4-DVZN/recipient/", func(r *http.Request) (*http.Response, error) {
+		resp, err := signed(`{"recipientId":"r1","response":"SUCCESS"}`, &recipient)(r)
+		recipients = append(recipients, fmt.Sprint(recipient["email"]))
+		return resp, err
+	})
+	httpmock.RegisterResponder("PUT", URL+"/package/GYL4-DVZN/file/", signed(`{"fileId":"file-1","response":"SUCCESS"}`, &createdFile))
+	httpmock.RegisterResponder("POST", URL+"/package/GYL4-DVZN/file/file-1/upload-urls/", func(r *http.Request) (*http.Response, error) {
+		var segments map[string]any
+		if _, err := signed("", &segments)(r); err != nil {
+			return nil, err
+		}
+		var urls []string
+		for i := int(segments["startSegment"].(float64)); i <= int(segments["endSegment"].(float64)); i++ {
+			urls = append(urls, fmt.Sprintf(`{"part":%v,"url":"https://upload.example.com/part-%v"}`, i, i))
+		}
+		return httpmock.NewStringResponse(200, `{"uploadUrls":[`+strings.Join(urls, ",")+`],"response":"SUCCESS"}`), nil
+	})
+	httpmock.RegisterResponder("PUT", `=~^https://upload\.example\.com/part-\d+$`, func(r *http.Request) (*http.Response, error) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		parts[r.URL.Path] = body
+		return httpmock.NewStringResponse(200, ""), nil
+	})
+	httpmock.RegisterResponder("POST", URL+"/package/GYL4-DVZN/file/file-1/upload-complete/", signed(`{"response":"SUCCESS"}`, nil))
+	httpmock.RegisterResponder("POST", URL+"/package/GYL4-DVZN/finalize/", signed(`{"message":"https://demo.sendsafely.com/receive/?packageCode=pkgCode","response":"SUCCESS"}`, &finalized))
+
+	fileName := filepath.Join(t.TempDir(), "diag.txt")
+	content := strings.Repeat("0123456789", 7)
+	if err := os.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	link, err := SendFiles(context.Background(), ssClient, SendArgs{
+		Files:      []string{fileName},
+		Recipients: []string{"support@example.com", "me@example.com"},
+		PartSize:   30,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error sending files '%v'", err)
+	}
+
+	keyCode, found := strings.CutPrefix(link, "https://demo.sendsafely.com/receive/?packageCode=pkgCode#keyCode=")
+	if !found || keyCode == "" {
+		t.Fatalf("unexpected link '%v'", link)
+	}
+	if finalized["checksum"] != ssClient.generateChecksum(keyCode, "pkgCode") {
+		t.Errorf("unexpected finalize checksum '%v'", finalized["checksum"])
+	}
+	if strings.Join(recipients, ",") != "support@example.com,me@example.com" {
+		t.Errorf("unexpected recipients %v", recipients)
+	}
+	if createdFile["filename"] != "diag.txt" || createdFile["parts"] != float64(3) || createdFile["filesize"] != float64(70) {
+		t.Errorf("unexpected file %v", createdFile)
+	}
+	if requests[len(requests)-1] != "POST /api/v2.0/package/GYL4-DVZN/finalize/" {
+		t.Errorf("expected the package to be finalized last but requests were %v", requests)
+	}
+	var decrypted strings.Builder
+	for i := 1; i <= 3; i++ {
+		encrypted, ok := parts[fmt.Sprintf("/part-%v", i)]
+		if !ok {
+			t.Fatalf("part %v was never uploaded", i)
+		}
+		if _, err := DecryptStream(bytes.NewReader(encrypted), &decrypted, "secret", keyCode); err != nil {
+			t.Fatalf("unable to decrypt part %v '%v'", i, err)
+		}
+	}
+	if decrypted.String() != content {
+		t.Errorf("expected the uploaded parts to decrypt to '%v' but was '%v'", content, decrypted.String())
+	}
+}
+
+func TestCreatePackageOnlyRetriedWhenNotCreated(t *testing.T) {
+	ssClient := NewSender(URL, "myApiKey", "mySecret", &http.Client{}, testPolicy(), false).(*DownloadClient)
+	httpmock.ActivateNonDefault(ssClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+
+	for _, tc := range []struct {
+		status   int
+		calls    int
+		expected bool
+	}{
+		// the package may have been created before the server failed, a second one is not made
+		{status: http.StatusInternalServerError, calls: 1, expected: false},
+		{status: http.StatusBadGateway, calls: 1, expected: false},
+		{status: http.StatusServiceUnavailable, calls: 2, expected: true},
+		{status: http.StatusTooManyRequests, calls: 2, expected: true},
+	} {
+		httpmock.Reset()
+		calls := 0
+		httpmock.RegisterResponder("PUT", URL+"/package/", func(_ *http.Request) (*http.Response, error) {
+			calls++
+			if calls == 1 {
+				return httpmock.NewStringResponse(tc.status, `{"response":"FAIL"}`), nil
+			}
+			return httpmock.NewStringResponse(200, `{"packageId":"GYL4-DVZN","packageCode":"pkgCode","serverSecret":"secret","response":"SUCCESS"}`), nil
+		})
+		_, err := ssClient.CreatePackage(context.Background())
+		if (err == nil) != tc.expected {
+			t.Errorf("expected success %v after a %v but error was %v", tc.expected, tc.status, err)
+		}
+		if calls != tc.calls {
+			t.Errorf("expected %v requests after a %v but was %v", tc.calls, tc.status, calls)
+		}
+	}
+}
+
+func TestSendFilesRequiresRecipient(t *testing.T) {
+	_, err := SendFiles(context.Background(), nil, SendArgs{Files: []string{"a.txt"}})
+	if err == nil || err.Error() != "at least one recipient is required" {
+		t.Errorf("expected a missing recipient error but was %v", err)
+	}
+}
@@ -0,0 +1,398 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// sendsafelytest package runs a fake sendsafely api in process so the download, decrypt and combine flow can be tested offline
+package sendsafelytest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// BasePath is where the api is served, the same as on sendsafely.com
+const BasePath = "/api/v2.0"
+
+// DefaultPartSize is how much of a file goes in each part when File.PartSize is not set, the same as SendSafely uses
+const DefaultPartSize = 2621440
+
+// TimestampTolerance is how far the ss-request-timestamp can be from the server clock before the request is rejected
+const TimestampTolerance = 5 * time.Minute
+
+// dateFmt is the format SendSafely uses for the timestamps of packages and files
+const dateFmt = "Jan 2, 2006 3:04:05 PM"
+
+// File is a file of a fake package, Content is split into parts of PartSize that are encrypted when the package is
+// added to the server
+type File struct {
+	FileID     string
+	Name       string
+	Content    []byte
+	PartSize   int
+	UploadedBy string
+}
+
+// Package is a fake package, the link to it returned by Server.AddPackage has the PackageCode and KeyCode
+type Package struct {
+	PackageID    string
+	PackageCode  string
+	ServerSecret string
+	KeyCode      string
+	Files        []File
+}
+
+// fakePackage is a package with its parts already encrypted
+type fakePackage struct {
+	Package
+	expired bool
+	// parts are the encrypted parts of each file by file id, parts[fileID][0] is part 1
+	parts map[string][][]byte
+}
+
+// fault is a scripted failure, it applies to requests for the path until it has happened times times
+type fault struct {
+	path   string
+	status int
+	body   string
+	// truncate sends only half of the body while still promising all of it in the Content-Length
+	truncate bool
+	times    int
+}
+
+// Server is a fake SendSafely api speaking the package information and download-urls endpoints and serving the
+// encrypted parts. Every api request must carry a valid ss-request-signature and download-urls requests must carry
+// the PBKDF2 checksum of the keycode, just like the real api. Failures are scripted with FailRequests, ExpirePartURL,
+// TruncatePart and ExpirePackage
+type Server struct {
+	*httptest.Server
+	APIKey    string
+	APISecret string
+	// ClockSkew is how far the server clock is ahead of ours, it is sent in the Date header of every response and
+	// requests with a timestamp more than TimestampTolerance from it fail the signature check
+	ClockSkew time.Duration
+
+	lock     sync.Mutex
+	packages map[string]*fakePackage
+	faults   []*fault
+	requests []string
+}
+
+// NewServer starts a fake api that accepts requests signed with apiKey and apiSecret, call Close when done
+func NewServer(apiKey, apiSecret string) *Server {
+	s := &Server{
+		APIKey:    apiKey,
+		APISecret: apiSecret,
+		packages:  make(map[string]*fakePackage),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// APIURL is the url to configure the sendsafely client with
+func (s *Server) APIURL() string {
+	return s.URL + BasePath
+}
+
+// AddPackage encrypts the parts of every file of the package and returns the link to download it
+func (s *Server) AddPackage(p Package) (string, error) {
+	fp := &fakePackage{Package: p, parts: make(map[string][][]byte)}
+	for _, f := range p.Files {
+		partSize := f.PartSize
+		if partSize <= 0 {
+			partSize = DefaultPartSize
+		}
+		content := f.Content
+		// an empty file is still one empty part
+		for first := true; first || len(content) > 0; first = false {
+			n := min(partSize, len(content))
+			encrypted, err := Encrypt(content[:n], p.ServerSecret+p.KeyCode)
+			if err != nil {
+				return "", err
+			}
+			fp.parts[f.FileID] = append(fp.parts[f.FileID], encrypted)
+			content = content[n:]
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.packages[p.PackageID] = fp
+	return fmt.Sprintf("%v/receive/?thread=%v&packageCode=%v#keyCode=%v", s.URL, p.PackageID, p.PackageCode, p.KeyCode), nil
+}
+
+// Encrypt encrypts a part with the pgp options SendSafely uses, AES-256, SHA-256, an S2K count of 65535 and no
+// compression
+func Encrypt(plainText []byte, passphrase string) ([]byte, error) {
+	config := &packet.Config{
+		DefaultCipher:     packet.CipherAES256,
+		DefaultHash:       crypto.SHA256,
+		S2KCount:          65535,
+		CompressionConfig: &packet.CompressionConfig{Level: 0},
+	}
+	var buf bytes.Buffer
+	w, err := openpgp.SymmetricallyEncrypt(&buf, []byte(passphrase), &openpgp.FileHints{IsBinary: true}, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to setup encryption due to error '%v'", err)
+	}
+	if _, err := w.Write(plainText); err != nil {
+		return nil, fmt.Errorf("unable to encrypt due to error '%v'", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("unable to encrypt due to error '%v'", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Checksum is the PBKDF2-HMAC-SHA256 of the keycode salted with the package code that download-urls requires
+func Checksum(keyCode, packageCode string) string {
+	return hex.EncodeToString(pbkdf2.Key([]byte(keyCode), []byte(packageCode), 1024, 32, sha256.New))
+}
+
+// ExpirePackage makes the package information request for the package fail the way it does once SendSafely has
+// removed it
+func (s *Server) ExpirePackage(packageID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if p, ok := s.packages[packageID]; ok {
+		p.expired = true
+	}
+}
+
+// FailRequests answers the next times requests to the path, relative to the server url, with the status
+func (s *Server) FailRequests(path string, status, times int) {
+	s.addFault(&fault{path: path, status: status, body: fmt.Sprintf(`{"response":"FAIL","message":"scripted %v"}`, status), times: times})
+}
+
+// ExpirePartURL rejects the next times downloads of the part the way S3 rejects an expired presigned url
+func (s *Server) ExpirePartURL(fileID string, part, times int) {
+	s.addFault(&fault{path: PartPath(fileID, part), status: http.StatusForbidden, body: "<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>", times: times})
+}
+
+// TruncatePart cuts the connection halfway through the next times downloads of the part
+func (s *Server) TruncatePart(fileID string, part, times int) {
+	s.addFault(&fault{path: PartPath(fileID, part), truncate: true, times: times})
+}
+
+// PartPath is the path the encrypted part is downloaded from
+func PartPath(fileID string, part int) string {
+	return fmt.Sprintf("/parts/%v/%v", fileID, part)
+}
+
+// Requests are the method and path of every request the server received, in order
+func (s *Server) Requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) addFault(f *fault) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults = append(s.faults, f)
+}
+
+// nextFault returns the first fault still left for the path and uses it up
+func (s *Server) nextFault(path string) *fault {
+	for _, f := range s.faults {
+		if f.path == path && f.times > 0 {
+			f.times--
+			return f
+		}
+	}
+	return nil
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	w.Header().Set("Date", s.now().UTC().Format(http.TimeFormat))
+	f := s.nextFault(r.URL.Path)
+	if f != nil && !f.truncate {
+		w.WriteHeader(f.status)
+		_, _ = io.WriteString(w, f.body)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/parts/") {
+		s.servePart(w, r, f != nil)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		reply(w, http.StatusBadRequest, map[string]any{"response": "FAIL", "message": err.Error()})
+		return
+	}
+	if msg := s.checkSignature(r, string(body)); msg != "" {
+		reply(w, http.StatusUnauthorized, map[string]any{"response": "AUTHENTICATION_FAILED", "message": msg})
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, BasePath), "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "package":
+		s.servePackage(w, parts[1])
+	case r.Method == http.MethodPost && len(parts) == 5 && parts[0] == "package" && parts[2] == "file" && parts[4] == "download-urls":
+		s.serveDownloadURLs(w, parts[1], parts[3], body)
+	default:
+		reply(w, http.StatusNotFound, map[string]any{"response": "FAIL", "message": "no such endpoint " + r.Method + " " + r.URL.Path})
+	}
+}
+
+// checkSignature returns why the request is not signed with the api key and secret, empty when it is
+func (s *Server) checkSignature(r *http.Request, body string) string {
+	if r.Header.Get("ss-api-key") != s.APIKey {
+		return "unknown ss-api-key"
+	}
+	ts := r.Header.Get("ss-request-timestamp")
+	requestTime, err := time.Parse("2006-01-02T15:04:05-0700", ts)
+	if err != nil {
+		return fmt.Sprintf("invalid ss-request-timestamp '%v'", ts)
+	}
+	if requestTime.Sub(s.now()).Abs() > TimestampTolerance {
+		// like the real api a stale timestamp looks like any other bad signature
+		return "invalid ss-request-signature"
+	}
+	h := hmac.New(sha256.New, []byte(s.APISecret))
+	_, _ = h.Write([]byte(s.APIKey + r.URL.Path + ts + body))
+	if !hmac.Equal([]byte(r.Header.Get("ss-request-signature")), []byte(hex.EncodeToString(h.Sum(nil)))) {
+		return "invalid ss-request-signature"
+	}
+	return ""
+}
+
+// now is the time on the server clock
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.ClockSkew)
+}
+
+// lookup finds a package by the package id or by the package code of its link
+func (s *Server) lookup(id string) *fakePackage {
+	if p, ok := s.packages[id]; ok {
+		return p
+	}
+	for _, p := range s.packages {
+		if p.PackageCode == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *Server) servePackage(w http.ResponseWriter, id string) {
+	p := s.lookup(id)
+	if p == nil || p.expired {
+		reply(w, http.StatusOK, map[string]any{"response": "UNKNOWN_PACKAGE", "message": "This package has expired or does not exist"})
+		return
+	}
+	uploaded := time.Date(2022, 6, 9, 13, 32, 34, 0, time.UTC)
+	var files []map[string]any
+	for _, f := range p.Files {
+		files = append(files, map[string]any{
+			"fileId":          f.FileID,
+			"fileName":        f.Name,
+			"fileSize":        strconv.Itoa(len(f.Content)),
+			"parts":           len(p.parts[f.FileID]),
+			"createdByEmail":  f.UploadedBy,
+			"fileUploaded":    uploaded.Format(dateFmt),
+			"fileUploadedStr": uploaded.Format("Jan 2, 2006 at 15:04"),
+			"fileVersion":     "1",
+		})
+	}
+	reply(w, http.StatusOK, map[string]any{
+		"packageId":        p.PackageID,
+		"packageCode":      p.PackageCode,
+		"serverSecret":     p.ServerSecret,
+		"files":            files,
+		"directories":      []any{},
+		"state":            "PACKAGE_STATE_IN_PROGRESS",
+		"passwordRequired": false,
+		"life":             10,
+		"packageTimestamp": uploaded.Format(dateFmt),
+		"response":         "SUCCESS",
+	})
+}
+
+func (s *Server) serveDownloadURLs(w http.ResponseWriter, packageID, fileID string, body []byte) {
+	p := s.lookup(packageID)
+	if p == nil || p.expired {
+		reply(w, http.StatusOK, map[string]any{"response": "UNKNOWN_PACKAGE", "message": "This package has expired or does not exist"})
+		return
+	}
+	var request struct {
+		Checksum     string `json:"checksum"`
+		StartSegment int    `json:"startSegment"`
+		EndSegment   int    `json:"endSegment"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		reply(w, http.StatusBadRequest, map[string]any{"response": "FAIL", "message": err.Error()})
+		return
+	}
+	if request.Checksum != Checksum(p.KeyCode, p.PackageCode) {
+		reply(w, http.StatusOK, map[string]any{"response": "INVALID_CHECKSUM", "message": "The checksum does not match the keycode"})
+		return
+	}
+	parts, ok := p.parts[fileID]
+	if !ok || request.StartSegment < 1 || request.EndSegment > len(parts) || request.StartSegment > request.EndSegment {
+		reply(w, http.StatusOK, map[string]any{"response": "FAIL", "message": fmt.Sprintf("no parts %v-%v for file %v", request.StartSegment, request.EndSegment, fileID)})
+		return
+	}
+	var urls []map[string]any
+	for part := request.StartSegment; part <= request.EndSegment; part++ {
+		urls = append(urls, map[string]any{"part": part, "url": s.URL + PartPath(fileID, part)})
+	}
+	reply(w, http.StatusOK, map[string]any{"downloadUrls": urls, "response": "SUCCESS"})
+}
+
+func (s *Server) servePart(w http.ResponseWriter, r *http.Request, truncate bool) {
+	var fileID string
+	var part int
+	if _, err := fmt.Sscanf(strings.ReplaceAll(strings.TrimPrefix(r.URL.Path, "/parts/"), "/", " "), "%s %d", &fileID, &part); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	for _, p := range s.packages {
+		if parts, ok := p.parts[fileID]; ok && part >= 1 && part <= len(parts) {
+			encrypted := parts[part-1]
+			w.Header().Set("Content-Length", strconv.Itoa(len(encrypted)))
+			w.WriteHeader(http.StatusOK)
+			if truncate {
+				encrypted = encrypted[:len(encrypted)/2]
+			}
+			_, _ = w.Write(encrypted)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func reply(w http.ResponseWriter, status int, body map[string]any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
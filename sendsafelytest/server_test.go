@@ -0,0 +1,72 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// sendsafelytest package runs a fake sendsafely api in process so the download, decrypt and combine flow can be tested offline
+package sendsafelytest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAddPackageReturnsLink(t *testing.T) {
+	s := NewServer("key", "secret")
+	defer s.Close()
+	link, err := s.AddPackage(Package{PackageID: "GYL4-DVZN", PackageCode: "pkgCode", ServerSecret: "serverSecret", KeyCode: "keyCode"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := s.URL + "/receive/?thread=GYL4-DVZN&packageCode=pkgCode#keyCode=keyCode"
+	if link != expected {
+		t.Errorf("expected %v but was %v", expected, link)
+	}
+}
+
+func TestUnsignedRequestsAreRejected(t *testing.T) {
+	s := NewServer("key", "secret")
+	defer s.Close()
+	resp, err := http.Get(s.APIURL() + "/package/pkgCode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 but was %v", resp.StatusCode)
+	}
+	if requests := s.Requests(); len(requests) != 1 || !strings.HasSuffix(requests[0], "/package/pkgCode") {
+		t.Errorf("unexpected requests %v", requests)
+	}
+}
+
+func TestScriptedFailuresRunOut(t *testing.T) {
+	s := NewServer("key", "secret")
+	defer s.Close()
+	s.FailRequests("/api/v2.0/package/pkgCode", http.StatusInternalServerError, 2)
+	var statuses []int
+	for range 3 {
+		resp, err := http.Get(s.APIURL() + "/package/pkgCode")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+	// the third request is past the scripted failures and fails the signature check instead
+	if statuses[0] != 500 || statuses[1] != 500 || statuses[2] != 401 {
+		t.Errorf("expected 500, 500 then 401 but was %v", statuses)
+	}
+}
@@ -0,0 +1,630 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// storage package is where downloaded files end up, either the local filesystem or an S3 compatible bucket
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rsvihladremio/ssdownloader/retry"
+)
+
+const (
+	// defaultPartSize is how much is buffered before a part is uploaded, this is also the memory used by each writer
+	defaultPartSize = 16 * 1024 * 1024
+	// s3MinPartSize is the smallest part S3 accepts in a multipart upload other than the last one
+	s3MinPartSize = 5 * 1024 * 1024
+	// s3MaxCopySize is the largest object or part S3 will copy in one request
+	s3MaxCopySize = 5 * 1024 * 1024 * 1024
+)
+
+// S3Options configures an S3 compatible bucket such as AWS S3 or MinIO
+type S3Options struct {
+	// Endpoint is the base url of the service, https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Endpoint string
+	// Region is used for signing, MinIO accepts the default of us-east-1
+	Region string
+	Bucket string
+	// Prefix is put in front of every key so one bucket can be shared
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// PathStyle puts the bucket in the path instead of the host name, MinIO and most self hosted servers need this
+	PathStyle bool
+	// Root is the download directory, the names passed to the storage are made relative to it to build the keys
+	Root string
+}
+
+// S3 stores files in an S3 compatible bucket. Writes are buffered and sent as a multipart upload so the
+// object only appears once the writer is closed, appends and renames are done with server side copies
+type S3 struct {
+	opts     S3Options
+	endpoint *url.URL
+	client   *http.Client
+	policy   retry.Policy
+	// these are only changed by tests, real S3 rejects smaller parts
+	partSize    int
+	minPartSize int64
+	maxCopySize int64
+	now         func() time.Time
+}
+
+// NewS3 validates the options and builds the S3 storage, httpClient should be the client built by the transport package
+func NewS3(o S3Options, httpClient *http.Client, policy retry.Policy) (Storage, error) {
+	if o.Bucket == "" {
+		return nil, errors.New("s3 bucket is required")
+	}
+	if o.AccessKey == "" || o.SecretKey == "" {
+		return nil, errors.New("s3 access key and secret key are required")
+	}
+	endpoint, err := url.Parse(o.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint '%v' due to error '%v'", o.Endpoint, err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint '%v' it has to be an http or https url", o.Endpoint)
+	}
+	if o.Region == "" {
+		o.Region = "us-east-1"
+	}
+	return &S3{
+		opts:        o,
+		endpoint:    endpoint,
+		client:      httpClient,
+		policy:      policy,
+		partSize:    defaultPartSize,
+		minPartSize: s3MinPartSize,
+		maxCopySize: s3MaxCopySize,
+		now:         time.Now,
+	}, nil
+}
+
+// OutsideRootErr is returned for names that are not under the download directory and so have no key
+type OutsideRootErr struct {
+	Name string
+	Root string
+}
+
+func (e OutsideRootErr) Error() string {
+	return fmt.Sprintf("'%v' is not under the download dir '%v' so it cannot be stored in s3", e.Name, e.Root)
+}
+
+// key converts a file name into an object key
+func (s *S3) key(name string) (string, error) {
+	rel, err := filepath.Rel(s.opts.Root, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", OutsideRootErr{Name: name, Root: s.opts.Root}
+	}
+	if rel == "." {
+		rel = ""
+	}
+	return strings.TrimPrefix(path.Join(s.opts.Prefix, filepath.ToSlash(rel)), "/"), nil
+}
+
+// name converts an object key back into a file name
+func (s *S3) name(key string) string {
+	rel := strings.TrimPrefix(strings.TrimPrefix(key, s.opts.Prefix), "/")
+	return filepath.Join(s.opts.Root, filepath.FromSlash(rel))
+}
+
+func (s *S3) url(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if s.opts.PathStyle {
+		p += "/" + s.opts.Bucket
+	} else {
+		u.Host = s.opts.Bucket + "." + u.Host
+	}
+	if key != "" || !s.opts.PathStyle {
+		p += "/" + key
+	}
+	u.Path = p
+	u.RawPath = awsURIEncode(p, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// send makes one signed request, a 404 is returned as an error wrapping fs.ErrNotExist and any other error status
+// as retry.HTTPStatusErr. The caller has to close the body of the response
+func (s *S3) send(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := s.url(key, query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request for key '%v' due to error '%v'", key, err)
+	}
+	req.URL = u
+	req.Host = u.Host
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payloadHash := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(payloadHash[:]))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to %v s3 key '%v' due to error '%w'", method, key, err)
+	}
+	if resp.StatusCode >= 300 {
+		defer func() {
+			if err := resp.Body.Close(); err != nil {
+				slog.Debug("unable to close body handle for s3 key", "key", key, "error_msg", err)
+			}
+		}()
+		if resp.StatusCode == http.StatusNotFound && key != "" {
+			return nil, &fs.PathError{Op: method, Path: key, Err: fs.ErrNotExist}
+		}
+		return nil, retry.NewHTTPStatusErr(resp, u.String())
+	}
+	return resp, nil
+}
+
+// call is send with retries, reading the whole response body
+func (s *S3) call(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (respBody []byte, respHeader http.Header, err error) {
+	err = retry.Do(ctx, s.policy, "s3 "+method+" "+key, func() error {
+		resp, err := s.send(ctx, method, key, query, header, body)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := resp.Body.Close(); err != nil {
+				slog.Debug("unable to close body handle for s3 key", "key", key, "error_msg", err)
+			}
+		}()
+		respBody, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("unable to read response for s3 key '%v' due to error '%w'", key, err)
+		}
+		// copies report failures with a 200 and an error document
+		if isErrorDocument(respBody) {
+			return retry.RetryableErr{BaseErr: fmt.Errorf("s3 %v of key '%v' failed with '%v'", method, key, string(respBody))}
+		}
+		respHeader = resp.Header
+		return nil
+	})
+	return respBody, respHeader, err
+}
+
+// isErrorDocument is true when the first element of the xml body is Error
+func isErrorDocument(b []byte) bool {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return false
+		}
+		if e, ok := t.(xml.StartElement); ok {
+			return e.Name.Local == "Error"
+		}
+	}
+}
+
+func (s *S3) Create(ctx context.Context, name string) (Writer, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{ctx: ctx, s: s, key: key}, nil
+}
+
+func (s *S3) Append(ctx context.Context, name string) (Writer, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.Stat(ctx, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &s3Writer{ctx: ctx, s: s, key: key}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	w := &s3Writer{ctx: ctx, s: s, key: key}
+	if info.Size < s.minPartSize {
+		// too small to be a part of its own so it goes at the front of the buffer
+		b, err := ReadFile(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+		w.buf.Write(b)
+		return w, nil
+	}
+	if err := w.copyParts(key, info.Size); err != nil {
+		w.abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (s *S3) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	var resp *http.Response
+	err = retry.Do(ctx, s.policy, "s3 GET "+key, func() error {
+		var err error
+		resp, err = s.send(ctx, http.MethodGet, key, nil, nil, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Rename(ctx context.Context, from, to string) error {
+	fromKey, err := s.key(from)
+	if err != nil {
+		return err
+	}
+	toKey, err := s.key(to)
+	if err != nil {
+		return err
+	}
+	info, err := s.Stat(ctx, from)
+	if err != nil {
+		return err
+	}
+	if info.Size <= s.maxCopySize {
+		header := http.Header{}
+		header.Set("x-amz-copy-source", s.copySource(fromKey))
+		if _, _, err := s.call(ctx, http.MethodPut, toKey, nil, header, nil); err != nil {
+			return fmt.Errorf("unable to copy s3 key '%v' to '%v' due to error '%w'", fromKey, toKey, err)
+		}
+	} else {
+		// too big for a single copy so it is copied in parts
+		w := &s3Writer{ctx: ctx, s: s, key: toKey}
+		if err := w.copyParts(fromKey, info.Size); err != nil {
+			w.abort()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	return s.Remove(ctx, from)
+}
+
+func (s *S3) Stat(ctx context.Context, name string) (Info, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return Info{}, err
+	}
+	_, header, err := s.call(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return Info{}, fmt.Errorf("unable to read size of s3 key '%v' due to error '%v'", key, err)
+	}
+	return Info{Name: name, Size: size}, nil
+}
+
+// listBucketResult is the part of the ListObjectsV2 response we use
+type listBucketResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3) List(ctx context.Context, dir string) ([]Info, error) {
+	prefix, err := s.key(dir)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	var files []Info
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		b, _, err := s.call(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list s3 prefix '%v' due to error '%w'", prefix, err)
+		}
+		var result listBucketResult
+		if err := xml.Unmarshal(b, &result); err != nil {
+			return nil, fmt.Errorf("unable to read list of s3 prefix '%v' due to error '%v'", prefix, err)
+		}
+		for _, c := range result.Contents {
+			files = append(files, Info{Name: s.name(c.Key), Size: c.Size})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3) Remove(ctx context.Context, name string) error {
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.call(ctx, http.MethodDelete, key, nil, nil, nil)
+	return err
+}
+
+func (s *S3) copySource(key string) string {
+	return "/" + s.opts.Bucket + "/" + awsURIEncode(key, false)
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// s3Writer buffers writes into parts, nothing is uploaded for small objects until Close which then does a single put
+type s3Writer struct {
+	ctx      context.Context
+	s        *S3
+	key      string
+	buf      bytes.Buffer
+	uploadID string
+	parts    []completedPart
+	err      error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf.Write(p)
+	for w.buf.Len() >= w.s.partSize {
+		part := make([]byte, w.s.partSize)
+		copy(part, w.buf.Next(w.s.partSize))
+		if err := w.uploadPart(part); err != nil {
+			w.err = err
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.err != nil {
+		w.abort()
+		return w.err
+	}
+	w.err = errors.New("writer is closed")
+	if w.uploadID == "" {
+		if _, _, err := w.s.call(w.ctx, http.MethodPut, w.key, nil, nil, w.buf.Bytes()); err != nil {
+			return fmt.Errorf("unable to upload s3 key '%v' due to error '%w'", w.key, err)
+		}
+		return nil
+	}
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(w.buf.Bytes()); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	body, err := xml.Marshal(completeMultipartUpload{Parts: w.parts})
+	if err != nil {
+		w.abort()
+		return fmt.Errorf("unable to build the completion of s3 key '%v' due to error '%v'", w.key, err)
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+	if _, _, err := w.s.call(w.ctx, http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, header, body); err != nil {
+		w.abort()
+		return fmt.Errorf("unable to complete upload of s3 key '%v' due to error '%w'", w.key, err)
+	}
+	return nil
+}
+
+func (w *s3Writer) Abort() error {
+	if w.err == nil {
+		w.err = errors.New("writer is aborted")
+	}
+	return w.abort()
+}
+
+func (w *s3Writer) abort() error {
+	if w.uploadID == "" {
+		return nil
+	}
+	uploadID := w.uploadID
+	w.uploadID = ""
+	// the context may be why we are aborting so the upload is cleaned up without it
+	if _, _, err := w.s.call(context.WithoutCancel(w.ctx), http.MethodDelete, w.key, url.Values{"uploadId": {uploadID}}, nil, nil); err != nil {
+		slog.Warn("unable to abort s3 upload, the bucket lifecycle rules will have to clean it up", "key", w.key, "upload_id", uploadID, "error_msg", err)
+		return err
+	}
+	return nil
+}
+
+func (w *s3Writer) startUpload() error {
+	if w.uploadID != "" {
+		return nil
+	}
+	b, _, err := w.s.call(w.ctx, http.MethodPost, w.key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return fmt.Errorf("unable to start upload of s3 key '%v' due to error '%w'", w.key, err)
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(b, &result); err != nil || result.UploadID == "" {
+		return fmt.Errorf("unable to read upload id for s3 key '%v' from '%v'", w.key, string(b))
+	}
+	w.uploadID = result.UploadID
+	return nil
+}
+
+func (w *s3Writer) uploadPart(part []byte) error {
+	if err := w.startUpload(); err != nil {
+		return err
+	}
+	partNumber := len(w.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {w.uploadID}}
+	_, header, err := w.s.call(w.ctx, http.MethodPut, w.key, query, nil, part)
+	if err != nil {
+		return fmt.Errorf("unable to upload part %v of s3 key '%v' due to error '%w'", partNumber, w.key, err)
+	}
+	w.parts = append(w.parts, completedPart{PartNumber: partNumber, ETag: header.Get("ETag")})
+	return nil
+}
+
+// copyParts adds the source object as the first parts of the upload, each part is at most maxCopySize and
+// none is smaller than minPartSize since more parts may follow
+func (w *s3Writer) copyParts(sourceKey string, size int64) error {
+	if err := w.startUpload(); err != nil {
+		return err
+	}
+	for start := int64(0); start < size; {
+		end := start + w.s.maxCopySize
+		if size-end < w.s.minPartSize {
+			end = size
+			if end-start > w.s.maxCopySize {
+				// split what is left in two so both halves are big enough
+				end = start + (size-start)/2
+			}
+		}
+		partNumber := len(w.parts) + 1
+		header := http.Header{}
+		header.Set("x-amz-copy-source", w.s.copySource(sourceKey))
+		header.Set("x-amz-copy-source-range", fmt.Sprintf("bytes=%v-%v", start, end-1))
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {w.uploadID}}
+		b, _, err := w.s.call(w.ctx, http.MethodPut, w.key, query, header, nil)
+		if err != nil {
+			return fmt.Errorf("unable to copy part %v of s3 key '%v' due to error '%w'", partNumber, sourceKey, err)
+		}
+		var result struct {
+			ETag string
+		}
+		if err := xml.Unmarshal(b, &result); err != nil {
+			return fmt.Errorf("unable to read copy result for s3 key '%v' from '%v'", sourceKey, string(b))
+		}
+		w.parts = append(w.parts, completedPart{PartNumber: partNumber, ETag: result.ETag})
+		start = end
+	}
+	return nil
+}
+
+// sign adds the AWS signature version 4 headers described at
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.opts.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.opts.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.Host}
+	for k, v := range req.Header {
+		lower := strings.ToLower(k)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" || lower == "range" || lower == "content-md5" {
+			headers[lower] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, s.opts.Region, "s3", "aws4_request"}, "/")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.opts.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, s.opts.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", s.opts.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsURIEncode escapes everything except the unreserved characters as required for signing,
+// this is stricter than url.PathEscape
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery sorts and escapes the query, it is used both on the wire and for signing so they always match
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for k, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,256 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// storage package is where downloaded files end up, either the local filesystem or an S3 compatible bucket
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Info describes a stored file
+type Info struct {
+	Name string
+	Size int64
+}
+
+// Writer is returned by Create and Append. Close makes everything written visible, Abort stops writing
+// and for backends that support it (S3) throws away everything written since Create or Append was called
+type Writer interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// Storage is implemented by every backend. Names are file paths under the download directory, backends
+// map them to whatever they need (S3 keys are relative to the download directory). Missing files are reported
+// with an error wrapping fs.ErrNotExist, parent directories are created as needed
+type Storage interface {
+	// Create opens name for writing, replacing anything already there
+	Create(ctx context.Context, name string) (Writer, error)
+	// Append opens name for writing after the existing content, it is created when missing
+	Append(ctx context.Context, name string) (Writer, error)
+	// Open opens name for reading
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// Rename moves from to to, replacing anything at to
+	Rename(ctx context.Context, from, to string) error
+	// Stat returns the size of name
+	Stat(ctx context.Context, name string) (Info, error)
+	// List returns every file below dir including files in sub directories
+	List(ctx context.Context, dir string) ([]Info, error)
+	// Remove deletes name
+	Remove(ctx context.Context, name string) error
+}
+
+// Exists is true when name is in storage
+func Exists(ctx context.Context, s Storage, name string) (bool, error) {
+	_, err := s.Stat(ctx, name)
+	if err == nil {
+		return true, nil
+	} else if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return false, fmt.Errorf("trying to check file %v resulted in error %v", name, err)
+}
+
+// InProgressSuffix is added to the name of a file while it is written, it is only renamed to the final
+// name once it is complete so a crash never leaves a truncated file behind under the final name
+const InProgressSuffix = ".inprogress"
+
+// WriteFile is the storage version of os.WriteFile, the file is written under a temporary name and
+// renamed once complete so a crash never leaves a truncated file behind
+func WriteFile(ctx context.Context, s Storage, name string, data []byte) error {
+	tmpName := name + InProgressSuffix
+	w, err := s.Create(ctx, tmpName)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		if abortErr := w.Abort(); abortErr != nil {
+			return fmt.Errorf("unable to write file '%v' due to error '%v' and unable to abort the write due to error '%v'", name, err, abortErr)
+		}
+		if removeErr := s.Remove(ctx, tmpName); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			return fmt.Errorf("unable to write file '%v' due to error '%v' and unable to remove it due to error '%v'", name, err, removeErr)
+		}
+		return fmt.Errorf("unable to write file '%v' due to error '%v'", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("unable to write file '%v' due to error '%v'", name, err)
+	}
+	return s.Rename(ctx, tmpName, name)
+}
+
+// RemoveOrphans removes files under dir left with the InProgressSuffix by a run that crashed or was killed,
+// they were never complete so there is nothing to keep unless keep says they can be resumed. The names of the
+// removed files are returned
+func RemoveOrphans(ctx context.Context, s Storage, dir string, keep func(name string) bool) ([]string, error) {
+	files, err := s.List(ctx, dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var removed []string
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name, InProgressSuffix) || keep(f.Name) {
+			continue
+		}
+		if err := s.Remove(ctx, f.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, fmt.Errorf("unable to remove orphaned file '%v' due to error '%v'", f.Name, err)
+		}
+		removed = append(removed, f.Name)
+	}
+	return removed, nil
+}
+
+// ReadFile is the storage version of os.ReadFile
+func ReadFile(ctx context.Context, s Storage, name string) ([]byte, error) {
+	r, err := s.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(r)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	return b, err
+}
+
+// Local stores files on the local filesystem, names are used as is
+type Local struct{}
+
+// NewLocal is the default storage
+func NewLocal() Storage {
+	return &Local{}
+}
+
+// localWriter wraps os.File to satisfy Writer, there is nothing to throw away on Abort
+// since the filesystem has no way to undo writes, callers remove the file when needed
+type localWriter struct {
+	*os.File
+}
+
+// Close flushes the file to disk first, the file is usually renamed into place next and a crash after the rename
+// must not leave it empty or truncated under its final name
+func (w *localWriter) Close() error {
+	if err := w.Sync(); err != nil {
+		if closeErr := w.File.Close(); closeErr != nil {
+			return fmt.Errorf("sync failed with '%w' and close failed with '%v'", err, closeErr)
+		}
+		return err
+	}
+	return w.File.Close()
+}
+
+func (w *localWriter) Abort() error {
+	return w.File.Close()
+}
+
+func (l *Local) openForWrite(name string, flag int) (Writer, error) {
+	cleanedName := filepath.Clean(name)
+	if err := os.MkdirAll(filepath.Dir(cleanedName), 0700); err != nil {
+		return nil, fmt.Errorf("unable to create dir '%v' due to error '%w'", filepath.Dir(cleanedName), err)
+	}
+	f, err := os.OpenFile(cleanedName, flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: f}, nil
+}
+
+func (l *Local) Create(_ context.Context, name string) (Writer, error) {
+	return l.openForWrite(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+}
+
+func (l *Local) Append(_ context.Context, name string) (Writer, error) {
+	return l.openForWrite(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY)
+}
+
+func (l *Local) Open(_ context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Clean(name))
+}
+
+func (l *Local) Rename(_ context.Context, from, to string) error {
+	cleanedTo := filepath.Clean(to)
+	if err := os.MkdirAll(filepath.Dir(cleanedTo), 0700); err != nil {
+		return fmt.Errorf("unable to create dir '%v' due to error '%w'", filepath.Dir(cleanedTo), err)
+	}
+	if err := os.Rename(filepath.Clean(from), cleanedTo); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(cleanedTo))
+}
+
+// syncDir flushes the directory entry of a rename to disk. Windows cannot sync a directory and makes the rename
+// durable on its own
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(filepath.Clean(dir))
+	if err != nil {
+		return fmt.Errorf("unable to open dir '%v' to sync it due to error '%w'", dir, err)
+	}
+	if err := d.Sync(); err != nil {
+		if closeErr := d.Close(); closeErr != nil {
+			return fmt.Errorf("unable to sync dir '%v' due to error '%w' and close failed with '%v'", dir, err, closeErr)
+		}
+		return fmt.Errorf("unable to sync dir '%v' due to error '%w'", dir, err)
+	}
+	return d.Close()
+}
+
+func (l *Local) Stat(_ context.Context, name string) (Info, error) {
+	fi, err := os.Stat(filepath.Clean(name))
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Name: name, Size: fi.Size()}, nil
+}
+
+func (l *Local) List(_ context.Context, dir string) ([]Info, error) {
+	var files []Info
+	err := filepath.WalkDir(filepath.Clean(dir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, Info{Name: path, Size: fi.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (l *Local) Remove(_ context.Context, name string) error {
+	return os.Remove(filepath.Clean(name))
+}
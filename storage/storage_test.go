@@ -0,0 +1,199 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// storage package is where downloaded files end up, either the local filesystem or an S3 compatible bucket
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testStorage is run against every backend so they all behave the same
+func testStorage(t *testing.T, s Storage, root string) {
+	ctx := context.Background()
+	name := filepath.Join(root, "tickets", "1", "file.txt")
+
+	if err := WriteFile(ctx, s, name, []byte("hello")); err != nil {
+		t.Fatalf("unable to write file %v", err)
+	}
+	info, err := s.Stat(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 5 {
+		t.Errorf("expected size 5 but was %v", info.Size)
+	}
+
+	w, err := s.Append(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ReadFile(ctx, s, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello world" {
+		t.Errorf("expected 'hello world' but was '%v'", string(b))
+	}
+
+	appended := filepath.Join(root, "tickets", "1", "new.txt")
+	w, err = s.Append(ctx, appended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := filepath.Join(root, "tickets", "1", "sub", "renamed.txt")
+	if err := s.Rename(ctx, name, renamed); err != nil {
+		t.Fatal(err)
+	}
+	exists, err := Exists(ctx, s, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Errorf("expected %v to be gone after the rename", name)
+	}
+
+	files, err := s.List(ctx, filepath.Join(root, "tickets"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	expected := []Info{{Name: appended, Size: 3}, {Name: renamed, Size: 11}}
+	if len(files) != len(expected) {
+		t.Fatalf("expected %v but was %v", expected, files)
+	}
+	for i := range expected {
+		if files[i] != expected[i] {
+			t.Errorf("expected %v but was %v", expected[i], files[i])
+		}
+	}
+
+	if err := s.Remove(ctx, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open(ctx, renamed); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist opening a removed file but was %v", err)
+	}
+	if _, err := s.Stat(ctx, renamed); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist for stat of a removed file but was %v", err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	testStorage(t, NewLocal(), t.TempDir())
+}
+
+func TestLocalAbortKeepsWhatWasWritten(t *testing.T) {
+	ctx := context.Background()
+	s := NewLocal()
+	name := filepath.Join(t.TempDir(), "file.txt")
+	w, err := s.Create(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(w, bytes.NewReader([]byte("partial"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ReadFile(ctx, s, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "partial" {
+		t.Errorf("expected 'partial' but was '%v'", string(b))
+	}
+}
+
+func TestWriteFileLeavesNoTemporaryFile(t *testing.T) {
+	ctx := context.Background()
+	s := NewLocal()
+	name := filepath.Join(t.TempDir(), "dir", "comment.txt")
+	if err := WriteFile(ctx, s, name, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	files, err := s.List(ctx, filepath.Dir(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != name {
+		t.Errorf("expected only %v but was %#v", name, files)
+	}
+}
+
+func TestRemoveOrphans(t *testing.T) {
+	ctx := context.Background()
+	s := NewLocal()
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt.inprogress", "c.txt.partial", filepath.Join("sub", "d.txt.1.inprogress")} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keep := func(name string) bool { return false }
+	removed, err := RemoveOrphans(ctx, s, dir, keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "b.txt.inprogress"), filepath.Join(dir, "sub", "d.txt.1.inprogress")}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("expected %v but was %v", expected, removed)
+	}
+	resumable := filepath.Join(dir, "e.txt.inprogress")
+	if err := os.WriteFile(resumable, []byte("e"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := RemoveOrphans(ctx, s, dir, func(name string) bool { return name == resumable }); err != nil || len(removed) != 0 {
+		t.Errorf("expected the resumable file to be kept but removed %v %v", removed, err)
+	}
+	for _, name := range []string{"a.txt", "c.txt.partial"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %v to be kept but got %v", name, err)
+		}
+	}
+	removed, err = RemoveOrphans(ctx, s, filepath.Join(dir, "missing"), keep)
+	if err != nil || len(removed) != 0 {
+		t.Errorf("expected nothing to do for a missing dir but was %v %v", removed, err)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// transport package builds the http client shared by the zendesk client, the sendsafely client and the downloader
+// so proxies, private certificate authorities, client certificates and timeouts only have to be configured once
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Options configures the shared http client, the zero value behaves like http.DefaultClient
+// except the proxy is always read from the environment when ProxyURL is empty
+type Options struct {
+	// ProxyURL is an http, https, socks5 or socks5h url, when empty HTTPS_PROXY, HTTP_PROXY and NO_PROXY are used
+	ProxyURL string
+	// CAFile is a pem bundle trusted on top of the system certificates, for networks doing tls inspection
+	CAFile string
+	// ClientCertFile and ClientKeyFile are the pem encoded certificate and key for mutual tls
+	ClientCertFile string
+	ClientKeyFile  string
+	// ConnectTimeout limits the tcp connect and the tls handshake
+	ConnectTimeout time.Duration
+	// ReadTimeout limits how long we wait for response headers and how long any single read can stall,
+	// it does not limit the total time of a download
+	ReadTimeout time.Duration
+	// MaxIdleConnsPerHost is the size of the keep-alive pool for each host, this should match how many
+	// downloads run at once otherwise connections are thrown away and opened again
+	MaxIdleConnsPerHost int
+}
+
+// InvalidProxyErr is returned when the proxy url cannot be used
+type InvalidProxyErr struct {
+	ProxyURL string
+	Reason   string
+}
+
+func (e InvalidProxyErr) Error() string {
+	return fmt.Sprintf("invalid proxy url '%v': %v", e.ProxyURL, e.Reason)
+}
+
+// NewClient builds an http client from the options, every file referenced by the options is read now so
+// a bad path is reported before any download starts
+func NewClient(o Options) (*http.Client, error) {
+	t, err := NewTransport(o)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+// NewTransport builds the http.Transport used by NewClient
+func NewTransport(o Options) (*http.Transport, error) {
+	proxy, err := proxyFunc(o.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := tlsConfig(o)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   o.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	if o.ReadTimeout > 0 {
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &readTimeoutConn{Conn: conn, readTimeout: o.ReadTimeout}, nil
+		}
+	}
+	maxIdlePerHost := o.MaxIdleConnsPerHost
+	if maxIdlePerHost < 1 {
+		maxIdlePerHost = http.DefaultMaxIdleConnsPerHost
+	}
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dial,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   o.ConnectTimeout,
+		ResponseHeaderTimeout: o.ReadTimeout,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   maxIdlePerHost,
+		// zendesk, sendsafely and the storage hosts behind the presigned urls each get their own pool
+		MaxIdleConns: maxIdlePerHost * 4,
+	}, nil
+}
+
+func proxyFunc(proxyURL string) (func(*http.Request) (*url.URL, error), error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, InvalidProxyErr{ProxyURL: proxyURL, Reason: err.Error()}
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, InvalidProxyErr{ProxyURL: proxyURL, Reason: fmt.Sprintf("unsupported scheme '%v' only http, https, socks5 and socks5h are supported", u.Scheme)}
+	}
+	if u.Host == "" {
+		return nil, InvalidProxyErr{ProxyURL: proxyURL, Reason: "missing host"}
+	}
+	return http.ProxyURL(u), nil
+}
+
+func tlsConfig(o Options) (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			// not available on every platform, the bundle alone still works
+			pool = x509.NewCertPool()
+		}
+		cleanedCAFile := filepath.Clean(o.CAFile)
+		pem, err := os.ReadFile(cleanedCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca file '%v' due to error '%v'", cleanedCAFile, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no pem encoded certificates found in ca file '%v'", cleanedCAFile)
+		}
+		c.RootCAs = pool
+	}
+	if o.ClientCertFile != "" || o.ClientKeyFile != "" {
+		if o.ClientCertFile == "" || o.ClientKeyFile == "" {
+			return nil, errors.New("client cert and client key have to be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(filepath.Clean(o.ClientCertFile), filepath.Clean(o.ClientKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client cert '%v' and key '%v' due to error '%v'", o.ClientCertFile, o.ClientKeyFile, err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// readTimeoutConn pushes the read deadline forward before every read so a stalled connection fails
+// with a timeout, which is retried, while a slow but steady download is never cut off
+type readTimeoutConn struct {
+	net.Conn
+	readTimeout time.Duration
+}
+
+func (c *readTimeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
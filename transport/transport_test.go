@@ -0,0 +1,193 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// transport package builds the http client shared by the zendesk client, the sendsafely client and the downloader
+// so proxies, private certificate authorities, client certificates and timeouts only have to be configured once
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rsvihladremio/ssdownloader/retry"
+)
+
+func TestProxyURL(t *testing.T) {
+	for _, proxyURL := range []string{"http://proxy.example.com:3128", "https://proxy.example.com", "socks5://127.0.0.1:1080", "socks5h://proxy:1080"} {
+		tr, err := NewTransport(Options{ProxyURL: proxyURL})
+		if err != nil {
+			t.Fatalf("unexpected error for %v: %v", proxyURL, err)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "https://app.sendsafely.com/api/v2.0", nil)
+		u, err := tr.Proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.String() != proxyURL {
+			t.Errorf("expected proxy %v but was %v", proxyURL, u)
+		}
+	}
+}
+
+func TestInvalidProxyURL(t *testing.T) {
+	for _, proxyURL := range []string{"ftp://proxy.example.com", "http://", "://bad"} {
+		_, err := NewTransport(Options{ProxyURL: proxyURL})
+		var proxyErr InvalidProxyErr
+		if !errors.As(err, &proxyErr) {
+			t.Errorf("expected InvalidProxyErr for %v but was %v", proxyURL, err)
+		}
+	}
+}
+
+func writePEM(t *testing.T, name, blockType string, b []byte) string {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: b}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestCAFile(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ts.URL); err == nil {
+		t.Fatal("expected the test server certificate to be untrusted without the ca file")
+	}
+
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", ts.Certificate().Raw)
+	c, err = NewClient(Options{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("expected the ca file to be trusted but was %v", err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestCAFileWithoutCertificates(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(caFile, []byte("not a cert"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewClient(Options{CAFile: caFile}); err == nil {
+		t.Error("expected an error for a ca file without certificates")
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := writePEM(t, "client.pem", "CERTIFICATE", der)
+	keyFile := writePEM(t, "client.key", "EC PRIVATE KEY", keyDer)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", ts.Certificate().Raw)
+	c, err := NewClient(Options{CAFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the client certificate to be sent but status was %v", resp.StatusCode)
+	}
+}
+
+func TestClientCertRequiresKey(t *testing.T) {
+	if _, err := NewClient(Options{ClientCertFile: "client.pem"}); err == nil {
+		t.Error("expected an error when the client key is missing")
+	}
+}
+
+func TestReadTimeoutOnStalledBody(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("start"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	c, err := NewClient(Options{ReadTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	_, err = io.ReadAll(resp.Body)
+	if err == nil {
+		t.Fatal("expected the stalled body to time out")
+	}
+	if retry.Classify(err) != retry.Retryable {
+		t.Errorf("expected a stalled read to be retryable but was %v", err)
+	}
+}
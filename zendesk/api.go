@@ -19,17 +19,27 @@ package zendesk
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"strings"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/rsvihladremio/ssdownloader/retry"
 )
 
-func URL(subDomain, ticketID string) string {
-	return fmt.Sprintf("https://%v.zendesk.com/api/v2/tickets/%v/comments.json", subDomain, ticketID)
+// BaseURL is the zendesk url of the subdomain the tickets are in
+func BaseURL(subDomain string) string {
+	return fmt.Sprintf("https://%v.zendesk.com", subDomain)
+}
+
+// URL is the first page of the comments of the ticket, the authors are sideloaded so attachments have an uploader
+func URL(baseURL, ticketID string) string {
+	return fmt.Sprintf("%v/api/v2/tickets/%v/comments.json?include=users", baseURL, ticketID)
 }
 
 // GetTicketComments returns all comments as a concatenated string so we can search them
@@ -75,22 +85,40 @@ func URL(subDomain, ticketID string) string {
 //		  }
 //		]
 //	  }
-func (z *Client) GetTicketComentsJSON(ticketID string, pageURL *string) (string, error) {
-	url := URL(z.subDomain, ticketID)
+func (z *Client) GetTicketComentsJSON(ctx context.Context, ticketID string, pageURL *string) (string, error) {
+	var body string
+	err := retry.Do(ctx, z.policy, "get comments for ticket "+ticketID, func() error {
+		var err error
+		body, err = z.getTicketComentsJSON(ctx, ticketID, pageURL)
+		return err
+	})
+	return body, err
+}
+
+func (z *Client) getTicketComentsJSON(ctx context.Context, ticketID string, pageURL *string) (string, error) {
+	url := URL(z.baseURL, ticketID)
 	if pageURL != nil && *pageURL != "" {
 		url = *pageURL
 	}
 	auth := fmt.Sprintf("%v/token:%v", z.username, z.password)
 	base64Auth := base64.StdEncoding.EncodeToString([]byte(auth))
 	r, err := z.client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Authorization", fmt.Sprintf("Basic %v", base64Auth)).
 		Get(url)
 	if err != nil {
-		return "", fmt.Errorf("unable to read ticket comments with error '%v'", err)
+		return "", fmt.Errorf("unable to read ticket comments with error '%w'", err)
 	}
 	rawBody := r.Body()
 	statusCode := r.StatusCode()
+	if retry.RetryableStatus(statusCode) {
+		return "", retry.HTTPStatusErr{
+			Code:       statusCode,
+			URL:        url,
+			RetryAfter: retry.ParseRetryAfter(r.Header().Get("Retry-After")),
+		}
+	}
 	if statusCode > 299 {
 		return "", errors.New(string(rawBody))
 	}
@@ -105,20 +133,71 @@ func (z *Client) GetTicketComentsJSON(ticketID string, pageURL *string) (string,
 	return string(rawBody), nil
 }
 
+// AddComment adds a public comment to the ticket, transient failures are retried according to the retry policy
+// PUT /api/v2/tickets/{ticket_id}.json
+//
+//	{"ticket": {"comment": {"body": "Thanks for choosing Acme Jet Motors.", "public": true}}}
+func (z *Client) AddComment(ctx context.Context, ticketID, comment string) error {
+	return retry.Do(ctx, z.policy, "add comment to ticket "+ticketID, func() error {
+		return z.addComment(ctx, ticketID, comment)
+	})
+}
+
+func (z *Client) addComment(ctx context.Context, ticketID, comment string) error {
+	url := fmt.Sprintf("%v/api/v2/tickets/%v.json", z.baseURL, ticketID)
+	body, err := json.Marshal(map[string]any{
+		"ticket": map[string]any{
+			"comment": map[string]any{
+				"body":   comment,
+				"public": true,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write comment with error '%w'", err)
+	}
+	auth := fmt.Sprintf("%v/token:%v", z.username, z.password)
+	base64Auth := base64.StdEncoding.EncodeToString([]byte(auth))
+	r, err := z.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", fmt.Sprintf("Basic %v", base64Auth)).
+		SetBody(body).
+		Put(url)
+	if err != nil {
+		return fmt.Errorf("unable to add comment to ticket with error '%w'", err)
+	}
+	statusCode := r.StatusCode()
+	if retry.RetryableStatus(statusCode) {
+		return retry.HTTPStatusErr{
+			Code:       statusCode,
+			URL:        url,
+			RetryAfter: retry.ParseRetryAfter(r.Header().Get("Retry-After")),
+		}
+	}
+	if statusCode > 299 {
+		return errors.New(string(r.Body()))
+	}
+	return nil
+}
+
 type Client struct {
-	client    *resty.Client
-	username  string
-	password  string
-	subDomain string
-	verbose   bool
+	client   *resty.Client
+	policy   retry.Policy
+	username string
+	password string
+	baseURL  string
+	verbose  bool
 }
 
-func NewClient(username, password, subDomain string, verbose bool) *Client {
+// NewClient builds a client for the zendesk at baseURL, usually BaseURL of the subdomain
+func NewClient(username, password, baseURL string, httpClient *http.Client, policy retry.Policy, verbose bool) *Client {
 	return &Client{
-		subDomain: subDomain,
-		username:  username,
-		password:  password,
-		client:    resty.New(),
-		verbose:   verbose,
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		username: username,
+		password: password,
+		client:   resty.NewWithClient(httpClient),
+		policy:   policy,
+		verbose:  verbose,
 	}
 }
@@ -18,16 +18,31 @@
 package zendesk
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/jarcoal/httpmock"
+	"github.com/rsvihladremio/ssdownloader/retry"
 )
 
+// testPolicy retries quickly so tests covering retries do not slow the suite down
+func testPolicy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	}
+}
+
 // This is the default happy path test, no errors
 func TestRetrievePackgeById(t *testing.T) {
 	// since we are using a mock http api we can use any api secret we feel like
-	zdClient := NewClient("myApiKey", "mySecret", "zdsub", false)
+	zdClient := NewClient("myApiKey", "mySecret", BaseURL("zdsub"), &http.Client{}, testPolicy(), false)
 
 	// pass in the resty httpy client that the SendSafelyClient uses so that
 	// httpmock can replace it's transport parameter with a mock one
@@ -43,11 +58,11 @@ func TestRetrievePackgeById(t *testing.T) {
 	// setup a responder to the expected status code of 200 and then returning the json data setup above
 	responder := httpmock.NewStringResponder(200, resp)
 
-	url := URL(zdClient.subDomain, ticketID)
+	url := URL(zdClient.baseURL, ticketID)
 	// we are expecting a GET request with the exact url specified above, if that exact match happens
 	// the json body setup in the responder will return instead of hitting the remote sendsafely server
 	httpmock.RegisterResponder("GET", url, responder)
-	comments, err := zdClient.GetTicketComentsJSON(ticketID, nil)
+	comments, err := zdClient.GetTicketComentsJSON(context.Background(), ticketID, nil)
 	if err != nil {
 		t.Fatalf("expected error but was nil")
 	}
@@ -61,11 +76,11 @@ func TestCommentReadFail(t *testing.T) {
 	restClient := resty.New()
 	httpClient := restClient.GetClient()
 	zdClient := &Client{
-		subDomain: "doesnotexistatall",
-		username:  "myApiKey",
-		password:  "mySecret",
-		client:    restClient,
-		verbose:   true,
+		baseURL:  BaseURL("doesnotexistatall"),
+		username: "myApiKey",
+		password: "mySecret",
+		client:   restClient,
+		verbose:  true,
 	}
 	// as above prevent remote calls from going to SendSafely
 	httpmock.ActivateNonDefault(httpClient)
@@ -77,7 +92,7 @@ func TestCommentReadFail(t *testing.T) {
 	// we are expecting a GET request with the exact url specified above, if that exact match happens
 	// the json body setup in the responder will return instead of hitting the remote sendsafely server
 	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(404, resp))
-	_, err := zdClient.GetTicketComentsJSON(ticketID, &url)
+	_, err := zdClient.GetTicketComentsJSON(context.Background(), ticketID, &url)
 	if err == nil {
 		t.Errorf("expected an error retrieving id but was '%v'", err)
 	}
@@ -88,7 +103,7 @@ func TestCommentReadFail(t *testing.T) {
 
 func TestWithVerbose(t *testing.T) {
 	// since we are using a mock http api we can use any api secret we feel like
-	zdClient := NewClient("myApiKey", "mySecret", "zdsub", true)
+	zdClient := NewClient("myApiKey", "mySecret", BaseURL("zdsub"), &http.Client{}, testPolicy(), true)
 
 	// pass in the resty httpy client that the SendSafelyClient uses so that
 	// httpmock can replace it's transport parameter with a mock one
@@ -100,11 +115,11 @@ func TestWithVerbose(t *testing.T) {
 	resp := `[{"id":"oye"}]`
 	responder := httpmock.NewStringResponder(200, resp)
 
-	url := URL(zdClient.subDomain, ticketID)
+	url := URL(zdClient.baseURL, ticketID)
 	// we are expecting a GET request with the exact url specified above, if that exact match happens
 	// the json body setup in the responder will return instead of hitting the remote sendsafely server
 	httpmock.RegisterResponder("GET", url, responder)
-	comments, err := zdClient.GetTicketComentsJSON(ticketID, nil)
+	comments, err := zdClient.GetTicketComentsJSON(context.Background(), ticketID, nil)
 	if err != nil {
 		t.Fatalf("expected error but was nil")
 	}
@@ -112,3 +127,65 @@ func TestWithVerbose(t *testing.T) {
 		t.Errorf("expected %v but received %v", resp, comments)
 	}
 }
+
+func TestRetriesRateLimiting(t *testing.T) {
+	zdClient := NewClient("myApiKey", "mySecret", BaseURL("zdsub"), &http.Client{}, testPolicy(), false)
+	httpmock.ActivateNonDefault(zdClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+	ticketID := "12314"
+	resp := `[{"id":"oye"}]`
+	httpmock.RegisterResponder("GET", URL(zdClient.baseURL, ticketID), httpmock.ResponderFromMultipleResponses(
+		[]*http.Response{
+			httpmock.NewStringResponse(429, "slow down"),
+			httpmock.NewStringResponse(500, "oops"),
+			httpmock.NewStringResponse(200, resp),
+		},
+	))
+	comments, err := zdClient.GetTicketComentsJSON(context.Background(), ticketID, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if comments != resp {
+		t.Errorf("expected %v but received %v", resp, comments)
+	}
+	if calls := httpmock.GetTotalCallCount(); calls != 3 {
+		t.Errorf("expected 3 calls but there were %v", calls)
+	}
+}
+
+func TestAddComment(t *testing.T) {
+	zdClient := NewClient("me@example.com", "myToken", BaseURL("zdsub"), &http.Client{}, testPolicy(), false)
+	httpmock.ActivateNonDefault(zdClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+	var body map[string]map[string]map[string]any
+	var auth string
+	httpmock.RegisterResponder("PUT", "https://zdsub.zendesk.com/api/v2/tickets/12314.json", func(r *http.Request) (*http.Response, error) {
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		return httpmock.NewStringResponse(200, `{"ticket":{"id":12314}}`), nil
+	})
+	if err := zdClient.AddComment(context.Background(), "12314", "files at https://example.sendsafely.com/receive/?packageCode=abc"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	comment := body["ticket"]["comment"]
+	if comment["body"] != "files at https://example.sendsafely.com/receive/?packageCode=abc" || comment["public"] != true {
+		t.Errorf("unexpected comment %v", comment)
+	}
+	expectedAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("me@example.com/token:myToken"))
+	if auth != expectedAuth {
+		t.Errorf("expected auth %q but was %q", expectedAuth, auth)
+	}
+}
+
+func TestAddCommentFails(t *testing.T) {
+	zdClient := NewClient("me@example.com", "myToken", BaseURL("zdsub"), &http.Client{}, testPolicy(), false)
+	httpmock.ActivateNonDefault(zdClient.client.GetClient())
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("PUT", "https://zdsub.zendesk.com/api/v2/tickets/12314.json", httpmock.NewStringResponder(403, `{"error":"Forbidden"}`))
+	err := zdClient.AddComment(context.Background(), "12314", "hello")
+	if err == nil || err.Error() != `{"error":"Forbidden"}` {
+		t.Errorf("expected the forbidden reply as the error but was %v", err)
+	}
+}
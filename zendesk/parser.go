@@ -206,6 +206,7 @@ func GetLinksFromComments(jsonData string) ([]CommentTextWithLink, *string, erro
 //
 // with additional data from parent comment
 type Attachment struct {
+	ID                int64     // "id": 498483, zero when missing
 	ParentCommentDate time.Time // "created_at": "2000-01-01T11:11:07Z",
 	ParentCommentID   int64
 	FileName          string
@@ -213,6 +214,8 @@ type Attachment struct {
 	ContentType       string
 	Size              int64
 	Deleted           bool
+	// UploadedBy is the email of the comment author, empty when the users were not sideloaded
+	UploadedBy string
 }
 
 // GetLinksFromComments is parsing out the links from the html_
@@ -261,6 +264,11 @@ func GetAttachmentsFromComments(jsonData string) ([]Attachment, *string, error)
 		}
 	}
 	var attachments []Attachment
+	// the authors are sideloaded with include=users
+	emails := make(map[int64]string)
+	for _, u := range result.GetArray("users") {
+		emails[u.GetInt64("id")] = string(u.GetStringBytes("email"))
+	}
 
 	for i, comment := range comments {
 		parentIDValue := comment.Get("id")
@@ -410,6 +418,7 @@ func GetAttachmentsFromComments(jsonData string) ([]Attachment, *string, error)
 				}
 			}
 			attachments = append(attachments, Attachment{
+				ID:                a.GetInt64("id"),
 				ParentCommentID:   parentID,
 				ParentCommentDate: createdAt,
 				FileName:          fileName,
@@ -417,6 +426,7 @@ func GetAttachmentsFromComments(jsonData string) ([]Attachment, *string, error)
 				ContentURL:        contentURL,
 				ContentType:       contentType,
 				Size:              size,
+				UploadedBy:        emails[comment.GetInt64("author_id")],
 			})
 		}
 	}
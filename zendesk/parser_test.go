@@ -287,9 +287,11 @@ func TestGetAttachmentsFromComments(t *testing.T) {
 		"comments": [
 		  {
 			"id": 1,
+			"author_id": 42,
 			"created_at": "2022-01-02T15:04:05Z",
 			"attachments": [
 				{
+					"id": 7,
 					"file_name": "abc",
 					"deleted": false,
 					"content_url": "http://test.com?file='test'",
@@ -319,6 +321,12 @@ func TestGetAttachmentsFromComments(t *testing.T) {
 		   ]
 		}
 		],
+		"users": [
+			{
+				"id": 42,
+				"email": "customer@example.com"
+			}
+		],
 		"next_page": null
 	}`)
 	if err != nil {
@@ -334,6 +342,7 @@ func TestGetAttachmentsFromComments(t *testing.T) {
 		t.Fatal(err)
 	}
 	expectedFirst := Attachment{
+		ID:                7,
 		FileName:          "abc",
 		ParentCommentDate: t1,
 		ParentCommentID:   1,
@@ -341,6 +350,7 @@ func TestGetAttachmentsFromComments(t *testing.T) {
 		ContentType:       "application/text",
 		Size:              999,
 		Deleted:           false,
+		UploadedBy:        "customer@example.com",
 	}
 	if !reflect.DeepEqual(first, expectedFirst) {
 		t.Errorf("expected %v but was %v", expectedFirst, first)
@@ -357,6 +367,7 @@ func TestGetAttachmentsFromComments(t *testing.T) {
 		ContentType:       "application/image",
 		Size:              100,
 		Deleted:           true,
+		UploadedBy:        "customer@example.com",
 	}
 	if !reflect.DeepEqual(second, expectedSecond) {
 		t.Errorf("expected %v but was %v", expectedFirst, second)
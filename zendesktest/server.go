@@ -0,0 +1,311 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// zendesktest package runs a fake zendesk api in process so the ticket command can be tested end to end offline
+package zendesktest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPageSize is how many comments are on each page when Server.PageSize is not set, the same as zendesk uses
+const DefaultPageSize = 100
+
+// Attachment is a file attached to a comment, the content of a deleted attachment is never served
+type Attachment struct {
+	ID          int64
+	FileName    string
+	ContentType string
+	Content     []byte
+	Deleted     bool
+}
+
+// Comment is a comment on a ticket, HTMLBody is made from Body when it is empty so only comments with links
+// need one
+type Comment struct {
+	ID          int64
+	AuthorID    int64
+	Body        string
+	HTMLBody    string
+	CreatedAt   time.Time
+	Attachments []Attachment
+}
+
+// fault is a scripted failure, it applies to requests for the path until it has happened times times
+type fault struct {
+	path   string
+	status int
+	times  int
+}
+
+// Server is a fake zendesk api serving the comments of tickets a page at a time with next_page links, the
+// sideloaded authors and the content of the attachments. Api requests must carry the Basic auth of the email and
+// api token like the real api, attachment content is served without auth like the token urls zendesk hands out.
+// Failures such as 401, 429 and 500 are scripted with FailRequests
+type Server struct {
+	*httptest.Server
+	Email    string
+	Token    string
+	PageSize int
+
+	lock        sync.Mutex
+	tickets     map[string][]Comment
+	users       map[int64]string
+	attachments map[int64]Attachment
+	faults      []*fault
+	requests    []string
+}
+
+// NewServer starts a fake zendesk that accepts the email and api token, call Close when done
+func NewServer(email, token string) *Server {
+	s := &Server{
+		Email:       email,
+		Token:       token,
+		tickets:     make(map[string][]Comment),
+		users:       make(map[int64]string),
+		attachments: make(map[int64]Attachment),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// AddUser adds a user that is sideloaded as the author of the comments with the id
+func (s *Server) AddUser(id int64, email string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users[id] = email
+}
+
+// AddComments adds the comments to the ticket, the ticket is created when it does not exist yet
+func (s *Server) AddComments(ticketID string, comments ...Comment) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range comments {
+		for _, a := range c.Attachments {
+			s.attachments[a.ID] = a
+		}
+	}
+	s.tickets[ticketID] = append(s.tickets[ticketID], comments...)
+}
+
+// Comments are the comments of the ticket, including any added through the api
+func (s *Server) Comments(ticketID string) []Comment {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Comment{}, s.tickets[ticketID]...)
+}
+
+// AttachmentURL is where the content of the attachment is served
+func (s *Server) AttachmentURL(id int64) string {
+	return fmt.Sprintf("%v%v", s.URL, AttachmentPath(id))
+}
+
+// AttachmentPath is the path the content of the attachment is served from
+func AttachmentPath(id int64) string {
+	return fmt.Sprintf("/attachments/token/%v/", id)
+}
+
+// CommentsPath is the path of the comments of the ticket
+func CommentsPath(ticketID string) string {
+	return fmt.Sprintf("/api/v2/tickets/%v/comments.json", ticketID)
+}
+
+// FailRequests answers the next times requests to the path, without the query, with the status. A 429 is sent
+// with a Retry-After of 0 so retries do not slow tests down
+func (s *Server) FailRequests(path string, status, times int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults = append(s.faults, &fault{path: path, status: status, times: times})
+}
+
+// Requests are the method, path and query of every request the server received, in order
+func (s *Server) Requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.RequestURI())
+	for _, f := range s.faults {
+		if f.path == r.URL.Path && f.times > 0 {
+			f.times--
+			if f.status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "0")
+			}
+			reply(w, f.status, map[string]any{"error": http.StatusText(f.status)})
+			return
+		}
+	}
+	if strings.HasPrefix(r.URL.Path, "/attachments/token/") {
+		s.serveAttachment(w, r)
+		return
+	}
+	if !s.authorized(r) {
+		reply(w, http.StatusUnauthorized, map[string]any{"error": "Couldn't authenticate you"})
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 5 && parts[2] == "tickets" && parts[4] == "comments.json":
+		s.serveComments(w, r, parts[3])
+	case r.Method == http.MethodPut && len(parts) == 4 && parts[2] == "tickets" && strings.HasSuffix(parts[3], ".json"):
+		s.addComment(w, r, strings.TrimSuffix(parts[3], ".json"))
+	default:
+		reply(w, http.StatusNotFound, map[string]any{"error": "InvalidEndpoint"})
+	}
+}
+
+// authorized checks the Basic auth is the email and api token the way the zendesk client sends them
+func (s *Server) authorized(r *http.Request) bool {
+	expected := base64.StdEncoding.EncodeToString([]byte(s.Email + "/token:" + s.Token))
+	return r.Header.Get("Authorization") == "Basic "+expected
+}
+
+func (s *Server) serveComments(w http.ResponseWriter, r *http.Request, ticketID string) {
+	comments, ok := s.tickets[ticketID]
+	if !ok {
+		reply(w, http.StatusNotFound, map[string]any{"error": "RecordNotFound"})
+		return
+	}
+	pageSize := s.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	page := 1
+	if p := r.URL.Query().Get("page"); p != "" {
+		var err error
+		if page, err = strconv.Atoi(p); err != nil || page < 1 {
+			reply(w, http.StatusBadRequest, map[string]any{"error": "invalid page " + p})
+			return
+		}
+	}
+	start := min((page-1)*pageSize, len(comments))
+	end := min(start+pageSize, len(comments))
+	includeUsers := r.URL.Query().Get("include") == "users"
+	var nextPage any
+	if end < len(comments) {
+		next := fmt.Sprintf("%v%v?page=%v", s.URL, CommentsPath(ticketID), page+1)
+		if includeUsers {
+			next += "&include=users"
+		}
+		nextPage = next
+	}
+	var commentsJSON []map[string]any
+	authors := make(map[int64]bool)
+	for _, c := range comments[start:end] {
+		htmlBody := c.HTMLBody
+		if htmlBody == "" {
+			htmlBody = "<p>" + html.EscapeString(c.Body) + "</p>"
+		}
+		attachments := []map[string]any{}
+		for _, a := range c.Attachments {
+			attachments = append(attachments, map[string]any{
+				"id":           a.ID,
+				"file_name":    a.FileName,
+				"content_url":  s.AttachmentURL(a.ID),
+				"content_type": a.ContentType,
+				"size":         len(a.Content),
+				"deleted":      a.Deleted,
+				"inline":       false,
+				"thumbnails":   []any{},
+			})
+		}
+		authors[c.AuthorID] = true
+		commentsJSON = append(commentsJSON, map[string]any{
+			"id":          c.ID,
+			"author_id":   c.AuthorID,
+			"body":        c.Body,
+			"plain_body":  c.Body,
+			"html_body":   htmlBody,
+			"created_at":  c.CreatedAt.UTC().Format(time.RFC3339),
+			"public":      true,
+			"type":        "Comment",
+			"attachments": attachments,
+		})
+	}
+	body := map[string]any{
+		"comments":      commentsJSON,
+		"next_page":     nextPage,
+		"previous_page": nil,
+		"count":         len(comments),
+	}
+	if includeUsers {
+		users := []map[string]any{}
+		for id, email := range s.users {
+			if authors[id] {
+				users = append(users, map[string]any{"id": id, "email": email})
+			}
+		}
+		body["users"] = users
+	}
+	reply(w, http.StatusOK, body)
+}
+
+// addComment adds the comment of a ticket update to the ticket
+func (s *Server) addComment(w http.ResponseWriter, r *http.Request, ticketID string) {
+	var update struct {
+		Ticket struct {
+			Comment struct {
+				Body string `json:"body"`
+			} `json:"comment"`
+		} `json:"ticket"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		reply(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
+		return
+	}
+	if _, ok := s.tickets[ticketID]; !ok {
+		reply(w, http.StatusNotFound, map[string]any{"error": "RecordNotFound"})
+		return
+	}
+	s.tickets[ticketID] = append(s.tickets[ticketID], Comment{
+		ID:        int64(len(s.tickets[ticketID]) + 1),
+		Body:      update.Ticket.Comment.Body,
+		CreatedAt: time.Now(),
+	})
+	reply(w, http.StatusOK, map[string]any{"ticket": map[string]any{"id": ticketID}})
+}
+
+func (s *Server) serveAttachment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(r.URL.Path, "/attachments/token/"), "/"), 10, 64)
+	a, ok := s.attachments[id]
+	if err != nil || !ok || a.Deleted {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(a.Content)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(a.Content)
+}
+
+func reply(w http.ResponseWriter, status int, body map[string]any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
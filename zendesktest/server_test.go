@@ -0,0 +1,151 @@
+/*
+   Copyright 2022 Ryan SVIHLA
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// zendesktest package runs a fake zendesk api in process so the ticket command can be tested end to end offline
+package zendesktest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rsvihladremio/ssdownloader/retry"
+	"github.com/rsvihladremio/ssdownloader/zendesk"
+)
+
+func testPolicy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	}
+}
+
+func newTicket(s *Server, comments int) {
+	s.AddUser(7, "customer@example.com")
+	for i := 1; i <= comments; i++ {
+		s.AddComments("1111", Comment{
+			ID:        int64(i),
+			AuthorID:  7,
+			Body:      fmt.Sprintf("comment %v", i),
+			CreatedAt: time.Date(2024, 1, 1, 10, i, 0, 0, time.UTC),
+			Attachments: []Attachment{
+				{ID: int64(100 + i), FileName: fmt.Sprintf("log%v.txt", i), ContentType: "text/plain", Content: []byte("log")},
+			},
+		})
+	}
+}
+
+func TestCommentsArePagedWithNextPage(t *testing.T) {
+	s := NewServer("me@example.com", "token")
+	defer s.Close()
+	s.PageSize = 2
+	newTicket(s, 5)
+	client := zendesk.NewClient("me@example.com", "token", s.URL, &http.Client{}, testPolicy(), false)
+	var attachments []zendesk.Attachment
+	var nextPage *string
+	for pages := 0; pages == 0 || nextPage != nil; pages++ {
+		if pages > 3 {
+			t.Fatalf("expected 3 pages but there were more, next page was %v", *nextPage)
+		}
+		body, err := client.GetTicketComentsJSON(context.Background(), "1111", nextPage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page []zendesk.Attachment
+		page, nextPage, err = zendesk.GetAttachmentsFromComments(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attachments = append(attachments, page...)
+	}
+	if len(attachments) != 5 {
+		t.Fatalf("expected 5 attachments but had %v", len(attachments))
+	}
+	for i, a := range attachments {
+		if a.FileName != fmt.Sprintf("log%v.txt", i+1) || a.UploadedBy != "customer@example.com" || a.ContentURL != s.AttachmentURL(int64(101+i)) {
+			t.Errorf("unexpected attachment %#v", a)
+		}
+	}
+}
+
+func TestWrongTokenIsRejected(t *testing.T) {
+	s := NewServer("me@example.com", "token")
+	defer s.Close()
+	newTicket(s, 1)
+	client := zendesk.NewClient("me@example.com", "wrong", s.URL, &http.Client{}, testPolicy(), false)
+	if _, err := client.GetTicketComentsJSON(context.Background(), "1111", nil); err == nil {
+		t.Error("expected the wrong token to be rejected")
+	}
+}
+
+func TestScriptedFailuresAreRetried(t *testing.T) {
+	s := NewServer("me@example.com", "token")
+	defer s.Close()
+	newTicket(s, 1)
+	s.FailRequests(CommentsPath("1111"), http.StatusTooManyRequests, 1)
+	s.FailRequests(CommentsPath("1111"), http.StatusInternalServerError, 1)
+	client := zendesk.NewClient("me@example.com", "token", s.URL, &http.Client{}, testPolicy(), false)
+	if _, err := client.GetTicketComentsJSON(context.Background(), "1111", nil); err != nil {
+		t.Fatalf("expected the 429 and 500 to be retried but was %v", err)
+	}
+	if requests := s.Requests(); len(requests) != 3 {
+		t.Errorf("expected 3 requests but were %v", requests)
+	}
+	s.FailRequests(CommentsPath("1111"), http.StatusUnauthorized, 1)
+	_, err := client.GetTicketComentsJSON(context.Background(), "1111", nil)
+	var statusErr retry.HTTPStatusErr
+	if err == nil || errors.As(err, &statusErr) {
+		t.Errorf("expected a 401 to fail without retrying but was %v", err)
+	}
+}
+
+func TestDeletedAttachmentsAreNotServed(t *testing.T) {
+	s := NewServer("me@example.com", "token")
+	defer s.Close()
+	s.AddComments("1111", Comment{ID: 1, Body: "gone", Attachments: []Attachment{
+		{ID: 1, FileName: "kept.txt", Content: []byte("kept")},
+		{ID: 2, FileName: "gone.txt", Content: []byte("gone"), Deleted: true},
+	}})
+	for id, expected := range map[int64]int{1: http.StatusOK, 2: http.StatusNotFound} {
+		resp, err := http.Get(s.AttachmentURL(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("expected %v for attachment %v but was %v", expected, id, resp.StatusCode)
+		}
+	}
+}
+
+func TestAddComment(t *testing.T) {
+	s := NewServer("me@example.com", "token")
+	defer s.Close()
+	newTicket(s, 1)
+	client := zendesk.NewClient("me@example.com", "token", s.URL, &http.Client{}, testPolicy(), false)
+	if err := client.AddComment(context.Background(), "1111", "the files"); err != nil {
+		t.Fatal(err)
+	}
+	if comments := s.Comments("1111"); len(comments) != 2 || comments[1].Body != "the files" {
+		t.Errorf("expected the comment to be added but comments were %v", comments)
+	}
+}